@@ -0,0 +1,264 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/smsv1/sms.proto
+
+package smsv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SmsService_Send_FullMethodName        = "/sms.v1.SmsService/Send"
+	SmsService_SendBatch_FullMethodName   = "/sms.v1.SmsService/SendBatch"
+	SmsService_GetStatus_FullMethodName   = "/sms.v1.SmsService/GetStatus"
+	SmsService_WatchEvents_FullMethodName = "/sms.v1.SmsService/WatchEvents"
+)
+
+// SmsServiceClient is the client API for SmsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SmsServiceClient interface {
+	// Send queues a sms. An invalid sms is INVALID_ARGUMENT with the field in
+	// a BadRequest detail, one the api key may not send PERMISSION_DENIED.
+	Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	// SendBatch queues every sms of a batch, or none when any is invalid. A
+	// batch which fails while queueing can be sent again as a whole, the
+	// queued sms_ids are dropped as duplicates.
+	SendBatch(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchResponse, error)
+	// GetStatus returns the latest status of a sms from its history.
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*SmsStatus, error)
+	// WatchEvents streams the sms events as they are published. A client
+	// falling behind is ended with RESOURCE_EXHAUSTED.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (SmsService_WatchEventsClient, error)
+}
+
+type smsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSmsServiceClient(cc grpc.ClientConnInterface) SmsServiceClient {
+	return &smsServiceClient{cc}
+}
+
+func (c *smsServiceClient) Send(ctx context.Context, in *SendRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, SmsService_Send_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *smsServiceClient) SendBatch(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchResponse, error) {
+	out := new(SendBatchResponse)
+	err := c.cc.Invoke(ctx, SmsService_SendBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *smsServiceClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*SmsStatus, error) {
+	out := new(SmsStatus)
+	err := c.cc.Invoke(ctx, SmsService_GetStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *smsServiceClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (SmsService_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &SmsService_ServiceDesc.Streams[0], SmsService_WatchEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &smsServiceWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type SmsService_WatchEventsClient interface {
+	Recv() (*SmsEvent, error)
+	grpc.ClientStream
+}
+
+type smsServiceWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *smsServiceWatchEventsClient) Recv() (*SmsEvent, error) {
+	m := new(SmsEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SmsServiceServer is the server API for SmsService service.
+// All implementations must embed UnimplementedSmsServiceServer
+// for forward compatibility
+type SmsServiceServer interface {
+	// Send queues a sms. An invalid sms is INVALID_ARGUMENT with the field in
+	// a BadRequest detail, one the api key may not send PERMISSION_DENIED.
+	Send(context.Context, *SendRequest) (*SendResponse, error)
+	// SendBatch queues every sms of a batch, or none when any is invalid. A
+	// batch which fails while queueing can be sent again as a whole, the
+	// queued sms_ids are dropped as duplicates.
+	SendBatch(context.Context, *SendBatchRequest) (*SendBatchResponse, error)
+	// GetStatus returns the latest status of a sms from its history.
+	GetStatus(context.Context, *GetStatusRequest) (*SmsStatus, error)
+	// WatchEvents streams the sms events as they are published. A client
+	// falling behind is ended with RESOURCE_EXHAUSTED.
+	WatchEvents(*WatchEventsRequest, SmsService_WatchEventsServer) error
+	mustEmbedUnimplementedSmsServiceServer()
+}
+
+// UnimplementedSmsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedSmsServiceServer struct {
+}
+
+func (UnimplementedSmsServiceServer) Send(context.Context, *SendRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
+}
+func (UnimplementedSmsServiceServer) SendBatch(context.Context, *SendBatchRequest) (*SendBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendBatch not implemented")
+}
+func (UnimplementedSmsServiceServer) GetStatus(context.Context, *GetStatusRequest) (*SmsStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedSmsServiceServer) WatchEvents(*WatchEventsRequest, SmsService_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedSmsServiceServer) mustEmbedUnimplementedSmsServiceServer() {}
+
+// UnsafeSmsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SmsServiceServer will
+// result in compilation errors.
+type UnsafeSmsServiceServer interface {
+	mustEmbedUnimplementedSmsServiceServer()
+}
+
+func RegisterSmsServiceServer(s grpc.ServiceRegistrar, srv SmsServiceServer) {
+	s.RegisterService(&SmsService_ServiceDesc, srv)
+}
+
+func _SmsService_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SmsServiceServer).Send(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SmsService_Send_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SmsServiceServer).Send(ctx, req.(*SendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SmsService_SendBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SmsServiceServer).SendBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SmsService_SendBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SmsServiceServer).SendBatch(ctx, req.(*SendBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SmsService_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SmsServiceServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SmsService_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SmsServiceServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SmsService_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SmsServiceServer).WatchEvents(m, &smsServiceWatchEventsServer{stream})
+}
+
+type SmsService_WatchEventsServer interface {
+	Send(*SmsEvent) error
+	grpc.ServerStream
+}
+
+type smsServiceWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *smsServiceWatchEventsServer) Send(m *SmsEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// SmsService_ServiceDesc is the grpc.ServiceDesc for SmsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SmsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sms.v1.SmsService",
+	HandlerType: (*SmsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Send",
+			Handler:    _SmsService_Send_Handler,
+		},
+		{
+			MethodName: "SendBatch",
+			Handler:    _SmsService_SendBatch_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _SmsService_GetStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _SmsService_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/smsv1/sms.proto",
+}
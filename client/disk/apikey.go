@@ -0,0 +1,57 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteAPIKey(ctx context.Context, key user.APIKey) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(apiKeyBucket), key.ID, key, 0)
+	})
+}
+
+func (c *Client) ReadAPIKey(ctx context.Context, id string) (key user.APIKey, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		found, err := get(tx.Bucket(apiKeyBucket), id, &key)
+		if err == nil && !found {
+			err = user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+		}
+		return err
+	})
+	return key, err
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) (keys []user.APIKey, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeyBucket).ForEach(func(_, data []byte) error {
+			var r record
+			if err := json.Unmarshal(data, &r); err != nil {
+				return err
+			}
+
+			var key user.APIKey
+			if err := json.Unmarshal(r.Value, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (c *Client) DeleteAPIKey(ctx context.Context, id string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiKeyBucket)
+		if b.Get([]byte(id)) == nil {
+			return user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+		}
+		return b.Delete([]byte(id))
+	})
+}
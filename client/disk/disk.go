@@ -0,0 +1,324 @@
+// Package disk keeps the correlation data in a local bbolt file, for single
+// node deployments without redis or a nats cluster.
+//
+// Every write is a fsynced transaction, so the data survives crashes and
+// restarts. Keys store their expiry with the value: expired keys read as
+// missing and are deleted by a reaper, which also compacts the file once
+// most of it is free space.
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/config"
+)
+
+const (
+	// sequenceTTL is how long a submit_sm waits for its response.
+	sequenceTTL = 900 * time.Second
+
+	// messageSequenceGrace keeps a correlation past the sms validity, so the
+	// expiry sweep still finds it.
+	messageSequenceGrace = time.Hour
+
+	// submissionPendingTTL bounds how long a crashed submission blocks
+	// redeliveries of the same sms.
+	submissionPendingTTL = time.Minute
+
+	// compactMinSize is the file size below which compaction is not worth it.
+	compactMinSize = 1 << 20
+)
+
+var (
+	counterBucket        = []byte("counter")
+	sequenceBucket       = []byte("seq")
+	messageBucket        = []byte("msg")
+	segmentBucket        = []byte("segments")
+	submissionBucket     = []byte("submit")
+	lockBucket           = []byte("lock")
+	historyBucket        = []byte("history")
+	historyIndexBucket   = []byte("history_idx")
+	apiKeyBucket         = []byte("apikeys")
+	webhookBucket        = []byte("webhooks")
+	webhookAttemptBucket = []byte("webhook_attempts")
+	webhookFailureBucket = []byte("webhook_failures")
+	optOutBucket         = []byte("optouts")
+
+	// expiringBuckets are the buckets the reaper cleans up.
+	expiringBuckets = [][]byte{sequenceBucket, messageBucket, segmentBucket, submissionBucket, lockBucket, historyBucket, historyIndexBucket}
+)
+
+// Client holds the bbolt database.
+type Client struct {
+	// mu is held for writing only while the file is swapped by compact.
+	mu             sync.RWMutex
+	db             *bolt.DB
+	path           string
+	idempotencyTTL time.Duration
+	validity       time.Duration
+
+	historyRetention time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Init opens the database file, creating it when missing, and starts the
+// reaper.
+func (c *Client) Init(ctx context.Context, config *config.Config) error {
+	if dir := filepath.Dir(config.DiskPath); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	c.path = config.DiskPath
+	c.idempotencyTTL = config.IdempotencyTTL
+	c.validity = config.SmsValidity
+	c.historyRetention = config.HistoryRetention
+
+	if err := c.open(); err != nil {
+		return err
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.reapEvery(config.DiskCompactInterval)
+
+	return nil
+}
+
+// Close stops the reaper and closes the database.
+func (c *Client) Close() error {
+	close(c.stop)
+	<-c.done
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.db.Close()
+}
+
+func (c *Client) open() error {
+	// another process holding the file fails the open instead of blocking it
+	db, err := bolt.Open(c.path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", c.path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{counterBucket, apiKeyBucket, webhookBucket, webhookAttemptBucket, webhookFailureBucket, optOutBucket}, expiringBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("error creating buckets in %s: %w", c.path, err)
+	}
+
+	c.db = db
+	return nil
+}
+
+func (c *Client) view(fn func(tx *bolt.Tx) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.db.View(fn)
+}
+
+func (c *Client) update(fn func(tx *bolt.Tx) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.db.Update(fn)
+}
+
+func (c *Client) reapEvery(interval time.Duration) {
+	defer close(c.done)
+
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.reap(time.Now()); err != nil {
+			log.Errorf("disk storage reap: %v", err)
+		}
+
+		if err := c.compactIfSparse(); err != nil {
+			log.Errorf("disk storage compaction: %v", err)
+		}
+	}
+}
+
+// reap deletes the keys which expired before now.
+func (c *Client) reap(now time.Time) error {
+	return c.update(func(tx *bolt.Tx) error {
+		for _, name := range expiringBuckets {
+			b := tx.Bucket(name)
+
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				var r record
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+
+				if r.expired(now) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// compactIfSparse compacts the file when more than half of it is free pages.
+func (c *Client) compactIfSparse() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	stats := c.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(c.db.Info().PageSize)
+	c.mu.RUnlock()
+
+	if info.Size() < compactMinSize || free*2 < info.Size() {
+		return nil
+	}
+
+	return c.compact()
+}
+
+// compact copies the live data into a new file and swaps it in. The rename
+// is atomic, a crash leaves either the old or the new file in place.
+func (c *Client) compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tmp := c.path + ".compact"
+	_ = os.Remove(tmp)
+
+	dst, err := bolt.Open(tmp, 0o600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = bolt.Compact(dst, c.db, 0)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err := c.db.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		_ = os.Remove(tmp)
+		return c.open()
+	}
+
+	if err := syncDir(filepath.Dir(c.path)); err != nil {
+		log.Errorf("disk storage compaction: %v", err)
+	}
+
+	return c.open()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// record is a stored value with its expiry, a zero expiry never expires.
+type record struct {
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires"`
+}
+
+func (r record) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && now.After(r.Expires)
+}
+
+// get decodes the value of key into v, it returns false when the key is
+// missing or expired.
+func get(b *bolt.Bucket, key string, v interface{}) (bool, error) {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return false, err
+	}
+
+	if r.expired(time.Now()) {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(r.Value, v)
+}
+
+// put stores v under key for ttl, forever when ttl is 0.
+func put(b *bolt.Bucket, key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	r := record{Value: value}
+	if ttl > 0 {
+		r.Expires = time.Now().Add(ttl)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), data)
+}
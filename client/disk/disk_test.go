@@ -0,0 +1,168 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/client/storagetest"
+	"github.com/qosimmax/sms-executor/config"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func testConfig(path string, validity time.Duration) *config.Config {
+	return &config.Config{
+		DiskPath:            path,
+		DiskCompactInterval: time.Hour,
+		IdempotencyTTL:      time.Hour,
+		SmsValidity:         validity,
+		HistoryRetention:    time.Hour,
+	}
+}
+
+func newTestClient(t *testing.T, path string, validity time.Duration) *Client {
+	var c Client
+	if err := c.Init(context.Background(), testConfig(path, validity)); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	return &c
+}
+
+func TestClient_Storage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, validity time.Duration) storagetest.Storage {
+		c := newTestClient(t, filepath.Join(t.TempDir(), "data", "sms.db"), validity)
+		t.Cleanup(func() { _ = c.Close() })
+
+		return storagetest.Storage{StorageReadWriter: c}
+	})
+}
+
+func TestClient_History(t *testing.T) {
+	storagetest.RunHistory(t, func(t *testing.T) user.HistoryReaderWriter {
+		c := newTestClient(t, filepath.Join(t.TempDir(), "sms.db"), time.Hour)
+		t.Cleanup(func() { _ = c.Close() })
+
+		return c
+	})
+}
+
+func TestClient_APIKeys(t *testing.T) {
+	storagetest.RunAPIKeys(t, func(t *testing.T) user.APIKeyReaderWriter {
+		c := newTestClient(t, filepath.Join(t.TempDir(), "sms.db"), time.Hour)
+		t.Cleanup(func() { _ = c.Close() })
+
+		return c
+	})
+}
+
+func TestClient_Webhooks(t *testing.T) {
+	storagetest.RunWebhooks(t, func(t *testing.T) user.WebhookStore {
+		c := newTestClient(t, filepath.Join(t.TempDir(), "sms.db"), time.Hour)
+		t.Cleanup(func() { _ = c.Close() })
+
+		return c
+	})
+}
+
+func TestClient_OptOuts(t *testing.T) {
+	storagetest.RunOptOuts(t, func(t *testing.T) user.OptOutReaderWriter {
+		c := newTestClient(t, filepath.Join(t.TempDir(), "sms.db"), time.Hour)
+		t.Cleanup(func() { _ = c.Close() })
+
+		return c
+	})
+}
+
+func TestClient_Restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.db")
+	ctx := context.Background()
+
+	c := newTestClient(t, path, time.Hour)
+
+	if _, err := c.AllocateSequenceNumbers(ctx, 100); err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if err := c.WriteMessageSequence(ctx, user.SmsData{SmsID: "sms-1", SequenceMessageID: "msg-1"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := c.CompleteSubmission(ctx, "company-1", "sms-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	c = newTestClient(t, path, time.Hour)
+	defer c.Close()
+
+	first, err := c.AllocateSequenceNumbers(ctx, 1)
+	if err != nil || first != 101 {
+		t.Errorf("allocate after restart = %d, %v, want 101", first, err)
+	}
+
+	got, err := c.ReadMessageSequence(ctx, "msg-1")
+	if err != nil || got.SmsID != "sms-1" {
+		t.Errorf("read after restart = %+v, %v, want sms-1", got, err)
+	}
+
+	state, err := c.ClaimSubmission(ctx, "company-1", "sms-1")
+	if err != nil || state != user.SubmissionDone {
+		t.Errorf("claim after restart = %v, %v, want done", state, err)
+	}
+}
+
+func TestClient_ReapAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.db")
+	ctx := context.Background()
+
+	c := newTestClient(t, path, time.Hour)
+	defer c.Close()
+
+	for i := 0; i < 5000; i++ {
+		err := c.WriteSequenceNumber(ctx, user.SmsData{SmsID: fmt.Sprintf("sms-%d", i), SequenceNumber: int32(i)})
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := c.CompleteSubmission(ctx, "company-1", "sms-kept"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+
+	// the sequence numbers expire long before the submission
+	if err := c.reap(time.Now().Add(sequenceTTL + time.Second)); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+
+	if got, _ := c.ReadSequenceNumber(ctx, 1); got.SmsID != "" {
+		t.Errorf("sequence number kept after reap: %+v", got)
+	}
+
+	before := fileSize(t, path)
+	if err := c.compactIfSparse(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	if after := fileSize(t, path); after*2 > before {
+		t.Errorf("file size %d after compaction, was %d", after, before)
+	}
+
+	state, err := c.ClaimSubmission(ctx, "company-1", "sms-kept")
+	if err != nil || state != user.SubmissionDone {
+		t.Errorf("claim after compaction = %v, %v, want done", state, err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return info.Size()
+}
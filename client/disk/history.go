@@ -0,0 +1,150 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) AppendHistory(ctx context.Context, sms user.SmsHistory, entry user.HistoryEntry) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+
+		key := historyKey(sms.CompanyID, sms.SmsID)
+		var history user.SmsHistory
+		if _, err := get(b, key, &history); err != nil {
+			return err
+		}
+
+		before := history
+		history.Merge(sms, entry)
+		if err := put(b, key, history, c.historyRetention); err != nil {
+			return err
+		}
+
+		// the sms is indexed by when it was first seen, once the recipient
+		// and the company are known
+		index := tx.Bucket(historyIndexBucket)
+		seen := history.Entries[0].Time
+		if before.Recipient == "" && history.Recipient != "" {
+			if err := put(index, historyIndexKey('r', history.Recipient, seen, key), nil, c.historyRetention); err != nil {
+				return err
+			}
+		}
+		if before.CompanyID == "" && history.CompanyID != "" {
+			if err := put(index, historyIndexKey('c', history.CompanyID, seen, key), nil, c.historyRetention); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// historyKey is <company_id>\x00<sms_id>, a sms_id is only unique within its
+// company.
+func historyKey(companyID, smsID string) string {
+	return companyID + "\x00" + smsID
+}
+
+// historyIndexKey is <kind><value>\x00<first seen><history key>, so the keys
+// of a recipient or a company are sorted by when the sms was first seen.
+func historyIndexKey(kind byte, value string, seen time.Time, key string) string {
+	return string(historyIndexPrefix(kind, value)) + string(historyIndexTime(seen)) + key
+}
+
+func historyIndexPrefix(kind byte, value string) []byte {
+	return append(append([]byte{kind}, value...), 0)
+}
+
+func historyIndexTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixMilli()))
+	return b
+}
+
+func (c *Client) ReadHistory(ctx context.Context, companyID, smsID string) (history user.SmsHistory, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		found, err := get(tx.Bucket(historyBucket), historyKey(companyID, smsID), &history)
+		if err == nil && !found {
+			err = user.ErrNotFound{Err: fmt.Errorf("no history of sms %s", smsID)}
+		}
+		return err
+	})
+	return history, err
+}
+
+func (c *Client) FindHistory(ctx context.Context, query user.HistoryQuery) ([]user.SmsHistory, error) {
+	// the company is filtered after the lookup when both are given
+	var prefix []byte
+	switch {
+	case query.Recipient != "":
+		prefix = historyIndexPrefix('r', query.Recipient)
+	case query.CompanyID != "":
+		prefix = historyIndexPrefix('c', query.CompanyID)
+	default:
+		return nil, fmt.Errorf("history query without recipient or company")
+	}
+
+	histories := []user.SmsHistory{}
+	err := c.view(func(tx *bolt.Tx) error {
+		index := tx.Bucket(historyIndexBucket)
+		b := tx.Bucket(historyBucket)
+
+		start := prefix
+		if !query.From.IsZero() {
+			start = append(append([]byte{}, prefix...), historyIndexTime(query.From)...)
+		}
+
+		var keys []string
+		cursor := index.Cursor()
+		for k, _ := cursor.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			rest := k[len(prefix):]
+			if len(rest) < 8 {
+				continue
+			}
+
+			seen := int64(binary.BigEndian.Uint64(rest[:8]))
+			if !query.To.IsZero() && seen > query.To.UnixMilli() {
+				break
+			}
+
+			var marker interface{}
+			if found, err := get(index, string(k), &marker); err != nil || !found {
+				continue
+			}
+
+			keys = append(keys, string(rest[8:]))
+		}
+
+		// most recently seen first
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+
+		for _, key := range keys {
+			if query.Limit > 0 && len(histories) == query.Limit {
+				break
+			}
+
+			var history user.SmsHistory
+			found, err := get(b, key, &history)
+			if err != nil {
+				return err
+			}
+
+			if !found || query.CompanyID != "" && history.CompanyID != query.CompanyID {
+				continue
+			}
+
+			histories = append(histories, history)
+		}
+		return nil
+	})
+	return histories, err
+}
@@ -0,0 +1,47 @@
+package disk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func (c *Client) Lock(ctx context.Context, name string, ttl time.Duration) (token string, ok bool, err error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+
+	err = c.update(func(tx *bolt.Tx) error {
+		locks := tx.Bucket(lockBucket)
+
+		var held string
+		found, err := get(locks, name, &held)
+		if err != nil || found {
+			return err
+		}
+
+		token, ok = hex.EncodeToString(b), true
+		return put(locks, name, token, ttl)
+	})
+	return token, ok, err
+}
+
+// Unlock deletes the lock only if it is still held with the token, an
+// expired lock taken over by another holder is left alone.
+func (c *Client) Unlock(ctx context.Context, name, token string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		locks := tx.Bucket(lockBucket)
+
+		var held string
+		found, err := get(locks, name, &held)
+		if err != nil || !found || held != token {
+			return err
+		}
+
+		return locks.Delete([]byte(name))
+	})
+}
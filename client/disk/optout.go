@@ -0,0 +1,50 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteOptOut(ctx context.Context, optOut user.OptOut) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(optOutBucket), optOut.Key(), optOut, 0)
+	})
+}
+
+func (c *Client) ListOptOuts(ctx context.Context, recipient string) ([]user.OptOut, error) {
+	optOuts := []user.OptOut{}
+	err := c.view(func(tx *bolt.Tx) error {
+		prefix := []byte(recipient + ".")
+		cursor := tx.Bucket(optOutBucket).Cursor()
+		for k, data := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = cursor.Next() {
+			var r record
+			if err := json.Unmarshal(data, &r); err != nil {
+				return err
+			}
+
+			var optOut user.OptOut
+			if err := json.Unmarshal(r.Value, &optOut); err != nil {
+				return err
+			}
+			optOuts = append(optOuts, optOut)
+		}
+		return nil
+	})
+	return optOuts, err
+}
+
+func (c *Client) DeleteOptOut(ctx context.Context, optOut user.OptOut) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(optOutBucket)
+		if b.Get([]byte(optOut.Key())) == nil {
+			return user.ErrNotFound{Err: fmt.Errorf("no opt-out %s", optOut.Key())}
+		}
+		return b.Delete([]byte(optOut.Key()))
+	})
+}
@@ -0,0 +1,149 @@
+package disk
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+var counterKey = []byte("seq")
+
+func (c *Client) AllocateSequenceNumbers(ctx context.Context, n int64) (first int64, err error) {
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(counterBucket)
+
+		var last int64
+		if data := b.Get(counterKey); data != nil {
+			var err error
+			last, err = strconv.ParseInt(string(data), 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+
+		first = last + 1
+		return b.Put(counterKey, []byte(strconv.FormatInt(last+n, 10)))
+	})
+	return first, err
+}
+
+func (c *Client) WriteSequenceNumber(ctx context.Context, smsData user.SmsData) error {
+	smsData.Message = ""
+	return c.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(sequenceBucket), sequenceKey(smsData.SequenceNumber), smsData, sequenceTTL)
+	})
+}
+
+func (c *Client) ReadSequenceNumber(ctx context.Context, sequenceNumber int32) (smsData user.SmsData, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		found, err := get(tx.Bucket(sequenceBucket), sequenceKey(sequenceNumber), &smsData)
+		if found {
+			smsData.SequenceNumber = sequenceNumber
+		}
+		return err
+	})
+	return smsData, err
+}
+
+func sequenceKey(sequenceNumber int32) string {
+	return strconv.FormatInt(int64(sequenceNumber), 10)
+}
+
+// correlation is a message id correlation with the end of its sms validity,
+// which is set the first time it is written.
+type correlation struct {
+	Sms     user.SmsData `json:"sms"`
+	Expires time.Time    `json:"expires"`
+}
+
+func (c *Client) WriteMessageSequence(ctx context.Context, smsData user.SmsData) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageBucket)
+
+		var current correlation
+		found, err := get(b, smsData.SequenceMessageID, &current)
+		if err != nil {
+			return err
+		}
+
+		expires := time.Now().Add(c.validity)
+		if found {
+			expires = current.Expires
+		}
+
+		return put(b, smsData.SequenceMessageID, correlation{Sms: smsData, Expires: expires}, c.validity+messageSequenceGrace)
+	})
+}
+
+func (c *Client) ReadMessageSequence(ctx context.Context, sequenceMessageID string) (user.SmsData, error) {
+	var smsData user.SmsData
+	err := c.view(func(tx *bolt.Tx) error {
+		var err error
+		smsData, _, err = readCorrelation(tx.Bucket(messageBucket), sequenceMessageID)
+		return err
+	})
+	return smsData, err
+}
+
+func (c *Client) DeleteMessageSequence(ctx context.Context, sequenceMessageID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messageBucket).Delete([]byte(sequenceMessageID))
+	})
+}
+
+// FinishSegments counts the finished segments of a sms for as long as its
+// correlations are kept.
+func (c *Client) FinishSegments(ctx context.Context, companyID, smsID string, n int) (finished int, err error) {
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(segmentBucket)
+		key := historyKey(companyID, smsID)
+
+		if _, err := get(b, key, &finished); err != nil {
+			return err
+		}
+
+		finished += n
+		return put(b, key, finished, c.validity+messageSequenceGrace)
+	})
+	return finished, err
+}
+
+// ExpiredMessageSequences scans the bucket, which holds only the sms still
+// waiting for a final receipt and the recently finished ones.
+func (c *Client) ExpiredMessageSequences(ctx context.Context, before time.Time, limit int) ([]user.SmsData, error) {
+	var expired []user.SmsData
+	err := c.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(messageBucket)
+		cursor := b.Cursor()
+
+		for k, _ := cursor.First(); k != nil && len(expired) < limit; k, _ = cursor.Next() {
+			smsData, expires, err := readCorrelation(b, string(k))
+			if err != nil {
+				return err
+			}
+
+			if smsData.SmsID != "" && !expires.After(before) {
+				expired = append(expired, smsData)
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// readCorrelation returns the sms and the end of its validity, the message
+// id is not part of the stored sms, it is the key.
+func readCorrelation(b *bolt.Bucket, sequenceMessageID string) (user.SmsData, time.Time, error) {
+	var current correlation
+	found, err := get(b, sequenceMessageID, &current)
+	if err != nil || !found {
+		return user.SmsData{}, time.Time{}, err
+	}
+
+	current.Sms.SequenceMessageID = sequenceMessageID
+	return current.Sms, current.Expires, nil
+}
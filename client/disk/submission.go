@@ -0,0 +1,56 @@
+package disk
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	submissionPending = "pending"
+	submissionDone    = "done"
+)
+
+func (c *Client) ClaimSubmission(ctx context.Context, companyID, smsID string) (state user.SubmissionState, err error) {
+	key := submissionKey(companyID, smsID)
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(submissionBucket)
+
+		var current string
+		found, err := get(b, key, &current)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !found:
+			state = user.SubmissionNew
+			return put(b, key, submissionPending, submissionPendingTTL)
+		case current == submissionDone:
+			state = user.SubmissionDone
+		default:
+			state = user.SubmissionPending
+		}
+		return nil
+	})
+	return state, err
+}
+
+func (c *Client) CompleteSubmission(ctx context.Context, companyID, smsID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(submissionBucket), submissionKey(companyID, smsID), submissionDone, c.idempotencyTTL)
+	})
+}
+
+func (c *Client) ReleaseSubmission(ctx context.Context, companyID, smsID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(submissionBucket).Delete([]byte(submissionKey(companyID, smsID)))
+	})
+}
+
+// submissionKey is <company_id>\x00<sms_id>, like the history key.
+func submissionKey(companyID, smsID string) string {
+	return historyKey(companyID, smsID)
+}
@@ -0,0 +1,94 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteWebhook(ctx context.Context, webhook user.Webhook) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(webhookBucket), webhook.CompanyID, webhook, 0)
+	})
+}
+
+func (c *Client) ReadWebhook(ctx context.Context, companyID string) (webhook user.Webhook, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		found, err := get(tx.Bucket(webhookBucket), companyID, &webhook)
+		if err == nil && !found {
+			err = user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+		}
+		return err
+	})
+	return webhook, err
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, companyID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		if b.Get([]byte(companyID)) == nil {
+			return user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+		}
+		return b.Delete([]byte(companyID))
+	})
+}
+
+// AppendWebhookAttempt keeps the attempts of a company in one value, the
+// latest first.
+func (c *Client) AppendWebhookAttempt(ctx context.Context, companyID string, attempt user.WebhookAttempt) error {
+	return c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookAttemptBucket)
+
+		var attempts []user.WebhookAttempt
+		if _, err := get(b, companyID, &attempts); err != nil {
+			return err
+		}
+
+		attempts = append([]user.WebhookAttempt{attempt}, attempts...)
+		if len(attempts) > user.WebhookAttemptsKept {
+			attempts = attempts[:user.WebhookAttemptsKept]
+		}
+		return put(b, companyID, attempts, 0)
+	})
+}
+
+func (c *Client) ReadWebhookAttempts(ctx context.Context, companyID string, limit int) (attempts []user.WebhookAttempt, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		_, err := get(tx.Bucket(webhookAttemptBucket), companyID, &attempts)
+		return err
+	})
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	return attempts, err
+}
+
+func (c *Client) AddWebhookFailure(ctx context.Context, companyID string) (failures int, err error) {
+	err = c.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookFailureBucket)
+		if _, err := get(b, companyID, &failures); err != nil {
+			return err
+		}
+
+		failures++
+		return put(b, companyID, failures, 0)
+	})
+	return failures, err
+}
+
+func (c *Client) WebhookFailures(ctx context.Context, companyID string) (failures int, err error) {
+	err = c.view(func(tx *bolt.Tx) error {
+		_, err := get(tx.Bucket(webhookFailureBucket), companyID, &failures)
+		return err
+	})
+	return failures, err
+}
+
+func (c *Client) ResetWebhookFailures(ctx context.Context, companyID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookFailureBucket).Delete([]byte(companyID))
+	})
+}
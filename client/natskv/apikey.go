@@ -0,0 +1,65 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteAPIKey(ctx context.Context, key user.APIKey) error {
+	data, _ := json.Marshal(key)
+	_, err := c.apiKeys.Put(key.ID, data)
+	return err
+}
+
+func (c *Client) ReadAPIKey(ctx context.Context, id string) (user.APIKey, error) {
+	entry, err := c.apiKeys.Get(id)
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return user.APIKey{}, user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+	}
+	if err != nil {
+		return user.APIKey{}, err
+	}
+
+	var key user.APIKey
+	err = json.Unmarshal(entry.Value(), &key)
+	return key, err
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]user.APIKey, error) {
+	ids, err := c.apiKeys.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]user.APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := c.ReadAPIKey(ctx, id)
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			// deleted since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (c *Client) DeleteAPIKey(ctx context.Context, id string) error {
+	if _, err := c.ReadAPIKey(ctx, id); err != nil {
+		return err
+	}
+	return c.apiKeys.Delete(id)
+}
@@ -0,0 +1,189 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// AppendHistory merges the entry into the history of the sms with an
+// optimistic update, retrying when another instance won the race.
+func (c *Client) AppendHistory(ctx context.Context, sms user.SmsHistory, entry user.HistoryEntry) error {
+	key := historyKey(sms.CompanyID, sms.SmsID)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var history user.SmsHistory
+		var revision uint64
+		current, err := c.history.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			revision = current.Revision()
+			if err := json.Unmarshal(current.Value(), &history); err != nil {
+				return err
+			}
+		}
+
+		before := history
+		history.Merge(sms, entry)
+		data, _ := json.Marshal(history)
+
+		if revision == 0 {
+			_, err = c.history.Create(key, data)
+		} else {
+			_, err = c.history.Update(key, data, revision)
+		}
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.indexHistory(before, history)
+	}
+}
+
+// indexHistory indexes the sms by its recipient and company once they are
+// known, by when the sms was first seen.
+func (c *Client) indexHistory(before, after user.SmsHistory) error {
+	seen := strconv.FormatInt(after.Entries[0].Time.UnixMilli(), 10)
+
+	if before.Recipient == "" && after.Recipient != "" {
+		_, err := c.historyIndex.Put(historyIndexKey("r", after.Recipient, seen, after.CompanyID, after.SmsID), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if before.CompanyID == "" && after.CompanyID != "" {
+		_, err := c.historyIndex.Put(historyIndexKey("c", after.CompanyID, seen, after.CompanyID, after.SmsID), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// historyKey is <company_id>.<sms_id>, a sms_id is only unique within its
+// company.
+func historyKey(companyID, smsID string) string {
+	return encodeKey(companyID) + "." + encodeKey(smsID)
+}
+
+// historyIndexKey is <kind>.<value>.<first seen>.<company_id>.<sms_id>, so a
+// watch on <kind>.<value>.> lists the sms of a recipient or a company.
+func historyIndexKey(kind, value, seen, companyID, smsID string) string {
+	return strings.Join([]string{kind, encodeKey(value), seen, historyKey(companyID, smsID)}, ".")
+}
+
+func (c *Client) ReadHistory(ctx context.Context, companyID, smsID string) (user.SmsHistory, error) {
+	var history user.SmsHistory
+	entry, err := c.history.Get(historyKey(companyID, smsID))
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return history, user.ErrNotFound{Err: fmt.Errorf("no history of sms %s", smsID)}
+		}
+		return history, err
+	}
+
+	err = json.Unmarshal(entry.Value(), &history)
+	return history, err
+}
+
+func (c *Client) FindHistory(ctx context.Context, query user.HistoryQuery) ([]user.SmsHistory, error) {
+	// the company is filtered after the lookup when both are given
+	var prefix string
+	switch {
+	case query.Recipient != "":
+		prefix = "r." + encodeKey(query.Recipient) + "."
+	case query.CompanyID != "":
+		prefix = "c." + encodeKey(query.CompanyID) + "."
+	default:
+		return nil, fmt.Errorf("history query without recipient or company")
+	}
+
+	watcher, err := c.historyIndex.Watch(prefix+">", nats.IgnoreDeletes(), nats.MetaOnly(), nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	type indexed struct {
+		seen      int64
+		companyID string
+		smsID     string
+	}
+
+	var found []indexed
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+
+		parts := strings.Split(strings.TrimPrefix(entry.Key(), prefix), ".")
+		if len(parts) != 3 {
+			continue
+		}
+
+		seen, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if !query.From.IsZero() && seen < query.From.UnixMilli() || !query.To.IsZero() && seen > query.To.UnixMilli() {
+			continue
+		}
+
+		companyID, err := decodeKey(parts[1])
+		if err != nil || query.CompanyID != "" && companyID != query.CompanyID {
+			continue
+		}
+
+		smsID, err := decodeKey(parts[2])
+		if err != nil {
+			continue
+		}
+
+		found = append(found, indexed{seen: seen, companyID: companyID, smsID: smsID})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].seen > found[j].seen
+	})
+
+	histories := []user.SmsHistory{}
+	for _, f := range found {
+		if query.Limit > 0 && len(histories) == query.Limit {
+			break
+		}
+
+		history, err := c.ReadHistory(ctx, f.companyID, f.smsID)
+		if err != nil {
+			var errNotFound user.ErrNotFound
+			if errors.As(err, &errNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		histories = append(histories, history)
+	}
+
+	return histories, nil
+}
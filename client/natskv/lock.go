@@ -0,0 +1,84 @@
+package natskv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func (c *Client) Lock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	token := hex.EncodeToString(b)
+
+	key := encodeKey(name)
+	_, err := c.locks.Create(key, newLease(token, ttl))
+	if err == nil {
+		return token, true, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return "", false, err
+	}
+
+	entry, err := c.locks.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	held, err := readLease(entry)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !held.expired() {
+		return "", false, nil
+	}
+
+	// take over the expired lock, unless another holder was faster
+	_, err = c.locks.Update(key, newLease(token, ttl), entry.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	return token, true, nil
+}
+
+// Unlock deletes the lock only if it is still held with the token, an
+// expired lock taken over by another holder is left alone.
+func (c *Client) Unlock(ctx context.Context, name, token string) error {
+	key := encodeKey(name)
+	entry, err := c.locks.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	held, err := readLease(entry)
+	if err != nil {
+		return err
+	}
+
+	if held.Value != token {
+		return nil
+	}
+
+	err = c.locks.Delete(key, nats.LastRevision(entry.Revision()))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return nil
+	}
+	return err
+}
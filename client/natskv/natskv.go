@@ -0,0 +1,237 @@
+// Package natskv keeps the correlation data in JetStream key-value buckets,
+// so a deployment which already runs JetStream does not need redis.
+//
+// Each key type has its own bucket, whose TTL bounds how long its keys are
+// kept. JetStream has no per-key TTL, so keys which expire sooner than their
+// bucket, like submissions and locks, store their expiry with the value.
+// The correlations are also indexed by the minute their validity ends, which
+// the expiry sweep walks instead of listing the whole bucket.
+package natskv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/config"
+)
+
+const (
+	// sequenceTTL is how long a submit_sm waits for its response.
+	sequenceTTL = 900 * time.Second
+
+	// messageSequenceGrace keeps a correlation past the sms validity, so the
+	// expiry sweep still finds it.
+	messageSequenceGrace = time.Hour
+
+	// submissionPendingTTL bounds how long a crashed submission blocks
+	// redeliveries of the same sms.
+	submissionPendingTTL = time.Minute
+
+	// lockTTL bounds how long an abandoned lock is kept, a lock expires
+	// after the ttl it was taken with regardless.
+	lockTTL = 24 * time.Hour
+)
+
+// Client holds the key-value buckets.
+type Client struct {
+	conn            *nats.Conn
+	counter         nats.KeyValue
+	sequences       nats.KeyValue
+	messages        nats.KeyValue
+	messageExpiry   nats.KeyValue
+	segments        nats.KeyValue
+	submissions     nats.KeyValue
+	locks           nats.KeyValue
+	history         nats.KeyValue
+	historyIndex    nats.KeyValue
+	apiKeys         nats.KeyValue
+	webhooks        nats.KeyValue
+	webhookAttempts nats.KeyValue
+	webhookFailures nats.KeyValue
+	optOuts         nats.KeyValue
+	idempotencyTTL  time.Duration
+	validity        time.Duration
+}
+
+// Init connects to nats and creates the buckets.
+func (c *Client) Init(ctx context.Context, config *config.Config) error {
+	nc, err := nats.Connect(config.NatsURL)
+	if err != nil {
+		return err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	var storage nats.StorageType
+	err = storage.UnmarshalJSON([]byte(strconv.Quote(strings.ToLower(config.NatsKVStorage))))
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("invalid kv storage %q: %w", config.NatsKVStorage, err)
+	}
+
+	submissionTTL := config.IdempotencyTTL
+	if submissionTTL < submissionPendingTTL {
+		submissionTTL = submissionPendingTTL
+	}
+
+	buckets := []struct {
+		kv   *nats.KeyValue
+		name string
+		ttl  time.Duration
+	}{
+		{&c.counter, "counter", 0},
+		{&c.sequences, "seq", sequenceTTL},
+		{&c.messages, "msg", config.SmsValidity + messageSequenceGrace},
+		{&c.messageExpiry, "msg_exp", config.SmsValidity + messageSequenceGrace},
+		{&c.segments, "segments", config.SmsValidity + messageSequenceGrace},
+		{&c.submissions, "submit", submissionTTL},
+		{&c.locks, "lock", lockTTL},
+		{&c.history, "history", config.HistoryRetention},
+		{&c.historyIndex, "history_idx", config.HistoryRetention},
+	}
+
+	for _, b := range buckets {
+		*b.kv, err = ensureBucket(js, &nats.KeyValueConfig{
+			Bucket:   bucketName(config.NatsKVBucketPrefix, config.NatsTopic, b.name),
+			History:  1,
+			TTL:      b.ttl,
+			Storage:  storage,
+			Replicas: config.NatsKVReplicas,
+		})
+		if err != nil {
+			nc.Close()
+			return err
+		}
+	}
+
+	// api keys, webhooks and opt-outs are shared by the executors of every
+	// operator
+	shared := []struct {
+		kv   *nats.KeyValue
+		name string
+	}{
+		{&c.apiKeys, "apikeys"},
+		{&c.webhooks, "webhooks"},
+		{&c.webhookAttempts, "webhook_attempts"},
+		{&c.webhookFailures, "webhook_failures"},
+		{&c.optOuts, "optouts"},
+	}
+
+	for _, b := range shared {
+		*b.kv, err = ensureBucket(js, &nats.KeyValueConfig{
+			Bucket:   invalidBucketChars.ReplaceAllString(config.NatsKVBucketPrefix+"_"+b.name, "_"),
+			History:  1,
+			Storage:  storage,
+			Replicas: config.NatsKVReplicas,
+		})
+		if err != nil {
+			nc.Close()
+			return err
+		}
+	}
+
+	c.conn = nc
+	c.idempotencyTTL = config.IdempotencyTTL
+	c.validity = config.SmsValidity
+
+	return nil
+}
+
+// Close closes the underlying nats connection.
+func (c *Client) Close() error {
+	c.conn.Close()
+	return nil
+}
+
+// ensureBucket creates the bucket, or updates its TTL when it differs from
+// the desired one, for example after SMS_VALIDITY changed.
+func ensureBucket(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error creating bucket %s: %w", cfg.Bucket, err)
+		}
+
+		log.Infof("bucket %s created", cfg.Bucket)
+		return kv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting bucket %s: %w", cfg.Bucket, err)
+	}
+
+	status, err := kv.Status()
+	if err != nil {
+		return nil, fmt.Errorf("error getting bucket %s: %w", cfg.Bucket, err)
+	}
+
+	if status.TTL() != cfg.TTL {
+		stream := "KV_" + cfg.Bucket
+		info, err := js.StreamInfo(stream)
+		if err != nil {
+			return nil, fmt.Errorf("error getting bucket %s: %w", cfg.Bucket, err)
+		}
+
+		info.Config.MaxAge = cfg.TTL
+		_, err = js.UpdateStream(&info.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error updating bucket %s: %w", cfg.Bucket, err)
+		}
+
+		log.Infof("bucket %s ttl changed from %s to %s", cfg.Bucket, status.TTL(), cfg.TTL)
+	}
+
+	return kv, nil
+}
+
+var invalidBucketChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// bucketName names a bucket per operator topic, like sms_beeline_seq.
+func bucketName(prefix, topic, name string) string {
+	return invalidBucketChars.ReplaceAllString(fmt.Sprintf("%s_%s_%s", prefix, topic, name), "_")
+}
+
+// encodeKey turns an arbitrary string, like a message id from the SMSC, into
+// a valid key.
+func encodeKey(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeKey(key string) (string, error) {
+	s, err := base64.RawURLEncoding.DecodeString(key)
+	return string(s), err
+}
+
+// lease is a value which expires before its bucket TTL.
+type lease struct {
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l lease) expired() bool {
+	return time.Now().After(l.Expires)
+}
+
+func newLease(value string, ttl time.Duration) []byte {
+	data, _ := json.Marshal(lease{Value: value, Expires: time.Now().Add(ttl)})
+	return data
+}
+
+func readLease(entry nats.KeyValueEntry) (lease, error) {
+	var l lease
+	err := json.Unmarshal(entry.Value(), &l)
+	return l, err
+}
@@ -0,0 +1,110 @@
+package natskv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+
+	"github.com/qosimmax/sms-executor/client/storagetest"
+	"github.com/qosimmax/sms-executor/config"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func newTestClient(t *testing.T, validity time.Duration) *Client {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("nats server: %v", err)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	var c Client
+	err = c.Init(context.Background(), &config.Config{
+		NatsURL:            ns.ClientURL(),
+		NatsTopic:          "test.operator",
+		NatsKVBucketPrefix: "sms",
+		NatsKVReplicas:     1,
+		NatsKVStorage:      "memory",
+		IdempotencyTTL:     time.Hour,
+		SmsValidity:        validity,
+		HistoryRetention:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+
+	return &c
+}
+
+func TestClient_Storage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, validity time.Duration) storagetest.Storage {
+		return storagetest.Storage{StorageReadWriter: newTestClient(t, validity)}
+	})
+}
+
+func TestClient_History(t *testing.T) {
+	storagetest.RunHistory(t, func(t *testing.T) user.HistoryReaderWriter {
+		return newTestClient(t, time.Hour)
+	})
+}
+
+func TestClient_APIKeys(t *testing.T) {
+	storagetest.RunAPIKeys(t, func(t *testing.T) user.APIKeyReaderWriter {
+		return newTestClient(t, time.Hour)
+	})
+}
+
+func TestClient_Webhooks(t *testing.T) {
+	storagetest.RunWebhooks(t, func(t *testing.T) user.WebhookStore {
+		return newTestClient(t, time.Hour)
+	})
+}
+
+func TestClient_OptOuts(t *testing.T) {
+	storagetest.RunOptOuts(t, func(t *testing.T) user.OptOutReaderWriter {
+		return newTestClient(t, time.Hour)
+	})
+}
+
+func TestClient_MessageSequenceValidity(t *testing.T) {
+	c := newTestClient(t, 200*time.Millisecond)
+	ctx := context.Background()
+
+	sms := user.SmsData{SmsID: "sms-1", SequenceMessageID: "msg-1"}
+	if err := c.WriteMessageSequence(ctx, sms); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// a rewrite keeps the validity of the first write
+	sms.State = user.SmsIntermediate
+	if err := c.WriteMessageSequence(ctx, sms); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	expired, err := c.ExpiredMessageSequences(ctx, time.Now(), 10)
+	if err != nil || len(expired) != 1 || expired[0].State != user.SmsIntermediate {
+		t.Fatalf("expired = %+v, %v, want the intermediate sms", expired, err)
+	}
+}
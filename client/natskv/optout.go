@@ -0,0 +1,52 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteOptOut(ctx context.Context, optOut user.OptOut) error {
+	data, _ := json.Marshal(optOut)
+	_, err := c.optOuts.Put(optOut.Key(), data)
+	return err
+}
+
+func (c *Client) ListOptOuts(ctx context.Context, recipient string) ([]user.OptOut, error) {
+	watcher, err := c.optOuts.Watch(recipient+".*", nats.IgnoreDeletes(), nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	optOuts := []user.OptOut{}
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+
+		var optOut user.OptOut
+		if err := json.Unmarshal(entry.Value(), &optOut); err != nil {
+			return nil, err
+		}
+		optOuts = append(optOuts, optOut)
+	}
+
+	return optOuts, nil
+}
+
+func (c *Client) DeleteOptOut(ctx context.Context, optOut user.OptOut) error {
+	_, err := c.optOuts.Get(optOut.Key())
+	if errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, nats.ErrInvalidKey) {
+		return user.ErrNotFound{Err: fmt.Errorf("no opt-out %s", optOut.Key())}
+	}
+	if err != nil {
+		return err
+	}
+	return c.optOuts.Delete(optOut.Key())
+}
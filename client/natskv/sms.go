@@ -0,0 +1,295 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const counterKey = "seq"
+
+// AllocateSequenceNumbers increments the shared counter by n with an
+// optimistic update, retrying when another instance won the race.
+func (c *Client) AllocateSequenceNumbers(ctx context.Context, n int64) (int64, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		var last int64
+		entry, err := c.counter.Get(counterKey)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+			_, err = c.counter.Create(counterKey, []byte(strconv.FormatInt(n, 10)))
+		case err != nil:
+			return 0, err
+		default:
+			last, err = strconv.ParseInt(string(entry.Value()), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = c.counter.Update(counterKey, []byte(strconv.FormatInt(last+n, 10)), entry.Revision())
+		}
+
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return last + 1, nil
+	}
+}
+
+func (c *Client) WriteSequenceNumber(ctx context.Context, smsData user.SmsData) error {
+	smsData.Message = ""
+	data, _ := json.Marshal(smsData)
+	_, err := c.sequences.Put(strconv.FormatInt(int64(smsData.SequenceNumber), 10), data)
+	return err
+}
+
+func (c *Client) ReadSequenceNumber(ctx context.Context, sequenceNumber int32) (smsData user.SmsData, err error) {
+	entry, err := c.sequences.Get(strconv.FormatInt(int64(sequenceNumber), 10))
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return smsData, nil
+		}
+		return smsData, err
+	}
+
+	err = json.Unmarshal(entry.Value(), &smsData)
+	smsData.SequenceNumber = sequenceNumber
+	return smsData, err
+}
+
+// correlation is a message id correlation with the end of its sms validity,
+// which is set the first time it is written.
+type correlation struct {
+	Sms     user.SmsData `json:"sms"`
+	Expires time.Time    `json:"expires"`
+}
+
+// WriteMessageSequence stores the correlation of a message id, and indexes
+// it by the end of its validity the first time it is written.
+func (c *Client) WriteMessageSequence(ctx context.Context, smsData user.SmsData) error {
+	key := encodeKey(smsData.SequenceMessageID)
+
+	current, err := c.readCorrelation(key)
+	if err != nil {
+		return err
+	}
+
+	expires := current.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(c.validity)
+
+		// indexed first, an index entry without its correlation is dropped
+		// by the sweep
+		_, err = c.messageExpiry.Put(expiryKey(expiryMinute(expires), key), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, _ := json.Marshal(correlation{Sms: smsData, Expires: expires})
+	_, err = c.messages.Put(key, data)
+	return err
+}
+
+func (c *Client) ReadMessageSequence(ctx context.Context, sequenceMessageID string) (user.SmsData, error) {
+	current, err := c.readCorrelation(encodeKey(sequenceMessageID))
+	return current.Sms, err
+}
+
+func (c *Client) DeleteMessageSequence(ctx context.Context, sequenceMessageID string) error {
+	key := encodeKey(sequenceMessageID)
+
+	current, err := c.readCorrelation(key)
+	if err != nil || current.Expires.IsZero() {
+		return err
+	}
+
+	err = c.messages.Delete(key)
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		return err
+	}
+
+	err = c.messageExpiry.Delete(expiryKey(expiryMinute(current.Expires), key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// FinishSegments counts the finished segments of a sms with an optimistic
+// update, like AllocateSequenceNumbers.
+func (c *Client) FinishSegments(ctx context.Context, companyID, smsID string, n int) (int, error) {
+	key := historyKey(companyID, smsID)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		var finished int
+		entry, err := c.segments.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+			_, err = c.segments.Create(key, []byte(strconv.Itoa(n)))
+		case err != nil:
+			return 0, err
+		default:
+			finished, err = strconv.Atoi(string(entry.Value()))
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = c.segments.Update(key, []byte(strconv.Itoa(finished+n)), entry.Revision())
+		}
+
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return finished + n, nil
+	}
+}
+
+// expiryCursorKey keeps, in the counter bucket, the oldest minute of the
+// expiry index which may still hold correlations.
+const expiryCursorKey = "expiry"
+
+// ExpiredMessageSequences walks the expiry index minute by minute, from the
+// cursor up to the minute of before. The cursor moves past the minutes whose
+// correlations were all deleted, so a sweep only looks up the minutes which
+// are due.
+func (c *Client) ExpiredMessageSequences(ctx context.Context, before time.Time, limit int) ([]user.SmsData, error) {
+	now := expiryMinute(time.Now())
+	cursor, err := c.expiryCursor(now)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []user.SmsData
+	next := cursor
+	for minute := cursor; minute <= expiryMinute(before) && len(expired) < limit; minute++ {
+		keys, err := c.expiryKeys(ctx, minute)
+		if err != nil {
+			return nil, err
+		}
+
+		drained := true
+		for _, key := range keys {
+			current, err := c.readCorrelation(key)
+			if err != nil {
+				return nil, err
+			}
+
+			// deleted in between, or the correlation lapsed
+			if current.Sms.SmsID == "" {
+				err = c.messageExpiry.Delete(expiryKey(minute, key))
+				if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+					return nil, err
+				}
+				continue
+			}
+
+			drained = false
+			if len(expired) == limit || current.Expires.After(before) {
+				continue
+			}
+
+			expired = append(expired, current.Sms)
+		}
+
+		// the current minute may still get correlations
+		if drained && minute == next && minute < now {
+			next = minute + 1
+		}
+	}
+
+	if next != cursor {
+		_, err = c.counter.Put(expiryCursorKey, []byte(strconv.FormatInt(next, 10)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// expiryCursor returns the cursor of the expiry index, which starts at the
+// current minute: a correlation is due a validity after it was written.
+func (c *Client) expiryCursor(now int64) (int64, error) {
+	entry, err := c.counter.Get(expiryCursorKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		_, err = c.counter.Put(expiryCursorKey, []byte(strconv.FormatInt(now, 10)))
+		return now, err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(entry.Value()), 10, 64)
+}
+
+// expiryKeys returns the correlation keys which are due within a minute.
+func (c *Client) expiryKeys(ctx context.Context, minute int64) ([]string, error) {
+	prefix := expiryKey(minute, "")
+	watcher, err := c.messageExpiry.Watch(prefix+"*", nats.IgnoreDeletes(), nats.MetaOnly(), nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	var keys []string
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		keys = append(keys, strings.TrimPrefix(entry.Key(), prefix))
+	}
+
+	return keys, nil
+}
+
+// expiryKey indexes a correlation key by the minute its sms validity ends.
+func expiryKey(minute int64, key string) string {
+	return strconv.FormatInt(minute, 10) + "." + key
+}
+
+// expiryMinute is the minute of the expiry index a time falls in.
+func expiryMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func (c *Client) readCorrelation(key string) (current correlation, err error) {
+	entry, err := c.messages.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return current, nil
+		}
+		return current, err
+	}
+
+	err = json.Unmarshal(entry.Value(), &current)
+	if err != nil {
+		return current, err
+	}
+
+	// the message id is not part of the stored sms, it is the key
+	id, err := decodeKey(key)
+	current.Sms.SequenceMessageID = id
+	return current, err
+}
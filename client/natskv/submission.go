@@ -0,0 +1,76 @@
+package natskv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	submissionPending = "pending"
+	submissionDone    = "done"
+)
+
+func (c *Client) ClaimSubmission(ctx context.Context, companyID, smsID string) (user.SubmissionState, error) {
+	key := submissionKey(companyID, smsID)
+	_, err := c.submissions.Create(key, newLease(submissionPending, submissionPendingTTL))
+	if err == nil {
+		return user.SubmissionNew, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return user.SubmissionNew, err
+	}
+
+	entry, err := c.submissions.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			// released in between, let the redelivery claim it
+			return user.SubmissionPending, nil
+		}
+		return user.SubmissionNew, err
+	}
+
+	state, err := readLease(entry)
+	if err != nil {
+		return user.SubmissionNew, err
+	}
+
+	if state.expired() {
+		_, err = c.submissions.Update(key, newLease(submissionPending, submissionPendingTTL), entry.Revision())
+		if errors.Is(err, nats.ErrKeyExists) {
+			return user.SubmissionPending, nil
+		}
+		if err != nil {
+			return user.SubmissionNew, err
+		}
+
+		return user.SubmissionNew, nil
+	}
+
+	if state.Value == submissionDone {
+		return user.SubmissionDone, nil
+	}
+
+	return user.SubmissionPending, nil
+}
+
+func (c *Client) CompleteSubmission(ctx context.Context, companyID, smsID string) error {
+	_, err := c.submissions.Put(submissionKey(companyID, smsID), newLease(submissionDone, c.idempotencyTTL))
+	return err
+}
+
+func (c *Client) ReleaseSubmission(ctx context.Context, companyID, smsID string) error {
+	err := c.submissions.Delete(submissionKey(companyID, smsID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+// submissionKey is <company_id>.<sms_id>, like the history key.
+func submissionKey(companyID, smsID string) string {
+	return historyKey(companyID, smsID)
+}
@@ -0,0 +1,154 @@
+package natskv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func (c *Client) WriteWebhook(ctx context.Context, webhook user.Webhook) error {
+	data, _ := json.Marshal(webhook)
+	_, err := c.webhooks.Put(encodeKey(webhook.CompanyID), data)
+	return err
+}
+
+func (c *Client) ReadWebhook(ctx context.Context, companyID string) (user.Webhook, error) {
+	entry, err := c.webhooks.Get(encodeKey(companyID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return user.Webhook{}, user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+	}
+	if err != nil {
+		return user.Webhook{}, err
+	}
+
+	var webhook user.Webhook
+	err = json.Unmarshal(entry.Value(), &webhook)
+	return webhook, err
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, companyID string) error {
+	if _, err := c.ReadWebhook(ctx, companyID); err != nil {
+		return err
+	}
+	return c.webhooks.Delete(encodeKey(companyID))
+}
+
+// AppendWebhookAttempt keeps the attempts of a company in one value, the
+// latest first, with an optimistic update.
+func (c *Client) AppendWebhookAttempt(ctx context.Context, companyID string, attempt user.WebhookAttempt) error {
+	key := encodeKey(companyID)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var attempts []user.WebhookAttempt
+		var revision uint64
+		current, err := c.webhookAttempts.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+		case err != nil:
+			return err
+		default:
+			revision = current.Revision()
+			if err := json.Unmarshal(current.Value(), &attempts); err != nil {
+				return err
+			}
+		}
+
+		attempts = append([]user.WebhookAttempt{attempt}, attempts...)
+		if len(attempts) > user.WebhookAttemptsKept {
+			attempts = attempts[:user.WebhookAttemptsKept]
+		}
+		data, _ := json.Marshal(attempts)
+
+		if revision == 0 {
+			_, err = c.webhookAttempts.Create(key, data)
+		} else {
+			_, err = c.webhookAttempts.Update(key, data, revision)
+		}
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		return err
+	}
+}
+
+func (c *Client) ReadWebhookAttempts(ctx context.Context, companyID string, limit int) ([]user.WebhookAttempt, error) {
+	entry, err := c.webhookAttempts.Get(encodeKey(companyID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts []user.WebhookAttempt
+	if err := json.Unmarshal(entry.Value(), &attempts); err != nil {
+		return nil, err
+	}
+
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	return attempts, nil
+}
+
+// AddWebhookFailure counts a failed event with an optimistic update.
+func (c *Client) AddWebhookFailure(ctx context.Context, companyID string) (int, error) {
+	key := encodeKey(companyID)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		var failures int
+		entry, err := c.webhookFailures.Get(key)
+		switch {
+		case errors.Is(err, nats.ErrKeyNotFound):
+			_, err = c.webhookFailures.Create(key, []byte("1"))
+		case err != nil:
+			return 0, err
+		default:
+			failures, err = strconv.Atoi(string(entry.Value()))
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = c.webhookFailures.Update(key, []byte(strconv.Itoa(failures+1)), entry.Revision())
+		}
+
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return failures + 1, nil
+	}
+}
+
+func (c *Client) WebhookFailures(ctx context.Context, companyID string) (int, error) {
+	entry, err := c.webhookFailures.Get(encodeKey(companyID))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(entry.Value()))
+}
+
+func (c *Client) ResetWebhookFailures(ctx context.Context, companyID string) error {
+	return c.webhookFailures.Delete(encodeKey(companyID))
+}
@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	settingsStream = "sms-settings"
+
+	// BindsSubject is requested for the binds of every executor.
+	BindsSubject = "sms.admin.binds"
+)
+
+// SettingsSubject returns the subject keeping the runtime settings of an
+// operator, only the latest message is kept.
+func SettingsSubject(operator string) string {
+	return fmt.Sprintf("sms.settings.%s", operator)
+}
+
+// RebindSubject returns the subject requesting a rebind of the executors of
+// an operator.
+func RebindSubject(operator string) string {
+	return fmt.Sprintf("sms.admin.rebind.%s", operator)
+}
+
+// settingsStreamConfig derives the settings stream definition.
+func settingsStreamConfig(cfg *nats.StreamConfig) *nats.StreamConfig {
+	return &nats.StreamConfig{
+		Name:              settingsStream,
+		Subjects:          []string{"sms.settings.>"},
+		Retention:         nats.LimitsPolicy,
+		MaxMsgsPerSubject: 1,
+		MaxBytes:          -1,
+		Replicas:          cfg.Replicas,
+		Storage:           cfg.Storage,
+	}
+}
+
+// ReadSettings returns the runtime settings of an operator and their
+// revision, empty settings at revision 0 when none were written.
+func (c *Client) ReadSettings(ctx context.Context, operator string) (user.Settings, uint64, error) {
+	msg, err := c.GetLastMsg(settingsStream, SettingsSubject(operator), nats.Context(ctx))
+	if err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			return user.Settings{Operator: operator}, 0, nil
+		}
+		return user.Settings{}, 0, fmt.Errorf("error reading settings of %s: %w", operator, err)
+	}
+
+	var settings user.Settings
+	if err := json.Unmarshal(msg.Data, &settings); err != nil {
+		return user.Settings{}, 0, fmt.Errorf("error unmarshalling settings of %s: %w", operator, err)
+	}
+
+	return settings, msg.Sequence, nil
+}
+
+// WriteSettings replaces the runtime settings of an operator, unless they
+// were written since revision.
+func (c *Client) WriteSettings(ctx context.Context, settings user.Settings, revision uint64) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("error marshalling settings: %w", err)
+	}
+
+	_, err = c.Publish(SettingsSubject(settings.Operator), data,
+		nats.ExpectLastSequencePerSubject(revision), nats.Context(ctx))
+	if err != nil {
+		var apiErr *nats.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+			return user.ErrConflict{Err: fmt.Errorf("settings of %s changed since revision %d", settings.Operator, revision)}
+		}
+		return fmt.Errorf("error writing settings of %s: %w", settings.Operator, err)
+	}
+
+	return nil
+}
+
+// SubscribeSettings calls cb with the latest runtime settings of the operator
+// of the client, and then with every change.
+func (c *Client) SubscribeSettings(cb nats.MsgHandler) (*nats.Subscription, error) {
+	return c.Subscribe(SettingsSubject(c.topic), cb,
+		nats.BindStream(settingsStream),
+		nats.DeliverLastPerSubject(),
+		nats.AckNone(),
+	)
+}
+
+// SubscribeBindRequests subscribes to the requests for the bind of every
+// executor, and for a rebind of the executors of the operator of the client.
+func (c *Client) SubscribeBindRequests(binds, rebind nats.MsgHandler) ([]*nats.Subscription, error) {
+	bindsSub, err := c.conn.Subscribe(BindsSubject, binds)
+	if err != nil {
+		return nil, err
+	}
+
+	rebindSub, err := c.conn.Subscribe(RebindSubject(c.topic), rebind)
+	if err != nil {
+		_ = bindsSub.Unsubscribe()
+		return nil, err
+	}
+
+	return []*nats.Subscription{bindsSub, rebindSub}, nil
+}
+
+// Binds gathers the binds of every executor which answers within the reply
+// wait.
+func (c *Client) Binds(ctx context.Context) ([]user.Bind, error) {
+	return c.gatherBinds(ctx, BindsSubject, nil)
+}
+
+// Rebind asks the executors of an operator, or one instance of it, to
+// rebind, and gathers their binds after the rebind.
+func (c *Client) Rebind(ctx context.Context, operator, instance string) ([]user.Bind, error) {
+	data, err := json.Marshal(user.RebindRequest{Instance: instance})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling rebind request: %w", err)
+	}
+
+	return c.gatherBinds(ctx, RebindSubject(operator), data)
+}
+
+// gatherBinds publishes a request to every executor and collects the binds
+// they answer with until the reply wait is over.
+func (c *Client) gatherBinds(ctx context.Context, subject string, data []byte) ([]user.Bind, error) {
+	inbox := c.conn.NewRespInbox()
+	sub, err := c.conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	if err := c.conn.PublishRequest(subject, inbox, data); err != nil {
+		return nil, fmt.Errorf("error requesting %s: %w", subject, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.replyWait)
+	defer cancel()
+
+	binds := []user.Bind{}
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, nats.ErrNoResponders) {
+				return binds, nil
+			}
+			return nil, err
+		}
+
+		var bind user.Bind
+		if err := json.Unmarshal(msg.Data, &bind); err != nil {
+			return nil, fmt.Errorf("error unmarshalling bind: %w", err)
+		}
+		binds = append(binds, bind)
+	}
+}
+
+// ListConsumers returns the durable consumers of the sms stream.
+func (c *Client) ListConsumers(ctx context.Context) ([]user.Consumer, error) {
+	consumers := []user.Consumer{}
+	for info := range c.ConsumersInfo(c.stream, nats.Context(ctx)) {
+		consumers = append(consumers, user.Consumer{
+			Name:        info.Name,
+			Subject:     info.Config.FilterSubject,
+			Pending:     info.NumPending,
+			AckPending:  info.NumAckPending,
+			Redelivered: info.NumRedelivered,
+			Waiting:     info.NumWaiting,
+		})
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return consumers, nil
+}
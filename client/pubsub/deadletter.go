@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	deadLetterStream = "sms-dlq"
+
+	// deadLetterMaxAge is how long dead letters are kept to be replayed.
+	deadLetterMaxAge = 30 * 24 * time.Hour
+
+	headerDeadLetterSubject       = "Sms-Dlq-Subject"
+	headerDeadLetterError         = "Sms-Dlq-Error"
+	headerDeadLetterDeliveryCount = "Sms-Dlq-Delivery-Count"
+	headerDeadLetterFailedAt      = "Sms-Dlq-Failed-At"
+	headerDeadLetterMsgID         = "Sms-Dlq-Msg-Id"
+)
+
+// DeadLetterSubject maps sms.create.<operator>.<class> to sms.dlq.<operator>.<class>.
+func DeadLetterSubject(subject string) string {
+	return "sms.dlq." + strings.TrimPrefix(subject, "sms.create.")
+}
+
+// PublishDeadLetter parks a message which can never be processed on its
+// dead-letter subject, together with the original headers, the error and
+// the delivery count.
+func (c *Client) PublishDeadLetter(ctx context.Context, msg *nats.Msg, cause error) error {
+	span, _ := opentracing.StartSpanFromContext(ctx, "PublishDeadLetter")
+	defer span.Finish()
+
+	var deliveryCount uint64
+	if meta, err := msg.Metadata(); err == nil {
+		deliveryCount = meta.NumDelivered
+	}
+
+	dlq := nats.NewMsg(DeadLetterSubject(msg.Subject))
+	dlq.Data = msg.Data
+	for k, v := range msg.Header {
+		// the original id would make the stream drop the dead letter, it is
+		// kept for the replay
+		if k == nats.MsgIdHdr {
+			dlq.Header.Set(headerDeadLetterMsgID, msg.Header.Get(k))
+			continue
+		}
+		dlq.Header[k] = v
+	}
+
+	dlq.Header.Set(headerDeadLetterSubject, msg.Subject)
+	dlq.Header.Set(headerDeadLetterError, cause.Error())
+	dlq.Header.Set(headerDeadLetterDeliveryCount, strconv.FormatUint(deliveryCount, 10))
+	dlq.Header.Set(headerDeadLetterFailedAt, time.Now().Format(time.RFC3339))
+
+	_, err := c.PublishMsg(dlq)
+	if err != nil {
+		return fmt.Errorf("error publishing dead letter to %s: %w", dlq.Subject, err)
+	}
+
+	return nil
+}
+
+// DeadLetters returns up to limit dead letters starting at fromSequence.
+// An empty subject matches all dead-letter subjects. The stream looks up
+// the next dead letter of the subject, so only the returned ones are read.
+func (c *Client) DeadLetters(ctx context.Context, subject string, fromSequence uint64, limit int) ([]user.DeadLetter, error) {
+	filter := subject
+	if filter == "" {
+		filter = "sms.dlq.>"
+	}
+	if fromSequence == 0 {
+		fromSequence = 1
+	}
+
+	deadLetters := []user.DeadLetter{}
+	for seq := fromSequence; len(deadLetters) < limit; {
+		msg, err := c.GetMsg(deadLetterStream, seq, nats.DirectGetNext(filter), nats.Context(ctx))
+		if err != nil {
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				break
+			}
+			return nil, fmt.Errorf("error getting dead letter after %d: %w", seq, err)
+		}
+
+		deadLetters = append(deadLetters, toDeadLetter(msg))
+		seq = msg.Sequence + 1
+	}
+
+	return deadLetters, nil
+}
+
+// ReplayDeadLetter publishes a dead letter back onto its original subject
+// and removes it from the dead-letter stream. The replay carries a message
+// id of the dead letter, so the stream drops it when the dead letter is
+// replayed again before it is removed.
+func (c *Client) ReplayDeadLetter(ctx context.Context, sequence uint64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ReplayDeadLetter")
+	defer span.Finish()
+
+	msg, err := c.GetMsg(deadLetterStream, sequence, nats.Context(ctx))
+	if err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			return user.ErrNotFound{Err: fmt.Errorf("dead letter %d not found", sequence)}
+		}
+		return fmt.Errorf("error getting dead letter %d: %w", sequence, err)
+	}
+
+	original := msg.Header.Get(headerDeadLetterSubject)
+	if original == "" {
+		return fmt.Errorf("dead letter %d has no original subject", sequence)
+	}
+
+	replay := nats.NewMsg(original)
+	replay.Data = msg.Data
+	for k, v := range msg.Header {
+		if strings.HasPrefix(k, "Sms-Dlq-") {
+			continue
+		}
+		replay.Header[k] = v
+	}
+	replay.Header.Set(nats.MsgIdHdr, replayMsgID(msg.Header.Get(headerDeadLetterMsgID), sequence))
+
+	_, err = c.PublishMsg(replay, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("error replaying dead letter %d to %s: %w", sequence, original, err)
+	}
+
+	err = c.DeleteMsg(deadLetterStream, sequence, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("error deleting replayed dead letter %d: %w", sequence, err)
+	}
+
+	return nil
+}
+
+// replayMsgID is the message id of a replayed dead letter. The original id
+// alone is still in the duplicate window of the stream when the message was
+// dead-lettered right away, which would drop the replay.
+func replayMsgID(originalID string, sequence uint64) string {
+	id := "dlq." + strconv.FormatUint(sequence, 10)
+	if originalID == "" {
+		return id
+	}
+	return originalID + ":" + id
+}
+
+func toDeadLetter(msg *nats.RawStreamMsg) user.DeadLetter {
+	deliveryCount, _ := strconv.ParseUint(msg.Header.Get(headerDeadLetterDeliveryCount), 10, 64)
+	failedAt, _ := time.Parse(time.RFC3339, msg.Header.Get(headerDeadLetterFailedAt))
+
+	header := make(map[string]string)
+	for k := range msg.Header {
+		if strings.HasPrefix(k, "Sms-Dlq-") {
+			continue
+		}
+		header[k] = msg.Header.Get(k)
+	}
+
+	return user.DeadLetter{
+		Sequence:        msg.Sequence,
+		Subject:         msg.Subject,
+		OriginalSubject: msg.Header.Get(headerDeadLetterSubject),
+		Error:           msg.Header.Get(headerDeadLetterError),
+		DeliveryCount:   deliveryCount,
+		FailedAt:        failedAt,
+		Header:          header,
+		Data:            msg.Data,
+	}
+}
@@ -0,0 +1,28 @@
+package pubsub
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SmsEventsSubject matches the sms events of every operator.
+const SmsEventsSubject = "sms.events.>"
+
+// SubscribeSmsEvents pull subscribes the durable consumer to the stream
+// which captures the sms events. The stream belongs to the downstream
+// services, a new consumer starts at the events published from now on.
+func (c *Client) SubscribeSmsEvents(durable string, maxAckPending int, ackWait time.Duration) (*nats.Subscription, error) {
+	return c.PullSubscribe(SmsEventsSubject, durable,
+		nats.DeliverNew(),
+		nats.MaxAckPending(maxAckPending),
+		nats.AckWait(ackWait),
+	)
+}
+
+// SubscribeLiveSmsEvents subscribes to the sms events as they are published,
+// without a consumer. Every subscriber gets every event, and nothing is kept
+// for a subscriber which was not there.
+func (c *Client) SubscribeLiveSmsEvents(cb nats.MsgHandler) (*nats.Subscription, error) {
+	return c.conn.Subscribe(SmsEventsSubject, cb)
+}
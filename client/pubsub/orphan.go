@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	orphanStream = "sms-orphans"
+
+	// orphanMaxAge is how long orphan receipts are kept for investigation.
+	orphanMaxAge = 7 * 24 * time.Hour
+)
+
+// OrphanSubject returns the subject of receipts of an operator which could
+// not be matched to a sms.
+func OrphanSubject(operator string) string {
+	return fmt.Sprintf("sms.orphans.%s", operator)
+}
+
+// orphanStreamConfig derives the orphan receipts stream definition.
+func orphanStreamConfig(cfg *nats.StreamConfig) *nats.StreamConfig {
+	return &nats.StreamConfig{
+		Name:      orphanStream,
+		Subjects:  []string{"sms.orphans.>"},
+		Retention: nats.LimitsPolicy,
+		MaxAge:    orphanMaxAge,
+		MaxBytes:  -1,
+		Replicas:  cfg.Replicas,
+		Storage:   cfg.Storage,
+	}
+}
+
+// NotifyOrphanReceipt publishes a receipt which could not be matched to a
+// sms within the parking time.
+func (c *Client) NotifyOrphanReceipt(ctx context.Context, smsEvent user.SmsEvent) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "NotifyOrphanReceipt")
+	defer span.Finish()
+
+	data, err := json.Marshal(smsEvent)
+	if err != nil {
+		return fmt.Errorf("error marshalling orphan receipt to send to pubsub: %w", err)
+	}
+
+	err = c.send(ctx, OrphanSubject(c.topic), data)
+	if err != nil {
+		return fmt.Errorf("error sending orphan receipt to pubsub: %w", err)
+	}
+
+	return nil
+}
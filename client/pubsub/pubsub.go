@@ -2,6 +2,7 @@ package pubsub
 
 import (
 	"context"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/qosimmax/sms-executor/config"
@@ -11,6 +12,14 @@ import (
 // Client holds the PubSub client.
 type Client struct {
 	nats.JetStreamContext
+	conn     *nats.Conn
+	stream   string
+	topic    string
+	classes  config.SmsClasses
+	consumer nats.ConsumerConfig
+	// replyWait is how long the executors are given to answer a request
+	// sent to all of them.
+	replyWait time.Duration
 }
 
 // Init sets up a new pubsub client.
@@ -25,27 +34,78 @@ func (c *Client) Init(ctx context.Context, config *config.Config) error {
 		return err
 	}
 
-	_, err = js.StreamInfo("sms")
+	c.JetStreamContext = js
+	c.conn = nc
+	c.stream = config.NatsStreamName
+	c.topic = config.NatsTopic
+	c.classes = config.SmsClasses
+	c.replyWait = config.AdminReplyWait
+	c.consumer = nats.ConsumerConfig{
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       config.NatsConsumerAckWait,
+		MaxAckPending: config.NatsConsumerMaxAckPending,
+		MaxWaiting:    128,
+		MaxDeliver:    config.MaxDeliver,
+	}
+
+	streamCfg, err := streamConfig(config)
 	if err != nil {
-		if err == nats.ErrStreamNotFound {
-			_, err = js.AddStream(&nats.StreamConfig{
-				Name:     "sms",
-				Subjects: []string{"sms.create.*.default", "sms.create.*.otp", "sms.create.*.excel"},
-			})
+		return err
+	}
 
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
+	err = c.reconcileStream(streamCfg)
+	if err != nil {
+		return err
+	}
+
+	err = c.reconcileStream(deadLetterStreamConfig(streamCfg))
+	if err != nil {
+		return err
+	}
+
+	err = c.reconcileStream(orphanStreamConfig(streamCfg))
+	if err != nil {
+		return err
+	}
+
+	return c.reconcileStream(settingsStreamConfig(streamCfg))
+}
+
+// Close closes the underlying nats connection.
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+// Drain drains the nats connection, so pending acks and publishes are
+// flushed, and waits until it is closed.
+func (c *Client) Drain(ctx context.Context) error {
+	err := c.conn.Drain()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !c.conn.IsClosed() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
 
-	c.JetStreamContext = js
 	return nil
 }
 
-func (c *Client) send(ctx context.Context, topicName string, data []byte) error {
+// StreamName returns the name of the stream holding the sms to send.
+func (c *Client) StreamName() string {
+	return c.stream
+}
+
+func (c *Client) send(ctx context.Context, topicName string, data []byte, opts ...nats.PubOpt) error {
 	spanCarrier := trace.InjectIntoCarrier(ctx)
 
 	msg := nats.NewMsg(topicName)
@@ -54,7 +114,7 @@ func (c *Client) send(ctx context.Context, topicName string, data []byte) error
 		msg.Header.Set(k, v)
 	}
 
-	_, err := c.PublishMsg(msg)
+	_, err := c.PublishMsg(msg, opts...)
 	if err != nil {
 		return err
 	}
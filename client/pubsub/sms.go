@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/nats-io/nats.go"
 	"github.com/opentracing/opentracing-go"
+	"strings"
 
+	"github.com/qosimmax/sms-executor/config"
 	"github.com/qosimmax/sms-executor/user"
 )
 
@@ -13,6 +16,10 @@ func (c *Client) NotifySmsEvent(ctx context.Context, smsEvent user.SmsEvent) err
 	span, ctx := opentracing.StartSpanFromContext(ctx, "NotifySmsEvent")
 	defer span.Finish()
 
+	if smsEvent.Operator == "" {
+		smsEvent.Operator = c.topic
+	}
+
 	data, err := json.Marshal(smsEvent)
 	if err != nil {
 		return fmt.Errorf("error marshalling sms-event data to send to pubsub: %w", err)
@@ -25,3 +32,56 @@ func (c *Client) NotifySmsEvent(ctx context.Context, smsEvent user.SmsEvent) err
 
 	return nil
 }
+
+// PublishSms publishes a sms to send. The company_id and sms_id are used as
+// the message id, so the stream drops republished duplicates within its
+// duplicate window without dropping the sms of another company.
+func (c *Client) PublishSms(ctx context.Context, subject string, smsData user.SmsData) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PublishSms")
+	defer span.Finish()
+
+	data, err := json.Marshal(smsData)
+	if err != nil {
+		return fmt.Errorf("error marshalling sms data to send to pubsub: %w", err)
+	}
+
+	var opts []nats.PubOpt
+	if smsData.SmsID != "" {
+		opts = append(opts, nats.MsgId(smsData.CompanyID+":"+smsData.SmsID))
+	}
+
+	err = c.send(ctx, subject, data, opts...)
+	if err != nil {
+		return fmt.Errorf("error sending sms data message to pubsub: %w", err)
+	}
+
+	return nil
+}
+
+// QueueSms publishes a sms to the subject of its class on this operator and
+// returns the subject. An unknown class is an ErrInvalid.
+func (c *Client) QueueSms(ctx context.Context, class string, smsData user.SmsData) (string, error) {
+	for _, smsClass := range c.classes {
+		if smsClass.Name == class {
+			subject := SmsSubject(c.topic, smsClass, smsData.CompanyID)
+			return subject, c.PublishSms(ctx, subject, smsData)
+		}
+	}
+
+	return "", user.ErrInvalid{
+		Field: "class",
+		Err:   fmt.Errorf("unknown class %q, one of %s", class, strings.Join(c.classes.Names(), ", ")),
+	}
+}
+
+// SmsSubject returns the subject to publish a sms of a class to. Sms of fair
+// classes go to the subject of their company when the company_id is usable
+// as a subject token.
+func SmsSubject(operator string, class config.SmsClass, companyID string) string {
+	subject := fmt.Sprintf("sms.create.%s.%s", operator, class.Name)
+	if class.Fair && companyID != "" && !strings.ContainsAny(companyID, ".*> \t\r\n") {
+		subject += "." + companyID
+	}
+
+	return subject
+}
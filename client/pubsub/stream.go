@@ -0,0 +1,202 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/config"
+)
+
+// streamConfig builds the sms stream definition from config.
+func streamConfig(config *config.Config) (*nats.StreamConfig, error) {
+	var retention nats.RetentionPolicy
+	err := retention.UnmarshalJSON([]byte(strconv.Quote(strings.ToLower(config.NatsStreamRetention))))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream retention %q: %w", config.NatsStreamRetention, err)
+	}
+
+	var storage nats.StorageType
+	err = storage.UnmarshalJSON([]byte(strconv.Quote(strings.ToLower(config.NatsStreamStorage))))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream storage %q: %w", config.NatsStreamStorage, err)
+	}
+
+	subjects := config.NatsStreamSubjects
+	if len(subjects) == 0 {
+		for _, class := range config.SmsClasses {
+			subjects = append(subjects, fmt.Sprintf("sms.create.*.%s", class.Name))
+			if class.Fair {
+				subjects = append(subjects, fmt.Sprintf("sms.create.*.%s.*", class.Name))
+			}
+		}
+	}
+
+	return &nats.StreamConfig{
+		Name:       config.NatsStreamName,
+		Subjects:   subjects,
+		Retention:  retention,
+		MaxAge:     config.NatsStreamMaxAge,
+		MaxBytes:   config.NatsStreamMaxBytes,
+		Replicas:   config.NatsStreamReplicas,
+		Storage:    storage,
+		Duplicates: config.NatsStreamDuplicateWindow,
+	}, nil
+}
+
+// deadLetterStreamConfig derives the dead-letter stream definition, which
+// keeps its messages until they are replayed, removed or too old. Direct
+// gets let the dead letters of a subject be listed without a consumer.
+func deadLetterStreamConfig(cfg *nats.StreamConfig) *nats.StreamConfig {
+	return &nats.StreamConfig{
+		Name:        deadLetterStream,
+		Subjects:    []string{"sms.dlq.>"},
+		Retention:   nats.LimitsPolicy,
+		MaxAge:      deadLetterMaxAge,
+		MaxBytes:    -1,
+		Replicas:    cfg.Replicas,
+		Storage:     cfg.Storage,
+		AllowDirect: true,
+	}
+}
+
+// reconcileStream creates the stream, or updates it when its definition
+// differs from the desired one.
+func (c *Client) reconcileStream(cfg *nats.StreamConfig) error {
+	info, err := c.StreamInfo(cfg.Name)
+	if err != nil {
+		if err != nats.ErrStreamNotFound {
+			return fmt.Errorf("error getting stream %s: %w", cfg.Name, err)
+		}
+
+		_, err = c.AddStream(cfg)
+		if err != nil {
+			return fmt.Errorf("error creating stream %s: %w", cfg.Name, err)
+		}
+
+		log.Infof("stream %s created", cfg.Name)
+		return nil
+	}
+
+	diff := streamDiff(info.Config, *cfg)
+	if len(diff) == 0 {
+		return nil
+	}
+
+	log.Infof("stream %s differs from config: %s", cfg.Name, strings.Join(diff, ", "))
+
+	_, err = c.UpdateStream(cfg)
+	if err != nil {
+		return fmt.Errorf("error updating stream %s: %w", cfg.Name, err)
+	}
+
+	log.Infof("stream %s updated", cfg.Name)
+	return nil
+}
+
+// EnsureConsumer creates the durable pull consumer of a subject on the sms
+// stream, or updates it when its definition differs from config.
+func (c *Client) EnsureConsumer(durable, subject string) error {
+	cfg := c.consumer
+	cfg.Durable = durable
+	cfg.FilterSubject = subject
+
+	return c.ensureConsumer(cfg)
+}
+
+// EnsureCompanyConsumer creates the durable pull consumer of a company
+// subject like EnsureConsumer, which the server deletes once nobody pulled
+// from it for inactive. A new one starts at the messages published since
+// start, the older ones were handled by the deleted consumer or are too old
+// to be sent.
+func (c *Client) EnsureCompanyConsumer(durable, subject string, inactive time.Duration, start time.Time) error {
+	cfg := c.consumer
+	cfg.Durable = durable
+	cfg.FilterSubject = subject
+	cfg.InactiveThreshold = inactive
+	cfg.DeliverPolicy = nats.DeliverByStartTimePolicy
+	cfg.OptStartTime = &start
+
+	return c.ensureConsumer(cfg)
+}
+
+func (c *Client) ensureConsumer(cfg nats.ConsumerConfig) error {
+	durable := cfg.Durable
+	info, err := c.ConsumerInfo(c.stream, durable)
+	if err != nil {
+		if err != nats.ErrConsumerNotFound {
+			return fmt.Errorf("error getting consumer %s: %w", durable, err)
+		}
+
+		_, err = c.AddConsumer(c.stream, &cfg)
+		if err != nil {
+			return fmt.Errorf("error creating consumer %s: %w", durable, err)
+		}
+
+		log.Infof("consumer %s created", durable)
+		return nil
+	}
+
+	diff := consumerDiff(info.Config, cfg)
+	if len(diff) == 0 {
+		return nil
+	}
+
+	log.Infof("consumer %s differs from config: %s", durable, strings.Join(diff, ", "))
+
+	// the start of an existing consumer cannot change
+	cfg.DeliverPolicy = info.Config.DeliverPolicy
+	cfg.OptStartTime = info.Config.OptStartTime
+	_, err = c.UpdateConsumer(c.stream, &cfg)
+	if err != nil {
+		return fmt.Errorf("error updating consumer %s: %w", durable, err)
+	}
+
+	log.Infof("consumer %s updated", durable)
+	return nil
+}
+
+func streamDiff(current, desired nats.StreamConfig) (diff []string) {
+	diff = appendDiff(diff, "subjects", sorted(current.Subjects), sorted(desired.Subjects))
+	diff = appendDiff(diff, "retention", current.Retention, desired.Retention)
+	diff = appendDiff(diff, "max_age", current.MaxAge, desired.MaxAge)
+	diff = appendDiff(diff, "max_bytes", current.MaxBytes, desired.MaxBytes)
+	diff = appendDiff(diff, "replicas", current.Replicas, desired.Replicas)
+	diff = appendDiff(diff, "storage", current.Storage, desired.Storage)
+	diff = appendDiff(diff, "allow_direct", current.AllowDirect, desired.AllowDirect)
+	if desired.Duplicates > 0 {
+		diff = appendDiff(diff, "duplicate_window", current.Duplicates, desired.Duplicates)
+	}
+
+	return diff
+}
+
+func consumerDiff(current, desired nats.ConsumerConfig) (diff []string) {
+	diff = appendDiff(diff, "ack_wait", current.AckWait, desired.AckWait)
+	diff = appendDiff(diff, "max_ack_pending", current.MaxAckPending, desired.MaxAckPending)
+	diff = appendDiff(diff, "max_deliver", current.MaxDeliver, desired.MaxDeliver)
+	diff = appendDiff(diff, "max_waiting", current.MaxWaiting, desired.MaxWaiting)
+	diff = appendDiff(diff, "inactive_threshold", current.InactiveThreshold, desired.InactiveThreshold)
+
+	return diff
+}
+
+func sorted(values []string) []string {
+	values = append([]string(nil), values...)
+	sort.Strings(values)
+	return values
+}
+
+func appendDiff(diff []string, name string, current, desired interface{}) []string {
+	if reflect.DeepEqual(current, desired) {
+		return diff
+	}
+
+	return append(diff, fmt.Sprintf("%s: %v -> %v", name, current, desired))
+}
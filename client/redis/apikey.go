@@ -0,0 +1,78 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// WriteAPIKey stores a key. API keys are shared by the executors of every
+// operator, so their keys have no topic.
+func (c *Client) WriteAPIKey(ctx context.Context, key user.APIKey) error {
+	data, _ := json.Marshal(key)
+
+	pipe := c.redis.Pipeline()
+	pipe.Set(ctx, c.key("apikey:%s", key.ID), data, 0)
+	pipe.SAdd(ctx, c.key("apikeys"), key.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *Client) ReadAPIKey(ctx context.Context, id string) (user.APIKey, error) {
+	data, err := c.redis.Get(ctx, c.key("apikey:%s", id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return user.APIKey{}, user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+	}
+	if err != nil {
+		return user.APIKey{}, err
+	}
+
+	var key user.APIKey
+	err = json.Unmarshal(data, &key)
+	return key, err
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]user.APIKey, error) {
+	ids, err := c.redis.SMembers(ctx, c.key("apikeys")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]user.APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := c.ReadAPIKey(ctx, id)
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			// deleted since listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (c *Client) DeleteAPIKey(ctx context.Context, id string) error {
+	deleted, err := c.redis.Del(ctx, c.key("apikey:%s", id)).Result()
+	if err != nil {
+		return err
+	}
+
+	// the set is cleaned up even for a key which is already gone
+	if err := c.redis.SRem(ctx, c.key("apikeys"), id).Err(); err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+	}
+	return nil
+}
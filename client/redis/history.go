@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// historyRecord is one append to the history list of a sms, the list is
+// merged when it is read, so appends from several instances never race.
+type historyRecord struct {
+	Sms   user.SmsHistory   `json:"sms"`
+	Entry user.HistoryEntry `json:"entry"`
+}
+
+func (c *Client) AppendHistory(ctx context.Context, sms user.SmsHistory, entry user.HistoryEntry) error {
+	key := c.historyKey(sms.CompanyID, sms.SmsID)
+	data, _ := json.Marshal(historyRecord{Sms: sms, Entry: entry})
+
+	pipe := c.redis.Pipeline()
+	pipe.RPush(ctx, key, data)
+
+	// the sms is indexed by when it was first seen
+	indexes := c.historyIndexes(sms.Recipient, sms.CompanyID)
+	for _, index := range indexes {
+		pipe.ZAddNX(ctx, index, redis.Z{Score: float64(entry.Time.UnixMilli()), Member: historyMember(sms.CompanyID, sms.SmsID)})
+	}
+
+	// without a retention the history is kept forever
+	if c.historyRetention > 0 {
+		lapsed := strconv.FormatInt(time.Now().Add(-c.historyRetention).UnixMilli(), 10)
+
+		pipe.Expire(ctx, key, c.historyRetention)
+		for _, index := range indexes {
+			pipe.ZRemRangeByScore(ctx, index, "-inf", "("+lapsed)
+			pipe.Expire(ctx, index, c.historyRetention)
+		}
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *Client) ReadHistory(ctx context.Context, companyID, smsID string) (user.SmsHistory, error) {
+	records, err := c.redis.LRange(ctx, c.historyKey(companyID, smsID), 0, -1).Result()
+	if err != nil {
+		return user.SmsHistory{}, err
+	}
+
+	if len(records) == 0 {
+		return user.SmsHistory{}, user.ErrNotFound{Err: fmt.Errorf("no history of sms %s", smsID)}
+	}
+
+	var history user.SmsHistory
+	for _, data := range records {
+		var record historyRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return user.SmsHistory{}, err
+		}
+
+		history.Merge(record.Sms, record.Entry)
+	}
+
+	return history, nil
+}
+
+func (c *Client) FindHistory(ctx context.Context, query user.HistoryQuery) ([]user.SmsHistory, error) {
+	indexes := c.historyIndexes(query.Recipient, query.CompanyID)
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("history query without recipient or company")
+	}
+
+	by := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !query.From.IsZero() {
+		by.Min = strconv.FormatInt(query.From.UnixMilli(), 10)
+	}
+	if !query.To.IsZero() {
+		by.Max = strconv.FormatInt(query.To.UnixMilli(), 10)
+	}
+
+	// the company is filtered after the lookup when both are given
+	members, err := c.redis.ZRevRangeByScore(ctx, indexes[0], by).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	histories := []user.SmsHistory{}
+	for _, member := range members {
+		if query.Limit > 0 && len(histories) == query.Limit {
+			break
+		}
+
+		companyID, smsID, _ := strings.Cut(member, "\x00")
+		if query.CompanyID != "" && companyID != query.CompanyID {
+			continue
+		}
+
+		history, err := c.ReadHistory(ctx, companyID, smsID)
+		if err != nil {
+			var errNotFound user.ErrNotFound
+			if errors.As(err, &errNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		histories = append(histories, history)
+	}
+
+	return histories, nil
+}
+
+// historyKey is the key of the history list of a sms, a sms_id is only
+// unique within its company.
+func (c *Client) historyKey(companyID, smsID string) string {
+	return c.key("history:%s:%s:%s", c.topic, companyID, smsID)
+}
+
+// historyMember is the member of a sms in the history indexes.
+func historyMember(companyID, smsID string) string {
+	return companyID + "\x00" + smsID
+}
+
+// historyIndexes returns the keys of the recipient and company indexes, the
+// recipient one first.
+func (c *Client) historyIndexes(recipient, companyID string) []string {
+	var indexes []string
+	if recipient != "" {
+		indexes = append(indexes, c.key("historyRecipient:%s:%s", c.topic, recipient))
+	}
+	if companyID != "" {
+		indexes = append(indexes, c.key("historyCompany:%s:%s", c.topic, companyID))
+	}
+	return indexes
+}
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// unlockScript deletes the lock only if it is still held with the token,
+// an expired lock taken over by another holder is left alone.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (c *Client) Lock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	token := hex.EncodeToString(b)
+
+	ok, err := c.redis.SetNX(ctx, c.lockKey(name), token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+
+	return token, ok, nil
+}
+
+func (c *Client) Unlock(ctx context.Context, name, token string) error {
+	return unlockScript.Run(ctx, c.redis, []string{c.lockKey(name)}, token).Err()
+}
+
+func (c *Client) lockKey(name string) string {
+	return c.key("lock:%s:%s", c.topic, name)
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// WriteOptOut stores an opt-out in the hash of its recipient. Opt-outs are
+// shared by the executors of every operator, so their keys have no topic.
+func (c *Client) WriteOptOut(ctx context.Context, optOut user.OptOut) error {
+	data, _ := json.Marshal(optOut)
+	return c.redis.HSet(ctx, c.key("optout:%s", optOut.Recipient), optOut.Key(), data).Err()
+}
+
+func (c *Client) ListOptOuts(ctx context.Context, recipient string) ([]user.OptOut, error) {
+	entries, err := c.redis.HGetAll(ctx, c.key("optout:%s", recipient)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	optOuts := make([]user.OptOut, 0, len(entries))
+	for _, data := range entries {
+		var optOut user.OptOut
+		if err := json.Unmarshal([]byte(data), &optOut); err != nil {
+			return nil, err
+		}
+		optOuts = append(optOuts, optOut)
+	}
+
+	return optOuts, nil
+}
+
+func (c *Client) DeleteOptOut(ctx context.Context, optOut user.OptOut) error {
+	deleted, err := c.redis.HDel(ctx, c.key("optout:%s", optOut.Recipient), optOut.Key()).Result()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return user.ErrNotFound{Err: fmt.Errorf("no opt-out %s", optOut.Key())}
+	}
+	return nil
+}
@@ -2,31 +2,123 @@ package redis
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/qosimmax/sms-executor/config"
 )
 
 type Client struct {
-	redis *redis.Client
-	topic string
+	redis          redis.UniversalClient
+	prefix         string
+	topic          string
+	idempotencyTTL time.Duration
+	validity       time.Duration
+
+	historyRetention time.Duration
 }
 
 // Init initializes a new client.
 func (c *Client) Init(ctx context.Context, config *config.Config) error {
-	c.redis = redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:6379", config.RedisAddress),
-		Password: "", // no password set
-		PoolSize: 20,
-	})
+	opts, err := universalOptions(config)
+	if err != nil {
+		return fmt.Errorf("error configuring redis: %w", err)
+	}
 
-	err := c.redis.Ping(context.Background()).Err()
+	if config.RedisCluster {
+		c.redis = redis.NewClusterClient(opts.Cluster())
+	} else {
+		c.redis = redis.NewUniversalClient(opts)
+	}
+
+	err = c.redis.Ping(context.Background()).Err()
 	if err != nil {
 		return fmt.Errorf("error pinging redis: %w", err)
 	}
 
+	c.prefix = config.RedisKeyPrefix
 	c.topic = config.NatsTopic
+	c.idempotencyTTL = config.IdempotencyTTL
+	c.validity = config.SmsValidity
+	c.historyRetention = config.HistoryRetention
 
 	return nil
 }
+
+// Close closes the redis connections.
+func (c *Client) Close() error {
+	return c.redis.Close()
+}
+
+// universalOptions builds the client options from REDIS_URL, or from
+// REDIS_ADDRESS and the explicit fields. With REDIS_MASTER_NAME the
+// addresses are the sentinels, with REDIS_CLUSTER the cluster seed nodes.
+func universalOptions(config *config.Config) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Username:         config.RedisUsername,
+		Password:         config.RedisPassword,
+		DB:               config.RedisDB,
+		MasterName:       config.RedisMasterName,
+		SentinelUsername: config.RedisSentinelUsername,
+		SentinelPassword: config.RedisSentinelPassword,
+		PoolSize:         config.RedisPoolSize,
+		MinIdleConns:     config.RedisMinIdleConns,
+		DialTimeout:      config.RedisDialTimeout,
+		ReadTimeout:      config.RedisReadTimeout,
+		WriteTimeout:     config.RedisWriteTimeout,
+	}
+
+	for _, addr := range strings.Split(config.RedisAddress, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		// a bare host uses the default port
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "6379")
+		}
+		opts.Addrs = append(opts.Addrs, addr)
+	}
+
+	if config.RedisTLS {
+		opts.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: config.RedisTLSInsecureSkipVerify,
+		}
+	}
+
+	if config.RedisURL != "" {
+		u, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Addrs = []string{u.Addr}
+		opts.Username = u.Username
+		opts.Password = u.Password
+		opts.DB = u.DB
+		if u.TLSConfig != nil {
+			opts.TLSConfig = u.TLSConfig
+		}
+	}
+
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("no redis address, set REDIS_URL or REDIS_ADDRESS")
+	}
+
+	if config.RedisCluster && opts.DB != 0 {
+		return nil, fmt.Errorf("redis cluster supports only db 0")
+	}
+
+	return opts, nil
+}
+
+// key prefixes a key with the configured namespace.
+func (c *Client) key(format string, args ...interface{}) string {
+	return c.prefix + fmt.Sprintf(format, args...)
+}
@@ -3,15 +3,25 @@ package redis
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/redis/go-redis/v9"
+	"strconv"
 	"time"
 
 	"github.com/qosimmax/sms-executor/user"
 )
 
+func (c *Client) AllocateSequenceNumbers(ctx context.Context, n int64) (int64, error) {
+	key := c.key("seqCounter:%s", c.topic)
+	last, err := c.redis.IncrBy(ctx, key, n).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return last - n + 1, nil
+}
+
 func (c *Client) WriteSequenceNumber(ctx context.Context, smsData user.SmsData) error {
-	key := fmt.Sprintf("seqId:%s:%d", c.topic, smsData.SequenceNumber)
+	key := c.key("seqId:%s:%d", c.topic, smsData.SequenceNumber)
 	smsData.Message = ""
 	data, _ := json.Marshal(smsData)
 	err := c.redis.Set(ctx, key, data, 900*time.Second).Err()
@@ -19,7 +29,7 @@ func (c *Client) WriteSequenceNumber(ctx context.Context, smsData user.SmsData)
 }
 
 func (c *Client) ReadSequenceNumber(ctx context.Context, sequenceNumber int32) (smsData user.SmsData, err error) {
-	key := fmt.Sprintf("seqId:%s:%d", c.topic, sequenceNumber)
+	key := c.key("seqId:%s:%d", c.topic, sequenceNumber)
 	data, err := c.redis.Get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
@@ -29,18 +39,32 @@ func (c *Client) ReadSequenceNumber(ctx context.Context, sequenceNumber int32) (
 	}
 
 	err = json.Unmarshal(data, &smsData)
+	smsData.SequenceNumber = sequenceNumber
 	return
 }
 
+// messageSequenceGrace is how long a correlation is kept after the validity
+// of its sms ended, so that the sweeper finds it before it lapses.
+const messageSequenceGrace = time.Hour
+
+// WriteMessageSequence stores the correlation of a message id, and indexes
+// it by the end of its validity the first time it is written.
 func (c *Client) WriteMessageSequence(ctx context.Context, smsData user.SmsData) error {
-	key := fmt.Sprintf("seqMsgID:%s:%s", c.topic, smsData.SequenceMessageID)
+	key := c.key("seqMsgID:%s:%s", c.topic, smsData.SequenceMessageID)
 	data, _ := json.Marshal(smsData)
-	err := c.redis.Set(ctx, key, data, 24*time.Hour+time.Minute).Err()
+
+	pipe := c.redis.Pipeline()
+	pipe.Set(ctx, key, data, c.validity+messageSequenceGrace)
+	pipe.ZAddNX(ctx, c.expiryKey(), redis.Z{
+		Score:  float64(time.Now().Add(c.validity).Unix()),
+		Member: smsData.SequenceMessageID,
+	})
+	_, err := pipe.Exec(ctx)
 	return err
 }
 
 func (c *Client) ReadMessageSequence(ctx context.Context, sequenceMessageID string) (smsData user.SmsData, err error) {
-	key := fmt.Sprintf("seqMsgID:%s:%s", c.topic, sequenceMessageID)
+	key := c.key("seqMsgID:%s:%s", c.topic, sequenceMessageID)
 	data, err := c.redis.Get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
@@ -49,7 +73,69 @@ func (c *Client) ReadMessageSequence(ctx context.Context, sequenceMessageID stri
 		return user.SmsData{}, err
 	}
 
-	_ = c.redis.Del(ctx, key).Err()
 	err = json.Unmarshal(data, &smsData)
+	smsData.SequenceMessageID = sequenceMessageID
 	return
 }
+
+func (c *Client) DeleteMessageSequence(ctx context.Context, sequenceMessageID string) error {
+	key := c.key("seqMsgID:%s:%s", c.topic, sequenceMessageID)
+
+	pipe := c.redis.Pipeline()
+	pipe.Del(ctx, key)
+	pipe.ZRem(ctx, c.expiryKey(), sequenceMessageID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// FinishSegments counts the finished segments of a sms for as long as its
+// correlations are kept.
+func (c *Client) FinishSegments(ctx context.Context, companyID, smsID string, n int) (int, error) {
+	key := c.key("smsSegments:%s:%s:%s", c.topic, companyID, smsID)
+
+	pipe := c.redis.Pipeline()
+	finished := pipe.IncrBy(ctx, key, int64(n))
+	pipe.Expire(ctx, key, c.validity+messageSequenceGrace)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(finished.Val()), nil
+}
+
+func (c *Client) ExpiredMessageSequences(ctx context.Context, before time.Time, limit int) ([]user.SmsData, error) {
+	ids, err := c.redis.ZRangeByScore(ctx, c.expiryKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(before.Unix(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []user.SmsData
+	for _, id := range ids {
+		smsData, err := c.ReadMessageSequence(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// the correlation lapsed, nothing is left to report
+		if smsData.SmsID == "" {
+			err = c.redis.ZRem(ctx, c.expiryKey(), id).Err()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		expired = append(expired, smsData)
+	}
+
+	return expired, nil
+}
+
+func (c *Client) expiryKey() string {
+	return c.key("seqMsgExpiry:%s", c.topic)
+}
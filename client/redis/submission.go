@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	submissionPending = "pending"
+	submissionDone    = "done"
+
+	// submissionPendingTTL bounds how long a crashed submission blocks
+	// redeliveries of the same sms.
+	submissionPendingTTL = time.Minute
+)
+
+func (c *Client) ClaimSubmission(ctx context.Context, companyID, smsID string) (user.SubmissionState, error) {
+	key := c.submissionKey(companyID, smsID)
+	claimed, err := c.redis.SetNX(ctx, key, submissionPending, submissionPendingTTL).Result()
+	if err != nil {
+		return user.SubmissionNew, err
+	}
+
+	if claimed {
+		return user.SubmissionNew, nil
+	}
+
+	state, err := c.redis.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			// expired in between, let the redelivery claim it
+			return user.SubmissionPending, nil
+		}
+		return user.SubmissionNew, err
+	}
+
+	if state == submissionDone {
+		return user.SubmissionDone, nil
+	}
+
+	return user.SubmissionPending, nil
+}
+
+func (c *Client) CompleteSubmission(ctx context.Context, companyID, smsID string) error {
+	key := c.submissionKey(companyID, smsID)
+	return c.redis.Set(ctx, key, submissionDone, c.idempotencyTTL).Err()
+}
+
+func (c *Client) ReleaseSubmission(ctx context.Context, companyID, smsID string) error {
+	key := c.submissionKey(companyID, smsID)
+	return c.redis.Del(ctx, key).Err()
+}
+
+func (c *Client) submissionKey(companyID, smsID string) string {
+	return c.key("smsSubmit:%s:%s:%s", c.topic, companyID, smsID)
+}
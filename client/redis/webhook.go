@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// WriteWebhook stores the webhook of a company. Webhooks, like api keys, are
+// shared by the executors of every operator.
+func (c *Client) WriteWebhook(ctx context.Context, webhook user.Webhook) error {
+	data, _ := json.Marshal(webhook)
+	return c.redis.Set(ctx, c.key("webhook:%s", webhook.CompanyID), data, 0).Err()
+}
+
+func (c *Client) ReadWebhook(ctx context.Context, companyID string) (user.Webhook, error) {
+	data, err := c.redis.Get(ctx, c.key("webhook:%s", companyID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return user.Webhook{}, user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+	}
+	if err != nil {
+		return user.Webhook{}, err
+	}
+
+	var webhook user.Webhook
+	err = json.Unmarshal(data, &webhook)
+	return webhook, err
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, companyID string) error {
+	deleted, err := c.redis.Del(ctx, c.key("webhook:%s", companyID)).Result()
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+	}
+	return nil
+}
+
+func (c *Client) AppendWebhookAttempt(ctx context.Context, companyID string, attempt user.WebhookAttempt) error {
+	key := c.key("webhookAttempts:%s", companyID)
+	data, _ := json.Marshal(attempt)
+
+	pipe := c.redis.Pipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, user.WebhookAttemptsKept-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *Client) ReadWebhookAttempts(ctx context.Context, companyID string, limit int) ([]user.WebhookAttempt, error) {
+	records, err := c.redis.LRange(ctx, c.key("webhookAttempts:%s", companyID), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make([]user.WebhookAttempt, 0, len(records))
+	for _, data := range records {
+		var attempt user.WebhookAttempt
+		if err := json.Unmarshal([]byte(data), &attempt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, nil
+}
+
+func (c *Client) AddWebhookFailure(ctx context.Context, companyID string) (int, error) {
+	failures, err := c.redis.Incr(ctx, c.key("webhookFailures:%s", companyID)).Result()
+	return int(failures), err
+}
+
+func (c *Client) WebhookFailures(ctx context.Context, companyID string) (int, error) {
+	failures, err := c.redis.Get(ctx, c.key("webhookFailures:%s", companyID)).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return failures, err
+}
+
+func (c *Client) ResetWebhookFailures(ctx context.Context, companyID string) error {
+	return c.redis.Del(ctx, c.key("webhookFailures:%s", companyID)).Err()
+}
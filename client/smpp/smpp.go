@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/ratelimit"
@@ -22,16 +25,50 @@ import (
 
 // Client holds the SMPP client.
 type Client struct {
-	smpp         *gosmpp.Session
+	smpp         atomic.Pointer[session]
 	events       chan user.SmsEvent
-	rl           ratelimit.Limiter
+	rl           atomic.Pointer[limiter]
 	operatorName string
+
+	auth      gosmpp.Auth
+	settings  gosmpp.Settings
+	rateLimit int
+	instance  string
+
+	// mu guards the bind state.
+	mu        sync.Mutex
+	state     string
+	since     time.Time
+	bindError string
+	binds     int
+	rebinding sync.Mutex
+
+	// closing is closed when the session is being closed, events which
+	// can no longer be delivered are dropped rather than blocking it.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// session is a smpp session with the submitted pdus still waiting for a
+// response on it. The responses of a connection are lost with it, so the
+// count is reset whenever the session closes or drops its connection.
+type session struct {
+	*gosmpp.Session
+	pending atomic.Int64
+}
+
+// limiter is a rate limiter with the rate it was made for.
+type limiter struct {
+	ratelimit.Limiter
+	rate int
 }
 
 func (c *Client) Init(ctx context.Context, config *config.Config) (err error) {
 	c.events = make(chan user.SmsEvent, 100)
-	c.rl = ratelimit.New(config.RateLimit)
-	auth := gosmpp.Auth{
+	c.closing = make(chan struct{})
+	c.rateLimit = config.RateLimit
+	c.rl.Store(&limiter{Limiter: ratelimit.New(config.RateLimit), rate: config.RateLimit})
+	c.auth = gosmpp.Auth{
 		SMSC:       config.OperatorURL,
 		SystemID:   config.OperatorLogin,
 		Password:   config.OperatorPassword,
@@ -39,42 +76,230 @@ func (c *Client) Init(ctx context.Context, config *config.Config) (err error) {
 	}
 
 	c.operatorName = config.NatsTopic
+	c.instance = config.InstanceID
+	if c.instance == "" {
+		c.instance, _ = os.Hostname()
+	}
 
-	c.smpp, err = gosmpp.NewSession(
-		gosmpp.TRXConnector(gosmpp.NonTLSDialer, auth),
-		gosmpp.Settings{
-			EnquireLink: 5 * time.Second,
+	c.settings = gosmpp.Settings{
+		EnquireLink: 5 * time.Second,
 
-			ReadTimeout: 10 * time.Second,
+		ReadTimeout: 10 * time.Second,
 
-			OnSubmitError: func(_ pdu.PDU, err error) {
-				log.Println("SubmitPDU error:", err)
-			},
+		OnSubmitError: func(_ pdu.PDU, err error) {
+			log.Println("SubmitPDU error:", err)
+		},
 
-			OnReceivingError: func(err error) {
-				log.Println("Receiving PDU/Network error:", err)
-			},
+		OnReceivingError: func(err error) {
+			log.Println("Receiving PDU/Network error:", err)
+		},
 
-			OnRebindingError: func(err error) {
-				log.Println("Rebinding but error:", err)
-			},
+		OnRebindingError: func(err error) {
+			log.Println("Rebinding but error:", err)
+			c.setState(user.BindRebinding, err)
+		},
+	}
+
+	session, err := c.connect()
+	if err != nil {
+		return fmt.Errorf("error connect smpp server:%w, host=%s, login=%s, pass=%s", err,
+			c.auth.SMSC, c.auth.SystemID, c.auth.Password)
+	}
+	c.smpp.Store(session)
 
-			OnPDU: c.handlePDU(),
+	return nil
+}
 
-			OnClosed: func(state gosmpp.State) {
-				log.Println(state)
-			},
-		}, 5*time.Second)
+// connect binds a new session, which rebinds by itself when the connection
+// is lost.
+func (c *Client) connect() (*session, error) {
+	s := &session{}
+
+	settings := c.settings
+	settings.OnPDU = c.handlePDU(s)
+	settings.OnClosed = func(state gosmpp.State) {
+		log.Println(state)
+		if n := s.pending.Swap(0); n > 0 {
+			log.Printf("%d submits lost without response: %s\n", n, state.String())
+		}
+		if state != gosmpp.ExplicitClosing {
+			c.setState(user.BindRebinding, fmt.Errorf("closed: %s", state.String()))
+		}
+	}
 
+	var err error
+	s.Session, err = gosmpp.NewSession(boundConnector{
+		Connector: gosmpp.TRXConnector(gosmpp.NonTLSDialer, c.auth),
+		bound:     func() { c.setState(user.BindBound, nil) },
+	}, settings, 5*time.Second)
 	if err != nil {
-		return fmt.Errorf("error connect smpp server:%w, host=%s, login=%s, pass=%s", err,
-			auth.SMSC, auth.SystemID, auth.Password)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// boundConnector reports every successful bind of a session.
+type boundConnector struct {
+	gosmpp.Connector
+	bound func()
+}
+
+func (c boundConnector) Connect() (*gosmpp.Connection, error) {
+	conn, err := c.Connector.Connect()
+	if err == nil {
+		c.bound()
+	}
+	return conn, err
+}
+
+func (c *Client) setState(state string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// every bind is a new session, even in the same state
+	if state != c.state || state == user.BindBound {
+		c.since = time.Now().UTC()
+	}
+	if state == user.BindBound {
+		c.binds++
+	}
+
+	c.state = state
+	c.bindError = ""
+	if err != nil {
+		c.bindError = err.Error()
+	}
+}
+
+// Bind returns the state of the smpp session.
+func (c *Client) Bind() user.Bind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rebinds := 0
+	if c.binds > 1 {
+		rebinds = c.binds - 1
+	}
+
+	return user.Bind{
+		Instance:  c.instance,
+		Operator:  c.operatorName,
+		SMSC:      c.auth.SMSC,
+		SystemID:  c.auth.SystemID,
+		State:     c.state,
+		Since:     c.since,
+		Error:     c.bindError,
+		Rebinds:   rebinds,
+		Pending:   c.Pending(),
+		RateLimit: c.rl.Load().rate,
+	}
+}
+
+// Rebind replaces the smpp session with a newly bound one. The responses
+// and receipts of the old session still to come are lost with it, and are
+// handled like the ones of a session which dropped.
+func (c *Client) Rebind() error {
+	c.rebinding.Lock()
+	defer c.rebinding.Unlock()
+
+	select {
+	case <-c.closing:
+		return fmt.Errorf("the smpp session is closed")
+	default:
+	}
+
+	session, err := c.connect()
+	if err != nil {
+		// the old session stays
+		c.mu.Lock()
+		c.bindError = err.Error()
+		c.mu.Unlock()
+		return fmt.Errorf("error rebinding smpp session: %w", err)
+	}
+
+	old := c.smpp.Swap(session)
+	if err := old.Close(); err != nil {
+		log.Println("Closing replaced session:", err)
+	}
+	if n := old.pending.Swap(0); n > 0 {
+		log.Printf("%d submits lost without response: rebind\n", n)
+	}
+
+	return nil
+}
+
+// ApplySettings takes the rate limit of the runtime settings, or the
+// configured one when it is unset.
+func (c *Client) ApplySettings(settings user.Settings) {
+	rate := c.rateLimit
+	if settings.RateLimit > 0 {
+		rate = settings.RateLimit
+	}
+
+	if c.rl.Load().rate != rate {
+		c.rl.Store(&limiter{Limiter: ratelimit.New(rate), rate: rate})
+	}
+}
+
+// Close unbinds and closes the smpp session.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+
+	c.rebinding.Lock()
+	defer c.rebinding.Unlock()
+
+	c.setState(user.BindClosed, nil)
+
+	session := c.smpp.Load()
+	err := session.Close()
+	session.pending.Store(0)
+	return err
+}
+
+// Pending returns how many submitted pdus of the current session have not
+// got a response yet.
+func (c *Client) Pending() int64 {
+	return c.smpp.Load().pending.Load()
+}
+
+// WaitPending waits until every submitted pdu got its response.
+func (c *Client) WaitPending(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d submits without response: %w", c.Pending(), ctx.Err())
+		case <-ticker.C:
+		}
 	}
 
 	return nil
 }
 
-func (c *Client) handlePDU() func(pdu.PDU, bool) {
+// notify passes an event to the listener, unless the session is closing.
+func (c *Client) notify(event user.SmsEvent) {
+	select {
+	case c.events <- event:
+	case <-c.closing:
+		log.Printf("dropping smpp event while closing: %+v\n", event)
+	}
+}
+
+// responded records the response of a pdu submitted on the session.
+func (s *session) responded() {
+	if s.pending.Add(-1) < 0 {
+		// a response for a submit counted before the reset of a lost
+		// connection
+		s.pending.Add(1)
+	}
+}
+
+func (c *Client) handlePDU(s *session) func(pdu.PDU, bool) {
 	return func(p pdu.PDU, _ bool) {
 		switch pd := p.(type) {
 		case *pdu.SubmitSMResp:
@@ -83,16 +308,18 @@ func (c *Client) handlePDU() func(pdu.PDU, bool) {
 				deliveryStatus = user.StatusSmsFailed
 			}
 
-			c.events <- user.SmsEvent{
+			s.responded()
+			c.notify(user.SmsEvent{
 				SequenceMessageID: pd.MessageID,
 				CommandStatus:     pd.CommandStatus.String(),
 				SequenceNumber:    pd.SequenceNumber,
 				DeliveryStatus:    deliveryStatus,
 				SubmitDate:        time.Now().Format(time.RFC3339),
 				DoneDate:          time.Now().Format(time.RFC3339),
-			}
+			})
 
 		case *pdu.GenericNack:
+			s.responded()
 			log.Println("GenericNack Received")
 
 		case *pdu.EnquireLinkResp:
@@ -105,12 +332,28 @@ func (c *Client) handlePDU() func(pdu.PDU, bool) {
 			//log.Printf("DeliverSM:%+v\n", pd)
 
 			message, _ := pd.Message.GetMessage()
-			values, _ := parseMessage(message)
+			values := receiptFields(message)
+
+			// a message of the recipient rather than a receipt, some
+			// SMSCs send receipts without the esm_class bits
+			if pd.EsmClass&messageTypeMask == data.SM_ESM_DEFAULT && !isReceipt(values) {
+				c.notify(user.SmsEvent{
+					DestAddress:    pd.SourceAddr.Address(),
+					SourceAddress:  pd.DestAddr.Address(),
+					CommandStatus:  pd.CommandStatus.String(),
+					SubmitDate:     time.Now().Format(time.RFC3339),
+					DoneDate:       time.Now().Format(time.RFC3339),
+					DeliveryStatus: user.StatusSmsMO,
+					SequenceNumber: pd.SequenceNumber,
+					Message:        message,
+				})
+				return
+			}
 
 			messageId := strings.TrimPrefix(values["id"], "0")
 			messageId = strings.TrimPrefix(messageId, "0")
 
-			c.events <- user.SmsEvent{
+			c.notify(user.SmsEvent{
 				SequenceMessageID: messageId,
 				DestAddress:       pd.SourceAddr.Address(),
 				SourceAddress:     pd.DestAddr.Address(),
@@ -121,17 +364,22 @@ func (c *Client) handlePDU() func(pdu.PDU, bool) {
 				//DoneDate:          values["done_date"],
 				DeliveryStatus: values["stat"],
 				SequenceNumber: pd.SequenceNumber,
-			}
+			})
 
 		}
 	}
 }
 
+// messageTypeMask selects the message type bits of the esm_class of a
+// deliver_sm, which are zero for a mobile originated message.
+const messageTypeMask = 0x3C
+
 // Regex pattern captures "key: value" pair from the content.
 var pattern = regexp.MustCompile(`(?m)(?P<key>\w+):(?P<value>\w+)`)
 
-func parseMessage(message string) (map[string]string, error) {
-
+// receiptFields returns the "key:value" pairs of a delivery receipt as they
+// are, without parsing the dates.
+func receiptFields(message string) map[string]string {
 	values := make(map[string]string)
 	content := strings.Replace(message, "done date", "done_date", 1)
 	content = strings.Replace(content, "submit date", "submit_date", 1)
@@ -140,6 +388,19 @@ func parseMessage(message string) (map[string]string, error) {
 		values[sub[1]] = sub[2]
 	}
 
+	return values
+}
+
+// isReceipt reports whether the fields carry the id and stat of a delivery
+// receipt.
+func isReceipt(values map[string]string) bool {
+	return values["id"] != "" && values["stat"] != ""
+}
+
+func parseMessage(message string) (map[string]string, error) {
+
+	values := receiptFields(message)
+
 	t1, err := time.Parse("0601021504", values["submit_date"])
 	if err != nil {
 		return nil, err
@@ -6,7 +6,6 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"strconv"
 
-	"github.com/qosimmax/gosmpp/data"
 	"github.com/qosimmax/gosmpp/pdu"
 	"github.com/qosimmax/sms-executor/user"
 )
@@ -22,9 +21,12 @@ func (c *Client) SendSms(ctx context.Context, smsData user.SmsData) (err error)
 
 	for i, _ := range submits {
 		//ratelimit
-		c.rl.Take()
-		err = c.smpp.Transceiver().Submit(submits[i])
+		c.rl.Load().Take()
+		session := c.smpp.Load()
+		session.pending.Add(1)
+		err = session.Transceiver().Submit(submits[i])
 		if err != nil {
+			session.responded()
 			return err
 		}
 
@@ -34,20 +36,7 @@ func (c *Client) SendSms(ctx context.Context, smsData user.SmsData) (err error)
 }
 
 func (c *Client) getMultiSubmitSM(smsData user.SmsData) (submits []*pdu.SubmitSM, err error) {
-	enc := data.GSM7BIT
-	if smsData.IsUnicode {
-		enc = data.UCS2
-	}
-
-	var partitions []*pdu.ShortMessage
-	if enc == data.UCS2 && len([]rune(smsData.Message)) <= 70 {
-		var sm pdu.ShortMessage
-		sm, err = pdu.NewShortMessageWithEncoding(smsData.Message, enc)
-		partitions = append(partitions, &sm)
-	} else {
-		partitions, err = pdu.NewLongMessageWithEncoding(smsData.Message, enc)
-	}
-
+	partitions, err := smsData.ShortMessages()
 	if err != nil {
 		return nil, fmt.Errorf("error get message partitions:%w", err)
 	}
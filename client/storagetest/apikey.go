@@ -0,0 +1,81 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// APIKeyFactory creates an empty api key store.
+type APIKeyFactory func(t *testing.T) user.APIKeyReaderWriter
+
+// RunAPIKeys runs the conformance suite against the api key stores
+// newKeys creates.
+func RunAPIKeys(t *testing.T, newKeys APIKeyFactory) {
+	ctx := context.Background()
+	keys := newKeys(t)
+
+	var errNotFound user.ErrNotFound
+	if _, err := keys.ReadAPIKey(ctx, user.APIKeyID("unknown")); !errors.As(err, &errNotFound) {
+		t.Fatalf("read unknown = %v, want not found", err)
+	}
+	if err := keys.DeleteAPIKey(ctx, user.APIKeyID("unknown")); !errors.As(err, &errNotFound) {
+		t.Fatalf("delete unknown = %v, want not found", err)
+	}
+
+	listed, err := keys.ListAPIKeys(ctx)
+	if err != nil || len(listed) != 0 {
+		t.Fatalf("list empty = %v, %v, want none", listed, err)
+	}
+
+	company := user.APIKey{
+		ID:        user.APIKeyID("company-token"),
+		CompanyID: "company-1",
+		Senders:   []string{"Bank"},
+		Classes:   []string{"otp"},
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	admin := user.APIKey{
+		ID:        user.APIKeyID("admin-token"),
+		Admin:     true,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	for _, key := range []user.APIKey{company, admin} {
+		if err := keys.WriteAPIKey(ctx, key); err != nil {
+			t.Fatalf("write api key: %v", err)
+		}
+	}
+
+	got, err := keys.ReadAPIKey(ctx, company.ID)
+	if err != nil {
+		t.Fatalf("read api key: %v", err)
+	}
+	if !reflect.DeepEqual(got, company) {
+		t.Errorf("read %+v, want %+v", got, company)
+	}
+
+	listed, err = keys.ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatalf("list api keys: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("listed %d keys, want 2", len(listed))
+	}
+
+	if err := keys.DeleteAPIKey(ctx, company.ID); err != nil {
+		t.Fatalf("delete api key: %v", err)
+	}
+	if _, err := keys.ReadAPIKey(ctx, company.ID); !errors.As(err, &errNotFound) {
+		t.Errorf("read deleted = %v, want not found", err)
+	}
+
+	listed, err = keys.ListAPIKeys(ctx)
+	if err != nil || len(listed) != 1 || listed[0].ID != admin.ID {
+		t.Errorf("list after delete = %+v, %v, want the admin key", listed, err)
+	}
+}
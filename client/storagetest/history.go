@@ -0,0 +1,173 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// HistoryFactory creates an empty history store.
+type HistoryFactory func(t *testing.T) user.HistoryReaderWriter
+
+// RunHistory runs the conformance suite against the history stores
+// newHistory creates.
+func RunHistory(t *testing.T, newHistory HistoryFactory) {
+	t.Run("ReadHistory", func(t *testing.T) {
+		testReadHistory(t, newHistory(t))
+	})
+	t.Run("FindHistory", func(t *testing.T) {
+		testFindHistory(t, newHistory(t))
+	})
+}
+
+func testReadHistory(t *testing.T, h user.HistoryReaderWriter) {
+	ctx := context.Background()
+
+	_, err := h.ReadHistory(ctx, "company-1", "sms-1")
+	var errNotFound user.ErrNotFound
+	if !errors.As(err, &errNotFound) {
+		t.Fatalf("read unknown = %v, want not found", err)
+	}
+
+	at := time.Now().Truncate(time.Millisecond)
+	appends := []struct {
+		sms   user.SmsHistory
+		entry user.HistoryEntry
+	}{
+		{
+			user.SmsHistory{SmsID: "sms-1", Recipient: "998901234567", NickName: "Bank", CompanyID: "company-1", TariffID: 3},
+			user.HistoryEntry{Time: at, Kind: user.HistoryReceived, MessageLength: 200},
+		},
+		{
+			user.SmsHistory{SmsID: "sms-1", CompanyID: "company-1"},
+			user.HistoryEntry{Time: at.Add(time.Second), Kind: user.HistorySubmitted, SequenceNumber: 7},
+		},
+		// the second segment response is recorded by another instance
+		// after the first receipt
+		{
+			user.SmsHistory{SmsID: "sms-1", Recipient: "998901234567", CompanyID: "company-1"},
+			user.HistoryEntry{Time: at.Add(4 * time.Second), Kind: user.HistoryEvent, DeliveryStatus: "DELIVRD", SequenceMessageID: "msg-a"},
+		},
+		{
+			user.SmsHistory{SmsID: "sms-1", Recipient: "998901234567", CompanyID: "company-1"},
+			user.HistoryEntry{Time: at.Add(2 * time.Second), Kind: user.HistoryEvent, DeliveryStatus: user.StatusSmsSent, CommandStatus: "ESME_ROK", SequenceMessageID: "msg-a"},
+		},
+		{
+			user.SmsHistory{SmsID: "sms-1", Recipient: "998901234567", CompanyID: "company-1"},
+			user.HistoryEntry{Time: at.Add(3 * time.Second), Kind: user.HistoryEvent, DeliveryStatus: user.StatusSmsSent, CommandStatus: "ESME_ROK", SequenceMessageID: "msg-b"},
+		},
+		// another company picked the same sms_id
+		{
+			user.SmsHistory{SmsID: "sms-1", Recipient: "998907654321", CompanyID: "company-2"},
+			user.HistoryEntry{Time: at, Kind: user.HistoryReceived, MessageLength: 10},
+		},
+	}
+
+	for _, a := range appends {
+		if err := h.AppendHistory(ctx, a.sms, a.entry); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	history, err := h.ReadHistory(ctx, "company-1", "sms-1")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	if history.Recipient != "998901234567" || history.NickName != "Bank" || history.CompanyID != "company-1" || history.TariffID != 3 {
+		t.Errorf("history = %+v, want the received metadata", history)
+	}
+	if fmt.Sprint(history.MessageIDs) != "[msg-a msg-b]" {
+		t.Errorf("message ids = %v, want msg-a msg-b", history.MessageIDs)
+	}
+	if history.Status != "DELIVRD" || !history.Final {
+		t.Errorf("status = %s final = %v, want a final DELIVRD", history.Status, history.Final)
+	}
+
+	var kinds []string
+	for i, e := range history.Entries {
+		if !e.Time.Equal(at.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("entry %d at %s, want the entries in time order", i, e.Time)
+		}
+		kinds = append(kinds, e.Kind+":"+e.DeliveryStatus)
+	}
+	if want := "[received: submitted: event:SENT event:SENT event:DELIVRD]"; fmt.Sprint(kinds) != want {
+		t.Errorf("entries = %v, want %s", kinds, want)
+	}
+
+	other, err := h.ReadHistory(ctx, "company-2", "sms-1")
+	if err != nil {
+		t.Fatalf("read other company: %v", err)
+	}
+	if other.Recipient != "998907654321" || len(other.Entries) != 1 {
+		t.Errorf("history of the other company = %+v, want its own entry", other)
+	}
+
+	_, err = h.ReadHistory(ctx, "company-3", "sms-1")
+	if !errors.As(err, &errNotFound) {
+		t.Errorf("read of a company without the sms = %v, want not found", err)
+	}
+}
+
+func testFindHistory(t *testing.T, h user.HistoryReaderWriter) {
+	ctx := context.Background()
+	at := time.Now().Truncate(time.Second)
+
+	sms := []user.SmsHistory{
+		{SmsID: "sms-1", Recipient: "998900000001", CompanyID: "company-x"},
+		{SmsID: "sms-2", Recipient: "998900000001", CompanyID: "company-y"},
+		{SmsID: "sms-3", Recipient: "998900000001", CompanyID: "company-x"},
+		{SmsID: "sms-4", Recipient: "998900000002", CompanyID: "company-x"},
+		{SmsID: "sms-4", Recipient: "998900000002", CompanyID: "company-y"},
+	}
+
+	for i, s := range sms {
+		err := h.AppendHistory(ctx, s, user.HistoryEntry{Time: at.Add(time.Duration(i) * time.Second), Kind: user.HistoryReceived})
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// later steps do not move a sms in the index
+	err := h.AppendHistory(ctx, sms[0], user.HistoryEntry{Time: at.Add(time.Minute), Kind: user.HistorySubmitted})
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query user.HistoryQuery
+		want  string
+	}{
+		{"recipient", user.HistoryQuery{Recipient: "998900000001"}, "[sms-3 sms-2 sms-1]"},
+		{"company", user.HistoryQuery{CompanyID: "company-x"}, "[sms-4 sms-3 sms-1]"},
+		{"company sharing a sms_id", user.HistoryQuery{CompanyID: "company-y"}, "[sms-4 sms-2]"},
+		{"recipient and company", user.HistoryQuery{Recipient: "998900000001", CompanyID: "company-x"}, "[sms-3 sms-1]"},
+		{"from", user.HistoryQuery{CompanyID: "company-x", From: at.Add(2 * time.Second)}, "[sms-4 sms-3]"},
+		{"to", user.HistoryQuery{CompanyID: "company-x", To: at.Add(2 * time.Second)}, "[sms-3 sms-1]"},
+		{"limit", user.HistoryQuery{Recipient: "998900000001", Limit: 2}, "[sms-3 sms-2]"},
+		{"recipient of both companies", user.HistoryQuery{Recipient: "998900000002"}, "[sms-4 sms-4]"},
+		{"unknown", user.HistoryQuery{Recipient: "998900000003"}, "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			histories, err := h.FindHistory(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("find: %v", err)
+			}
+
+			ids := []string{}
+			for _, history := range histories {
+				ids = append(ids, history.SmsID)
+			}
+			if fmt.Sprint(ids) != tt.want {
+				t.Errorf("found %v, want %s", ids, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// OptOutFactory creates an empty opt-out store.
+type OptOutFactory func(t *testing.T) user.OptOutReaderWriter
+
+// RunOptOuts runs the conformance suite against the opt-out stores
+// newOptOuts creates.
+func RunOptOuts(t *testing.T, newOptOuts OptOutFactory) {
+	ctx := context.Background()
+	optOuts := newOptOuts(t)
+
+	var errNotFound user.ErrNotFound
+	if err := optOuts.DeleteOptOut(ctx, user.OptOut{Recipient: "998901234567"}); !errors.As(err, &errNotFound) {
+		t.Fatalf("delete unknown = %v, want not found", err)
+	}
+
+	listed, err := optOuts.ListOptOuts(ctx, "998901234567")
+	if err != nil || len(listed) != 0 {
+		t.Fatalf("list empty = %v, %v, want none", listed, err)
+	}
+
+	created := time.Now().UTC().Truncate(time.Second)
+	global := user.OptOut{Recipient: "998901234567", Source: user.OptOutSourceAPI, CreatedAt: created}
+	company := user.OptOut{Recipient: "998901234567", CompanyID: "company 1", Source: user.OptOutSourceAPI, CreatedAt: created}
+	sender := user.OptOut{Recipient: "998901234567", Sender: "Bank & Co", Source: user.OptOutSourceMO, Keyword: "STOP", CreatedAt: created}
+	// a recipient which is a prefix of the other one
+	other := user.OptOut{Recipient: "99890123456", Source: user.OptOutSourceAPI, CreatedAt: created}
+
+	for _, optOut := range []user.OptOut{global, company, sender, other, company} {
+		if err := optOuts.WriteOptOut(ctx, optOut); err != nil {
+			t.Fatalf("write opt-out: %v", err)
+		}
+	}
+
+	listed, err = optOuts.ListOptOuts(ctx, "998901234567")
+	if err != nil {
+		t.Fatalf("list opt-outs: %v", err)
+	}
+	if len(listed) != 3 {
+		t.Fatalf("listed %+v, want the global, company and sender opt-outs", listed)
+	}
+	for _, optOut := range listed {
+		if optOut.Key() == sender.Key() && !reflect.DeepEqual(optOut, sender) {
+			t.Errorf("listed %+v, want %+v", optOut, sender)
+		}
+	}
+
+	if err := optOuts.DeleteOptOut(ctx, user.OptOut{Recipient: company.Recipient, CompanyID: company.CompanyID}); err != nil {
+		t.Fatalf("delete opt-out: %v", err)
+	}
+	if err := optOuts.DeleteOptOut(ctx, company); !errors.As(err, &errNotFound) {
+		t.Errorf("delete deleted = %v, want not found", err)
+	}
+
+	listed, err = optOuts.ListOptOuts(ctx, "998901234567")
+	if err != nil || len(listed) != 2 {
+		t.Errorf("list after delete = %+v, %v, want the global and sender opt-outs", listed, err)
+	}
+
+	listed, err = optOuts.ListOptOuts(ctx, "99890123456")
+	if err != nil || len(listed) != 1 || listed[0].Recipient != other.Recipient {
+		t.Errorf("list other = %+v, %v, want its opt-out", listed, err)
+	}
+}
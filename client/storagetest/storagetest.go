@@ -0,0 +1,321 @@
+// Package storagetest is the conformance suite every user.StorageReadWriter
+// implementation has to pass.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// Storage is a storage under test.
+type Storage struct {
+	user.StorageReadWriter
+
+	// Wait lets d pass for the storage, time.Sleep when nil. Storages on a
+	// fake clock advance it instead.
+	Wait func(d time.Duration)
+}
+
+// Factory creates an empty storage which keeps sms correlations for the
+// given validity.
+type Factory func(t *testing.T, validity time.Duration) Storage
+
+// Run runs the conformance suite against the storages newStorage creates.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"AllocateSequenceNumbers", testAllocateSequenceNumbers},
+		{"SequenceNumber", testSequenceNumber},
+		{"MessageSequence", testMessageSequence},
+		{"ExpiredMessageSequences", testExpiredMessageSequences},
+		{"FinishSegments", testFinishSegments},
+		{"Submission", testSubmission},
+		{"Lock", testLock},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t, time.Hour)
+			if s.Wait == nil {
+				s.Wait = time.Sleep
+			}
+
+			tt.test(t, s)
+		})
+	}
+}
+
+func testAllocateSequenceNumbers(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	first, err := s.AllocateSequenceNumbers(ctx, 10)
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if first != 1 {
+		t.Fatalf("first allocation starts at %d, want 1", first)
+	}
+
+	var (
+		mu   sync.Mutex
+		seen = map[int64]bool{}
+		wg   sync.WaitGroup
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				first, err := s.AllocateSequenceNumbers(ctx, 10)
+				if err != nil {
+					t.Errorf("allocate: %v", err)
+					return
+				}
+
+				mu.Lock()
+				for n := first; n < first+10; n++ {
+					if n <= 10 || seen[n] {
+						t.Errorf("sequence number %d allocated twice", n)
+					}
+					seen[n] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 800 {
+		t.Errorf("allocated %d sequence numbers, want 800", len(seen))
+	}
+}
+
+func testSequenceNumber(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	got, err := s.ReadSequenceNumber(ctx, 42)
+	if err != nil || got.SmsID != "" {
+		t.Fatalf("read unknown = %+v, %v, want nothing", got, err)
+	}
+
+	err = s.WriteSequenceNumber(ctx, user.SmsData{
+		SmsID:          "sms-1",
+		Recipient:      "998901234567",
+		CompanyID:      "company-1",
+		Message:        "text",
+		SequenceNumber: 42,
+	})
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	got, err = s.ReadSequenceNumber(ctx, 42)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got.SmsID != "sms-1" || got.Recipient != "998901234567" || got.CompanyID != "company-1" || got.SequenceNumber != 42 {
+		t.Errorf("read = %+v, want sms-1 with sequence number 42", got)
+	}
+}
+
+func testMessageSequence(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	// message ids come from the SMSC, they are not always plain tokens
+	const id = "0a:1f b2*/x.y"
+
+	got, err := s.ReadMessageSequence(ctx, id)
+	if err != nil || got.SmsID != "" {
+		t.Fatalf("read unknown = %+v, %v, want nothing", got, err)
+	}
+
+	sms := user.SmsData{SmsID: "sms-1", Recipient: "998901234567", State: user.SmsSent, SequenceMessageID: id}
+	if err := s.WriteMessageSequence(ctx, sms); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	sms.State = user.SmsIntermediate
+	if err := s.WriteMessageSequence(ctx, sms); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+
+	got, err = s.ReadMessageSequence(ctx, id)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got.SmsID != "sms-1" || got.State != user.SmsIntermediate || got.SequenceMessageID != id {
+		t.Errorf("read = %+v, want the rewritten sms-1 with its message id", got)
+	}
+
+	if err := s.DeleteMessageSequence(ctx, id); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	got, err = s.ReadMessageSequence(ctx, id)
+	if err != nil || got.SmsID != "" {
+		t.Errorf("read after delete = %+v, %v, want nothing", got, err)
+	}
+
+	if err := s.DeleteMessageSequence(ctx, id); err != nil {
+		t.Errorf("delete unknown: %v", err)
+	}
+}
+
+func testExpiredMessageSequences(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		err := s.WriteMessageSequence(ctx, user.SmsData{
+			SmsID:             fmt.Sprintf("sms-%d", i),
+			SequenceMessageID: fmt.Sprintf("msg-%d", i),
+		})
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	expired, err := s.ExpiredMessageSequences(ctx, time.Now(), 10)
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("expired within validity = %+v, %v, want none", expired, err)
+	}
+
+	// the storages keep the validity at a second resolution at least
+	after := time.Now().Add(time.Hour + 2*time.Second)
+
+	expired, err = s.ExpiredMessageSequences(ctx, after, 2)
+	if err != nil || len(expired) != 2 {
+		t.Fatalf("expired with limit 2 = %+v, %v, want 2", expired, err)
+	}
+
+	expired, err = s.ExpiredMessageSequences(ctx, after, 10)
+	if err != nil {
+		t.Fatalf("expired: %v", err)
+	}
+	if got := messageIDs(expired); fmt.Sprint(got) != "[msg-1 msg-2 msg-3]" {
+		t.Fatalf("expired = %v, want msg-1 msg-2 msg-3", got)
+	}
+
+	// the sweep deletes what it reported, by the message id it got
+	if err := s.DeleteMessageSequence(ctx, expired[0].SequenceMessageID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	expired, err = s.ExpiredMessageSequences(ctx, after, 10)
+	if err != nil || len(expired) != 2 {
+		t.Errorf("expired after delete = %+v, %v, want 2", expired, err)
+	}
+}
+
+func messageIDs(smsData []user.SmsData) []string {
+	var ids []string
+	for _, sms := range smsData {
+		ids = append(ids, sms.SequenceMessageID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func testFinishSegments(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	finish := func(companyID, smsID string, n, want int) {
+		t.Helper()
+
+		got, err := s.FinishSegments(ctx, companyID, smsID, n)
+		if err != nil {
+			t.Fatalf("finish %d segments of %s of %s: %v", n, smsID, companyID, err)
+		}
+		if got != want {
+			t.Fatalf("finish %d segments of %s of %s = %d, want %d", n, smsID, companyID, got, want)
+		}
+	}
+
+	finish("company-1", "sms-1", 1, 1)
+	finish("company-1", "sms-1", 1, 2)
+	finish("company-1", "sms-2", 1, 1)
+	// another company picked the same sms_id
+	finish("company-2", "sms-1", 1, 1)
+	// a failed publish undoes its segment
+	finish("company-1", "sms-1", -1, 1)
+	finish("company-1", "sms-1", 1, 2)
+}
+
+func testSubmission(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	claim := func(companyID, smsID string, want user.SubmissionState) {
+		t.Helper()
+
+		got, err := s.ClaimSubmission(ctx, companyID, smsID)
+		if err != nil {
+			t.Fatalf("claim %s of %s: %v", smsID, companyID, err)
+		}
+		if got != want {
+			t.Fatalf("claim %s of %s = %v, want %v", smsID, companyID, got, want)
+		}
+	}
+
+	claim("company-1", "sms-1", user.SubmissionNew)
+	claim("company-1", "sms-1", user.SubmissionPending)
+	claim("company-1", "sms-2", user.SubmissionNew)
+	// another company picked the same sms_id
+	claim("company-2", "sms-1", user.SubmissionNew)
+
+	if err := s.ReleaseSubmission(ctx, "company-1", "sms-1"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	claim("company-1", "sms-1", user.SubmissionNew)
+
+	if err := s.CompleteSubmission(ctx, "company-1", "sms-1"); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	claim("company-1", "sms-1", user.SubmissionDone)
+	claim("company-1", "sms-2", user.SubmissionPending)
+	claim("company-2", "sms-1", user.SubmissionPending)
+}
+
+func testLock(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	lock := func(name string, ttl time.Duration, want bool) string {
+		t.Helper()
+
+		token, ok, err := s.Lock(ctx, name, ttl)
+		if err != nil {
+			t.Fatalf("lock %s: %v", name, err)
+		}
+		if ok != want {
+			t.Fatalf("lock %s taken = %v, want %v", name, ok, want)
+		}
+		return token
+	}
+
+	stale := lock("appEvent:expired-sms", 200*time.Millisecond, true)
+	lock("appEvent:expired-sms", time.Minute, false)
+	lock("appEvent:other", time.Minute, true)
+
+	s.Wait(300 * time.Millisecond)
+
+	// an expired lock is taken over, and the old holder cannot release it
+	token := lock("appEvent:expired-sms", time.Minute, true)
+
+	if err := s.Unlock(ctx, "appEvent:expired-sms", stale); err != nil {
+		t.Fatalf("stale unlock: %v", err)
+	}
+	lock("appEvent:expired-sms", time.Minute, false)
+
+	if err := s.Unlock(ctx, "appEvent:expired-sms", token); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	lock("appEvent:expired-sms", time.Minute, true)
+}
@@ -0,0 +1,168 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// WebhookFactory creates an empty webhook store.
+type WebhookFactory func(t *testing.T) user.WebhookStore
+
+// RunWebhooks runs the conformance suite against the webhook stores
+// newWebhooks creates.
+func RunWebhooks(t *testing.T, newWebhooks WebhookFactory) {
+	t.Run("Webhook", func(t *testing.T) {
+		testWebhook(t, newWebhooks(t))
+	})
+	t.Run("WebhookAttempts", func(t *testing.T) {
+		testWebhookAttempts(t, newWebhooks(t))
+	})
+	t.Run("WebhookFailures", func(t *testing.T) {
+		testWebhookFailures(t, newWebhooks(t))
+	})
+}
+
+func testWebhook(t *testing.T, s user.WebhookStore) {
+	ctx := context.Background()
+
+	var errNotFound user.ErrNotFound
+	if _, err := s.ReadWebhook(ctx, "company-1"); !errors.As(err, &errNotFound) {
+		t.Fatalf("read unknown = %v, want not found", err)
+	}
+	if err := s.DeleteWebhook(ctx, "company-1"); !errors.As(err, &errNotFound) {
+		t.Fatalf("delete unknown = %v, want not found", err)
+	}
+
+	webhook := user.Webhook{
+		CompanyID: "company-1",
+		URL:       "https://example.com/hook",
+		Secret:    "secret",
+		UpdatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := s.WriteWebhook(ctx, webhook); err != nil {
+		t.Fatalf("write webhook: %v", err)
+	}
+
+	webhook.Disabled = true
+	webhook.DisabledAt = webhook.UpdatedAt
+	if err := s.WriteWebhook(ctx, webhook); err != nil {
+		t.Fatalf("overwrite webhook: %v", err)
+	}
+
+	got, err := s.ReadWebhook(ctx, "company-1")
+	if err != nil {
+		t.Fatalf("read webhook: %v", err)
+	}
+	if !reflect.DeepEqual(got, webhook) {
+		t.Errorf("read %+v, want %+v", got, webhook)
+	}
+
+	if _, err := s.ReadWebhook(ctx, "company-2"); !errors.As(err, &errNotFound) {
+		t.Errorf("read other company = %v, want not found", err)
+	}
+
+	if err := s.DeleteWebhook(ctx, "company-1"); err != nil {
+		t.Fatalf("delete webhook: %v", err)
+	}
+	if _, err := s.ReadWebhook(ctx, "company-1"); !errors.As(err, &errNotFound) {
+		t.Errorf("read deleted = %v, want not found", err)
+	}
+}
+
+func testWebhookAttempts(t *testing.T, s user.WebhookStore) {
+	ctx := context.Background()
+
+	attempts, err := s.ReadWebhookAttempts(ctx, "company-1", 10)
+	if err != nil || len(attempts) != 0 {
+		t.Fatalf("read none = %v, %v, want none", attempts, err)
+	}
+
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	for i := 0; i < user.WebhookAttemptsKept+5; i++ {
+		err := s.AppendWebhookAttempt(ctx, "company-1", user.WebhookAttempt{
+			Time:           at.Add(time.Duration(i) * time.Millisecond),
+			SmsID:          fmt.Sprintf("sms-%d", i),
+			DeliveryStatus: user.StatusSmsDELIVERED,
+			URL:            "https://example.com/hook",
+			Attempt:        1,
+			StatusCode:     500,
+			Duration:       time.Second,
+			Error:          "500 Internal Server Error",
+		})
+		if err != nil {
+			t.Fatalf("append attempt: %v", err)
+		}
+	}
+	if err := s.AppendWebhookAttempt(ctx, "company-2", user.WebhookAttempt{SmsID: "sms-other"}); err != nil {
+		t.Fatalf("append attempt: %v", err)
+	}
+
+	attempts, err = s.ReadWebhookAttempts(ctx, "company-1", 3)
+	if err != nil {
+		t.Fatalf("read attempts: %v", err)
+	}
+
+	last := user.WebhookAttemptsKept + 4
+	if len(attempts) != 3 || attempts[0].SmsID != fmt.Sprintf("sms-%d", last) || attempts[2].SmsID != fmt.Sprintf("sms-%d", last-2) {
+		t.Errorf("read %+v, want the latest 3 first", attempts)
+	}
+	if attempts[0].StatusCode != 500 || attempts[0].Duration != time.Second || !attempts[0].Time.Equal(at.Add(time.Duration(last)*time.Millisecond)) {
+		t.Errorf("read %+v, want the attempt as appended", attempts[0])
+	}
+
+	attempts, err = s.ReadWebhookAttempts(ctx, "company-1", 1000)
+	if err != nil || len(attempts) != user.WebhookAttemptsKept {
+		t.Errorf("read all = %d, %v, want %d kept", len(attempts), err, user.WebhookAttemptsKept)
+	}
+}
+
+func testWebhookFailures(t *testing.T, s user.WebhookStore) {
+	ctx := context.Background()
+
+	add := func(companyID string, want int) {
+		t.Helper()
+
+		got, err := s.AddWebhookFailure(ctx, companyID)
+		if err != nil {
+			t.Fatalf("add failure of %s: %v", companyID, err)
+		}
+		if got != want {
+			t.Fatalf("add failure of %s = %d, want %d", companyID, got, want)
+		}
+	}
+
+	read := func(companyID string, want int) {
+		t.Helper()
+
+		got, err := s.WebhookFailures(ctx, companyID)
+		if err != nil {
+			t.Fatalf("read failures of %s: %v", companyID, err)
+		}
+		if got != want {
+			t.Fatalf("failures of %s = %d, want %d", companyID, got, want)
+		}
+	}
+
+	read("company-1", 0)
+	if err := s.ResetWebhookFailures(ctx, "company-1"); err != nil {
+		t.Fatalf("reset without failures: %v", err)
+	}
+
+	add("company-1", 1)
+	add("company-1", 2)
+	add("company-2", 1)
+	read("company-1", 2)
+
+	if err := s.ResetWebhookFailures(ctx, "company-1"); err != nil {
+		t.Fatalf("reset failures: %v", err)
+	}
+	read("company-1", 0)
+	add("company-1", 1)
+	add("company-2", 2)
+}
@@ -0,0 +1,177 @@
+// Package webhook posts sms events to the webhooks of companies.
+//
+// Every request is signed: the X-Signature header is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)), where the
+// timestamp is the X-Timestamp header in unix seconds. Receivers should
+// reject old timestamps to prevent replays.
+//
+// A webhook only reaches public addresses: the URL is checked when it is set,
+// and every connection again once its host is resolved, so a host which
+// resolves to a private address later is refused too.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/qosimmax/sms-executor/config"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// Client posts signed requests to webhooks.
+type Client struct {
+	http *http.Client
+	now  func() time.Time
+	// allowPrivate lets the webhooks reach any address, for local setups.
+	allowPrivate bool
+}
+
+// Init sets up a new webhook client.
+func (c *Client) Init(ctx context.Context, config *config.Config) error {
+	c.allowPrivate = config.WebhookAllowPrivate
+
+	dialer := &net.Dialer{Timeout: config.WebhookTimeout, Control: c.control}
+	c.http = &http.Client{
+		Timeout: config.WebhookTimeout,
+		// no proxy, it would connect on behalf of the webhook unchecked
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// a redirected POST turns into a GET, so it is a failure
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c.now = time.Now
+	return nil
+}
+
+// CheckWebhookURL resolves the host of a webhook URL, it returns ErrInvalid
+// when the host does not resolve or one of its addresses is not public.
+func (c *Client) CheckWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return user.ErrInvalid{Field: "url", Err: fmt.Errorf("must be an absolute http or https URL")}
+	}
+
+	if c.allowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return user.ErrInvalid{Field: "url", Err: fmt.Errorf("host %s does not resolve", u.Hostname())}
+	}
+
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return user.ErrInvalid{Field: "url", Err: fmt.Errorf("host %s must only resolve to public addresses", u.Hostname())}
+		}
+	}
+
+	return nil
+}
+
+// control refuses the connections to addresses which are not public, after
+// the host is resolved for the request.
+func (c *Client) control(network, address string, _ syscall.RawConn) error {
+	if c.allowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !publicIP(net.ParseIP(host)) {
+		return user.ErrInvalid{Field: "url", Err: fmt.Errorf("webhook address is not public")}
+	}
+	return nil
+}
+
+// blockedNets are the ranges which are not public, besides the private,
+// loopback and link-local ones, the latter holding the cloud metadata.
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+// publicIP reports if a webhook may connect to ip.
+func publicIP(ip net.IP) bool {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+
+	for _, blocked := range blockedNets {
+		if blocked.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (c *Client) PostWebhook(ctx context.Context, webhook user.Webhook, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error creating webhook request: %w", err)
+	}
+
+	timestamp := c.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sms-executor")
+	req.Header.Set("X-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Signature", Sign(webhook.Secret, timestamp, body))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error posting webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the connection is only reused once the body is read
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign returns the X-Signature of a request body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
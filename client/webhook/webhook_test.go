@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/config"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func TestClient_PostWebhook(t *testing.T) {
+	body := []byte(`{"sms_id":"sms-1","delivery_status":"DELIVRD"}`)
+	now := time.Unix(1700000000, 0)
+
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+
+		if string(got) != string(body) || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s %q, want the json body", r.Header.Get("Content-Type"), got)
+		}
+		if timestamp != now.Unix() || r.Header.Get("X-Signature") != Sign("secret", timestamp, got) {
+			t.Errorf("signature %s at %d does not match", r.Header.Get("X-Signature"), timestamp)
+		}
+
+		if status == http.StatusFound {
+			http.Redirect(w, r, "/elsewhere", status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	var c Client
+	if err := c.Init(context.Background(), &config.Config{WebhookTimeout: time.Second, WebhookAllowPrivate: true}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	c.now = func() time.Time { return now }
+
+	webhook := user.Webhook{URL: srv.URL, Secret: "secret"}
+	for _, tt := range []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusNoContent, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusFound, false},
+	} {
+		status = tt.status
+		got, err := c.PostWebhook(context.Background(), webhook, body)
+		if got != tt.status || (err == nil) != tt.ok {
+			t.Errorf("post answered %d = %d, %v", tt.status, got, err)
+		}
+	}
+}
+
+func TestClient_PrivateAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request to a private address went through")
+	}))
+	t.Cleanup(srv.Close)
+
+	var c Client
+	if err := c.Init(context.Background(), &config.Config{WebhookTimeout: time.Second}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	for _, tt := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"ftp://93.184.216.34/hook", false},
+		{"http://127.0.0.1:8000/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.100.100.200/", false},
+		{"http://[::1]/hook", false},
+		{"http://[::ffff:192.168.0.1]/hook", false},
+	} {
+		err := c.CheckWebhookURL(context.Background(), tt.url)
+		var errInvalid user.ErrInvalid
+		if tt.ok && err != nil || !tt.ok && !errors.As(err, &errInvalid) {
+			t.Errorf("check %s: %v", tt.url, err)
+		}
+	}
+
+	// the address is checked again when the request connects
+	status, err := c.PostWebhook(context.Background(), user.Webhook{URL: srv.URL, Secret: "secret"}, []byte("{}"))
+	var errInvalid user.ErrInvalid
+	if status != 0 || !errors.As(err, &errInvalid) {
+		t.Errorf("post to %s = %d, %v, want a refused address", srv.URL, status, err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// a receiver verifying with another secret or body fails
+	signature := Sign("secret", 1700000000, []byte("{}"))
+	if signature == Sign("other", 1700000000, []byte("{}")) || signature == Sign("secret", 1700000001, []byte("{}")) {
+		t.Errorf("signature does not depend on the secret and the timestamp")
+	}
+	if len(signature) != len("sha256=")+64 {
+		t.Errorf("signature = %s, want a hex sha256", signature)
+	}
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SmsClass describes how a message class is scheduled.
+type SmsClass struct {
+	// Name is the last token of the class subject sms.create.<operator>.<name>.
+	Name string
+	// Priority > 0 makes the class strict: it is drained before any weighted
+	// class, higher priorities first.
+	Priority int
+	// Weight is the share of a weighted class relative to the other ones.
+	Weight int
+	// Reserved is the share of RATE_LIMIT guaranteed to the class even when
+	// classes with a higher priority are busy.
+	Reserved float64
+	// MaxBatch is the most messages fetched at once, RATE_LIMIT by default.
+	MaxBatch int
+	// Fair makes the class serve the per-company subjects
+	// sms.create.<operator>.<name>.<company_id> by company weight. New
+	// company subjects are discovered every 2s, the first sms of a company
+	// may wait that long.
+	Fair bool
+}
+
+// SmsClasses is a list of classes decoded from
+// "otp:priority=1,default:weight=2:reserved=0.1,excel:weight=1:batch=50:fair=true".
+type SmsClasses []SmsClass
+
+// Decode implements envconfig.Decoder.
+func (c *SmsClasses) Decode(value string) error {
+	var classes SmsClasses
+	names := make(map[string]bool)
+
+	for _, def := range strings.Split(value, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.Split(def, ":")
+		class := SmsClass{Name: parts[0], Weight: 1}
+		if class.Name == "" || strings.ContainsAny(class.Name, ".*> ") {
+			return fmt.Errorf("invalid sms class name %q", class.Name)
+		}
+
+		if names[class.Name] {
+			return fmt.Errorf("duplicate sms class %q", class.Name)
+		}
+		names[class.Name] = true
+
+		for _, opt := range parts[1:] {
+			key, val, ok := strings.Cut(opt, "=")
+			if !ok {
+				return fmt.Errorf("invalid option %q of sms class %q", opt, class.Name)
+			}
+
+			var err error
+			switch key {
+			case "priority":
+				class.Priority, err = strconv.Atoi(val)
+			case "weight":
+				class.Weight, err = strconv.Atoi(val)
+				if err == nil && class.Weight <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "reserved":
+				class.Reserved, err = strconv.ParseFloat(val, 64)
+				if err == nil && (class.Reserved < 0 || class.Reserved > 1) {
+					err = fmt.Errorf("must be between 0 and 1")
+				}
+			case "batch":
+				class.MaxBatch, err = strconv.Atoi(val)
+				if err == nil && class.MaxBatch <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "fair":
+				class.Fair, err = strconv.ParseBool(val)
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+
+			if err != nil {
+				return fmt.Errorf("invalid option %q of sms class %q: %w", opt, class.Name, err)
+			}
+		}
+
+		classes = append(classes, class)
+	}
+
+	if len(classes) == 0 {
+		return fmt.Errorf("no sms classes configured")
+	}
+
+	var reserved float64
+	for _, class := range classes {
+		reserved += class.Reserved
+	}
+
+	if reserved > 1 {
+		return fmt.Errorf("reserved shares of sms classes add up to %.2f", reserved)
+	}
+
+	*c = classes
+	return nil
+}
+
+// Names returns the class names in configuration order.
+func (c SmsClasses) Names() []string {
+	names := make([]string, 0, len(c))
+	for _, class := range c {
+		names = append(names, class.Name)
+	}
+
+	return names
+}
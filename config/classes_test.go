@@ -0,0 +1,38 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSmsClasses_Decode(t *testing.T) {
+	var classes SmsClasses
+	err := classes.Decode("otp:priority=1, default:weight=3:reserved=0.1,excel:batch=50:fair=true")
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	want := SmsClasses{
+		{Name: "otp", Priority: 1, Weight: 1},
+		{Name: "default", Weight: 3, Reserved: 0.1},
+		{Name: "excel", Weight: 1, MaxBatch: 50, Fair: true},
+	}
+	if !reflect.DeepEqual(classes, want) {
+		t.Errorf("classes = %+v, want %+v", classes, want)
+	}
+
+	for _, value := range []string{
+		"",
+		"otp,otp",
+		"otp:priority",
+		"otp:weight=0",
+		"otp:colour=red",
+		"otp:fair=maybe",
+		"sms.otp",
+		"otp:reserved=0.6,default:reserved=0.6",
+	} {
+		if err := classes.Decode(value); err == nil {
+			t.Errorf("decode %q: want error", value)
+		}
+	}
+}
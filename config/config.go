@@ -3,6 +3,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -16,13 +17,168 @@ type Config struct {
 	JaegerAgentPort    string  `envconfig:"JAEGER_AGENT_PORT" default:"6831"`
 	JaegerSamplerType  string  `envconfig:"JAEGER_SAMPLER_TYPE" default:"const"`
 	JaegerSamplerParam float64 `envconfig:"JAEGER_SAMPLER_PARAM" default:"1"`
-	RedisAddress       string  `envconfig:"REDIS_ADDRESS" required:"true"`
+	RedisAddress       string  `envconfig:"REDIS_ADDRESS"`
 	RateLimit          int     `envconfig:"RATE_LIMIT" default:"10"`
 	NatsURL            string  `envconfig:"NATS_URL" required:"true"`
 	NatsTopic          string  `envconfig:"NATS_TOPIC" required:"true"`
 	OperatorURL        string  `envconfig:"OPERATOR_URL" required:"true"`
 	OperatorLogin      string  `envconfig:"OPERATOR_LOGIN" required:"true"`
 	OperatorPassword   string  `envconfig:"OPERATOR_PASSWORD" required:"true"`
+	MaxDeliver         int     `envconfig:"MAX_DELIVER" default:"5"`
+
+	// Workers is how many messages are handled concurrently. Messages to
+	// the same recipient are still handled one at a time, in order.
+	Workers int `envconfig:"WORKERS" default:"8"`
+
+	// SequenceBlock is how many smpp sequence numbers an instance reserves
+	// at once from the counter shared with the other instances.
+	SequenceBlock int64 `envconfig:"SEQUENCE_BLOCK" default:"100"`
+
+	// ShutdownTimeout bounds how long a shutdown waits for in-flight
+	// messages, submit responses and pending events.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+
+	// StorageBackend is where the correlations, submissions, locks and the
+	// sequence counter are kept: redis, nats or disk.
+	//
+	// nats keeps them in JetStream KV buckets on NATS_URL, which lets a
+	// deployment run without redis. The buckets are named
+	// <NATS_KV_BUCKET_PREFIX>_<NATS_TOPIC>_<key type>.
+	//
+	// disk keeps them in the DISK_PATH file, for a single instance. Expired
+	// keys are deleted every DISK_COMPACT_INTERVAL, and the file is
+	// compacted when most of it is free.
+	StorageBackend      string        `envconfig:"STORAGE_BACKEND" default:"redis"`
+	NatsKVBucketPrefix  string        `envconfig:"NATS_KV_BUCKET_PREFIX" default:"sms"`
+	NatsKVReplicas      int           `envconfig:"NATS_KV_REPLICAS" default:"1"`
+	NatsKVStorage       string        `envconfig:"NATS_KV_STORAGE" default:"file"`
+	DiskPath            string        `envconfig:"DISK_PATH" default:"data/sms-executor.db"`
+	DiskCompactInterval time.Duration `envconfig:"DISK_COMPACT_INTERVAL" default:"10m"`
+
+	// HistoryBackend keeps the history of every sms for HistoryRetention,
+	// to answer what happened to a sms: redis, nats or disk, the storage
+	// backend when empty, or none.
+	HistoryBackend   string        `envconfig:"HISTORY_BACKEND"`
+	HistoryRetention time.Duration `envconfig:"HISTORY_RETENTION" default:"168h"`
+
+	// APIAuth requires an api key on the HTTP API except /metrics and
+	// /_healthz, it is on unless disabled explicitly for a trusted network.
+	// The admin routes require an admin key regardless.
+	// AdminAPIKeys are admin tokens which are not in the storage, to create
+	// the first keys with.
+	APIAuth      bool     `envconfig:"API_AUTH" default:"true"`
+	AdminAPIKeys []string `envconfig:"ADMIN_API_KEYS"`
+
+	// Redis connection. REDIS_URL (redis:// or rediss://) replaces the
+	// address, auth, db and TLS settings. REDIS_ADDRESS is a comma separated
+	// list: the sentinels with REDIS_MASTER_NAME, the seed nodes with
+	// REDIS_CLUSTER. Every key starts with REDIS_KEY_PREFIX, so several
+	// deployments can share a cluster.
+	RedisURL                   string        `envconfig:"REDIS_URL"`
+	RedisUsername              string        `envconfig:"REDIS_USERNAME"`
+	RedisPassword              string        `envconfig:"REDIS_PASSWORD"`
+	RedisDB                    int           `envconfig:"REDIS_DB" default:"0"`
+	RedisTLS                   bool          `envconfig:"REDIS_TLS" default:"false"`
+	RedisTLSInsecureSkipVerify bool          `envconfig:"REDIS_TLS_INSECURE_SKIP_VERIFY" default:"false"`
+	RedisMasterName            string        `envconfig:"REDIS_MASTER_NAME"`
+	RedisSentinelUsername      string        `envconfig:"REDIS_SENTINEL_USERNAME"`
+	RedisSentinelPassword      string        `envconfig:"REDIS_SENTINEL_PASSWORD"`
+	RedisCluster               bool          `envconfig:"REDIS_CLUSTER" default:"false"`
+	RedisPoolSize              int           `envconfig:"REDIS_POOL_SIZE" default:"20"`
+	RedisMinIdleConns          int           `envconfig:"REDIS_MIN_IDLE_CONNS" default:"0"`
+	RedisDialTimeout           time.Duration `envconfig:"REDIS_DIAL_TIMEOUT" default:"5s"`
+	RedisReadTimeout           time.Duration `envconfig:"REDIS_READ_TIMEOUT" default:"3s"`
+	RedisWriteTimeout          time.Duration `envconfig:"REDIS_WRITE_TIMEOUT" default:"3s"`
+	RedisKeyPrefix             string        `envconfig:"REDIS_KEY_PREFIX"`
+
+	// IdempotencyTTL is how long a submitted sms_id is remembered to drop
+	// redelivered and republished duplicates.
+	IdempotencyTTL time.Duration `envconfig:"IDEMPOTENCY_TTL" default:"24h"`
+
+	// SmsClasses are the message classes to consume and how they share
+	// RATE_LIMIT, see SmsClasses for the format.
+	SmsClasses SmsClasses `envconfig:"SMS_CLASSES" default:"otp:priority=1,default:weight=1:fair=true,excel:weight=1:fair=true"`
+
+	// OptOutExemptClasses are the classes sent to recipients who opted out,
+	// the sms of the other classes are rejected.
+	OptOutExemptClasses []string `envconfig:"OPT_OUT_EXEMPT_CLASSES" default:"otp"`
+
+	// OptOutKeywords replace the replies which opt a recipient out, the stop
+	// and unsubscribe words of user.OptOutKeywords when empty.
+	OptOutKeywords []string `envconfig:"OPT_OUT_KEYWORDS"`
+
+	// WebhookEnabled posts the sms events of sms.events.> to the webhooks of
+	// companies, up to WebhookConcurrency requests at a time per URL. A
+	// failed request is retried after each WebhookBackoff, and a webhook is
+	// disabled after WebhookDisableAfter events in a row failed every retry.
+	// The durable consumer shared by all executors keeps at most
+	// WebhookMaxPending events in flight. WebhookAllowPrivate lets the
+	// webhooks reach private and loopback addresses, for local setups.
+	WebhookEnabled      bool            `envconfig:"WEBHOOK_ENABLED" default:"false"`
+	WebhookTimeout      time.Duration   `envconfig:"WEBHOOK_TIMEOUT" default:"10s"`
+	WebhookBackoff      []time.Duration `envconfig:"WEBHOOK_BACKOFF" default:"1s,5s,30s,2m"`
+	WebhookConcurrency  int             `envconfig:"WEBHOOK_CONCURRENCY" default:"4"`
+	WebhookDisableAfter int             `envconfig:"WEBHOOK_DISABLE_AFTER" default:"10"`
+	WebhookMaxPending   int             `envconfig:"WEBHOOK_MAX_PENDING" default:"1000"`
+	WebhookAllowPrivate bool            `envconfig:"WEBHOOK_ALLOW_PRIVATE" default:"false"`
+
+	// EventStreamBuffer is how many sms events may wait for a client of the
+	// live event stream, a client falling further behind is dropped.
+	EventStreamBuffer int `envconfig:"EVENT_STREAM_BUFFER" default:"256"`
+
+	// SubmitMaxSegments is the most segments a sms queued over the HTTP API
+	// may have, SubmitMaxBatch the most sms in one POST /v1/sms/batch.
+	SubmitMaxSegments int `envconfig:"SUBMIT_MAX_SEGMENTS" default:"10"`
+	SubmitMaxBatch    int `envconfig:"SUBMIT_MAX_BATCH" default:"1000"`
+
+	// GRPCPort is the port of the gRPC API, which queues and watches sms
+	// like the HTTP API under the same api keys. Empty disables it, it is
+	// only served with APIAuth.
+	GRPCPort string `envconfig:"GRPC_PORT"`
+
+	// InstanceID names the executor in the admin API, the host name when
+	// empty. AdminReplyWait is how long the admin API waits for the
+	// executors to report their binds.
+	InstanceID     string        `envconfig:"INSTANCE_ID"`
+	AdminReplyWait time.Duration `envconfig:"ADMIN_REPLY_WAIT" default:"1s"`
+
+	// CompanyWeights are the weights of companies within fair classes, 1 by
+	// default. CompanyMaxShare caps the share of RATE_LIMIT one company can
+	// take within a fair class.
+	CompanyWeights  map[string]int `envconfig:"COMPANY_WEIGHTS"`
+	CompanyMaxShare float64        `envconfig:"COMPANY_MAX_SHARE" default:"1"`
+
+	// RedeliveryBackoff is the delay before each redelivery of a message
+	// which failed with a recoverable error, the last value repeats.
+	RedeliveryBackoff []time.Duration `envconfig:"REDELIVERY_BACKOFF" default:"1s,5s,30s,1m"`
+
+	// SmsValidity is how long a sent sms may wait for its final receipt.
+	// Sms without one are reported as SMS_EXPIRED by a sweep every
+	// ExpirySweepInterval, or on the ExpirySweepCron schedule when it is
+	// set, delayed by up to ExpirySweepJitter. ExpirySweepSingleRunner runs
+	// the sweep on one replica at a time, under a storage lock.
+	SmsValidity             time.Duration `envconfig:"SMS_VALIDITY" default:"24h"`
+	ExpirySweepInterval     time.Duration `envconfig:"EXPIRY_SWEEP_INTERVAL" default:"1m"`
+	ExpirySweepCron         string        `envconfig:"EXPIRY_SWEEP_CRON"`
+	ExpirySweepJitter       time.Duration `envconfig:"EXPIRY_SWEEP_JITTER" default:"5s"`
+	ExpirySweepSingleRunner bool          `envconfig:"EXPIRY_SWEEP_SINGLE_RUNNER" default:"true"`
+
+	// ReceiptParkBackoff is the delay before each retry of a receipt which
+	// arrived before its correlation was written. Receipts still unmatched
+	// after the last retry are published to sms.orphans.<operator>.
+	ReceiptParkBackoff []time.Duration `envconfig:"RECEIPT_PARK_BACKOFF" default:"200ms,1s,5s"`
+
+	// JetStream stream and durable consumer definitions, reconciled on startup.
+	NatsStreamName            string        `envconfig:"NATS_STREAM_NAME" default:"sms"`
+	NatsStreamSubjects        []string      `envconfig:"NATS_STREAM_SUBJECTS"` // sms.create.*.<class> by default
+	NatsStreamRetention       string        `envconfig:"NATS_STREAM_RETENTION" default:"limits"`
+	NatsStreamMaxAge          time.Duration `envconfig:"NATS_STREAM_MAX_AGE" default:"0"`
+	NatsStreamMaxBytes        int64         `envconfig:"NATS_STREAM_MAX_BYTES" default:"-1"`
+	NatsStreamReplicas        int           `envconfig:"NATS_STREAM_REPLICAS" default:"1"`
+	NatsStreamStorage         string        `envconfig:"NATS_STREAM_STORAGE" default:"file"`
+	NatsStreamDuplicateWindow time.Duration `envconfig:"NATS_STREAM_DUPLICATE_WINDOW" default:"2m"`
+	NatsConsumerAckWait       time.Duration `envconfig:"NATS_CONSUMER_ACK_WAIT" default:"30s"`
+	NatsConsumerMaxAckPending int           `envconfig:"NATS_CONSUMER_MAX_ACK_PENDING" default:"1000"`
 }
 
 // LoadConfig reads environment variables and populates Config.
@@ -33,15 +189,32 @@ func LoadConfig() (*Config, error) {
 
 	var c Config
 	err := envconfig.Process("", &c)
-	//TODO remove when config fixed
-	if c.RateLimit == 1 {
-		c.RateLimit = 2
-	}
 	log.Info(fmt.Sprintf("OPERATOR_URL=`%s`", c.OperatorURL))
 	log.Info("OPERATOR_LOGIN=", c.OperatorLogin)
 	log.Info("OPERATOR_PASSWORD=", c.OperatorPassword)
 	log.Info("RateLimit=", c.RateLimit)
 	log.Info("NATS_TOPIC=", c.NatsTopic)
+	log.Info("STORAGE_BACKEND=", c.StorageBackend)
+	log.Info("HISTORY_BACKEND=", c.HistoryBackend)
+	log.Info("API_AUTH=", c.APIAuth)
+	log.Info("WEBHOOK_ENABLED=", c.WebhookEnabled)
+	log.Info("GRPC_PORT=", c.GRPCPort)
+	if !c.APIAuth {
+		log.Warn("API_AUTH is disabled, the HTTP API is open to anyone who can reach it")
+	}
+	if len(c.AdminAPIKeys) == 0 {
+		log.Warn("ADMIN_API_KEYS is empty, the admin API only takes the admin keys in the storage")
+	}
+	log.Info("REDIS_ADDRESS=", c.RedisAddress)
+	log.Info("REDIS_MASTER_NAME=", c.RedisMasterName)
+	log.Info("REDIS_CLUSTER=", c.RedisCluster)
+	log.Info("REDIS_KEY_PREFIX=", c.RedisKeyPrefix)
+	log.Info("SMS_CLASSES=", c.SmsClasses.Names())
+	log.Info("OPT_OUT_EXEMPT_CLASSES=", c.OptOutExemptClasses)
+	log.Info("OPT_OUT_KEYWORDS=", c.OptOutKeywords)
+	log.Info("MAX_DELIVER=", c.MaxDeliver)
+	log.Info("WORKERS=", c.Workers)
+	log.Info("REDELIVERY_BACKOFF=", c.RedeliveryBackoff)
 
 	return &c, err
 }
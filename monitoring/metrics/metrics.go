@@ -2,6 +2,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -18,6 +20,106 @@ var (
 	},
 		[]string{"processed_message_type"},
 	)
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dead_letters",
+		Help: "Number of non-recoverable messages published to a dead-letter subject.",
+	},
+		[]string{"message_type"},
+	)
+	redeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redeliveries",
+		Help: "Number of messages scheduled for redelivery after a recoverable error.",
+	},
+		[]string{"message_type"},
+	)
+	exhaustedDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "exhausted_deliveries",
+		Help: "Number of messages which reached the max deliveries.",
+	},
+		[]string{"message_type"},
+	)
+	duplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "duplicates",
+		Help: "Number of duplicate sms deliveries which were not resubmitted.",
+	},
+		[]string{"state"},
+	)
+	staleEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stale_events",
+		Help: "Number of sms events ignored because the sms was already in a later state.",
+	},
+		[]string{"status"},
+	)
+	parkedReceipts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "parked_receipts",
+		Help: "Number of receipts parked because they arrived before their correlation, by outcome.",
+	},
+		[]string{"outcome"},
+	)
+	expiredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "expired_messages",
+		Help: "Number of sent sms reported as expired without a final receipt.",
+	})
+	scheduledMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scheduled_messages",
+		Help: "Number of messages fetched by the scheduler for each class.",
+	},
+		[]string{"class"},
+	)
+	classShare = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "class_share",
+		Help: "Share of the fetched messages each class actually got over the last window.",
+	},
+		[]string{"class"},
+	)
+	jobLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_last_run_timestamp_seconds",
+		Help: "Unix time of the last run of each app job.",
+	},
+		[]string{"job"},
+	)
+	jobDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_duration_seconds",
+		Help: "Duration of the last run of each app job.",
+	},
+		[]string{"job"},
+	)
+	jobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_failures",
+		Help: "Number of failed runs of each app job.",
+	},
+		[]string{"job"},
+	)
+	jobSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_skipped",
+		Help: "Number of runs of each app job skipped because another replica held the lock.",
+	},
+		[]string{"job"},
+	)
+	webhookAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_attempts",
+		Help: "Number of webhook requests by outcome: delivered, failed or rejected.",
+	},
+		[]string{"outcome"},
+	)
+	webhooksDisabled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webhooks_disabled",
+		Help: "Number of webhooks disabled after repeated failed deliveries.",
+	})
+	streamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "stream_clients",
+		Help: "Number of clients connected to the live event stream.",
+	})
+	streamDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stream_dropped_clients",
+		Help: "Number of live event stream clients dropped for falling behind.",
+	})
+	optedOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opted_out",
+		Help: "Number of opt-outs by event: rejected sms, or keyword for a recipient who replied with one.",
+	},
+		[]string{"event"},
+	)
 	timeToProcess = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "task_duration",
 		Help:    "Amount of time spent processing.",
@@ -27,7 +129,10 @@ var (
 
 // RegisterPrometheusCollectors tells prometheus to set up collectors.
 func RegisterPrometheusCollectors() {
-	prometheus.MustRegister(messagesReceived, errorsOccurred, timeToProcess)
+	prometheus.MustRegister(messagesReceived, errorsOccurred, deadLetters, redeliveries, exhaustedDeliveries,
+		duplicates, staleEvents, parkedReceipts, expiredMessages, scheduledMessages, classShare,
+		jobLastRun, jobDuration, jobFailures, jobSkipped, webhookAttempts, webhooksDisabled,
+		streamClients, streamDropped, optedOut, timeToProcess)
 }
 
 // ReceivedMessage records number of messages of each type received.
@@ -41,7 +146,100 @@ func OccurredError(msgType string) {
 	errorsOccurred.WithLabelValues(msgType).Add(1)
 }
 
+// DeadLetteredMessage records number of messages of each type published to
+// a dead-letter subject.
+func DeadLetteredMessage(msgType string) {
+	deadLetters.WithLabelValues(msgType).Add(1)
+}
+
+// RedeliveredMessage records number of messages of each type scheduled for
+// redelivery.
+func RedeliveredMessage(msgType string) {
+	redeliveries.WithLabelValues(msgType).Add(1)
+}
+
+// ExhaustedMessage records number of messages of each type which reached the
+// max deliveries.
+func ExhaustedMessage(msgType string) {
+	exhaustedDeliveries.WithLabelValues(msgType).Add(1)
+}
+
+// DuplicateMessage records number of duplicate sms deliveries by the state
+// of the original submission.
+func DuplicateMessage(state string) {
+	duplicates.WithLabelValues(state).Add(1)
+}
+
+// StaleEvent records number of ignored out of order events of each delivery
+// status.
+func StaleEvent(status string) {
+	staleEvents.WithLabelValues(status).Add(1)
+}
+
+// ParkedReceipt records number of parked receipts of each outcome: parked,
+// matched or orphaned.
+func ParkedReceipt(outcome string) {
+	parkedReceipts.WithLabelValues(outcome).Add(1)
+}
+
+// ExpiredMessage records number of sms reported as expired.
+func ExpiredMessage() {
+	expiredMessages.Inc()
+}
+
+// ScheduledMessages records number of messages fetched for each class.
+func ScheduledMessages(class string, n int) {
+	scheduledMessages.WithLabelValues(class).Add(float64(n))
+}
+
+// SetClassShare records the share of fetched messages a class got.
+func SetClassShare(class string, share float64) {
+	classShare.WithLabelValues(class).Set(share)
+}
+
 // ObserveTimeToProcess records amount of time spent processing messages.
 func ObserveTimeToProcess(t float64) {
 	timeToProcess.Observe(t)
 }
+
+// ObserveJob records the start and duration of a run of an app job.
+func ObserveJob(job string, start time.Time, duration time.Duration) {
+	jobLastRun.WithLabelValues(job).Set(float64(start.Unix()))
+	jobDuration.WithLabelValues(job).Set(duration.Seconds())
+}
+
+// FailedJob records number of failed runs of each app job.
+func FailedJob(job string) {
+	jobFailures.WithLabelValues(job).Add(1)
+}
+
+// SkippedJob records number of skipped runs of each app job.
+func SkippedJob(job string) {
+	jobSkipped.WithLabelValues(job).Add(1)
+}
+
+// WebhookAttempt records number of webhook requests of each outcome.
+func WebhookAttempt(outcome string) {
+	webhookAttempts.WithLabelValues(outcome).Add(1)
+}
+
+// DisabledWebhook records number of webhooks disabled after failing.
+func DisabledWebhook() {
+	webhooksDisabled.Inc()
+}
+
+// SetStreamClients records number of clients of the live event stream.
+func SetStreamClients(n int) {
+	streamClients.Set(float64(n))
+}
+
+// DroppedStreamClient records number of slow live event stream clients.
+func DroppedStreamClient() {
+	streamDropped.Inc()
+}
+
+// OptedOut records number of sms rejected for an opted out recipient, and
+// of recipients who opted out by keyword.
+func OptedOut(event string) {
+	optedOut.WithLabelValues(event).Add(1)
+}
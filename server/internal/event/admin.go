@@ -0,0 +1,89 @@
+package event
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/client/pubsub"
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+)
+
+// Responder is implemented by handlers which answer requests. A nil answer
+// is not sent, the request was not meant for the executor.
+type Responder interface {
+	Respond(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// SettingsEvents contains a slice of SettingsEvent.
+type SettingsEvents []SettingsEvent
+
+// SettingsEvent hands the runtime settings of the operator to the handler,
+// the latest ones on subscribing and then every change.
+type SettingsEvent struct {
+	Name    string
+	Handler Handler
+}
+
+// SubscribeAndListen subscribes to the settings until ctx is done.
+func (e *SettingsEvent) SubscribeAndListen(ctx context.Context, ps *pubsub.Client, errc chan<- error) {
+	sub, err := ps.SubscribeSettings(func(msg *nats.Msg) {
+		metrics.ReceivedMessage(e.Name, float64(1))
+
+		if err := e.Handler.Handle(ctx, msg.Data); err != nil {
+			log.Error(err.Error())
+			metrics.OccurredError(e.Name)
+		}
+	})
+	if err != nil {
+		errc <- fmt.Errorf("subscription receive(%s): %w", e.Name, err)
+		return
+	}
+
+	<-ctx.Done()
+	_ = sub.Unsubscribe()
+}
+
+// BindEvents contains a slice of BindEvent.
+type BindEvents []BindEvent
+
+// BindEvent answers the requests of the admin API for the smpp session of
+// the executor.
+type BindEvent struct {
+	Name   string
+	Binds  Responder
+	Rebind Responder
+}
+
+// SubscribeAndListen answers the requests until ctx is done.
+func (e *BindEvent) SubscribeAndListen(ctx context.Context, ps *pubsub.Client, errc chan<- error) {
+	subs, err := ps.SubscribeBindRequests(e.respond(ctx, e.Binds), e.respond(ctx, e.Rebind))
+	if err != nil {
+		errc <- fmt.Errorf("subscription receive(%s): %w", e.Name, err)
+		return
+	}
+
+	<-ctx.Done()
+	for _, sub := range subs {
+		_ = sub.Unsubscribe()
+	}
+}
+
+func (e *BindEvent) respond(ctx context.Context, r Responder) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		metrics.ReceivedMessage(e.Name, float64(1))
+
+		data, err := r.Respond(ctx, msg.Data)
+		if err != nil {
+			log.Error(err.Error())
+			metrics.OccurredError(e.Name)
+			return
+		}
+
+		if data != nil {
+			_ = msg.Respond(data)
+		}
+	}
+}
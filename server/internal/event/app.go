@@ -3,36 +3,133 @@ package event
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/opentracing/opentracing-go"
+	"math/rand"
 	"time"
 
+	"github.com/robfig/cron/v3"
+
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
 	"github.com/qosimmax/sms-executor/user"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// lockGrace keeps the lock of a run past its timeout, for a handler which
+// takes a moment to return once its context is done.
+const lockGrace = time.Minute
+
 // AppEvents contains a slice of AppEvent.
 type AppEvents []AppEvent
 
-// AppEvent contains the data for an in-app event type.
+// AppEvent contains the data for an in-app event type, a job which runs
+// every Rate, or on the Cron schedule when one is set.
+//
+// Runs never overlap: the next run is scheduled once the previous one
+// finished. Jitter delays each run by a random duration up to it, so the
+// replicas do not all run at once. With a Lock, a run is skipped unless
+// this replica holds the lock, so only one replica runs the job.
 type AppEvent struct {
 	Name    string
 	Rate    time.Duration
+	Cron    string
+	Jitter  time.Duration
+	Lock    user.Locker
+	Timeout time.Duration
 	Handler Handler
 }
 
-// SubscribeAndListen subscribes to an AppEvent.
+// SubscribeAndListen runs the job on its schedule until ctx is done.
 func (e *AppEvent) SubscribeAndListen(ctx context.Context) {
-	for t := range time.Tick(e.Rate) {
-		go func(t time.Time) {
-			span, ctx := opentracing.StartSpanFromContext(context.Background(), e.Name)
-			defer span.Finish()
-
-			var errExpected user.ErrExpected
-			err := e.Handler.Handle(ctx, nil)
-			if err != nil && !errors.As(err, &errExpected) {
-				log.Error(t, err.Error())
+	next, err := e.schedule()
+	if err != nil {
+		log.Errorf("app event %s: %v", e.Name, err)
+		return
+	}
+
+	for {
+		at := next(time.Now())
+		if e.Jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(e.Jitter))))
+		}
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		e.run(ctx)
+	}
+}
+
+// schedule returns the function which computes the time of the next run.
+func (e *AppEvent) schedule() (func(time.Time) time.Time, error) {
+	if e.Cron != "" {
+		schedule, err := cron.ParseStandard(e.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", e.Cron, err)
+		}
+
+		return schedule.Next, nil
+	}
+
+	if e.Rate <= 0 {
+		return nil, fmt.Errorf("no schedule")
+	}
+
+	return func(t time.Time) time.Time {
+		return t.Add(e.Rate)
+	}, nil
+}
+
+func (e *AppEvent) run(ctx context.Context) {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = e.Rate
+	}
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if e.Lock != nil {
+		// the lock outlives the run timeout, so a run is never taken over
+		token, ok, err := e.Lock.Lock(ctx, "appEvent:"+e.Name, timeout+lockGrace)
+		if err != nil {
+			log.Errorf("app event %s lock: %v", e.Name, err)
+			metrics.FailedJob(e.Name)
+			return
+		}
+
+		if !ok {
+			metrics.SkippedJob(e.Name)
+			return
+		}
+
+		defer func() {
+			if err := e.Lock.Unlock(context.Background(), "appEvent:"+e.Name, token); err != nil {
+				log.Errorf("app event %s unlock: %v", e.Name, err)
 			}
-		}(t)
+		}()
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, e.Name)
+	defer span.Finish()
+
+	start := time.Now()
+	err := e.Handler.Handle(ctx, nil)
+	metrics.ObserveJob(e.Name, start, time.Since(start))
+
+	var errExpected user.ErrExpected
+	if err != nil && !errors.As(err, &errExpected) {
+		span.SetTag("error", true)
+		log.Errorf("app event %s: %v", e.Name, err)
+		metrics.FailedJob(e.Name)
 	}
 }
@@ -0,0 +1,144 @@
+package event
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type handlerFunc func(ctx context.Context, data []byte) error
+
+func (f handlerFunc) Handle(ctx context.Context, data []byte) error {
+	return f(ctx, data)
+}
+
+// memLock is a Locker shared by the app events of a test.
+type memLock struct {
+	mu   sync.Mutex
+	held map[string]bool
+	ttl  time.Duration
+}
+
+func (l *memLock) Lock(ctx context.Context, name string, ttl time.Duration) (string, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held[name] {
+		return "", false, nil
+	}
+	l.held[name] = true
+	l.ttl = ttl
+	return name, true, nil
+}
+
+func (l *memLock) Unlock(ctx context.Context, name, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.held, name)
+	return nil
+}
+
+func TestAppEvent_NoOverlap(t *testing.T) {
+	var running, overlaps, runs int32
+	e := AppEvent{
+		Name: "slow",
+		Rate: 5 * time.Millisecond,
+		Handler: handlerFunc(func(ctx context.Context, _ []byte) error {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&runs, 1)
+			return nil
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		e.SubscribeAndListen(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("app event did not stop with its context")
+	}
+
+	if overlaps != 0 {
+		t.Errorf("%d runs overlapped", overlaps)
+	}
+
+	if runs == 0 || runs > 10 {
+		t.Errorf("got %d runs, want a run every 25ms", runs)
+	}
+}
+
+func TestAppEvent_SingleRunner(t *testing.T) {
+	lock := &memLock{held: make(map[string]bool)}
+
+	var running, overlaps, runs int32
+	handler := handlerFunc(func(ctx context.Context, _ []byte) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// replicas of the same job
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := AppEvent{Name: "sweep", Rate: time.Millisecond, Lock: lock, Handler: handler}
+			e.SubscribeAndListen(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if overlaps != 0 {
+		t.Errorf("%d runs overlapped across replicas", overlaps)
+	}
+
+	if runs == 0 {
+		t.Error("the job never ran")
+	}
+
+	// the lock outlives the run timeout
+	if want := time.Millisecond + lockGrace; lock.ttl != want {
+		t.Errorf("lock ttl = %s, want %s", lock.ttl, want)
+	}
+}
+
+func TestAppEvent_Schedule(t *testing.T) {
+	e := AppEvent{Cron: "*/5 * * * *"}
+	next, err := e.schedule()
+	if err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+
+	now := time.Date(2023, 5, 1, 10, 2, 30, 0, time.UTC)
+	if got, want := next(now), time.Date(2023, 5, 1, 10, 5, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next run = %v, want %v", got, want)
+	}
+
+	for _, e := range []AppEvent{{Cron: "every minute"}, {}} {
+		if _, err := e.schedule(); err == nil {
+			t.Errorf("schedule of %+v: want error", e)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/client/pubsub"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	// companyRefresh is how often the idle companies of a fair class are
+	// fetched from again.
+	companyRefresh = 2 * time.Second
+	// companyDiscovery is how often the per-company subjects of a fair class
+	// are looked up in the stream, so the first sms of a new company waits
+	// up to that long before it is served.
+	companyDiscovery = 15 * time.Second
+	// companyIdle is how long a company goes without sms before its
+	// subscription is dropped, it is subscribed again on its next sms.
+	companyIdle = 10 * time.Minute
+	// companyInactive is how long the server keeps the consumer of a company
+	// nobody pulls from. It outlasts the sms lifetime, so every sms the
+	// deleted consumer handled is older than the start of the new one.
+	companyInactive = user.SmsLifetime + companyIdle
+)
+
+// companyQueues serves a fair class by company. Each subject
+// sms.create.<operator>.<class>.<company_id> gets its own durable consumer,
+// and the plain class subject is served as one more company. The consumers
+// of the companies which stopped sending are dropped and deleted by the
+// server after companyInactive.
+//
+// Companies are served least served relative to their weight first, and
+// each company takes at most maxShare of the rate limit.
+type companyQueues struct {
+	class    *Subscription
+	ps       *pubsub.Client
+	weights  map[string]int
+	maxShare float64
+	rate     func() int
+	now      func() time.Time
+
+	queues     map[string]*companyQueue
+	refreshed  time.Time
+	discovered time.Time
+	// dropped is the number of messages of the subject of each dropped
+	// company when it was dropped, it is subscribed again once it changes.
+	dropped map[string]uint64
+}
+
+type companyQueue struct {
+	company string
+	sub     *nats.Subscription
+
+	// virtual is the number of messages served divided by the weight.
+	virtual float64
+	// idle is set when the last fetch returned no messages, idle queues are
+	// only tried again after the next refresh.
+	idle bool
+	// active is when the last fetch returned messages.
+	active time.Time
+
+	// tokens is the throughput the company may still take under maxShare.
+	tokens   float64
+	refilled time.Time
+}
+
+func newCompanyQueues(class *Subscription, ps *pubsub.Client, weights map[string]int, maxShare float64,
+	rate func() int, now func() time.Time) *companyQueues {
+	q := &companyQueues{
+		class:    class,
+		ps:       ps,
+		weights:  weights,
+		maxShare: maxShare,
+		rate:     rate,
+		now:      now,
+		queues:   make(map[string]*companyQueue),
+		dropped:  make(map[string]uint64),
+	}
+
+	q.queues[""] = &companyQueue{sub: class.sub, refilled: now()}
+
+	return q
+}
+
+// fetch fetches up to batch messages of the next company which has any.
+func (q *companyQueues) fetch(batch int) ([]*nats.Msg, error) {
+	now := q.now()
+	// the companies found idle since the last refresh are dropped first
+	if now.Sub(q.discovered) >= companyDiscovery {
+		if err := q.discover(); err != nil {
+			log.Errorf("error discovering companies of %s: %v", q.class.Name, err)
+		}
+		q.discovered = now
+	}
+	if now.Sub(q.refreshed) >= companyRefresh {
+		q.refresh()
+		q.refreshed = now
+	}
+
+	queues := make([]*companyQueue, 0, len(q.queues))
+	for _, cq := range q.queues {
+		if !cq.idle {
+			queues = append(queues, cq)
+		}
+	}
+
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].virtual != queues[j].virtual {
+			return queues[i].virtual < queues[j].virtual
+		}
+		return queues[i].company < queues[j].company
+	})
+
+	tried := false
+	for _, cq := range queues {
+		n := batch
+		// the class subject mixes companies and is not capped
+		if q.maxShare < 1 && cq.company != "" {
+			limit := q.maxShare * float64(q.rate())
+			cq.tokens = math.Min(cq.tokens+now.Sub(cq.refilled).Seconds()*limit, math.Max(1, limit))
+			cq.refilled = now
+
+			if cq.tokens < 1 {
+				continue
+			}
+
+			n = int(math.Min(float64(n), cq.tokens))
+		}
+
+		tried = true
+		msgs, err := cq.sub.Fetch(n, nats.MaxWait(q.class.Timeout))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			cq.idle = true
+			continue
+		}
+
+		cq.active = now
+		cq.virtual += float64(len(msgs)) / float64(q.weight(cq.company))
+		cq.tokens = math.Max(0, cq.tokens-float64(len(msgs)))
+
+		return msgs, nil
+	}
+
+	// everything is idle until the next refresh, keep waiting on the class
+	// subject like an unfair class would
+	if !tried {
+		return q.class.sub.Fetch(batch, nats.MaxWait(q.class.Timeout))
+	}
+
+	return nil, nats.ErrTimeout
+}
+
+// refresh makes idle companies eligible again, level with the busy ones.
+func (q *companyQueues) refresh() {
+	min, found := q.minVirtual()
+	for _, cq := range q.queues {
+		if cq.idle {
+			if found {
+				cq.virtual = math.Max(cq.virtual, min)
+			}
+			cq.idle = false
+		}
+	}
+}
+
+// minVirtual returns the least virtual time of the busy companies.
+func (q *companyQueues) minVirtual() (float64, bool) {
+	var min float64
+	found := false
+	for _, cq := range q.queues {
+		if !cq.idle && (!found || cq.virtual < min) {
+			min = cq.virtual
+			found = true
+		}
+	}
+	return min, found
+}
+
+// discover subscribes to newly seen company subjects and drops the
+// companies idle for companyIdle.
+func (q *companyQueues) discover() error {
+	now := q.now()
+
+	var idle []string
+	for company, cq := range q.queues {
+		if company != "" && cq.idle && now.Sub(cq.active) >= companyIdle {
+			idle = append(idle, company)
+		}
+	}
+	min, _ := q.minVirtual()
+
+	info, err := q.ps.StreamInfo(q.ps.StreamName(), &nats.StreamInfoRequest{
+		SubjectsFilter: q.class.Name + ".*",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, company := range idle {
+		if cq := q.queues[company]; q.drained(cq) {
+			_ = cq.sub.Unsubscribe()
+			delete(q.queues, company)
+			q.dropped[company] = info.State.Subjects[q.class.Name+"."+company]
+		}
+	}
+
+	for subject, n := range info.State.Subjects {
+		company := subject[strings.LastIndex(subject, ".")+1:]
+		if _, ok := q.queues[company]; ok {
+			continue
+		}
+
+		if dropped, ok := q.dropped[company]; ok && dropped == n {
+			continue
+		}
+
+		// the sms older than their lifetime are not sent, a company without
+		// newer ones has nothing to serve
+		start := now.Add(-user.SmsLifetime)
+		last, err := q.ps.GetLastMsg(q.ps.StreamName(), subject)
+		if err != nil {
+			return fmt.Errorf("error getting last message of %s: %w", subject, err)
+		}
+		if last.Time.Before(start) {
+			q.dropped[company] = n
+			continue
+		}
+		delete(q.dropped, company)
+
+		durable := fmt.Sprintf("%s:%s", q.class.Queue, company)
+		err = q.ps.EnsureCompanyConsumer(durable, subject, companyInactive, start)
+		if err != nil {
+			return err
+		}
+
+		sub, err := q.ps.PullSubscribe(subject, durable, nats.Bind(q.ps.StreamName(), durable))
+		if err != nil {
+			return fmt.Errorf("subscription receive(%s): %w", subject, err)
+		}
+
+		q.queues[company] = &companyQueue{
+			company:  company,
+			sub:      sub,
+			virtual:  min,
+			active:   now,
+			refilled: now,
+		}
+	}
+
+	return nil
+}
+
+// drained reports if the consumer of a company has no messages left to
+// deliver or to be acked, so dropping it loses none.
+func (q *companyQueues) drained(cq *companyQueue) bool {
+	info, err := cq.sub.ConsumerInfo()
+	if err != nil {
+		return false
+	}
+
+	return info.NumPending == 0 && info.NumAckPending == 0
+}
+
+func (q *companyQueues) unsubscribe() {
+	for _, cq := range q.queues {
+		_ = cq.sub.Unsubscribe()
+	}
+}
+
+func (q *companyQueues) weight(company string) int {
+	if w := q.weights[company]; w > 0 {
+		return w
+	}
+
+	return 1
+}
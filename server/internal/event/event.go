@@ -16,7 +16,7 @@ import (
 
 	"github.com/qosimmax/sms-executor/server/internal/handler"
 
-	"github.com/qosimmax/sms-executor/client/redis"
+	"github.com/qosimmax/sms-executor/user"
 )
 
 // Handler is an interface that all event handles must implement.
@@ -24,57 +24,197 @@ type Handler interface {
 	Handle(ctx context.Context, data []byte) error
 }
 
+// ExhaustedHandler is implemented by handlers which report messages that
+// ran out of delivery attempts.
+type ExhaustedHandler interface {
+	HandleExhausted(ctx context.Context, data []byte, err error) error
+}
+
+// OrphanHandler is implemented by handlers which report events that could
+// not be correlated within the parking time.
+type OrphanHandler interface {
+	HandleOrphan(ctx context.Context, data []byte) error
+}
+
+// OrderedHandler is implemented by handlers whose messages with the same
+// key must be handled one at a time, in order.
+type OrderedHandler interface {
+	OrderKey(data []byte) string
+}
+
 // GetPubSubEvents describes all the pubsub events to listen to.
-func GetPubSubEvents(r *redis.Client, s *smpp.Client, c *config.Config) PubSubEvents {
+func GetPubSubEvents(ps *pubsub.Client, r user.StorageReadWriter, h user.HistoryWriter, o user.OptOutReader,
+	s *smpp.Client, rt *Runtime, c *config.Config) PubSubEvents {
+	var subscriptions []Subscription
+	for _, class := range c.SmsClasses {
+		batchSize := class.MaxBatch
+		if batchSize == 0 {
+			batchSize = c.RateLimit
+		}
+
+		subscriptions = append(subscriptions, Subscription{
+			Name:      fmt.Sprintf("sms.create.%s.%s", c.NatsTopic, class.Name),
+			Queue:     queueName(c.NatsTopic, class.Name),
+			Class:     class.Name,
+			Priority:  class.Priority,
+			Weight:    class.Weight,
+			Reserved:  class.Reserved,
+			Fair:      class.Fair,
+			Timeout:   10 * time.Millisecond,
+			BatchSize: batchSize,
+		})
+	}
+
 	psEvents := PubSubEvents{
 		PubSubEvent{
-			Name: "sms",
-			Subscriptions: []Subscription{
-				{
-					Name:      fmt.Sprintf("sms.create.%s.otp", c.NatsTopic),
-					Queue:     fmt.Sprintf("sms-executor:sms:otp:%s", c.NatsTopic),
-					Timeout:   10 * time.Millisecond,
-					BatchSize: c.RateLimit,
-				},
-				{
-					Name:      fmt.Sprintf("sms.create.%s.default", c.NatsTopic),
-					Queue:     fmt.Sprintf("sms-executor:sms:%s", c.NatsTopic),
-					Timeout:   10 * time.Millisecond,
-					BatchSize: c.RateLimit / 2,
-				},
-				{
-					Name:      fmt.Sprintf("sms.create.%s.excel", c.NatsTopic),
-					Queue:     fmt.Sprintf("sms-executor:sms:excel:%s", c.NatsTopic),
-					Timeout:   10 * time.Millisecond,
-					BatchSize: c.RateLimit / 2,
-				},
-			},
+			Name:          "sms",
+			Subscriptions: subscriptions,
 			Handler: &handler.Sms{
-				SmsSender: s,
-				Storage:   r,
+				SmsSender:     s,
+				Storage:       r,
+				Pub:           ps,
+				History:       h,
+				Sequences:     r,
+				SequenceBlock: c.SequenceBlock,
+				OptOuts:       o,
+				OptOutExempt:  c.OptOutExemptClasses,
 			},
+			MaxDeliver:      c.MaxDeliver,
+			Backoff:         c.RedeliveryBackoff,
+			RateLimit:       c.RateLimit,
+			Workers:         c.Workers,
+			CompanyWeights:  c.CompanyWeights,
+			CompanyMaxShare: c.CompanyMaxShare,
+			Runtime:         rt,
 		},
 	}
 
 	return psEvents
 }
 
+// queueName returns the durable consumer name of a class. The default class
+// keeps its historical name without the class token.
+func queueName(topic, class string) string {
+	if class == "default" {
+		return fmt.Sprintf("sms-executor:sms:%s", topic)
+	}
+
+	return fmt.Sprintf("sms-executor:sms:%s:%s", class, topic)
+}
+
 // GetAppEvents describes all the app events to listen to.
-func GetAppEvents() AppEvents {
-	appEvents := AppEvents{}
+func GetAppEvents(ps *pubsub.Client, r user.StorageReadWriter, h user.HistoryWriter, c *config.Config) AppEvents {
+	// every replica sees the same correlations, one sweep at a time is enough
+	var sweepLock user.Locker
+	if c.ExpirySweepSingleRunner {
+		sweepLock = r
+	}
+
+	appEvents := AppEvents{
+		AppEvent{
+			Name:   "expired-sms",
+			Rate:   c.ExpirySweepInterval,
+			Cron:   c.ExpirySweepCron,
+			Jitter: c.ExpirySweepJitter,
+			Lock:   sweepLock,
+			Handler: &handler.ExpiredSms{
+				Storage: r,
+				Pub:     ps,
+				History: h,
+			},
+		},
+	}
 
 	return appEvents
 }
 
+// GetWebhookEvents describes the webhook deliveries of the sms events, the
+// consumer is shared by the executors of every operator.
+func GetWebhookEvents(w user.WebhookStore, p user.WebhookPoster, c *config.Config) WebhookEvents {
+	if !c.WebhookEnabled {
+		return nil
+	}
+
+	webhookEvents := WebhookEvents{
+		WebhookEvent{
+			Name:       "webhook",
+			Durable:    "sms-executor:webhooks",
+			MaxPending: c.WebhookMaxPending,
+			AckWait:    c.NatsConsumerAckWait,
+			Handler: &handler.Webhook{
+				Webhooks:     w,
+				Poster:       p,
+				Backoff:      c.WebhookBackoff,
+				Concurrency:  c.WebhookConcurrency,
+				DisableAfter: c.WebhookDisableAfter,
+			},
+		},
+	}
+
+	return webhookEvents
+}
+
+// GetStreamEvents describes the sms events pushed to the clients of the live
+// event stream, every executor streams the events of every operator.
+func GetStreamEvents(s *handler.EventStream) StreamEvents {
+	if s == nil {
+		return nil
+	}
+
+	streamEvents := StreamEvents{
+		StreamEvent{
+			Name:    "stream",
+			Handler: s,
+		},
+	}
+
+	return streamEvents
+}
+
+// GetSettingsEvents describes the runtime settings of the operator, applied
+// to the fetch loop and the smpp session as they change.
+func GetSettingsEvents(s *smpp.Client, rt *Runtime) SettingsEvents {
+	settingsEvents := SettingsEvents{
+		SettingsEvent{
+			Name: "settings",
+			Handler: &handler.Settings{
+				Appliers: []user.SettingsApplier{rt, s},
+			},
+		},
+	}
+
+	return settingsEvents
+}
+
+// GetBindEvents describes the requests for the smpp session of the executor.
+func GetBindEvents(s *smpp.Client) BindEvents {
+	bindEvents := BindEvents{
+		BindEvent{
+			Name:   "binds",
+			Binds:  &handler.BindStatus{Binder: s},
+			Rebind: &handler.Rebind{Binder: s},
+		},
+	}
+
+	return bindEvents
+}
+
 // GetSmppEvents describes all the smpp events to listen to.
-func GetSmppEvents(ps *pubsub.Client, r *redis.Client) SmppEvents {
+func GetSmppEvents(ps *pubsub.Client, r user.StorageReadWriter, h user.HistoryReaderWriter, o user.OptOutWriter,
+	c *config.Config) SmppEvents {
 	smppEvents := SmppEvents{
 		SmppEvent{
 			Name: "SMPP",
 			Handler: &handler.SmsEvent{
-				Storage: r,
-				Pub:     ps,
+				Storage:        r,
+				Pub:            ps,
+				Orphans:        ps,
+				History:        h,
+				OptOuts:        o,
+				OptOutKeywords: c.OptOutKeywords,
+				Replied:        h,
 			},
+			ParkBackoff: c.ReceiptParkBackoff,
 		},
 	}
 
@@ -0,0 +1,109 @@
+package event
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// workerPool handles fetched messages concurrently.
+//
+// Messages with the same key always go to the same worker, so they are
+// handled in the order they were fetched. At most size messages are in
+// flight, and the fetch loop only fetches as many as there are free slots,
+// so a busy low priority class cannot queue up ahead of a higher one.
+type workerPool struct {
+	slots   chan struct{}
+	workers []chan *nats.Msg
+	handle  func(*nats.Msg)
+	next    uint32
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(size int, handle func(*nats.Msg)) *workerPool {
+	if size <= 0 {
+		size = 1
+	}
+
+	p := &workerPool{
+		slots:   make(chan struct{}, size),
+		workers: make([]chan *nats.Msg, size),
+		handle:  handle,
+	}
+
+	for i := range p.workers {
+		// a worker never has more than size messages queued, because
+		// that is all the slots there are
+		p.workers[i] = make(chan *nats.Msg, size)
+
+		p.wg.Add(1)
+		go p.work(p.workers[i])
+	}
+
+	return p
+}
+
+func (p *workerPool) work(msgs <-chan *nats.Msg) {
+	defer p.wg.Done()
+
+	for msg := range msgs {
+		p.handle(msg)
+		<-p.slots
+	}
+}
+
+// acquire waits for at least one free slot and takes up to max of them.
+// It returns 0 when ctx is done.
+func (p *workerPool) acquire(ctx context.Context, max int) int {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0
+	}
+
+	n := 1
+	for n < max {
+		select {
+		case p.slots <- struct{}{}:
+			n++
+		default:
+			return n
+		}
+	}
+
+	return n
+}
+
+// release gives back n slots which were acquired but not used.
+func (p *workerPool) release(n int) {
+	for i := 0; i < n; i++ {
+		<-p.slots
+	}
+}
+
+// submit hands an acquired slot's message to the worker of its key.
+// Messages without a key are spread over the workers.
+func (p *workerPool) submit(key string, msg *nats.Msg) {
+	var i uint32
+	if key == "" {
+		i = atomic.AddUint32(&p.next, 1)
+	} else {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		i = h.Sum32()
+	}
+
+	p.workers[i%uint32(len(p.workers))] <- msg
+}
+
+// close stops the workers once they handled every submitted message.
+func (p *workerPool) close() {
+	for _, msgs := range p.workers {
+		close(msgs)
+	}
+
+	p.wg.Wait()
+}
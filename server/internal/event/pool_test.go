@@ -0,0 +1,74 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestWorkerPool_OrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+
+	p := newWorkerPool(4, func(msg *nats.Msg) {
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		key := msg.Header.Get("key")
+		var i int
+		_, _ = fmt.Sscan(string(msg.Data), &i)
+		handled[key] = append(handled[key], i)
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if p.acquire(ctx, 1) != 1 {
+			t.Fatal("acquire: no slot")
+		}
+
+		key := fmt.Sprintf("recipient-%d", i%3)
+		msg := &nats.Msg{Header: nats.Header{}, Data: []byte(fmt.Sprint(i))}
+		msg.Header.Set("key", key)
+		p.submit(key, msg)
+	}
+	p.close()
+
+	for key, order := range handled {
+		for j := 1; j < len(order); j++ {
+			if order[j] < order[j-1] {
+				t.Errorf("%s handled out of order: %v", key, order)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkerPool_Bounded(t *testing.T) {
+	block := make(chan struct{})
+	p := newWorkerPool(3, func(*nats.Msg) { <-block })
+
+	ctx := context.Background()
+	if n := p.acquire(ctx, 10); n != 3 {
+		t.Fatalf("acquired %d slots, want 3", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		p.submit("", &nats.Msg{})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if n := p.acquire(ctx, 1); n != 0 {
+		t.Errorf("acquired %d slots while all workers are busy", n)
+	}
+
+	close(block)
+	if n := p.acquire(context.Background(), 10); n == 0 {
+		t.Error("no slot after the workers finished")
+	}
+}
@@ -6,16 +6,29 @@ import (
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/opentracing/opentracing-go"
+	"strings"
 	"time"
 
 	"github.com/qosimmax/sms-executor/client/pubsub"
 	"github.com/qosimmax/sms-executor/monitoring/metrics"
 	"github.com/qosimmax/sms-executor/monitoring/trace"
+	"github.com/qosimmax/sms-executor/server/internal/handler"
 	"github.com/qosimmax/sms-executor/user"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// pausedWait is how long the fetch loop waits when no class can be fetched.
+const pausedWait = 10 * time.Millisecond
+
+// fetchErrorWait is how long the fetch loop waits after a failed fetch, like
+// on a closed or broken connection.
+const fetchErrorWait = time.Second
+
+// inProgressWait is how long a message waits for another delivery which
+// handles it before it is handled again.
+const inProgressWait = time.Second
+
 // PubSubEvents contains a slice of PubSubEvent.
 type PubSubEvents []PubSubEvent
 
@@ -27,15 +40,29 @@ type PubSubEvent struct {
 	Handler          Handler
 	Subscription     nats.JetStreamContext
 	Subscriptions    []Subscription
+	PubSub           *pubsub.Client
+	MaxDeliver       int
+	Backoff          []time.Duration
+	RateLimit        int
+	Workers          int
+	CompanyWeights   map[string]int
+	CompanyMaxShare  float64
+	// Runtime changes the rate limit and the classes fetched at runtime.
+	Runtime *Runtime
 }
 
-// SubscribeAndListen subscribes to a PubSubEvent.
+// SubscribeAndListen subscribes to a PubSubEvent. It stops fetching when ctx
+// is done, and returns once the fetched messages are handled.
 func (e *PubSubEvent) SubscribeAndListen(ctx context.Context, c *pubsub.Client, errc chan<- error) {
 	e.Subscription = c
-	go e.receive(ctx, errc)
+	e.PubSub = c
+	e.receive(ctx, errc)
 }
 
 func (e *PubSubEvent) receive(ctx context.Context, errc chan<- error) {
+	// stop ends the waits for other deliveries on shutdown
+	stop := ctx.Done()
+
 	handler := func(ctx context.Context, msg *nats.Msg) {
 		carrier := opentracing.TextMapCarrier{}
 		for k := range msg.Header {
@@ -54,11 +81,16 @@ func (e *PubSubEvent) receive(ctx context.Context, errc chan<- error) {
 
 		var errNonRecoverable user.ErrNonRecoverable
 		var errExpected user.ErrExpected
+		var errInProgress user.ErrInProgress
 
-		cctx, cancel := context.WithTimeout(ctx, time.Second*10)
-		defer cancel()
+		err := e.handle(ctx, msg)
+		for errors.As(err, &errInProgress) {
+			if !e.waitInProgress(stop, msg) {
+				return
+			}
+			err = e.handle(ctx, msg)
+		}
 
-		err := e.Handler.Handle(cctx, msg.Data)
 		if err != nil {
 			// If the error is not an expected error, log and record the error
 			if !errors.As(err, &errExpected) {
@@ -69,36 +101,67 @@ func (e *PubSubEvent) receive(ctx context.Context, errc chan<- error) {
 			}
 
 			// If the error is not a non-recoverable error, it means it is
-			// recoverable, so return before acking
+			// recoverable, so schedule a redelivery instead of acking
 			if !errors.As(err, &errNonRecoverable) {
+				e.redeliver(ctx, msg, err)
+				return
+			}
+
+			// Park the message on its dead-letter subject, and leave it
+			// unacked if that fails so it is not lost
+			dlqErr := e.PubSub.PublishDeadLetter(ctx, msg, err)
+			if dlqErr != nil {
+				log.Error(dlqErr.Error())
+				metrics.OccurredError(e.Name)
 				return
 			}
+
+			metrics.DeadLetteredMessage(e.Name)
 		}
 
 		_ = msg.Ack()
 	}
 
 	for i, _ := range e.Subscriptions {
-		sub, err := e.Subscription.PullSubscribe(e.Subscriptions[i].Name, e.Subscriptions[i].Queue,
-			nats.DeliverAll(), nats.PullMaxWaiting(128))
+		err := e.PubSub.EnsureConsumer(e.Subscriptions[i].Queue, e.Subscriptions[i].Name)
 		if err != nil {
-			if err != nil {
-				errc <- fmt.Errorf("subscription receive(%s): %w", e.Subscriptions[i].Name, err)
-			}
+			errc <- fmt.Errorf("subscription consumer(%s): %w", e.Subscriptions[i].Name, err)
+			return
+		}
 
+		sub, err := e.Subscription.PullSubscribe(e.Subscriptions[i].Name, e.Subscriptions[i].Queue,
+			nats.Bind(e.PubSub.StreamName(), e.Subscriptions[i].Queue))
+		if err != nil {
+			errc <- fmt.Errorf("subscription receive(%s): %w", e.Subscriptions[i].Name, err)
 			return
 		}
 
 		e.Subscriptions[i].sub = sub
-		e.Subscriptions[i].id = i
+		if e.Subscriptions[i].Fair {
+			e.Subscriptions[i].companies = newCompanyQueues(&e.Subscriptions[i], e.PubSub, e.CompanyWeights,
+				e.CompanyMaxShare, func() int { return e.Runtime.rateLimit(e.RateLimit) }, time.Now)
+		}
 	}
 
-	// queue of subscriptions
-	var queueSub *QueueSubscription
-	for i := len(e.Subscriptions) - 1; i >= 0; i-- {
-		push(&queueSub, e.Subscriptions[i])
+	orderKey := func(*nats.Msg) string { return "" }
+	if h, ok := e.Handler.(OrderedHandler); ok {
+		orderKey = func(msg *nats.Msg) string { return h.OrderKey(msg.Data) }
 	}
 
+	// fetched messages are handled to the end on shutdown, so they do not
+	// share the fetch context
+	pool := newWorkerPool(e.Workers, func(msg *nats.Msg) {
+		handler(e.classContext(context.Background(), msg.Subject), msg)
+	})
+	defer func() {
+		pool.close()
+		for i := range e.Subscriptions {
+			e.Subscriptions[i].unsubscribe()
+		}
+	}()
+
+	scheduler := newClassScheduler(e.Subscriptions, e.RateLimit, time.Now)
+	scheduler.runtime = e.Runtime
 	for {
 		select {
 		case <-ctx.Done():
@@ -106,66 +169,175 @@ func (e *PubSubEvent) receive(ctx context.Context, errc chan<- error) {
 		default:
 		}
 
-		for {
-			msgs, err := queueSub.Sub.Fetch(queueSub.BatchSize, nats.MaxWait(queueSub.Timeout))
-			if err == nats.ErrTimeout {
-				break
+		candidates := scheduler.order()
+		if len(candidates) == 0 {
+			// every class is paused or at its rate limit
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pausedWait):
 			}
+			continue
+		}
 
-			for _, msg := range msgs {
-				handler(ctx, msg)
+		for _, cand := range candidates {
+			// only fetch what the workers can take right away, so the next
+			// round is scheduled on what is waiting in the stream
+			slots := pool.acquire(ctx, cand.batch)
+			if slots == 0 {
+				return
 			}
 
-			// continue pull OTP type until timeout
-			if queueSub.ID != 0 {
+			msgs, err := cand.class.sub.fetch(slots)
+			pool.release(slots - len(msgs))
+			if err != nil && !errors.Is(err, nats.ErrTimeout) {
+				log.Errorf("error fetching %s: %v", cand.class.sub.Name, err)
+				metrics.OccurredError(e.Name)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(fetchErrorWait):
+				}
 				break
 			}
 
+			if len(msgs) == 0 {
+				scheduler.empty(cand)
+				continue
+			}
+
+			scheduler.served(cand, len(msgs))
+			for _, msg := range msgs {
+				pool.submit(orderKey(msg), msg)
+			}
+
+			break
 		}
+	}
+}
 
-		queueSub = queueSub.Next
+// handle runs the handler on a message, every run with its own timeout.
+func (e *PubSubEvent) handle(ctx context.Context, msg *nats.Msg) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
 
+	return e.Handler.Handle(ctx, msg.Data)
+}
+
+// waitInProgress waits for another delivery which handles the message. The
+// message is kept in progress meanwhile, so the wait neither redelivers it
+// nor uses up one of its delivery attempts. On shutdown the message is
+// naked and false is returned.
+func (e *PubSubEvent) waitInProgress(stop <-chan struct{}, msg *nats.Msg) bool {
+	_ = msg.InProgress()
+
+	select {
+	case <-stop:
+		_ = msg.NakWithDelay(inProgressWait)
+		return false
+	case <-time.After(inProgressWait):
+		return true
 	}
+}
 
+// classContext returns a context for handling a message of the class of
+// its subject, which ends with the company in a fair class.
+func (e *PubSubEvent) classContext(ctx context.Context, subject string) context.Context {
+	for _, s := range e.Subscriptions {
+		if subject == s.Name || strings.HasPrefix(subject, s.Name+".") {
+			return handler.WithClass(ctx, s.Class)
+		}
+	}
+	return ctx
 }
 
-type QueueSubscription struct {
-	ID        int
-	Timeout   time.Duration
-	BatchSize int
-	Sub       *nats.Subscription
-	Next      *QueueSubscription
+// redeliver naks a message which failed with a recoverable error, delayed
+// by the backoff for its delivery count. The consumer stops redelivering
+// after MaxDeliver attempts, so the last failed attempt is reported.
+//
+// The backoff is applied per nak rather than as the consumer BackOff,
+// which would also replace the AckWait of messages still being handled.
+func (e *PubSubEvent) redeliver(ctx context.Context, msg *nats.Msg, err error) {
+	var numDelivered uint64 = 1
+	if meta, metaErr := msg.Metadata(); metaErr == nil {
+		numDelivered = meta.NumDelivered
+	}
+
+	if e.MaxDeliver > 0 && numDelivered >= uint64(e.MaxDeliver) {
+		e.exhausted(ctx, msg, err)
+		return
+	}
+
+	var delay time.Duration
+	if len(e.Backoff) > 0 {
+		delay = e.Backoff[len(e.Backoff)-1]
+		if int(numDelivered) <= len(e.Backoff) {
+			delay = e.Backoff[numDelivered-1]
+		}
+	}
+
+	metrics.RedeliveredMessage(e.Name)
+	_ = msg.NakWithDelay(delay)
 }
 
+// exhausted reports a message which ran out of delivery attempts, falling
+// back to the dead-letter subject when that is not possible.
+func (e *PubSubEvent) exhausted(ctx context.Context, msg *nats.Msg, err error) {
+	metrics.ExhaustedMessage(e.Name)
+
+	h, ok := e.Handler.(ExhaustedHandler)
+	if ok {
+		hErr := h.HandleExhausted(ctx, msg.Data, err)
+		if hErr == nil {
+			_ = msg.Term()
+			return
+		}
+
+		log.Error(hErr.Error())
+	}
+
+	dlqErr := e.PubSub.PublishDeadLetter(ctx, msg, err)
+	if dlqErr != nil {
+		log.Error(dlqErr.Error())
+		return
+	}
+
+	metrics.DeadLetteredMessage(e.Name)
+	_ = msg.Term()
+}
+
+// Subscription is the pull subscription of a message class.
 type Subscription struct {
 	Name      string
 	Queue     string
+	Class     string
+	Priority  int
+	Weight    int
+	Reserved  float64
+	Fair      bool
 	Timeout   time.Duration
 	BatchSize int
-	id        int
 	sub       *nats.Subscription
+	companies *companyQueues
 }
 
-func push(headRef **QueueSubscription, s Subscription) {
-	ptr1 := &QueueSubscription{
-		ID:        s.id,
-		Timeout:   s.Timeout,
-		BatchSize: s.BatchSize,
-		Sub:       s.sub,
+// unsubscribe removes the pull subscriptions of the class, the durable
+// consumers stay.
+func (s *Subscription) unsubscribe() {
+	if s.companies != nil {
+		s.companies.unsubscribe()
+		return
 	}
-	temp := *headRef
-	ptr1.Next = *headRef
 
-	if *headRef != nil {
-		for temp.Next != *headRef {
-			temp = temp.Next
-		}
+	_ = s.sub.Unsubscribe()
+}
 
-		temp.Next = ptr1
-	} else {
-		ptr1.Next = ptr1
+// fetch fetches up to batch messages of the class, by company for a fair one.
+func (s *Subscription) fetch(batch int) ([]*nats.Msg, error) {
+	if s.companies != nil {
+		return s.companies.fetch(batch)
 	}
 
-	*headRef = ptr1
-
+	return s.sub.Fetch(batch, nats.MaxWait(s.Timeout))
 }
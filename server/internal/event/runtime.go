@@ -0,0 +1,61 @@
+package event
+
+import (
+	"sync"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// Runtime holds the runtime settings of the operator which the fetch loop
+// works with. A nil Runtime keeps the configured settings.
+type Runtime struct {
+	mu       sync.RWMutex
+	settings user.Settings
+}
+
+// ApplySettings implements user.SettingsApplier.
+func (r *Runtime) ApplySettings(settings user.Settings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.settings = settings
+}
+
+// rateLimit returns the rate limit of the operator, configured when unset.
+func (r *Runtime) rateLimit(configured int) int {
+	if r == nil {
+		return configured
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.settings.RateLimit > 0 {
+		return r.settings.RateLimit
+	}
+	return configured
+}
+
+// classRateLimit returns the sms per second fetched of a class, 0 when
+// it is not limited.
+func (r *Runtime) classRateLimit(class string) int {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.settings.ClassRateLimits[class]
+}
+
+func (r *Runtime) paused(class string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.settings.IsPaused(class)
+}
@@ -0,0 +1,238 @@
+package event
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+)
+
+// shareWindow is the period over which the class share metric is computed.
+const shareWindow = 10 * time.Second
+
+// classScheduler decides which class subscription to fetch from next.
+//
+// Each round the classes are tried in this order until one has messages:
+//  1. classes owed their reserved share of the rate limit, most owed first,
+//  2. strict priority classes, highest priority first,
+//  3. weighted classes, least served relative to their weight first.
+//
+// Paused classes, and classes which used up their runtime rate limit, are
+// left out of the round.
+type classScheduler struct {
+	classes []*classState
+	limit   int
+	rate    float64
+	runtime *Runtime
+	now     func() time.Time
+
+	window      time.Time
+	windowTotal int
+}
+
+type classState struct {
+	sub *Subscription
+
+	// virtual is the number of messages served divided by the weight.
+	virtual float64
+	// idle is set when the last fetch returned no messages.
+	idle bool
+
+	// tokens is the reserved throughput owed to the class.
+	tokens   float64
+	refilled time.Time
+
+	windowServed int
+
+	// limit is the runtime rate limit of the class, limitTokens what it may
+	// still fetch under it.
+	limit         float64
+	limitTokens   float64
+	limitRefilled time.Time
+}
+
+// candidate is a class to fetch from, and how many messages to fetch.
+type candidate struct {
+	class *classState
+	batch int
+}
+
+func newClassScheduler(subs []Subscription, rate int, now func() time.Time) *classScheduler {
+	s := &classScheduler{
+		limit:  rate,
+		rate:   float64(rate),
+		now:    now,
+		window: now(),
+	}
+
+	for i := range subs {
+		s.classes = append(s.classes, &classState{
+			sub:           &subs[i],
+			refilled:      s.window,
+			limitRefilled: s.window,
+		})
+	}
+
+	return s
+}
+
+// order returns the classes to try this round.
+func (s *classScheduler) order() []candidate {
+	now := s.now()
+	s.rate = float64(s.runtime.rateLimit(s.limit))
+
+	var reserved, strict, weighted []*classState
+	for _, c := range s.classes {
+		if s.runtime.paused(c.sub.Class) {
+			continue
+		}
+
+		c.refillLimit(now, s.runtime.classRateLimit(c.sub.Class))
+		if c.limit > 0 && c.limitTokens < 1 {
+			continue
+		}
+
+		if c.sub.Reserved > 0 {
+			c.tokens += now.Sub(c.refilled).Seconds() * c.sub.Reserved * s.rate
+			c.tokens = math.Min(c.tokens, float64(c.maxBatch()))
+			c.refilled = now
+
+			if c.tokens >= 1 {
+				reserved = append(reserved, c)
+				continue
+			}
+		}
+
+		if c.sub.Priority > 0 {
+			strict = append(strict, c)
+		} else {
+			weighted = append(weighted, c)
+		}
+	}
+
+	sort.SliceStable(reserved, func(i, j int) bool {
+		return reserved[i].tokens > reserved[j].tokens
+	})
+	sort.SliceStable(strict, func(i, j int) bool {
+		return strict[i].sub.Priority > strict[j].sub.Priority
+	})
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].virtual < weighted[j].virtual
+	})
+
+	candidates := make([]candidate, 0, len(s.classes))
+	for _, c := range reserved {
+		candidates = append(candidates, candidate{class: c, batch: c.limitBatch(int(c.tokens))})
+	}
+
+	for _, c := range append(strict, weighted...) {
+		candidates = append(candidates, candidate{class: c, batch: c.limitBatch(c.maxBatch())})
+	}
+
+	return candidates
+}
+
+// served records that n messages were fetched for a candidate.
+func (s *classScheduler) served(cand candidate, n int) {
+	c := cand.class
+
+	if c.sub.Reserved > 0 {
+		c.tokens = math.Max(0, c.tokens-float64(n))
+	}
+
+	if c.limit > 0 {
+		c.limitTokens = math.Max(0, c.limitTokens-float64(n))
+	}
+
+	if c.sub.Priority == 0 {
+		// a class coming back from idle starts level with the busy ones
+		// instead of catching up on the time it had nothing to send
+		if c.idle {
+			c.virtual = math.Max(c.virtual, s.minVirtual(c))
+		}
+		c.virtual += float64(n) / float64(c.weight())
+	}
+
+	c.idle = false
+	s.record(c, n)
+}
+
+// empty records that a candidate had no messages.
+func (s *classScheduler) empty(cand candidate) {
+	cand.class.idle = true
+}
+
+func (s *classScheduler) minVirtual(except *classState) float64 {
+	min := except.virtual
+	found := false
+	for _, c := range s.classes {
+		if c == except || c.idle || c.sub.Priority > 0 {
+			continue
+		}
+
+		if !found || c.virtual < min {
+			min = c.virtual
+			found = true
+		}
+	}
+
+	return min
+}
+
+func (s *classScheduler) record(c *classState, n int) {
+	metrics.ScheduledMessages(c.sub.Class, n)
+
+	now := s.now()
+	if now.Sub(s.window) >= shareWindow {
+		for _, c := range s.classes {
+			if s.windowTotal > 0 {
+				metrics.SetClassShare(c.sub.Class, float64(c.windowServed)/float64(s.windowTotal))
+			}
+			c.windowServed = 0
+		}
+
+		s.window = now
+		s.windowTotal = 0
+	}
+
+	c.windowServed += n
+	s.windowTotal += n
+}
+
+// refillLimit adds what the class may fetch under its runtime rate limit
+// since the last round, at most a batch.
+func (c *classState) refillLimit(now time.Time, rate int) {
+	c.limit = float64(rate)
+	if c.limit > 0 {
+		c.limitTokens += now.Sub(c.limitRefilled).Seconds() * c.limit
+		c.limitTokens = math.Min(c.limitTokens, math.Max(1, math.Min(c.limit, float64(c.maxBatch()))))
+	}
+	c.limitRefilled = now
+}
+
+// limitBatch caps a batch to what the class may fetch under its runtime
+// rate limit.
+func (c *classState) limitBatch(batch int) int {
+	if c.limit <= 0 {
+		return batch
+	}
+
+	return int(math.Min(float64(batch), c.limitTokens))
+}
+
+func (c *classState) maxBatch() int {
+	if c.sub.BatchSize <= 0 {
+		return 1
+	}
+
+	return c.sub.BatchSize
+}
+
+func (c *classState) weight() int {
+	if c.sub.Weight <= 0 {
+		return 1
+	}
+
+	return c.sub.Weight
+}
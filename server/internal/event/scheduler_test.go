@@ -0,0 +1,149 @@
+package event
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// simulate runs rounds of the scheduler where the busy classes always have
+// messages. Sending takes n/rate seconds, like the smpp rate limiter.
+func simulate(s *classScheduler, clock *fakeClock, rounds int, busy map[string]bool) map[string]int {
+	served := make(map[string]int)
+	for i := 0; i < rounds; i++ {
+		for _, cand := range s.order() {
+			if !busy[cand.class.sub.Class] {
+				s.empty(cand)
+				clock.now = clock.now.Add(10 * time.Millisecond)
+				continue
+			}
+
+			s.served(cand, cand.batch)
+			served[cand.class.sub.Class] += cand.batch
+			clock.now = clock.now.Add(time.Duration(float64(cand.batch) / s.rate * float64(time.Second)))
+			break
+		}
+	}
+
+	return served
+}
+
+func share(served map[string]int, class string) float64 {
+	var total int
+	for _, n := range served {
+		total += n
+	}
+
+	return float64(served[class]) / float64(total)
+}
+
+func TestClassScheduler_StrictPriority(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "default", Weight: 1, BatchSize: 10},
+		{Class: "otp", Priority: 1, BatchSize: 10},
+		{Class: "excel", Weight: 1, BatchSize: 10},
+	}, 10, clock.Now)
+
+	served := simulate(s, clock, 100, map[string]bool{"otp": true, "default": true, "excel": true})
+	if served["otp"] != 1000 {
+		t.Errorf("served %v, want only otp", served)
+	}
+
+	served = simulate(s, clock, 100, map[string]bool{"default": true, "excel": true})
+	if served["otp"] != 0 || served["default"] != 500 || served["excel"] != 500 {
+		t.Errorf("served %v, want default and excel equally", served)
+	}
+}
+
+func TestClassScheduler_Weighted(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "default", Weight: 3, BatchSize: 5},
+		{Class: "excel", Weight: 1, BatchSize: 5},
+	}, 100, clock.Now)
+
+	served := simulate(s, clock, 400, map[string]bool{"default": true, "excel": true})
+	if got := share(served, "excel"); math.Abs(got-0.25) > 0.01 {
+		t.Errorf("excel share = %.3f, want 0.25 (%v)", got, served)
+	}
+}
+
+func TestClassScheduler_Reserved(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "otp", Priority: 1, BatchSize: 10},
+		{Class: "excel", Weight: 1, Reserved: 0.2, BatchSize: 10},
+	}, 100, clock.Now)
+
+	// otp alone would starve excel, the reserved share keeps it going
+	served := simulate(s, clock, 1000, map[string]bool{"otp": true, "excel": true})
+	if got := share(served, "excel"); math.Abs(got-0.2) > 0.02 {
+		t.Errorf("excel share = %.3f, want 0.2 (%v)", got, served)
+	}
+}
+
+func TestClassScheduler_IdleClassDoesNotBurst(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "default", Weight: 1, BatchSize: 10},
+		{Class: "excel", Weight: 1, BatchSize: 10},
+	}, 100, clock.Now)
+
+	simulate(s, clock, 100, map[string]bool{"excel": true})
+
+	// default was idle for 100 rounds and must not get them all back now
+	served := simulate(s, clock, 10, map[string]bool{"default": true, "excel": true})
+	if served["default"] > 60 || served["excel"] < 40 {
+		t.Errorf("served %v after idle, want about equal", served)
+	}
+}
+
+func TestClassScheduler_Paused(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "otp", Priority: 1, BatchSize: 10},
+		{Class: "excel", Weight: 1, BatchSize: 10},
+	}, 100, clock.Now)
+	s.runtime = &Runtime{}
+	s.runtime.ApplySettings(user.Settings{Paused: []string{"excel"}})
+
+	served := simulate(s, clock, 100, map[string]bool{"excel": true})
+	if served["excel"] != 0 {
+		t.Errorf("served %v, want nothing of the paused excel", served)
+	}
+
+	s.runtime.ApplySettings(user.Settings{})
+	served = simulate(s, clock, 10, map[string]bool{"excel": true})
+	if served["excel"] != 100 {
+		t.Errorf("served %v after resume, want excel", served)
+	}
+}
+
+func TestClassScheduler_ClassRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newClassScheduler([]Subscription{
+		{Class: "default", Weight: 1, BatchSize: 10},
+		{Class: "excel", Weight: 1, BatchSize: 10},
+	}, 100, clock.Now)
+	s.runtime = &Runtime{}
+	s.runtime.ApplySettings(user.Settings{ClassRateLimits: map[string]int{"excel": 10}})
+
+	// excel alone would take the whole rate of 100/s
+	start := clock.now
+	served := simulate(s, clock, 1000, map[string]bool{"excel": true})
+	rate := float64(served["excel"]) / clock.now.Sub(start).Seconds()
+	if math.Abs(rate-10) > 1 {
+		t.Errorf("excel rate = %.1f/s, want 10/s (%v)", rate, served)
+	}
+}
@@ -3,12 +3,16 @@ package event
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/opentracing/opentracing-go"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/qosimmax/sms-executor/client/smpp"
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+	"github.com/qosimmax/sms-executor/user"
 )
 
 // SmppEvents contains a slice of SmppEvent.
@@ -19,31 +23,105 @@ type SmppEvent struct {
 	Name    string
 	Rate    time.Duration
 	Handler Handler
+	// ParkBackoff is the delay before each retry of an event which could
+	// not be correlated yet.
+	ParkBackoff []time.Duration
 }
 
 // SubscribeAndListen subscribes to an AppEvent.
 func (e *SmppEvent) SubscribeAndListen(ctx context.Context, c *smpp.Client) {
+	var parked sync.WaitGroup
+	defer parked.Wait()
+
 	events := c.Events(ctx)
 	for {
 		select {
 		case event := <-events:
-			func() {
-				span, ctx := opentracing.StartSpanFromContext(context.Background(), e.Name)
-				defer span.Finish()
-
-				data, _ := json.Marshal(event)
-				err := e.Handler.Handle(ctx, data)
-				if err != nil {
-					log.Errorf("error on smpp event: %v", err)
-				}
-				span.SetTag("event", true)
-				span.LogKV("event", event)
-			}()
+			e.handle(event, &parked)
 
 		case <-ctx.Done():
-			log.Info("done")
+			// flush what was received so far, the correlations of these
+			// responses and receipts are lost otherwise
+			for {
+				select {
+				case event := <-events:
+					e.handle(event, &parked)
+				default:
+					log.Info("done")
+					return
+				}
+			}
+		}
+	}
+
+}
+
+func (e *SmppEvent) handle(event user.SmsEvent, parked *sync.WaitGroup) {
+	data, _ := json.Marshal(event)
+
+	err := e.handleData(event, data)
+	var errUncorrelated user.ErrUncorrelated
+	if errors.As(err, &errUncorrelated) && len(e.ParkBackoff) > 0 {
+		metrics.ParkedReceipt("parked")
+
+		parked.Add(1)
+		go func() {
+			defer parked.Done()
+			e.park(event, data)
+		}()
+
+		return
+	}
+
+	if err != nil {
+		log.Errorf("error on smpp event: %v", err)
+	}
+}
+
+// park retries an event which arrived before its correlation was written,
+// and reports it as an orphan when it is still not correlated at the end.
+func (e *SmppEvent) park(event user.SmsEvent, data []byte) {
+	var errUncorrelated user.ErrUncorrelated
+
+	for _, delay := range e.ParkBackoff {
+		time.Sleep(delay)
+
+		err := e.handleData(event, data)
+		if err == nil {
+			metrics.ParkedReceipt("matched")
+			return
+		}
+
+		if !errors.As(err, &errUncorrelated) {
+			log.Errorf("error on parked smpp event: %v", err)
 			return
 		}
 	}
 
+	metrics.ParkedReceipt("orphaned")
+	log.Warnf("orphan smpp event: %+v", event)
+
+	h, ok := e.Handler.(OrphanHandler)
+	if !ok {
+		return
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), e.Name)
+	defer span.Finish()
+
+	err := h.HandleOrphan(ctx, data)
+	if err != nil {
+		log.Errorf("error on orphan smpp event: %v", err)
+	}
+}
+
+func (e *SmppEvent) handleData(event user.SmsEvent, data []byte) error {
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), e.Name)
+	defer span.Finish()
+
+	err := e.Handler.Handle(ctx, data)
+	span.SetTag("event", true)
+	span.LogKV("event", event)
+
+	return err
 }
@@ -0,0 +1,42 @@
+package event
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/client/pubsub"
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+)
+
+// StreamEvents contains a slice of StreamEvent.
+type StreamEvents []StreamEvent
+
+// StreamEvent hands the sms events to the handler as they are published.
+// Nothing is acknowledged or delivered again, an event published while the
+// executor is down is not streamed.
+type StreamEvent struct {
+	Name    string
+	Handler Handler
+}
+
+// SubscribeAndListen subscribes to the sms events until ctx is done.
+func (e *StreamEvent) SubscribeAndListen(ctx context.Context, ps *pubsub.Client, errc chan<- error) {
+	sub, err := ps.SubscribeLiveSmsEvents(func(msg *nats.Msg) {
+		metrics.ReceivedMessage(e.Name, float64(1))
+
+		if err := e.Handler.Handle(ctx, msg.Data); err != nil {
+			log.Error(err.Error())
+			metrics.OccurredError(e.Name)
+		}
+	})
+	if err != nil {
+		errc <- fmt.Errorf("subscription receive(%s): %w", e.Name, err)
+		return
+	}
+
+	<-ctx.Done()
+	_ = sub.Unsubscribe()
+}
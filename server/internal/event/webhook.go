@@ -0,0 +1,135 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/client/pubsub"
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	// webhookFetchBatch is the most events fetched at once.
+	webhookFetchBatch = 100
+
+	// webhookRetryDelay is the delay before an event whose webhook could
+	// not be looked up is delivered again.
+	webhookRetryDelay = 5 * time.Second
+)
+
+// WebhookEvents contains a slice of WebhookEvent.
+type WebhookEvents []WebhookEvent
+
+// WebhookEvent hands the sms events to the handler through a durable
+// consumer, MaxPending at a time. The handler may take long retrying a
+// webhook, so every event is handled on its own and kept in progress.
+type WebhookEvent struct {
+	Name       string
+	Durable    string
+	MaxPending int
+	AckWait    time.Duration
+	Handler    Handler
+}
+
+// SubscribeAndListen subscribes to the sms events. It stops fetching when
+// ctx is done, and returns once the events in flight gave up.
+func (e *WebhookEvent) SubscribeAndListen(ctx context.Context, ps *pubsub.Client, errc chan<- error) {
+	sub, err := ps.SubscribeSmsEvents(e.Durable, e.MaxPending, e.AckWait)
+	if err != nil {
+		errc <- fmt.Errorf("subscription receive(%s): %w", e.Name, err)
+		return
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	slots := make(chan struct{}, e.MaxPending)
+	var handling sync.WaitGroup
+	defer handling.Wait()
+
+	for {
+		// wait for one free slot, and take what else is free
+		select {
+		case <-ctx.Done():
+			return
+		case slots <- struct{}{}:
+		}
+
+		n := 1
+	fill:
+		for n < webhookFetchBatch {
+			select {
+			case slots <- struct{}{}:
+				n++
+			default:
+				break fill
+			}
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Second)
+		msgs, err := sub.Fetch(n, nats.Context(fetchCtx))
+		cancel()
+		if err != nil && ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, nats.ErrTimeout) {
+			log.Errorf("webhook event %s: %v", e.Name, err)
+		}
+
+		for i := len(msgs); i < n; i++ {
+			<-slots
+		}
+
+		for _, msg := range msgs {
+			handling.Add(1)
+			go func(msg *nats.Msg) {
+				defer handling.Done()
+				defer func() { <-slots }()
+				e.handle(ctx, msg)
+			}(msg)
+		}
+	}
+}
+
+func (e *WebhookEvent) handle(ctx context.Context, msg *nats.Msg) {
+	metrics.ReceivedMessage(e.Name, float64(1))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(e.AckWait / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = msg.InProgress()
+			}
+		}
+	}()
+
+	err := e.Handler.Handle(ctx, msg.Data)
+
+	var errNonRecoverable user.ErrNonRecoverable
+	switch {
+	case err == nil:
+	case errors.As(err, &errNonRecoverable):
+		log.Error(err.Error())
+		metrics.OccurredError(e.Name)
+	case ctx.Err() != nil:
+		// stopped, another executor takes the event over
+		_ = msg.Nak()
+		return
+	default:
+		log.Error(err.Error())
+		metrics.OccurredError(e.Name)
+		metrics.RedeliveredMessage(e.Name)
+		_ = msg.NakWithDelay(webhookRetryDelay)
+		return
+	}
+
+	_ = msg.Ack()
+}
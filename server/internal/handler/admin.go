@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// settingsRetries is how often a settings change is retried on the latest
+// settings when another change won the race.
+const settingsRetries = 3
+
+// Admin serves the runtime administration of the executors: their smpp
+// binds, the rate limits and paused classes, and the consumer lag. Every
+// change is written to the audit log.
+type Admin struct {
+	Settings  user.SettingsReaderWriter
+	Binds     user.BindController
+	Consumers user.ConsumerMonitor
+	// Operator is the operator of a request which does not name one.
+	Operator string
+	Classes  []string
+}
+
+type rateLimitRequest struct {
+	Operator string `json:"operator"`
+	// Class is the class to limit, the operator when empty.
+	Class string `json:"class"`
+	// RateLimit is the sms per second, 0 removes the runtime limit.
+	RateLimit int `json:"rate_limit"`
+}
+
+type classRequest struct {
+	Operator string `json:"operator"`
+	Class    string `json:"class"`
+}
+
+type rebindRequest struct {
+	Operator string `json:"operator"`
+	Instance string `json:"instance"`
+}
+
+// ListBinds handles GET /v1/admin/binds.
+func (h *Admin) ListBinds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	binds, err := h.Binds.Binds(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, binds)
+}
+
+// Rebind handles POST /v1/admin/binds/rebind, which rebinds the smpp
+// sessions of an operator, or of one instance of it.
+func (h *Admin) Rebind(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req rebindRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+	if req.Operator == "" {
+		req.Operator = h.Operator
+	}
+
+	binds, err := h.Binds.Rebind(r.Context(), req.Operator, req.Instance)
+	audit(r.Context(), "rebind", log.Fields{"operator": req.Operator, "instance": req.Instance}, err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(binds) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no executor of operator %s answered", req.Operator))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, binds)
+}
+
+// GetSettings handles GET /v1/admin/settings?operator=.
+func (h *Admin) GetSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	operator := r.URL.Query().Get("operator")
+	if operator == "" {
+		operator = h.Operator
+	}
+
+	settings, _, err := h.Settings.ReadSettings(r.Context(), operator)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// SetRateLimit handles POST /v1/admin/ratelimit, which changes the rate
+// limit of an operator or of one of its classes.
+func (h *Admin) SetRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req rateLimitRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	if req.RateLimit < 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, invalidResponse{Error: "rate_limit must not be negative", Field: "rate_limit"})
+		return
+	}
+	if req.Class != "" && !h.knownClass(req.Class) {
+		writeJSON(w, http.StatusUnprocessableEntity, invalidResponse{Error: fmt.Sprintf("unknown class %q", req.Class), Field: "class"})
+		return
+	}
+
+	h.update(w, r, req.Operator, "set rate limit", log.Fields{"class": req.Class, "rate_limit": req.RateLimit},
+		func(settings *user.Settings) {
+			if req.Class == "" {
+				settings.RateLimit = req.RateLimit
+				return
+			}
+
+			if settings.ClassRateLimits == nil {
+				settings.ClassRateLimits = make(map[string]int)
+			}
+			settings.ClassRateLimits[req.Class] = req.RateLimit
+			if req.RateLimit == 0 {
+				delete(settings.ClassRateLimits, req.Class)
+			}
+		})
+}
+
+// PauseClass handles POST /v1/admin/classes/pause, which stops fetching a
+// class until it is resumed.
+func (h *Admin) PauseClass(w http.ResponseWriter, r *http.Request) {
+	h.setPaused(w, r, true)
+}
+
+// ResumeClass handles POST /v1/admin/classes/resume.
+func (h *Admin) ResumeClass(w http.ResponseWriter, r *http.Request) {
+	h.setPaused(w, r, false)
+}
+
+func (h *Admin) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req classRequest
+	if !h.decode(w, r, &req) {
+		return
+	}
+
+	if !h.knownClass(req.Class) {
+		writeJSON(w, http.StatusUnprocessableEntity, invalidResponse{Error: fmt.Sprintf("unknown class %q", req.Class), Field: "class"})
+		return
+	}
+
+	action := "resume class"
+	if paused {
+		action = "pause class"
+	}
+
+	h.update(w, r, req.Operator, action, log.Fields{"class": req.Class}, func(settings *user.Settings) {
+		var classes []string
+		for _, class := range settings.Paused {
+			if class != req.Class {
+				classes = append(classes, class)
+			}
+		}
+		if paused {
+			classes = append(classes, req.Class)
+		}
+		settings.Paused = classes
+	})
+}
+
+// ListConsumers handles GET /v1/admin/consumers, the lag and pending acks
+// of the consumers of the sms stream.
+func (h *Admin) ListConsumers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	consumers, err := h.Consumers.ListConsumers(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, consumers)
+}
+
+// update changes the settings of an operator, retrying on the latest ones
+// when they changed in between, and responds with the new settings.
+func (h *Admin) update(w http.ResponseWriter, r *http.Request, operator, action string, fields log.Fields,
+	change func(*user.Settings)) {
+	if operator == "" {
+		operator = h.Operator
+	}
+	fields["operator"] = operator
+
+	var err error
+	for i := 0; i < settingsRetries; i++ {
+		var settings user.Settings
+		var revision uint64
+		settings, revision, err = h.Settings.ReadSettings(r.Context(), operator)
+		if err != nil {
+			break
+		}
+
+		change(&settings)
+		settings.Operator = operator
+		settings.UpdatedAt = time.Now().UTC()
+		settings.UpdatedBy = actorOf(r.Context())
+
+		err = h.Settings.WriteSettings(r.Context(), settings, revision)
+		var errConflict user.ErrConflict
+		if errors.As(err, &errConflict) {
+			continue
+		}
+
+		audit(r.Context(), action, fields, err)
+		if err != nil {
+			break
+		}
+
+		writeJSON(w, http.StatusOK, settings)
+		return
+	}
+
+	var errConflict user.ErrConflict
+	if errors.As(err, &errConflict) {
+		audit(r.Context(), action, fields, err)
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func (h *Admin) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return false
+	}
+	return true
+}
+
+func (h *Admin) knownClass(class string) bool {
+	for _, name := range h.Classes {
+		if name == class {
+			return true
+		}
+	}
+	return false
+}
+
+// actorOf names the api key of a request, anonymous without auth.
+func actorOf(ctx context.Context) string {
+	key, ok := ctx.Value(apiKeyContext{}).(user.APIKey)
+	if !ok {
+		return "anonymous"
+	}
+	return key.ID
+}
+
+// audit writes an admin action and its outcome to the audit log.
+func audit(ctx context.Context, action string, fields log.Fields, err error) {
+	entry := log.WithFields(fields).WithFields(log.Fields{
+		"audit":  true,
+		"action": action,
+		"actor":  actorOf(ctx),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("admin action failed")
+		return
+	}
+	entry.Info("admin action")
+}
+
+// Settings applies the runtime settings of the operator as they change.
+type Settings struct {
+	Appliers []user.SettingsApplier
+}
+
+// Handle applies the settings to every applier.
+func (h *Settings) Handle(ctx context.Context, data []byte) error {
+	var settings user.Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return user.ErrNonRecoverable{Err: fmt.Errorf("error unmarshalling settings: %w", err)}
+	}
+
+	for _, applier := range h.Appliers {
+		applier.ApplySettings(settings)
+	}
+
+	log.WithFields(log.Fields{
+		"operator":          settings.Operator,
+		"rate_limit":        settings.RateLimit,
+		"class_rate_limits": settings.ClassRateLimits,
+		"paused":            settings.Paused,
+		"updated_by":        settings.UpdatedBy,
+	}).Info("runtime settings applied")
+
+	return nil
+}
+
+// BindStatus answers with the smpp session of the executor.
+type BindStatus struct {
+	Binder user.Binder
+}
+
+// Respond returns the bind.
+func (h *BindStatus) Respond(ctx context.Context, data []byte) ([]byte, error) {
+	return json.Marshal(h.Binder.Bind())
+}
+
+// Rebind rebinds the smpp session of the executor when it is asked to.
+type Rebind struct {
+	Binder user.Binder
+}
+
+// Respond rebinds and returns the new bind, or nothing when another
+// instance is asked to rebind.
+func (h *Rebind) Respond(ctx context.Context, data []byte) ([]byte, error) {
+	var req user.RebindRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return nil, fmt.Errorf("error unmarshalling rebind request: %w", err)
+		}
+	}
+
+	bind := h.Binder.Bind()
+	if req.Instance != "" && req.Instance != bind.Instance {
+		return nil, nil
+	}
+
+	if err := h.Binder.Rebind(); err != nil {
+		// the bind tells what went wrong
+		log.Error(err.Error())
+	}
+
+	return json.Marshal(h.Binder.Bind())
+}
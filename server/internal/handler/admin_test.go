@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// settingsStore keeps the settings of the operators in memory, and lets
+// the next conflicts writes lose against another admin.
+type settingsStore struct {
+	settings  map[string]user.Settings
+	revisions map[string]uint64
+	conflicts int
+}
+
+func newSettingsStore() *settingsStore {
+	return &settingsStore{settings: make(map[string]user.Settings), revisions: make(map[string]uint64)}
+}
+
+func (s *settingsStore) ReadSettings(ctx context.Context, operator string) (user.Settings, uint64, error) {
+	settings, ok := s.settings[operator]
+	if !ok {
+		settings = user.Settings{Operator: operator}
+	}
+	return settings, s.revisions[operator], nil
+}
+
+func (s *settingsStore) WriteSettings(ctx context.Context, settings user.Settings, revision uint64) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		s.revisions[settings.Operator]++
+		return user.ErrConflict{Err: fmt.Errorf("settings changed")}
+	}
+
+	if revision != s.revisions[settings.Operator] {
+		return user.ErrConflict{Err: fmt.Errorf("settings changed")}
+	}
+
+	s.settings[settings.Operator] = settings
+	s.revisions[settings.Operator]++
+	return nil
+}
+
+// binder is a smpp session which counts its rebinds.
+type binder struct {
+	bind user.Bind
+}
+
+func (b *binder) Bind() user.Bind {
+	return b.bind
+}
+
+func (b *binder) Rebind() error {
+	b.bind.Rebinds++
+	return nil
+}
+
+func newAdmin(store *settingsStore) *Admin {
+	return &Admin{
+		Settings: store,
+		Operator: "beeline",
+		Classes:  []string{"otp", "default", "excel"},
+	}
+}
+
+func TestAdmin_SetRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		status    int
+		rate      int
+		classRate map[string]int
+	}{
+		{"operator", `{"rate_limit":50}`, http.StatusOK, 50, nil},
+		{"class", `{"class":"excel","rate_limit":5}`, http.StatusOK, 0, map[string]int{"excel": 5}},
+		{"negative", `{"rate_limit":-1}`, http.StatusUnprocessableEntity, 0, nil},
+		{"unknown class", `{"class":"sms","rate_limit":5}`, http.StatusUnprocessableEntity, 0, nil},
+		{"malformed", `{"rate_limit":`, http.StatusBadRequest, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newSettingsStore()
+			w := post(newAdmin(store).SetRateLimit, "/v1/admin/ratelimit", tt.body)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			settings := store.settings["beeline"]
+			if settings.RateLimit != tt.rate || len(settings.ClassRateLimits) != len(tt.classRate) {
+				t.Errorf("settings = %+v", settings)
+			}
+			for class, rate := range tt.classRate {
+				if settings.ClassRateLimits[class] != rate {
+					t.Errorf("rate limit of %s = %d, want %d", class, settings.ClassRateLimits[class], rate)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmin_PauseClass(t *testing.T) {
+	store := newSettingsStore()
+	admin := newAdmin(store)
+
+	for _, class := range []string{"excel", "default", "excel"} {
+		if w := post(admin.PauseClass, "/v1/admin/classes/pause", `{"class":"`+class+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("pause %s: status = %d: %s", class, w.Code, w.Body)
+		}
+	}
+	if paused := store.settings["beeline"].Paused; len(paused) != 2 {
+		t.Errorf("paused = %v, want default and excel once", paused)
+	}
+
+	w := post(admin.ResumeClass, "/v1/admin/classes/resume", `{"class":"excel"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resume: status = %d: %s", w.Code, w.Body)
+	}
+
+	var settings user.Settings
+	if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if settings.IsPaused("excel") || !settings.IsPaused("default") || settings.UpdatedBy != "anonymous" {
+		t.Errorf("settings = %+v, want only default paused", settings)
+	}
+
+	if w := post(admin.PauseClass, "/v1/admin/classes/pause", `{"class":"sms"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("pause unknown class: status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestAdmin_Conflict(t *testing.T) {
+	store := newSettingsStore()
+	store.conflicts = settingsRetries - 1
+
+	if w := post(newAdmin(store).SetRateLimit, "/v1/admin/ratelimit", `{"rate_limit":50}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d after retries: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	store.conflicts = settingsRetries
+	if w := post(newAdmin(store).SetRateLimit, "/v1/admin/ratelimit", `{"rate_limit":60}`); w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	if rate := store.settings["beeline"].RateLimit; rate != 50 {
+		t.Errorf("rate limit = %d, want 50", rate)
+	}
+}
+
+func TestAdmin_Settings(t *testing.T) {
+	settings := &Settings{Appliers: []user.SettingsApplier{&recordingApplier{}, &recordingApplier{}}}
+
+	if err := settings.Handle(context.Background(), []byte(`{"operator":"beeline","rate_limit":5}`)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	for _, applier := range settings.Appliers {
+		if got := applier.(*recordingApplier).settings; got.RateLimit != 5 {
+			t.Errorf("applied %+v, want rate limit 5", got)
+		}
+	}
+
+	if err := settings.Handle(context.Background(), []byte(`{`)); err == nil {
+		t.Errorf("malformed settings handled")
+	}
+}
+
+type recordingApplier struct {
+	settings user.Settings
+}
+
+func (a *recordingApplier) ApplySettings(settings user.Settings) {
+	a.settings = settings
+}
+
+func TestRebind(t *testing.T) {
+	b := &binder{bind: user.Bind{Instance: "executor-1", State: user.BindBound}}
+	h := &Rebind{Binder: b}
+
+	data, err := h.Respond(context.Background(), []byte(`{"instance":"executor-2"}`))
+	if err != nil || data != nil || b.bind.Rebinds != 0 {
+		t.Errorf("rebind of another instance answered %s, %v", data, err)
+	}
+
+	for _, req := range []string{`{"instance":"executor-1"}`, ``} {
+		data, err = h.Respond(context.Background(), []byte(req))
+		if err != nil {
+			t.Fatalf("rebind %q: %v", req, err)
+		}
+
+		var bind user.Bind
+		if err := json.Unmarshal(data, &bind); err != nil {
+			t.Fatalf("decode bind: %v", err)
+		}
+		if bind.Instance != "executor-1" {
+			t.Errorf("rebind %q answered %+v", req, bind)
+		}
+	}
+
+	if b.bind.Rebinds != 2 {
+		t.Errorf("rebinds = %d, want 2", b.bind.Rebinds)
+	}
+}
+
+func TestAdmin_Methods(t *testing.T) {
+	admin := newAdmin(newSettingsStore())
+
+	for path, handle := range map[string]http.HandlerFunc{
+		"/v1/admin/binds":          admin.ListBinds,
+		"/v1/admin/binds/rebind":   admin.Rebind,
+		"/v1/admin/ratelimit":      admin.SetRateLimit,
+		"/v1/admin/classes/pause":  admin.PauseClass,
+		"/v1/admin/classes/resume": admin.ResumeClass,
+	} {
+		method := http.MethodPut
+		w := httptest.NewRecorder()
+		handle(w, httptest.NewRequest(method, path, strings.NewReader(`{}`)))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status = %d, want %d", method, path, w.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
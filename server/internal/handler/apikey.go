@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// APIKeys serves the management of api keys.
+type APIKeys struct {
+	Store user.APIKeyReaderWriter
+}
+
+type apiKeyRequest struct {
+	CompanyID string   `json:"company_id"`
+	Senders   []string `json:"senders"`
+	Classes   []string `json:"classes"`
+	Admin     bool     `json:"admin"`
+}
+
+// apiKeyResponse is a created key with its token, which is not stored.
+type apiKeyResponse struct {
+	user.APIKey
+	Token string `json:"token"`
+}
+
+// Create handles POST /v1/admin/keys.
+func (h *APIKeys) Create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+
+	if req.CompanyID == "" && !req.Admin {
+		writeJSON(w, http.StatusUnprocessableEntity, invalidResponse{Error: "company_id is required", Field: "company_id"})
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	key := user.APIKey{
+		ID:        user.APIKeyID(token),
+		CompanyID: req.CompanyID,
+		Senders:   req.Senders,
+		Classes:   req.Classes,
+		Admin:     req.Admin,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := h.Store.WriteAPIKey(r.Context(), key); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, apiKeyResponse{APIKey: key, Token: token})
+}
+
+// List handles GET /v1/admin/keys.
+func (h *APIKeys) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	keys, err := h.Store.ListAPIKeys(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if keys == nil {
+		keys = []user.APIKey{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// Delete handles DELETE /v1/admin/keys/{id}.
+func (h *APIKeys) Delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/admin/keys/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	if err := h.Store.DeleteAPIKey(r.Context(), id); err != nil {
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sk_" + hex.EncodeToString(b), nil
+}
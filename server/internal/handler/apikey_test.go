@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+func TestAPIKeys(t *testing.T) {
+	store := apiKeyStore{}
+	h := &APIKeys{Store: store}
+
+	w := httptest.NewRecorder()
+	h.Create(w, httptest.NewRequest(http.MethodPost, "/v1/admin/keys",
+		strings.NewReader(`{"company_id":"company-1","senders":["Bank"],"classes":["otp"]}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	var created apiKeyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	// only the hash of the token is stored
+	key, ok := store[user.APIKeyID(created.Token)]
+	if !ok || key.ID != created.ID || key.CompanyID != "company-1" || !key.AllowsSender("Bank") || key.AllowsClass("default") {
+		t.Fatalf("stored %+v, want the key of token %s", store, created.Token)
+	}
+
+	w = httptest.NewRecorder()
+	h.Create(w, httptest.NewRequest(http.MethodPost, "/v1/admin/keys", strings.NewReader(`{"senders":["Bank"]}`)))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("create without company status = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	w = httptest.NewRecorder()
+	h.List(w, httptest.NewRequest(http.MethodGet, "/v1/admin/keys", nil))
+	var listed []user.APIKey
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 {
+		t.Fatalf("listed %s, want one key", w.Body)
+	}
+	if strings.Contains(w.Body.String(), created.Token) {
+		t.Errorf("list shows the token")
+	}
+
+	w = httptest.NewRecorder()
+	h.Delete(w, httptest.NewRequest(http.MethodDelete, "/v1/admin/keys/"+created.ID, nil))
+	if w.Code != http.StatusNoContent || len(store) != 0 {
+		t.Errorf("delete status = %d, %d keys left", w.Code, len(store))
+	}
+
+	w = httptest.NewRecorder()
+	h.Delete(w, httptest.NewRequest(http.MethodDelete, "/v1/admin/keys/"+created.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("delete unknown status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
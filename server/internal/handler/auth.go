@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+type apiKeyContext struct{}
+
+// Auth authenticates requests by the api key in "Authorization: Bearer
+// <token>" or "X-API-Key: <token>".
+type Auth struct {
+	Keys user.APIKeyReader
+	// AdminTokens are admin tokens kept outside the store.
+	AdminTokens []string
+	// Disabled lets the company requests through unrestricted, the admin
+	// ones still need an admin key.
+	Disabled bool
+}
+
+// Company lets through the requests with any key, handlers restrict a
+// company key to the sms of its company.
+func (a *Auth) Company(next http.HandlerFunc) http.HandlerFunc {
+	return a.authenticate(false, next)
+}
+
+// Admin lets through the requests with an admin key, even with
+// authentication disabled.
+func (a *Auth) Admin(next http.HandlerFunc) http.HandlerFunc {
+	return a.authenticate(true, next)
+}
+
+func (a *Auth) authenticate(admin bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Disabled && !admin {
+			next(w, r)
+			return
+		}
+
+		token := tokenOf(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("api key required"))
+			return
+		}
+
+		key, err := a.lookup(r.Context(), token)
+		if err != nil {
+			var errNotFound user.ErrNotFound
+			if errors.As(err, &errNotFound) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid api key"))
+				return
+			}
+
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if admin && !key.Admin {
+			writeError(w, http.StatusForbidden, fmt.Errorf("admin api key required"))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	}
+}
+
+func (a *Auth) lookup(ctx context.Context, token string) (user.APIKey, error) {
+	id := user.APIKeyID(token)
+	for _, adminToken := range a.AdminTokens {
+		if user.APIKeyID(adminToken) == id {
+			return user.APIKey{ID: id, Admin: true}, nil
+		}
+	}
+
+	if a.Keys == nil {
+		return user.APIKey{}, user.ErrNotFound{Err: fmt.Errorf("no api key store")}
+	}
+
+	return a.Keys.ReadAPIKey(ctx, id)
+}
+
+func tokenOf(r *http.Request) string {
+	if token := r.Header.Get("X-API-Key"); token != "" {
+		return token
+	}
+
+	return bearerToken(r.Header.Get("Authorization"))
+}
+
+// bearerToken returns the token of a "Bearer <token>" authorization.
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// companyKey returns the key of a request restricted to one company, that
+// is any key but an admin one, with authentication disabled there is none.
+func companyKey(ctx context.Context) (user.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContext{}).(user.APIKey)
+	if !ok || key.Admin {
+		return user.APIKey{}, false
+	}
+	return key, true
+}
+
+// requestCompany returns the company of a company key, or the one of the
+// company_id query parameter for an admin, writing the error when there is
+// none.
+func requestCompany(w http.ResponseWriter, r *http.Request) (string, bool) {
+	companyID := r.URL.Query().Get("company_id")
+	if key, ok := companyKey(r.Context()); ok {
+		if companyID != "" && companyID != key.CompanyID {
+			writeError(w, http.StatusForbidden, fmt.Errorf("company_id is not the company of the api key"))
+			return "", false
+		}
+		return key.CompanyID, true
+	}
+
+	if companyID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("company_id is required"))
+		return "", false
+	}
+	return companyID, true
+}
+
+// UnaryInterceptor authenticates the gRPC calls like Company, by the api key
+// in the "authorization" or "x-api-key" metadata.
+func (a *Auth) UnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticateRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor authenticates the gRPC streams like UnaryInterceptor.
+func (a *Auth) StreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticateRPC(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+func (a *Auth) authenticateRPC(ctx context.Context) (context.Context, error) {
+	if a.Disabled {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := ""
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		token = values[0]
+	} else if values := md.Get("authorization"); len(values) > 0 {
+		token = bearerToken(values[0])
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "api key required")
+	}
+
+	key, err := a.lookup(ctx, token)
+	if err != nil {
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "invalid api key")
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return context.WithValue(ctx, apiKeyContext{}, key), nil
+}
+
+// authenticatedStream carries the api key in the context of a stream.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
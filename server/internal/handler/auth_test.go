@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// apiKeyStore keeps api keys in memory.
+type apiKeyStore map[string]user.APIKey
+
+func (s apiKeyStore) ReadAPIKey(ctx context.Context, id string) (user.APIKey, error) {
+	key, ok := s[id]
+	if !ok {
+		return user.APIKey{}, user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+	}
+	return key, nil
+}
+
+func (s apiKeyStore) ListAPIKeys(ctx context.Context) ([]user.APIKey, error) {
+	var keys []user.APIKey
+	for _, key := range s {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s apiKeyStore) WriteAPIKey(ctx context.Context, key user.APIKey) error {
+	s[key.ID] = key
+	return nil
+}
+
+func (s apiKeyStore) DeleteAPIKey(ctx context.Context, id string) error {
+	if _, ok := s[id]; !ok {
+		return user.ErrNotFound{Err: fmt.Errorf("no api key %s", id)}
+	}
+	delete(s, id)
+	return nil
+}
+
+func newAuth() *Auth {
+	return &Auth{
+		Keys: apiKeyStore{
+			user.APIKeyID("company-token"): {
+				ID:        user.APIKeyID("company-token"),
+				CompanyID: "company-1",
+				Senders:   []string{"Bank"},
+				Classes:   []string{"otp"},
+			},
+			user.APIKeyID("stored-admin-token"): {ID: user.APIKeyID("stored-admin-token"), Admin: true},
+		},
+		AdminTokens: []string{"admin-token"},
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name   string
+		auth   *Auth
+		admin  bool
+		header string
+		token  string
+		status int
+	}{
+		{"disabled", &Auth{Disabled: true}, false, "", "", http.StatusNoContent},
+		{"disabled admin", &Auth{Disabled: true}, true, "", "", http.StatusUnauthorized},
+		{"disabled configured admin", &Auth{Disabled: true, AdminTokens: []string{"admin-token"}}, true, "X-API-Key", "admin-token", http.StatusNoContent},
+		{"missing", newAuth(), false, "", "", http.StatusUnauthorized},
+		{"unknown", newAuth(), false, "X-API-Key", "other-token", http.StatusUnauthorized},
+		{"company", newAuth(), false, "X-API-Key", "company-token", http.StatusNoContent},
+		{"company bearer", newAuth(), false, "Authorization", "Bearer company-token", http.StatusNoContent},
+		{"company basic", newAuth(), false, "Authorization", "Basic company-token", http.StatusUnauthorized},
+		{"company on admin", newAuth(), true, "X-API-Key", "company-token", http.StatusForbidden},
+		{"configured admin", newAuth(), true, "Authorization", "Bearer admin-token", http.StatusNoContent},
+		{"stored admin", newAuth(), true, "X-API-Key", "stored-admin-token", http.StatusNoContent},
+		{"admin on company", newAuth(), false, "X-API-Key", "admin-token", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle := tt.auth.Company(ok)
+			if tt.admin {
+				handle = tt.auth.Admin(ok)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/sms", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			handle(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuth_Submit(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		body    string
+		status  int
+		field   string
+		company string
+	}{
+		{"company filled in", "company-token", `{"recipient":"998901234567","nick_name":"Bank","message":"hello","class":"otp"}`, http.StatusAccepted, "", "company-1"},
+		{"other company", "company-token", `{"recipient":"998901234567","nick_name":"Bank","message":"hello","class":"otp","company_id":"company-2"}`, http.StatusForbidden, "company_id", ""},
+		{"other sender", "company-token", `{"recipient":"998901234567","nick_name":"Shop","message":"hello","class":"otp"}`, http.StatusForbidden, "nick_name", ""},
+		{"other class", "company-token", `{"recipient":"998901234567","nick_name":"Bank","message":"hello"}`, http.StatusForbidden, "class", ""},
+		{"admin any company", "admin-token", `{"recipient":"998901234567","nick_name":"Shop","message":"hello","company_id":"company-2"}`, http.StatusAccepted, "", "company-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &smsQueue{}
+			r := httptest.NewRequest(http.MethodPost, "/v1/sms", strings.NewReader(tt.body))
+			r.Header.Set("X-API-Key", tt.token)
+
+			w := httptest.NewRecorder()
+			newAuth().Company(newSubmit(queue).Send)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			if tt.status != http.StatusAccepted {
+				var res invalidResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				if res.Field != tt.field || len(queue.queued) != 0 {
+					t.Errorf("field = %q, queued %d, want %q and none", res.Field, len(queue.queued), tt.field)
+				}
+				return
+			}
+
+			if len(queue.queued) != 1 || queue.queued[0].CompanyID != tt.company {
+				t.Errorf("queued %+v, want one sms of %s", queue.queued, tt.company)
+			}
+		})
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		queue := &smsQueue{}
+		body := `{"messages":[` +
+			`{"recipient":"998901234567","nick_name":"Bank","message":"hello","class":"otp"},` +
+			`{"recipient":"998901234567","nick_name":"Shop","message":"hello","class":"otp"}]}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/sms/batch", strings.NewReader(body))
+		r.Header.Set("X-API-Key", "company-token")
+
+		w := httptest.NewRecorder()
+		newAuth().Company(newSubmit(queue).SendBatch)(w, r)
+
+		if w.Code != http.StatusForbidden || len(queue.queued) != 0 {
+			t.Errorf("status = %d, queued %d, want %d and none: %s", w.Code, len(queue.queued), http.StatusForbidden, w.Body)
+		}
+	})
+}
+
+func TestAuth_History(t *testing.T) {
+	store := &historyStore{history: user.SmsHistory{SmsID: "sms-1", CompanyID: "company-2"}}
+	h := &History{Store: store}
+
+	tests := []struct {
+		name    string
+		target  string
+		handle  http.HandlerFunc
+		status  int
+		company string
+	}{
+		{"get other company", "/v1/sms/sms-1", h.Get, http.StatusNotFound, ""},
+		{"get other company by id", "/v1/sms/sms-1?company_id=company-2", h.Get, http.StatusForbidden, ""},
+		{"list own company", "/v1/sms?recipient=998901234567", h.List, http.StatusOK, "company-1"},
+		{"list other company", "/v1/sms?company_id=company-2", h.List, http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.query = user.HistoryQuery{}
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set("X-API-Key", "company-token")
+
+			w := httptest.NewRecorder()
+			newAuth().Company(tt.handle)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if store.query.CompanyID != tt.company {
+				t.Errorf("queried company %q, want %q", store.query.CompanyID, tt.company)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	defaultDeadLetterLimit = 100
+	// maxDeadLetterLimit bounds a listing, every dead letter is a lookup.
+	maxDeadLetterLimit = 1000
+)
+
+// DeadLetter serves inspection and replay of dead-lettered messages.
+type DeadLetter struct {
+	Queue user.DeadLetterQueue
+}
+
+// List handles GET /v1/dlq?subject=&from=&limit=.
+func (h *DeadLetter) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+
+	var from uint64
+	if v := query.Get("from"); v != "" {
+		var err error
+		from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+			return
+		}
+	}
+
+	limit := defaultDeadLetterLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxDeadLetterLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s, must be 1 to %d", v, maxDeadLetterLimit))
+			return
+		}
+	}
+
+	deadLetters, err := h.Queue.DeadLetters(r.Context(), query.Get("subject"), from, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deadLetters)
+}
+
+// Replay handles POST /v1/dlq/replay?sequence=.
+func (h *DeadLetter) Replay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	sequence, err := strconv.ParseUint(r.URL.Query().Get("sequence"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid sequence: %w", err))
+		return
+	}
+
+	err = h.Queue.ReplayDeadLetter(r.Context(), sequence)
+	if err != nil {
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// expiredBatch is how many expired correlations are handled per lookup.
+const expiredBatch = 100
+
+// ExpiredSms sweeps sent sms which got no final receipt within their
+// validity, and gives them the final SMS_EXPIRED state. The correlations of
+// the sms which got one are removed. A multipart sms gets a single
+// SMS_EXPIRED, once its last segment is finished.
+type ExpiredSms struct {
+	Storage user.StorageReadWriter
+	Pub     user.SmsEventNotifier
+	History user.HistoryWriter
+}
+
+func (s *ExpiredSms) Handle(ctx context.Context, _ []byte) error {
+	for {
+		expired, err := s.Storage.ExpiredMessageSequences(ctx, time.Now(), expiredBatch)
+		if err != nil {
+			return fmt.Errorf("error on read expired message sequences in expired sms handle: %w", err)
+		}
+
+		for _, smsData := range expired {
+			// a finished sms kept its correlation for its late receipts
+			if smsData.State == user.SmsFinal {
+				err = s.Storage.DeleteMessageSequence(ctx, smsData.SequenceMessageID)
+			} else {
+				err = s.expire(ctx, smsData)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(expired) < expiredBatch {
+			return nil
+		}
+	}
+}
+
+func (s *ExpiredSms) expire(ctx context.Context, smsData user.SmsData) error {
+	final, err := finishSegment(ctx, s.Storage, smsData)
+	if err != nil {
+		return err
+	}
+
+	if !final {
+		err = s.Storage.DeleteMessageSequence(ctx, smsData.SequenceMessageID)
+		if err != nil {
+			s.undoSegment(ctx, smsData)
+			return fmt.Errorf("error on delete message sequence in expired sms handle: %w", err)
+		}
+		return nil
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	smsEvent := user.SmsEvent{
+		SmsID:             smsData.SmsID,
+		DestAddress:       smsData.Recipient,
+		SourceAddress:     smsData.NickName,
+		CommandStatus:     user.CommandStatusNoReceipt,
+		SubmitDate:        now,
+		DoneDate:          now,
+		DeliveryStatus:    user.StatusExpired,
+		SequenceMessageID: smsData.SequenceMessageID,
+		TariffID:          smsData.TariffID,
+		CompanyID:         smsData.CompanyID,
+		IsUnicode:         smsData.IsUnicode,
+		Final:             true,
+	}
+	err = s.Pub.NotifySmsEvent(ctx, smsEvent)
+	if err != nil {
+		s.undoSegment(ctx, smsData)
+		return fmt.Errorf("error notifying expired sms %s: %w", smsData.SmsID, err)
+	}
+
+	// removed only once the event is out, a failed sweep is retried
+	err = s.Storage.DeleteMessageSequence(ctx, smsData.SequenceMessageID)
+	if err != nil {
+		return fmt.Errorf("error on delete message sequence in expired sms handle: %w", err)
+	}
+
+	recordEvent(ctx, s.History, smsEvent)
+	metrics.ExpiredMessage()
+	return nil
+}
+
+// undoSegment takes back the segment of a correlation which is kept for the
+// next sweep, so that it is not counted twice.
+func (s *ExpiredSms) undoSegment(ctx context.Context, smsData user.SmsData) {
+	if smsData.Segments <= 1 {
+		return
+	}
+
+	_, err := s.Storage.FinishSegments(ctx, smsData.CompanyID, smsData.SmsID, -1)
+	if err != nil {
+		log.Errorf("error on undo finished segment of sms %s: %v", smsData.SmsID, err)
+	}
+}
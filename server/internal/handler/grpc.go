@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/qosimmax/sms-executor/api/smsv1"
+	"github.com/qosimmax/sms-executor/monitoring/trace"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// GRPC serves the sms service over gRPC. A sms is prepared, validated and
+// queued by Submit, exactly as over HTTP, so it is handled like any other
+// sms taken from the stream.
+type GRPC struct {
+	smsv1.UnimplementedSmsServiceServer
+
+	Submit *Submit
+	// History answers GetStatus, which is unimplemented without one.
+	History user.HistoryReader
+	// Events feeds WatchEvents, which is unimplemented without one.
+	Events *EventStream
+}
+
+// Send queues a sms.
+func (g *GRPC) Send(ctx context.Context, req *smsv1.SendRequest) (*smsv1.SendResponse, error) {
+	span, ctx := trace.ExtractFromCarrier(ctx, metadataCarrier(ctx), "SubmitSms")
+	defer span.Finish()
+
+	sms := submitRequestOf(req)
+	res, err := g.Submit.prepare(ctx, &sms)
+	if err != nil {
+		return nil, invalidStatus(codeOf(err), err.Error(), fieldViolation(fieldOf(err), err))
+	}
+
+	res.Subject, err = g.Submit.Queue.QueueSms(ctx, sms.Class, sms.SmsData)
+	if err != nil {
+		return nil, queueStatus(err)
+	}
+
+	return sendResponseOf(res), nil
+}
+
+// SendBatch queues every sms of a batch, or none when any is invalid.
+func (g *GRPC) SendBatch(ctx context.Context, req *smsv1.SendBatchRequest) (*smsv1.SendBatchResponse, error) {
+	span, ctx := trace.ExtractFromCarrier(ctx, metadataCarrier(ctx), "SubmitSmsBatch")
+	defer span.Finish()
+
+	if len(req.Messages) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "messages are required")
+	}
+
+	if g.Submit.MaxBatch > 0 && len(req.Messages) > g.Submit.MaxBatch {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"%d messages exceed the batch limit of %d", len(req.Messages), g.Submit.MaxBatch)
+	}
+
+	reqs := make([]submitRequest, len(req.Messages))
+	for i, message := range req.Messages {
+		reqs[i] = submitRequestOf(message)
+	}
+
+	results, invalid, forbidden := g.Submit.prepareBatch(ctx, reqs)
+	if len(invalid) > 0 {
+		code := codes.InvalidArgument
+		if forbidden {
+			code = codes.PermissionDenied
+		}
+
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(invalid))
+		for i, field := range invalid {
+			violations[i] = &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("messages[%d].%s", field.Index, field.Field),
+				Description: field.Error,
+			}
+		}
+		return nil, invalidStatus(code, fmt.Sprintf("%d of %d messages are invalid", len(invalid), len(reqs)), violations...)
+	}
+
+	res := &smsv1.SendBatchResponse{}
+	for i := range reqs {
+		subject, err := g.Submit.Queue.QueueSms(ctx, reqs[i].Class, reqs[i].SmsData)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "message %d: %v", i, err)
+		}
+
+		results[i].Subject = subject
+		res.Results = append(res.Results, sendResponseOf(results[i]))
+	}
+
+	return res, nil
+}
+
+// GetStatus returns the latest status of a sms of the company of the api
+// key, or of the requested company for an admin.
+func (g *GRPC) GetStatus(ctx context.Context, req *smsv1.GetStatusRequest) (*smsv1.SmsStatus, error) {
+	if g.History == nil {
+		return nil, status.Error(codes.Unimplemented, "the sms history is disabled")
+	}
+
+	companyID := req.CompanyId
+	if key, ok := companyKey(ctx); ok {
+		if companyID != "" && companyID != key.CompanyID {
+			return nil, status.Error(codes.PermissionDenied, "company_id is not the company of the api key")
+		}
+		companyID = key.CompanyID
+	}
+	if companyID == "" {
+		return nil, status.Error(codes.InvalidArgument, "company_id is required")
+	}
+
+	history, err := g.History.ReadHistory(ctx, companyID, req.SmsId)
+	if err != nil {
+		var errNotFound user.ErrNotFound
+		if errors.As(err, &errNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	smsStatus := &smsv1.SmsStatus{
+		SmsId:      history.SmsID,
+		Recipient:  history.Recipient,
+		NickName:   history.NickName,
+		CompanyId:  history.CompanyID,
+		CreatedAt:  timestamppb.New(history.CreatedAt),
+		MessageIds: history.MessageIDs,
+		Status:     history.Status,
+		Final:      history.Final,
+	}
+	if n := len(history.Entries); n > 0 {
+		smsStatus.UpdatedAt = timestamppb.New(history.Entries[n-1].Time)
+	}
+
+	return smsStatus, nil
+}
+
+// WatchEvents streams the sms events matching the request until the client
+// goes away, falls behind or the server shuts down.
+func (g *GRPC) WatchEvents(req *smsv1.WatchEventsRequest, stream smsv1.SmsService_WatchEventsServer) error {
+	if g.Events == nil {
+		return status.Error(codes.Unimplemented, "the event stream is disabled")
+	}
+
+	filter := eventFilter{
+		CompanyID: req.CompanyId,
+		SmsID:     req.SmsId,
+		Status:    req.Status,
+		Operator:  req.Operator,
+	}
+	if err := filter.restrict(stream.Context()); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	c, err := g.Events.subscribe(filter)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer g.Events.unsubscribe(c)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-c.done:
+			if c.slow {
+				return status.Error(codes.ResourceExhausted, c.reason)
+			}
+			return status.Error(codes.Unavailable, c.reason)
+		case data := <-c.events:
+			var smsEvent user.SmsEvent
+			if err := json.Unmarshal(data, &smsEvent); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+
+			if err := stream.Send(smsEventOf(smsEvent)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func submitRequestOf(req *smsv1.SendRequest) submitRequest {
+	sms := req.GetSms()
+
+	smsData := user.SmsData{
+		SmsID:     sms.GetSmsId(),
+		Message:   sms.GetMessage(),
+		Recipient: sms.GetRecipient(),
+		NickName:  sms.GetNickName(),
+		TariffID:  int(sms.GetTariffId()),
+		CompanyID: sms.GetCompanyId(),
+	}
+	if sms.GetCreatedAt() != nil {
+		smsData.CreatedAt = sms.GetCreatedAt().AsTime()
+	}
+
+	return submitRequest{SmsData: smsData, Class: req.GetClass()}
+}
+
+func sendResponseOf(res submitResponse) *smsv1.SendResponse {
+	return &smsv1.SendResponse{
+		SmsId:    res.SmsID,
+		Segments: int32(res.Segments),
+		Encoding: res.Encoding,
+		Subject:  res.Subject,
+	}
+}
+
+func smsEventOf(smsEvent user.SmsEvent) *smsv1.SmsEvent {
+	return &smsv1.SmsEvent{
+		SmsId:              smsEvent.SmsID,
+		DestinationAddress: smsEvent.DestAddress,
+		SourceAddress:      smsEvent.SourceAddress,
+		CommandStatus:      smsEvent.CommandStatus,
+		SubmitDate:         smsEvent.SubmitDate,
+		DoneDate:           smsEvent.DoneDate,
+		DeliveryStatus:     smsEvent.DeliveryStatus,
+		SequenceNumber:     smsEvent.SequenceNumber,
+		SequenceMessageId:  smsEvent.SequenceMessageID,
+		TariffId:           int32(smsEvent.TariffID),
+		CompanyId:          smsEvent.CompanyID,
+		IsUnicode:          smsEvent.IsUnicode,
+		Operator:           smsEvent.Operator,
+		Final:              smsEvent.Final,
+	}
+}
+
+// invalidStatus returns a status with the invalid fields in a BadRequest
+// detail.
+func invalidStatus(code codes.Code, msg string, violations ...*errdetails.BadRequest_FieldViolation) error {
+	st, err := status.New(code, msg).WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+func fieldViolation(field string, err error) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{Field: field, Description: err.Error()}
+}
+
+// codeOf is PERMISSION_DENIED for a forbidden field and INVALID_ARGUMENT for
+// an invalid one.
+func codeOf(err error) codes.Code {
+	var errForbidden user.ErrForbidden
+	if errors.As(err, &errForbidden) {
+		return codes.PermissionDenied
+	}
+	return codes.InvalidArgument
+}
+
+func queueStatus(err error) error {
+	var errInvalid user.ErrInvalid
+	if errors.As(err, &errInvalid) {
+		return invalidStatus(codes.InvalidArgument, err.Error(), fieldViolation(errInvalid.Field, err))
+	}
+
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// metadataCarrier carries the span context of the caller from the request
+// metadata.
+func metadataCarrier(ctx context.Context) opentracing.TextMapCarrier {
+	carrier := opentracing.TextMapCarrier{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if len(values) > 0 {
+			carrier[key] = values[0]
+		}
+	}
+	return carrier
+}
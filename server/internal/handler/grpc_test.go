@@ -0,0 +1,263 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/qosimmax/sms-executor/api/smsv1"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// newGRPCClient serves g behind the auth of newAuth and returns a client of
+// it.
+func newGRPCClient(t *testing.T, g *GRPC) smsv1.SmsServiceClient {
+	t.Helper()
+
+	auth := newAuth()
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(auth.UnaryInterceptor),
+		grpc.StreamInterceptor(auth.StreamInterceptor),
+	)
+	smsv1.RegisterSmsServiceServer(server, g)
+
+	lis := bufconn.Listen(1 << 20)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return smsv1.NewSmsServiceClient(conn)
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+// violatedFields returns the fields of the BadRequest detail of err.
+func violatedFields(err error) []string {
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				fields = append(fields, violation.Field)
+			}
+		}
+	}
+	return fields
+}
+
+func TestGRPC_Send(t *testing.T) {
+	sms := func(recipient, nickName, message string) *smsv1.Sms {
+		return &smsv1.Sms{Recipient: recipient, NickName: nickName, Message: message}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		req   *smsv1.SendRequest
+		code  codes.Code
+		field string
+	}{
+		{"queued", "company-token", &smsv1.SendRequest{Sms: sms("998901234567", "Bank", "hello"), Class: "otp"}, codes.OK, ""},
+		{"no api key", "", &smsv1.SendRequest{Sms: sms("998901234567", "Bank", "hello"), Class: "otp"}, codes.Unauthenticated, ""},
+		{"unknown api key", "other-token", &smsv1.SendRequest{Sms: sms("998901234567", "Bank", "hello"), Class: "otp"}, codes.Unauthenticated, ""},
+		{"invalid recipient", "company-token", &smsv1.SendRequest{Sms: sms("+998", "Bank", "hello"), Class: "otp"}, codes.InvalidArgument, "recipient"},
+		{"too many segments", "company-token", &smsv1.SendRequest{Sms: sms("998901234567", "Bank", strings.Repeat("a", 500)), Class: "otp"}, codes.InvalidArgument, "message"},
+		{"forbidden sender", "company-token", &smsv1.SendRequest{Sms: sms("998901234567", "Shop", "hello"), Class: "otp"}, codes.PermissionDenied, "nick_name"},
+		{"forbidden class", "company-token", &smsv1.SendRequest{Sms: sms("998901234567", "Bank", "hello")}, codes.PermissionDenied, "class"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &smsQueue{}
+			client := newGRPCClient(t, &GRPC{Submit: newSubmit(queue)})
+
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = withToken(tt.token)
+			}
+			res, err := client.Send(ctx, tt.req)
+
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("code = %s, want %s: %v", code, tt.code, err)
+			}
+
+			if tt.code != codes.OK {
+				if fields := violatedFields(err); tt.field != "" && (len(fields) != 1 || fields[0] != tt.field) {
+					t.Errorf("violated fields = %v, want %s", fields, tt.field)
+				}
+				if len(queue.queued) != 0 {
+					t.Errorf("queued %d sms, want none", len(queue.queued))
+				}
+				return
+			}
+
+			if res.SmsId == "" || res.Segments != 1 || res.Encoding != "gsm7" || res.Subject != "sms.create.test.otp" {
+				t.Errorf("response = %+v", res)
+			}
+			if len(queue.queued) != 1 || queue.queued[0].CompanyID != "company-1" || queue.queued[0].SmsID != res.SmsId {
+				t.Errorf("queued = %+v, want the sms of company-1", queue.queued)
+			}
+		})
+	}
+}
+
+func TestGRPC_SendBatch(t *testing.T) {
+	valid := &smsv1.SendRequest{Sms: &smsv1.Sms{Recipient: "998901234567", NickName: "Bank", Message: "hello"}, Class: "otp"}
+	invalid := &smsv1.SendRequest{Sms: &smsv1.Sms{Recipient: "+998", NickName: "Bank", Message: "hello"}, Class: "otp"}
+
+	t.Run("queued", func(t *testing.T) {
+		queue := &smsQueue{}
+		client := newGRPCClient(t, &GRPC{Submit: newSubmit(queue)})
+
+		res, err := client.SendBatch(withToken("company-token"), &smsv1.SendBatchRequest{
+			Messages: []*smsv1.SendRequest{valid, valid},
+		})
+		if err != nil {
+			t.Fatalf("send batch: %v", err)
+		}
+		if len(res.Results) != 2 || len(queue.queued) != 2 {
+			t.Errorf("results = %+v, queued %d sms, want 2", res.Results, len(queue.queued))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		queue := &smsQueue{}
+		client := newGRPCClient(t, &GRPC{Submit: newSubmit(queue)})
+
+		_, err := client.SendBatch(withToken("company-token"), &smsv1.SendBatchRequest{
+			Messages: []*smsv1.SendRequest{valid, invalid},
+		})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Fatalf("code = %s, want %s: %v", code, codes.InvalidArgument, err)
+		}
+		if fields := violatedFields(err); len(fields) != 1 || fields[0] != "messages[1].recipient" {
+			t.Errorf("violated fields = %v, want messages[1].recipient", fields)
+		}
+		if len(queue.queued) != 0 {
+			t.Errorf("queued %d sms of an invalid batch", len(queue.queued))
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		client := newGRPCClient(t, &GRPC{Submit: newSubmit(&smsQueue{})})
+
+		_, err := client.SendBatch(withToken("company-token"), &smsv1.SendBatchRequest{
+			Messages: []*smsv1.SendRequest{valid, valid, valid},
+		})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Errorf("code = %s, want %s: %v", code, codes.InvalidArgument, err)
+		}
+	})
+
+	t.Run("queue failure", func(t *testing.T) {
+		client := newGRPCClient(t, &GRPC{Submit: newSubmit(&smsQueue{failAt: 2})})
+
+		_, err := client.SendBatch(withToken("company-token"), &smsv1.SendBatchRequest{
+			Messages: []*smsv1.SendRequest{valid, valid},
+		})
+		if code := status.Code(err); code != codes.Unavailable {
+			t.Errorf("code = %s, want %s: %v", code, codes.Unavailable, err)
+		}
+	})
+}
+
+func TestGRPC_GetStatus(t *testing.T) {
+	created := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := &historyStore{history: user.SmsHistory{
+		SmsID:      "sms-1",
+		CompanyID:  "company-1",
+		CreatedAt:  created,
+		MessageIDs: []string{"1001"},
+		Status:     user.StatusSmsDELIVERED,
+		Final:      true,
+		Entries:    []user.HistoryEntry{{Time: created.Add(time.Minute)}},
+	}}
+	client := newGRPCClient(t, &GRPC{Submit: newSubmit(&smsQueue{}), History: store})
+
+	res, err := client.GetStatus(withToken("company-token"), &smsv1.GetStatusRequest{SmsId: "sms-1"})
+	if err != nil {
+		t.Fatalf("get status: %v", err)
+	}
+	if res.Status != user.StatusSmsDELIVERED || !res.Final || !res.UpdatedAt.AsTime().Equal(created.Add(time.Minute)) {
+		t.Errorf("status = %+v", res)
+	}
+
+	_, err = client.GetStatus(withToken("company-token"), &smsv1.GetStatusRequest{SmsId: "sms-2"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("unknown sms: code = %s, want %s", code, codes.NotFound)
+	}
+
+	_, err = client.GetStatus(withToken("company-token"), &smsv1.GetStatusRequest{SmsId: "sms-1", CompanyId: "company-2"})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("another company: code = %s, want %s", code, codes.PermissionDenied)
+	}
+
+	store.history.CompanyID = "company-2"
+	_, err = client.GetStatus(withToken("company-token"), &smsv1.GetStatusRequest{SmsId: "sms-1"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("sms of another company: code = %s, want %s", code, codes.NotFound)
+	}
+}
+
+func TestGRPC_WatchEvents(t *testing.T) {
+	events := &EventStream{Buffer: 4}
+	client := newGRPCClient(t, &GRPC{Submit: newSubmit(&smsQueue{}), Events: events})
+
+	ctx, cancel := context.WithCancel(withToken("company-token"))
+	defer cancel()
+
+	// the status of a stream arrives with its first receive
+	denied, err := client.WatchEvents(ctx, &smsv1.WatchEventsRequest{CompanyId: "company-2"})
+	if err == nil {
+		_, err = denied.Recv()
+	}
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("other company: code = %s, want %s", code, codes.PermissionDenied)
+	}
+
+	stream, err := client.WatchEvents(ctx, &smsv1.WatchEventsRequest{Status: user.StatusSmsDELIVERED})
+	if err != nil {
+		t.Fatalf("watch events: %v", err)
+	}
+	waitClients(t, events, 1)
+
+	handleEvents(t, events,
+		user.SmsEvent{SmsID: "sms-1", CompanyID: "company-1", DeliveryStatus: user.StatusSmsSent},
+		user.SmsEvent{SmsID: "sms-2", CompanyID: "company-2", DeliveryStatus: user.StatusSmsDELIVERED},
+		user.SmsEvent{SmsID: "sms-3", CompanyID: "company-1", DeliveryStatus: user.StatusSmsDELIVERED, Final: true},
+	)
+
+	smsEvent, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if smsEvent.SmsId != "sms-3" || !smsEvent.Final {
+		t.Errorf("event = %+v, want the final event of sms-3", smsEvent)
+	}
+
+	events.Close()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("after close: %v, want %s", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	defaultHistoryLimit = 100
+	// maxHistoryLimit bounds a listing, every sms is a read of the store.
+	maxHistoryLimit = 1000
+)
+
+// recordHistory appends an entry to the history of a sms. The history is
+// for support, failing to write it never fails the handling.
+func recordHistory(ctx context.Context, history user.HistoryWriter, sms user.SmsHistory, entry user.HistoryEntry) {
+	if history == nil || sms.SmsID == "" {
+		return
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	err := history.AppendHistory(ctx, sms, entry)
+	if err != nil {
+		log.Println("error on append history of sms", sms.SmsID, err)
+	}
+}
+
+// recordEvent appends a sms event to the history of its sms.
+func recordEvent(ctx context.Context, history user.HistoryWriter, smsEvent user.SmsEvent) {
+	sms, entry := historyOfEvent(smsEvent)
+	recordHistory(ctx, history, sms, entry)
+}
+
+func historyOfSms(smsData user.SmsData) user.SmsHistory {
+	return user.SmsHistory{
+		SmsID:     smsData.SmsID,
+		Recipient: smsData.Recipient,
+		NickName:  smsData.NickName,
+		CompanyID: smsData.CompanyID,
+		TariffID:  smsData.TariffID,
+		IsUnicode: smsData.IsUnicode,
+		CreatedAt: smsData.CreatedAt,
+	}
+}
+
+func historyOfEvent(smsEvent user.SmsEvent) (user.SmsHistory, user.HistoryEntry) {
+	sms := user.SmsHistory{
+		SmsID:     smsEvent.SmsID,
+		Recipient: smsEvent.DestAddress,
+		CompanyID: smsEvent.CompanyID,
+		TariffID:  smsEvent.TariffID,
+		IsUnicode: smsEvent.IsUnicode,
+	}
+
+	return sms, user.HistoryEntry{
+		Kind:              user.HistoryEvent,
+		SequenceNumber:    smsEvent.SequenceNumber,
+		SequenceMessageID: smsEvent.SequenceMessageID,
+		CommandStatus:     smsEvent.CommandStatus,
+		DeliveryStatus:    smsEvent.DeliveryStatus,
+	}
+}
+
+// History serves the history of sms.
+type History struct {
+	Store user.HistoryReader
+}
+
+// Get handles GET /v1/sms/{sms_id}?company_id=, the company is the one of
+// the api key for a company key.
+func (h *History) Get(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	smsID := strings.TrimPrefix(r.URL.Path, "/v1/sms/")
+	if smsID == "" || strings.Contains(smsID, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+
+	companyID, ok := requestCompany(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := h.Store.ReadHistory(r.Context(), companyID, smsID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// List handles GET /v1/sms?recipient=&company_id=&from=&to=&limit=, from
+// and to are RFC 3339 times.
+func (h *History) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+
+	q := user.HistoryQuery{
+		Recipient: query.Get("recipient"),
+		CompanyID: query.Get("company_id"),
+		Limit:     defaultHistoryLimit,
+	}
+	// a company key only finds the sms of its company
+	if key, ok := companyKey(r.Context()); ok {
+		if q.CompanyID != "" && q.CompanyID != key.CompanyID {
+			writeError(w, http.StatusForbidden, fmt.Errorf("company_id is not the company of the api key"))
+			return
+		}
+		q.CompanyID = key.CompanyID
+	}
+
+	if q.Recipient == "" && q.CompanyID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("recipient or company_id is required"))
+		return
+	}
+
+	var err error
+	q.From, err = parseTime(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %w", err))
+		return
+	}
+
+	q.To, err = parseTime(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %w", err))
+		return
+	}
+
+	if v := query.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit <= 0 || q.Limit > maxHistoryLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s, must be 1 to %d", v, maxHistoryLimit))
+			return
+		}
+	}
+
+	histories, err := h.Store.FindHistory(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, histories)
+}
+
+// parseTime parses an optional RFC 3339 time.
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
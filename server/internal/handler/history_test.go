@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// historyStore answers lookups from a fixed history and keeps the last query.
+type historyStore struct {
+	history user.SmsHistory
+	query   user.HistoryQuery
+}
+
+func (s *historyStore) ReadHistory(ctx context.Context, companyID, smsID string) (user.SmsHistory, error) {
+	if companyID != s.history.CompanyID || smsID != s.history.SmsID {
+		return user.SmsHistory{}, user.ErrNotFound{Err: fmt.Errorf("no history of sms %s", smsID)}
+	}
+	return s.history, nil
+}
+
+func (s *historyStore) FindHistory(ctx context.Context, query user.HistoryQuery) ([]user.SmsHistory, error) {
+	s.query = query
+	return []user.SmsHistory{s.history}, nil
+}
+
+func TestHistory(t *testing.T) {
+	store := &historyStore{history: user.SmsHistory{SmsID: "sms-1", CompanyID: "c1"}}
+	h := &History{Store: store}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		handle http.HandlerFunc
+		status int
+	}{
+		{"get", http.MethodGet, "/v1/sms/sms-1?company_id=c1", h.Get, http.StatusOK},
+		{"get unknown", http.MethodGet, "/v1/sms/sms-2?company_id=c1", h.Get, http.StatusNotFound},
+		{"get other company", http.MethodGet, "/v1/sms/sms-1?company_id=c2", h.Get, http.StatusNotFound},
+		{"get without company", http.MethodGet, "/v1/sms/sms-1", h.Get, http.StatusBadRequest},
+		{"get nested", http.MethodGet, "/v1/sms/sms-1/x", h.Get, http.StatusNotFound},
+		{"get method", http.MethodPost, "/v1/sms/sms-1", h.Get, http.StatusMethodNotAllowed},
+		{"list", http.MethodGet, "/v1/sms?recipient=998901234567&company_id=c1&from=2023-06-01T00:00:00Z&to=2023-06-02T00:00:00Z&limit=5", h.List, http.StatusOK},
+		{"list without filter", http.MethodGet, "/v1/sms?from=2023-06-01T00:00:00Z", h.List, http.StatusBadRequest},
+		{"list invalid from", http.MethodGet, "/v1/sms?recipient=998901234567&from=yesterday", h.List, http.StatusBadRequest},
+		{"list invalid limit", http.MethodGet, "/v1/sms?recipient=998901234567&limit=0", h.List, http.StatusBadRequest},
+		{"list limit above max", http.MethodGet, "/v1/sms?recipient=998901234567&limit=1001", h.List, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handle(w, httptest.NewRequest(tt.method, tt.target, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	want := user.HistoryQuery{
+		Recipient: "998901234567",
+		CompanyID: "c1",
+		From:      time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+		To:        time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC),
+		Limit:     5,
+	}
+	if store.query != want {
+		t.Errorf("query = %+v, want %+v", store.query, want)
+	}
+}
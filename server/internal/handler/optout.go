@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// OptOuts serves the opt-outs of recipients. A company key manages the
+// opt-outs of its company and sees the global ones, an admin manages every
+// opt-out, a global one when company_id and sender are empty. The opt-outs a
+// recipient made by reply are only replaced or removed by an admin.
+type OptOuts struct {
+	Store user.OptOutReaderWriter
+}
+
+type optOutRequest struct {
+	Recipient string `json:"recipient"`
+	CompanyID string `json:"company_id"`
+	Sender    string `json:"sender"`
+}
+
+// OptOuts handles GET /v1/optouts?recipient=, POST /v1/optouts and
+// DELETE /v1/optouts?recipient=&company_id=&sender=.
+func (h *OptOuts) OptOuts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.list(w, r)
+	case http.MethodPost:
+		var req optOutRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+			return
+		}
+		h.add(w, r, req)
+	case http.MethodDelete:
+		query := r.URL.Query()
+		h.remove(w, r, optOutRequest{
+			Recipient: query.Get("recipient"),
+			CompanyID: query.Get("company_id"),
+			Sender:    query.Get("sender"),
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (h *OptOuts) list(w http.ResponseWriter, r *http.Request) {
+	optOut := user.OptOut{Recipient: r.URL.Query().Get("recipient")}
+	if !validOptOut(w, optOut) {
+		return
+	}
+
+	optOuts, err := h.Store.ListOptOuts(r.Context(), optOut.Recipient)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	key, restricted := companyKey(r.Context())
+	visible := []user.OptOut{}
+	for _, optOut := range optOuts {
+		if !restricted || optOut.CompanyID == "" || optOut.CompanyID == key.CompanyID {
+			visible = append(visible, optOut)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func (h *OptOuts) add(w http.ResponseWriter, r *http.Request, req optOutRequest) {
+	optOut, ok := optOutOf(w, r, req)
+	if !ok || !h.changeable(w, r, optOut) {
+		return
+	}
+
+	optOut.Source = user.OptOutSourceAPI
+	optOut.CreatedAt = time.Now().UTC()
+	optOut.CreatedBy = actorOf(r.Context())
+
+	err := h.Store.WriteOptOut(r.Context(), optOut)
+	auditOptOut(r, "add opt-out", optOut, err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, optOut)
+}
+
+func (h *OptOuts) remove(w http.ResponseWriter, r *http.Request, req optOutRequest) {
+	optOut, ok := optOutOf(w, r, req)
+	if !ok || !h.changeable(w, r, optOut) {
+		return
+	}
+
+	err := h.Store.DeleteOptOut(r.Context(), optOut)
+	auditOptOut(r, "remove opt-out", optOut, err)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changeable reports if the request may replace or remove the stored
+// opt-out of the same scope, writing the error when it may not. A company
+// key may not undo the opt-out of a recipient who replied with a keyword.
+func (h *OptOuts) changeable(w http.ResponseWriter, r *http.Request, optOut user.OptOut) bool {
+	if _, restricted := companyKey(r.Context()); !restricted {
+		return true
+	}
+
+	optOuts, err := h.Store.ListOptOuts(r.Context(), optOut.Recipient)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	for _, stored := range optOuts {
+		if stored.Key() == optOut.Key() && stored.Source == user.OptOutSourceMO {
+			writeInvalid(w, user.ErrForbidden{Field: "source", Err: fmt.Errorf("the recipient opted out by reply, only an admin may change it")})
+			return false
+		}
+	}
+	return true
+}
+
+// optOutOf returns the opt-out of a request, scoped to the company of a
+// company key, writing the error when it is invalid.
+func optOutOf(w http.ResponseWriter, r *http.Request, req optOutRequest) (user.OptOut, bool) {
+	optOut := user.OptOut{Recipient: req.Recipient, CompanyID: req.CompanyID, Sender: req.Sender}
+
+	if key, ok := companyKey(r.Context()); ok {
+		if optOut.CompanyID != "" && optOut.CompanyID != key.CompanyID {
+			writeInvalid(w, user.ErrForbidden{Field: "company_id", Err: fmt.Errorf("is not the company of the api key")})
+			return user.OptOut{}, false
+		}
+		optOut.CompanyID = key.CompanyID
+	}
+
+	return optOut, validOptOut(w, optOut)
+}
+
+func validOptOut(w http.ResponseWriter, optOut user.OptOut) bool {
+	if err := optOut.Validate(); err != nil {
+		writeInvalid(w, err)
+		return false
+	}
+	return true
+}
+
+// auditOptOut writes a change of the opt-outs to the audit log, it may stop
+// or resume the sms to a recipient.
+func auditOptOut(r *http.Request, action string, optOut user.OptOut, err error) {
+	audit(r.Context(), action, log.Fields{
+		"recipient":  optOut.Recipient,
+		"company_id": optOut.CompanyID,
+		"sender":     optOut.Sender,
+	}, err)
+}
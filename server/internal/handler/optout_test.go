@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// optOutStore keeps opt-outs in memory by their key.
+type optOutStore map[string]user.OptOut
+
+func (s optOutStore) ListOptOuts(ctx context.Context, recipient string) ([]user.OptOut, error) {
+	var optOuts []user.OptOut
+	for _, optOut := range s {
+		if optOut.Recipient == recipient {
+			optOuts = append(optOuts, optOut)
+		}
+	}
+	return optOuts, nil
+}
+
+func (s optOutStore) WriteOptOut(ctx context.Context, optOut user.OptOut) error {
+	s[optOut.Key()] = optOut
+	return nil
+}
+
+func (s optOutStore) DeleteOptOut(ctx context.Context, optOut user.OptOut) error {
+	if _, ok := s[optOut.Key()]; !ok {
+		return user.ErrNotFound{Err: fmt.Errorf("no opt-out %s", optOut.Key())}
+	}
+	delete(s, optOut.Key())
+	return nil
+}
+
+func TestOptOuts(t *testing.T) {
+	store := optOutStore{}
+	h := &OptOuts{Store: store}
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-API-Key", token)
+
+		w := httptest.NewRecorder()
+		newAuth().Company(h.OptOuts)(w, r)
+		return w
+	}
+
+	w := request(http.MethodPost, "/v1/optouts", "admin-token", `{"recipient":"998901234567"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add global: status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	w = request(http.MethodPost, "/v1/optouts", "company-token", `{"recipient":"998901234567","sender":"Bank"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add company: status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	var added user.OptOut
+	if err := json.Unmarshal(w.Body.Bytes(), &added); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if added.CompanyID != "company-1" || added.Source != user.OptOutSourceAPI || added.CreatedBy != user.APIKeyID("company-token") {
+		t.Errorf("added %+v, want an opt-out of company-1", added)
+	}
+
+	_ = store.WriteOptOut(context.Background(), user.OptOut{Recipient: "998901234567", CompanyID: "company-2"})
+	// the recipient replied STOP to every sender of company-1
+	_ = store.WriteOptOut(context.Background(), user.OptOut{Recipient: "998907654321", CompanyID: "company-1", Source: user.OptOutSourceMO, Keyword: "STOP"})
+
+	w = request(http.MethodGet, "/v1/optouts?recipient=998901234567", "company-token", "")
+	var listed []user.OptOut
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 2 {
+		t.Errorf("company list = %s, want the global and its own opt-out", w.Body)
+	}
+
+	w = request(http.MethodGet, "/v1/optouts?recipient=998901234567", "admin-token", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 3 {
+		t.Errorf("admin list = %s, want every opt-out", w.Body)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"invalid recipient", http.MethodPost, "/v1/optouts", "company-token", `{"recipient":"+998"}`, http.StatusUnprocessableEntity},
+		{"other company", http.MethodPost, "/v1/optouts", "company-token", `{"recipient":"998901234567","company_id":"company-2"}`, http.StatusForbidden},
+		{"malformed", http.MethodPost, "/v1/optouts", "company-token", `{"recipient":`, http.StatusBadRequest},
+		{"list without recipient", http.MethodGet, "/v1/optouts", "company-token", "", http.StatusUnprocessableEntity},
+		// a company key removes the opt-out of its company, not the global one
+		{"remove global as company", http.MethodDelete, "/v1/optouts?recipient=998901234567", "company-token", "", http.StatusNotFound},
+		{"remove", http.MethodDelete, "/v1/optouts?recipient=998901234567&sender=Bank", "company-token", "", http.StatusNoContent},
+		// the opt-out of a reply is not undone by the sender
+		{"remove reply as company", http.MethodDelete, "/v1/optouts?recipient=998907654321", "company-token", "", http.StatusForbidden},
+		{"replace reply as company", http.MethodPost, "/v1/optouts", "company-token", `{"recipient":"998907654321"}`, http.StatusForbidden},
+		{"remove reply", http.MethodDelete, "/v1/optouts?recipient=998907654321&company_id=company-1", "admin-token", "", http.StatusNoContent},
+		{"remove global", http.MethodDelete, "/v1/optouts?recipient=998901234567", "admin-token", "", http.StatusNoContent},
+		{"remove unknown", http.MethodDelete, "/v1/optouts?recipient=998901234567", "admin-token", "", http.StatusNotFound},
+		{"method", http.MethodPut, "/v1/optouts", "company-token", "", http.StatusMethodNotAllowed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(tt.method, tt.target, tt.token, tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	if len(store) != 1 {
+		t.Errorf("store = %+v, want the opt-out of company-2", store)
+	}
+}
@@ -6,14 +6,45 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sync"
+	"time"
 
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
 	"github.com/qosimmax/sms-executor/user"
 )
 
+type classContext struct{}
+
+// WithClass returns a context for handling a sms of a class.
+func WithClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, classContext{}, class)
+}
+
+// ClassOf returns the class of the sms handled with ctx, empty when unknown.
+func ClassOf(ctx context.Context) string {
+	class, _ := ctx.Value(classContext{}).(string)
+	return class
+}
+
 type Sms struct {
-	SmsSender      user.SmsSender
-	Storage        user.StorageReadWriter
-	sequenceNumber int32
+	SmsSender user.SmsSender
+	Storage   user.StorageReadWriter
+	Pub       user.SmsEventNotifier
+	History   user.HistoryWriter
+
+	// Sequences reserves blocks of SequenceBlock sequence numbers, so that
+	// instances sharing the storage never hand out the same number.
+	Sequences     user.SequenceAllocator
+	SequenceBlock int64
+
+	// OptOuts rejects the sms to recipients who opted out, except in the
+	// OptOutExempt classes. Every sms is sent when it is nil.
+	OptOuts      user.OptOutReader
+	OptOutExempt []string
+
+	sequenceMu   sync.Mutex
+	sequenceNext int64
+	sequenceEnd  int64
 }
 
 func (s *Sms) Handle(ctx context.Context, data []byte) error {
@@ -25,15 +56,155 @@ func (s *Sms) Handle(ctx context.Context, data []byte) error {
 		}
 	}
 
+	recordHistory(ctx, s.History, historyOfSms(smsData), user.HistoryEntry{
+		Kind:          user.HistoryReceived,
+		MessageLength: len([]rune(smsData.Message)),
+	})
+
 	if smsData.IsTimout() {
-		return user.ErrNonRecoverable{
-			Err: fmt.Errorf("sms message live timeout"),
+		err = fmt.Errorf("sms message live timeout")
+		recordHistory(ctx, s.History, historyOfSms(smsData), user.HistoryEntry{
+			Kind:  user.HistorySubmitFailed,
+			Error: err.Error(),
+		})
+
+		return user.ErrNonRecoverable{Err: err}
+	}
+
+	if smsData.SmsID != "" {
+		state, err := s.Storage.ClaimSubmission(ctx, smsData.CompanyID, smsData.SmsID)
+		if err != nil {
+			return fmt.Errorf("error on claim submission in sms handle: %w", err)
+		}
+
+		switch state {
+		case user.SubmissionDone:
+			// already submitted, ack the duplicate without resubmission
+			metrics.DuplicateMessage("submitted")
+			return nil
+		case user.SubmissionPending:
+			metrics.DuplicateMessage("in_flight")
+			return user.ErrInProgress{
+				Err: fmt.Errorf("sms %s is being submitted by another delivery", smsData.SmsID),
+			}
+		}
+	}
+
+	err = s.submit(ctx, smsData)
+	if err != nil {
+		recordHistory(ctx, s.History, historyOfSms(smsData), user.HistoryEntry{
+			Kind:  user.HistorySubmitFailed,
+			Error: err.Error(),
+		})
+
+		if smsData.SmsID != "" {
+			if releaseErr := s.Storage.ReleaseSubmission(ctx, smsData.CompanyID, smsData.SmsID); releaseErr != nil {
+				log.Println("error on release submission in sms handle:", releaseErr)
+			}
+		}
+
+		return err
+	}
+
+	if smsData.SmsID != "" {
+		err = s.Storage.CompleteSubmission(ctx, smsData.CompanyID, smsData.SmsID)
+		if err != nil {
+			log.Println("error on complete submission in sms handle:", err)
 		}
 	}
 
+	return nil
+}
+
+// submit sends the sms, or rejects it when its recipient opted out.
+func (s *Sms) submit(ctx context.Context, smsData user.SmsData) error {
+	optOut, optedOut, err := s.optedOut(ctx, smsData)
+	if err != nil {
+		return err
+	}
+
+	if optedOut {
+		return s.reject(ctx, smsData, optOut)
+	}
+
+	return s.send(ctx, smsData)
+}
+
+// optedOut returns the opt-out which covers the sms, unless its class is
+// exempt.
+func (s *Sms) optedOut(ctx context.Context, smsData user.SmsData) (user.OptOut, bool, error) {
+	if s.OptOuts == nil {
+		return user.OptOut{}, false, nil
+	}
+
+	class := ClassOf(ctx)
+	for _, exempt := range s.OptOutExempt {
+		if class == exempt {
+			return user.OptOut{}, false, nil
+		}
+	}
+
+	optOuts, err := s.OptOuts.ListOptOuts(ctx, smsData.Recipient)
+	if err != nil {
+		return user.OptOut{}, false, fmt.Errorf("error on list opt-outs in sms handle: %w", err)
+	}
+
+	for _, optOut := range optOuts {
+		if optOut.Covers(smsData.CompanyID, smsData.NickName) {
+			return optOut, true, nil
+		}
+	}
+
+	return user.OptOut{}, false, nil
+}
+
+// reject publishes a final REJECTED event for a sms to a recipient who
+// opted out, instead of sending it.
+func (s *Sms) reject(ctx context.Context, smsData user.SmsData, optOut user.OptOut) error {
+	smsData.FindAndSetEncoding()
+	now := time.Now().Format(time.RFC3339)
+	smsEvent := user.SmsEvent{
+		SmsID:          smsData.SmsID,
+		DestAddress:    smsData.Recipient,
+		SourceAddress:  smsData.NickName,
+		CommandStatus:  user.CommandStatusOptedOut,
+		SubmitDate:     now,
+		DoneDate:       now,
+		DeliveryStatus: user.StatusSmsRejected,
+		TariffID:       smsData.TariffID,
+		CompanyID:      smsData.CompanyID,
+		IsUnicode:      smsData.IsUnicode,
+		Final:          true,
+	}
+	err := s.Pub.NotifySmsEvent(ctx, smsEvent)
+	if err != nil {
+		return fmt.Errorf("error notifying rejected sms %s: %w", smsData.SmsID, err)
+	}
+
+	metrics.OptedOut("rejected")
+
+	history, entry := historyOfEvent(smsEvent)
+	entry.Error = fmt.Sprintf("recipient opted out (%s)", optOut.Source)
+	recordHistory(ctx, s.History, history, entry)
+
+	return nil
+}
+
+func (s *Sms) send(ctx context.Context, smsData user.SmsData) error {
 	// set message sequence number
-	smsData.SequenceNumber = s.incSeqNumber()
+	seqNum, err := s.incSeqNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("error on allocate sequenceNumber in sms handle: %w", err)
+	}
+
+	smsData.SequenceNumber = seqNum
+	smsData.State = user.SmsSubmitted
 	smsData.FindAndSetEncoding()
+	// the correlations carry the segments, so that only the last finished
+	// one finishes the sms
+	if segments, err := smsData.ShortMessages(); err == nil {
+		smsData.Segments = len(segments)
+	}
 	err = s.Storage.WriteSequenceNumber(ctx, smsData)
 	if err != nil {
 		return fmt.Errorf("error on write sequenceNumber in sms handle: %w", err)
@@ -44,12 +215,62 @@ func (s *Sms) Handle(ctx context.Context, data []byte) error {
 		return fmt.Errorf("error sending sms message in sms handle: %w", err)
 	}
 
+	recordHistory(ctx, s.History, historyOfSms(smsData), user.HistoryEntry{
+		Kind:           user.HistorySubmitted,
+		SequenceNumber: seqNum,
+	})
+
+	return nil
+}
+
+// HandleExhausted publishes a final FAILED event for a sms which could not
+// be sent within the max deliveries.
+func (s *Sms) HandleExhausted(ctx context.Context, data []byte, cause error) error {
+	var smsData user.SmsData
+	err := json.Unmarshal(data, &smsData)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal sms data in sms exhausted handle: %w", err)
+	}
+
+	smsData.FindAndSetEncoding()
+	now := time.Now().Format(time.RFC3339)
+	smsEvent := user.SmsEvent{
+		SmsID:          smsData.SmsID,
+		DestAddress:    smsData.Recipient,
+		SourceAddress:  smsData.NickName,
+		CommandStatus:  user.CommandStatusRetriesExhausted,
+		SubmitDate:     now,
+		DoneDate:       now,
+		DeliveryStatus: user.StatusSmsFailed,
+		TariffID:       smsData.TariffID,
+		CompanyID:      smsData.CompanyID,
+		IsUnicode:      smsData.IsUnicode,
+		Final:          true,
+	}
+	err = s.Pub.NotifySmsEvent(ctx, smsEvent)
+	if err != nil {
+		return fmt.Errorf("error notifying exhausted sms %s (%v): %w", smsData.SmsID, cause, err)
+	}
+
+	history, entry := historyOfEvent(smsEvent)
+	entry.Error = cause.Error()
+	recordHistory(ctx, s.History, history, entry)
+
 	return nil
 }
 
 type SmsEvent struct {
 	Storage user.StorageReadWriter
 	Pub     user.SmsEventNotifier
+	Orphans user.OrphanReceiptNotifier
+	History user.HistoryWriter
+	// OptOuts records the recipients who reply with one of the
+	// OptOutKeywords, user.OptOutKeywords when empty.
+	OptOuts        user.OptOutWriter
+	OptOutKeywords []string
+	// Replied finds the companies which sent to a recipient from the sender
+	// it replied to, so that the opt-out covers their other senders too.
+	Replied user.HistoryReader
 }
 
 func (s *SmsEvent) Handle(ctx context.Context, data []byte) error {
@@ -62,12 +283,15 @@ func (s *SmsEvent) Handle(ctx context.Context, data []byte) error {
 	}
 
 	switch smsEvent.DeliveryStatus {
+	case user.StatusSmsMO:
+		return s.handleMO(ctx, smsEvent)
 	case user.StatusSmsSent:
 		seqNum, err := s.Storage.ReadSequenceNumber(ctx, smsEvent.SequenceNumber)
 		if err != nil {
 			return err
 		}
 		seqNum.SequenceMessageID = smsEvent.SequenceMessageID
+		seqNum.State = user.SmsSent
 		smsEvent.SmsID = seqNum.SmsID
 		smsEvent.DestAddress = seqNum.Recipient
 		smsEvent.CompanyID = seqNum.CompanyID
@@ -90,7 +314,12 @@ func (s *SmsEvent) Handle(ctx context.Context, data []byte) error {
 		smsEvent.TariffID = seqNum.TariffID
 		smsEvent.IsUnicode = seqNum.IsUnicode
 
-	default: //DELIVERED, UNDELIVERED, REJECTED, EXPIRED..., etc.
+		smsEvent.Final, err = finishSegment(ctx, s.Storage, seqNum)
+		if err != nil {
+			return err
+		}
+
+	default: //DELIVERED, UNDELIVERED, REJECTED, EXPIRED, ENROUTE, ACCEPTD..., etc.
 		seqMsg, err := s.Storage.ReadMessageSequence(ctx, smsEvent.SequenceMessageID)
 		if err != nil {
 			return err
@@ -100,6 +329,37 @@ func (s *SmsEvent) Handle(ctx context.Context, data []byte) error {
 		smsEvent.CompanyID = seqMsg.CompanyID
 		smsEvent.TariffID = seqMsg.TariffID
 		smsEvent.IsUnicode = seqMsg.IsUnicode
+
+		if seqMsg.SmsID == "" {
+			return user.ErrUncorrelated{
+				Err: fmt.Errorf("no sms for %s receipt of message %s", smsEvent.DeliveryStatus, smsEvent.SequenceMessageID),
+			}
+		}
+
+		// a finished sms takes no more receipts, like a duplicate final one
+		// or an intermediate one parked until after the final one
+		state := user.StateOf(smsEvent.DeliveryStatus)
+		if state < seqMsg.State || seqMsg.State == user.SmsFinal {
+			log.Printf("ignoring %s of sms %s in state %s", smsEvent.DeliveryStatus, seqMsg.SmsID, seqMsg.State)
+			metrics.StaleEvent(smsEvent.DeliveryStatus)
+			return nil
+		}
+
+		// the correlation of a finished sms is kept in the final state until
+		// the sweeper removes it at the end of its validity, so that its late
+		// receipts are dropped rather than reported as orphans
+		seqMsg.State = state
+		err = s.Storage.WriteMessageSequence(ctx, seqMsg)
+		if err != nil {
+			return err
+		}
+
+		if state == user.SmsFinal {
+			smsEvent.Final, err = finishSegment(ctx, s.Storage, seqMsg)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	log.Println("sms event", smsEvent)
@@ -114,14 +374,140 @@ func (s *SmsEvent) Handle(ctx context.Context, data []byte) error {
 		return err
 	}
 
+	recordEvent(ctx, s.History, smsEvent)
+	return nil
+}
+
+// finishSegment counts a finished segment of a multipart sms, it reports if
+// it was the last one and so finishes the sms.
+func finishSegment(ctx context.Context, segments user.SegmentCounter, smsData user.SmsData) (bool, error) {
+	if smsData.Segments <= 1 {
+		return true, nil
+	}
+
+	finished, err := segments.FinishSegments(ctx, smsData.CompanyID, smsData.SmsID, 1)
+	if err != nil {
+		return false, fmt.Errorf("error on finish segment of sms %s: %w", smsData.SmsID, err)
+	}
+
+	return finished >= smsData.Segments, nil
+}
+
+// handleMO opts the recipient out of the sms of the sender it replied to
+// when the reply is a stop keyword.
+func (s *SmsEvent) handleMO(ctx context.Context, smsEvent user.SmsEvent) error {
+	keywords := s.OptOutKeywords
+	if len(keywords) == 0 {
+		keywords = user.OptOutKeywords
+	}
+
+	keyword := user.OptOutKeyword(smsEvent.Message, keywords)
+	if keyword == "" || s.OptOuts == nil {
+		log.Printf("mobile originated message from %s to %s", smsEvent.DestAddress, smsEvent.SourceAddress)
+		return nil
+	}
+
+	companies, err := s.repliedCompanies(ctx, smsEvent)
+	if err != nil {
+		return err
+	}
+
+	// the sender may be a short code shared by companies, each company of a
+	// recent sms from it loses the recipient on all of its senders
+	optOuts := []user.OptOut{{Recipient: smsEvent.DestAddress, Sender: smsEvent.SourceAddress}}
+	for _, companyID := range companies {
+		optOuts = append(optOuts, user.OptOut{Recipient: smsEvent.DestAddress, CompanyID: companyID})
+	}
+
+	for _, optOut := range optOuts {
+		optOut.Source = user.OptOutSourceMO
+		optOut.Keyword = keyword
+		optOut.CreatedAt = time.Now().UTC()
+
+		err := s.OptOuts.WriteOptOut(ctx, optOut)
+		if err != nil {
+			return fmt.Errorf("error writing opt-out of %s: %w", optOut.Recipient, err)
+		}
+	}
+
+	metrics.OptedOut("keyword")
+	log.Printf("%s opted out of the sms of %s and companies %v with %s", smsEvent.DestAddress, smsEvent.SourceAddress, companies, keyword)
 	return nil
 }
 
-func (c *Sms) incSeqNumber() int32 {
-	if c.sequenceNumber >= math.MaxInt32-1 {
-		c.sequenceNumber = 0
+// repliedHistoryLimit is how many of the latest sms to a recipient are
+// looked at for the ones it replied to.
+const repliedHistoryLimit = 100
+
+// repliedCompanies returns the companies of the latest sms to the recipient
+// of a mobile originated message from the sender it was sent to.
+func (s *SmsEvent) repliedCompanies(ctx context.Context, smsEvent user.SmsEvent) ([]string, error) {
+	if s.Replied == nil {
+		return nil, nil
+	}
+
+	histories, err := s.Replied.FindHistory(ctx, user.HistoryQuery{Recipient: smsEvent.DestAddress, Limit: repliedHistoryLimit})
+	if err != nil {
+		return nil, fmt.Errorf("error finding the sms %s replied to: %w", smsEvent.DestAddress, err)
+	}
+
+	var companies []string
+	seen := make(map[string]bool)
+	for _, history := range histories {
+		if history.NickName == smsEvent.SourceAddress && history.CompanyID != "" && !seen[history.CompanyID] {
+			seen[history.CompanyID] = true
+			companies = append(companies, history.CompanyID)
+		}
+	}
+
+	return companies, nil
+}
+
+// OrderKey keeps the messages to one recipient in order.
+func (s *Sms) OrderKey(data []byte) string {
+	var smsData struct {
+		Recipient string `json:"recipient"`
 	}
-	c.sequenceNumber += 1
+	_ = json.Unmarshal(data, &smsData)
+
+	return smsData.Recipient
+}
+
+// HandleOrphan publishes a receipt which was never matched to a sms.
+func (s *SmsEvent) HandleOrphan(ctx context.Context, data []byte) error {
+	var smsEvent user.SmsEvent
+	err := json.Unmarshal(data, &smsEvent)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal sms event data in sms event orphan handle: %w", err)
+	}
+
+	return s.Orphans.NotifyOrphanReceipt(ctx, smsEvent)
+}
+
+// incSeqNumber returns the next number of the reserved block, reserving a
+// new block when it is used up.
+func (c *Sms) incSeqNumber(ctx context.Context) (int32, error) {
+	c.sequenceMu.Lock()
+	defer c.sequenceMu.Unlock()
+
+	if c.sequenceNext == 0 || c.sequenceNext > c.sequenceEnd {
+		block := c.SequenceBlock
+		if block <= 0 {
+			block = 1
+		}
+
+		first, err := c.Sequences.AllocateSequenceNumbers(ctx, block)
+		if err != nil {
+			return 0, err
+		}
+
+		c.sequenceNext = first
+		c.sequenceEnd = first + block - 1
+	}
+
+	n := c.sequenceNext
+	c.sequenceNext++
 
-	return c.sequenceNumber
+	// smpp sequence numbers are positive int32 values
+	return int32((n-1)%(math.MaxInt32-1)) + 1, nil
 }
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// counter is a shared sequence counter, like the redis one.
+type counter struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func (c *counter) AllocateSequenceNumbers(ctx context.Context, n int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last += n
+	return c.last - n + 1, nil
+}
+
+func TestSms_IncSeqNumber(t *testing.T) {
+	shared := &counter{}
+
+	// two instances with a few workers each
+	instances := []*Sms{
+		{Sequences: shared, SequenceBlock: 7},
+		{Sequences: shared, SequenceBlock: 7},
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int32]bool)
+
+	var wg sync.WaitGroup
+	for _, s := range instances {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(s *Sms) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					n, err := s.incSeqNumber(context.Background())
+					if err != nil {
+						t.Errorf("inc sequence number: %v", err)
+						return
+					}
+
+					mu.Lock()
+					if seen[n] {
+						t.Errorf("sequence number %d handed out twice", n)
+					}
+					seen[n] = true
+					mu.Unlock()
+				}
+			}(s)
+		}
+	}
+	wg.Wait()
+
+	if len(seen) != 8000 {
+		t.Errorf("got %d sequence numbers, want 8000", len(seen))
+	}
+}
+
+func TestSms_IncSeqNumberWraps(t *testing.T) {
+	s := &Sms{Sequences: &counter{last: math.MaxInt32 - 2}, SequenceBlock: 2}
+
+	for _, want := range []int32{math.MaxInt32 - 1, 1} {
+		n, err := s.incSeqNumber(context.Background())
+		if err != nil {
+			t.Fatalf("inc sequence number: %v", err)
+		}
+
+		if n != want {
+			t.Errorf("sequence number = %d, want %d", n, want)
+		}
+	}
+}
+
+func TestSmsEvent_OptOutKeyword(t *testing.T) {
+	tests := []struct {
+		message  string
+		keywords []string
+		keyword  string
+	}{
+		{"STOP", nil, "STOP"},
+		{" stop! ", nil, "STOP"},
+		{"Unsubscribe", nil, "UNSUBSCRIBE"},
+		{"stop-all", nil, "STOPALL"},
+		{"quit", nil, "QUIT"},
+		{"opt-out", nil, "OPTOUT"},
+		{"end", nil, ""},
+		{"baja", nil, ""},
+		{"стоп", nil, "СТОП"},
+		{"Отписаться", nil, "ОТПИСАТЬСЯ"},
+		{"to'xtat", nil, "TO'XTAT"},
+		{"Stopp", nil, "STOPP"},
+		{"abmelden", nil, "ABMELDEN"},
+		{"désabonner", nil, "DÉSABONNER"},
+		{"стоп", []string{"STOP", "стоп"}, "СТОП"},
+		{"quit", []string{"STOP", "стоп"}, ""},
+		{"please stop", nil, ""},
+		{"hello", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			store := optOutStore{}
+			h := &SmsEvent{OptOuts: store, OptOutKeywords: tt.keywords}
+
+			err := h.Handle(context.Background(), []byte(fmt.Sprintf(
+				`{"destination_address":"998901234567","source_address":"Bank","delivery_status":%q,"message":%q}`,
+				user.StatusSmsMO, tt.message)))
+			if err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+
+			optOuts, _ := store.ListOptOuts(context.Background(), "998901234567")
+			if tt.keyword == "" {
+				if len(optOuts) != 0 {
+					t.Errorf("opted out with %q: %+v", tt.message, optOuts)
+				}
+				return
+			}
+
+			if len(optOuts) != 1 || optOuts[0].Keyword != tt.keyword || optOuts[0].Sender != "Bank" ||
+				optOuts[0].CompanyID != "" || optOuts[0].Source != user.OptOutSourceMO {
+				t.Errorf("opt-outs = %+v, want one of Bank with %s", optOuts, tt.keyword)
+			}
+		})
+	}
+}
+
+func TestSmsEvent_OptOutCompany(t *testing.T) {
+	replied := &historyStore{history: user.SmsHistory{SmsID: "sms-1", Recipient: "998901234567", NickName: "1234", CompanyID: "company-1"}}
+
+	for _, tt := range []struct {
+		sender    string
+		companies []string
+	}{
+		{"1234", []string{"company-1"}},
+		{"5678", nil},
+	} {
+		t.Run(tt.sender, func(t *testing.T) {
+			store := optOutStore{}
+			h := &SmsEvent{OptOuts: store, Replied: replied}
+
+			err := h.Handle(context.Background(), []byte(fmt.Sprintf(
+				`{"destination_address":"998901234567","source_address":%q,"delivery_status":%q,"message":"STOP"}`,
+				tt.sender, user.StatusSmsMO)))
+			if err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+
+			// the sender it replied to, and every sender of the companies
+			// which sent from it
+			var companies []string
+			optOuts, _ := store.ListOptOuts(context.Background(), "998901234567")
+			for _, optOut := range optOuts {
+				switch {
+				case optOut.CompanyID == "" && optOut.Sender == tt.sender:
+				case optOut.CompanyID != "" && optOut.Sender == "" && optOut.Covers(optOut.CompanyID, "Bank"):
+					companies = append(companies, optOut.CompanyID)
+				default:
+					t.Errorf("unexpected opt-out %+v", optOut)
+				}
+			}
+
+			if len(optOuts) != 1+len(tt.companies) || fmt.Sprint(companies) != fmt.Sprint(tt.companies) {
+				t.Errorf("opt-outs = %+v, want the sender and companies %v", optOuts, tt.companies)
+			}
+			if replied.query.Recipient != "998901234567" {
+				t.Errorf("history query = %+v, want the sms to the recipient", replied.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	// streamHeartbeat is how often an idle stream is written to, so proxies
+	// keep it open and a gone client is noticed.
+	streamHeartbeat = 15 * time.Second
+
+	// streamWriteWait is the longest a websocket write may take.
+	streamWriteWait = 10 * time.Second
+
+	// defaultStreamBuffer is the buffer of a client when Buffer is unset.
+	defaultStreamBuffer = 256
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// EventStream pushes the sms events it handles to the clients of GET
+// /v1/events/stream, over Server-Sent Events or a WebSocket. A client whose
+// buffer is full is dropped rather than slowing the others down.
+type EventStream struct {
+	// Buffer is how many events may wait for a client.
+	Buffer int
+
+	mu      sync.Mutex
+	clients map[*streamClient]struct{}
+	closed  bool
+}
+
+// eventFilter keeps the events matching all of its set fields.
+type eventFilter struct {
+	CompanyID string
+	SmsID     string
+	Status    string
+	Operator  string
+}
+
+func (f eventFilter) match(smsEvent user.SmsEvent) bool {
+	return (f.CompanyID == "" || f.CompanyID == smsEvent.CompanyID) &&
+		(f.SmsID == "" || f.SmsID == smsEvent.SmsID) &&
+		(f.Status == "" || f.Status == smsEvent.DeliveryStatus) &&
+		(f.Operator == "" || f.Operator == smsEvent.Operator)
+}
+
+// restrict limits the filter of a company key to the events of its company.
+func (f *eventFilter) restrict(ctx context.Context) error {
+	key, ok := companyKey(ctx)
+	if !ok {
+		return nil
+	}
+
+	if f.CompanyID != "" && f.CompanyID != key.CompanyID {
+		return fmt.Errorf("company_id is not the company of the api key")
+	}
+	f.CompanyID = key.CompanyID
+	return nil
+}
+
+type streamClient struct {
+	filter eventFilter
+	events chan []byte
+	// done is closed when the client is dropped, with the reason.
+	done   chan struct{}
+	reason string
+	slow   bool
+}
+
+// Handle pushes an sms event to the clients it matches.
+func (h *EventStream) Handle(ctx context.Context, data []byte) error {
+	var smsEvent user.SmsEvent
+	if err := json.Unmarshal(data, &smsEvent); err != nil {
+		return user.ErrNonRecoverable{Err: fmt.Errorf("error unmarshalling sms event: %w", err)}
+	}
+
+	// one line, whatever the publisher wrote
+	data, err := json.Marshal(smsEvent)
+	if err != nil {
+		return user.ErrNonRecoverable{Err: fmt.Errorf("error marshalling sms event: %w", err)}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		if !c.filter.match(smsEvent) {
+			continue
+		}
+
+		select {
+		case c.events <- data:
+		default:
+			c.slow = true
+			h.drop(c, "the client fell behind the events")
+			metrics.DroppedStreamClient()
+		}
+	}
+
+	return nil
+}
+
+// Close drops every client, so their requests end, and refuses new ones.
+func (h *EventStream) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for c := range h.clients {
+		h.drop(c, "the server is shutting down")
+	}
+}
+
+func (h *EventStream) subscribe(filter eventFilter) (*streamClient, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, fmt.Errorf("the server is shutting down")
+	}
+
+	buffer := h.Buffer
+	if buffer <= 0 {
+		buffer = defaultStreamBuffer
+	}
+
+	c := &streamClient{
+		filter: filter,
+		events: make(chan []byte, buffer),
+		done:   make(chan struct{}),
+	}
+	if h.clients == nil {
+		h.clients = make(map[*streamClient]struct{})
+	}
+	h.clients[c] = struct{}{}
+	metrics.SetStreamClients(len(h.clients))
+
+	return c, nil
+}
+
+func (h *EventStream) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.drop(c, "")
+}
+
+// drop removes a client, h.mu must be held.
+func (h *EventStream) drop(c *streamClient, reason string) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+
+	delete(h.clients, c)
+	c.reason = reason
+	close(c.done)
+	metrics.SetStreamClients(len(h.clients))
+}
+
+// Stream handles GET /v1/events/stream?company_id=&sms_id=&status=&operator=,
+// a WebSocket when the request upgrades and Server-Sent Events otherwise.
+// A company key only streams the events of its company.
+func (h *EventStream) Stream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := eventFilter{
+		CompanyID: query.Get("company_id"),
+		SmsID:     query.Get("sms_id"),
+		Status:    query.Get("status"),
+		Operator:  query.Get("operator"),
+	}
+
+	if err := filter.restrict(r.Context()); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.streamWebSocket(w, r, filter)
+		return
+	}
+
+	h.streamSSE(w, r, filter)
+}
+
+func (h *EventStream) streamSSE(w http.ResponseWriter, r *http.Request, filter eventFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	c, err := h.subscribe(filter)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer h.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			data, _ := json.Marshal(errorResponse{Error: c.reason})
+			_, _ = fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		case data := <-c.events:
+			_, err = fmt.Fprintf(w, "event: sms\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *EventStream) streamWebSocket(w http.ResponseWriter, r *http.Request, filter eventFilter) {
+	c, err := h.subscribe(filter)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer h.unsubscribe(c)
+
+	// the upgrader writes the error response itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// the client sends nothing but control frames, which are only handled
+	// while reading
+	gone := make(chan struct{})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-gone:
+			return
+		case <-c.done:
+			code := websocket.CloseGoingAway
+			if c.slow {
+				code = websocket.CloseTryAgainLater
+			}
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, c.reason), time.Now().Add(streamWriteWait))
+			return
+		case data := <-c.events:
+			_ = conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			err = conn.WriteMessage(websocket.TextMessage, data)
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait))
+		}
+
+		if err != nil {
+			log.Debugf("event stream websocket: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// waitClients waits until the stream has n clients.
+func waitClients(t *testing.T, h *EventStream, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.mu.Lock()
+		got := len(h.clients)
+		h.mu.Unlock()
+
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream has %d clients, want %d", got, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func handleEvents(t *testing.T, h *EventStream, smsEvents ...user.SmsEvent) {
+	t.Helper()
+
+	for _, smsEvent := range smsEvents {
+		data, err := json.Marshal(smsEvent)
+		if err != nil {
+			t.Fatalf("marshal sms event: %v", err)
+		}
+		if err := h.Handle(context.Background(), data); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+}
+
+// readSSE returns the events of a Server-Sent Events body by name.
+func readSSE(t *testing.T, resp *http.Response) <-chan [2]string {
+	events := make(chan [2]string, 16)
+	go func() {
+		defer close(events)
+
+		var name string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				events <- [2]string{name, strings.TrimPrefix(line, "data: ")}
+			}
+		}
+	}()
+	return events
+}
+
+func nextSSE(t *testing.T, events <-chan [2]string) (string, string) {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("stream ended")
+		}
+		return event[0], event[1]
+	case <-time.After(time.Second):
+		t.Fatalf("no event streamed")
+	}
+	return "", ""
+}
+
+func TestEventStream_SSE(t *testing.T) {
+	h := &EventStream{}
+	srv := httptest.NewServer(newAuth().Company(h.Stream))
+	t.Cleanup(srv.Close)
+
+	get := func(target, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+target, nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-API-Key", token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", target, err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	if resp := get("/?company_id=company-2", "company-token"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d for another company, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	company := get("/", "company-token")
+	admin := get("/?status=DELIVRD&operator=op-1", "admin-token")
+	if company.StatusCode != http.StatusOK || admin.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d and %d, want %d", company.StatusCode, admin.StatusCode, http.StatusOK)
+	}
+	if got := company.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("content type = %q, want text/event-stream", got)
+	}
+	waitClients(t, h, 2)
+
+	handleEvents(t, h,
+		user.SmsEvent{SmsID: "sms-1", CompanyID: "company-2", DeliveryStatus: user.StatusSmsSent, Operator: "op-1"},
+		user.SmsEvent{SmsID: "sms-2", CompanyID: "company-1", DeliveryStatus: user.StatusSmsSent, Operator: "op-1"},
+		user.SmsEvent{SmsID: "sms-3", CompanyID: "company-2", DeliveryStatus: user.StatusSmsDELIVERED, Operator: "op-2"},
+		user.SmsEvent{SmsID: "sms-4", CompanyID: "company-2", DeliveryStatus: user.StatusSmsDELIVERED, Operator: "op-1"},
+	)
+
+	for _, tt := range []struct {
+		name  string
+		resp  *http.Response
+		smsID string
+	}{
+		{"company", company, "sms-2"},
+		{"filtered", admin, "sms-4"},
+	} {
+		name, data := nextSSE(t, readSSE(t, tt.resp))
+
+		var smsEvent user.SmsEvent
+		if err := json.Unmarshal([]byte(data), &smsEvent); err != nil {
+			t.Fatalf("%s: unmarshal %s: %v", tt.name, data, err)
+		}
+		if name != "sms" || smsEvent.SmsID != tt.smsID {
+			t.Errorf("%s: streamed %s %s, want sms %s", tt.name, name, data, tt.smsID)
+		}
+	}
+}
+
+func TestEventStream_Slow(t *testing.T) {
+	h := &EventStream{Buffer: 2}
+	srv := httptest.NewServer(http.HandlerFunc(h.Stream))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	waitClients(t, h, 1)
+
+	// nothing is read yet, the client is dropped once its buffer and the
+	// connection are full
+	smsEvent := user.SmsEvent{SmsID: strings.Repeat("x", 1024), DeliveryStatus: user.StatusSmsSent}
+	for i := 0; i < 10000; i++ {
+		handleEvents(t, h, smsEvent)
+
+		h.mu.Lock()
+		n := len(h.clients)
+		h.mu.Unlock()
+		if n == 0 {
+			break
+		}
+	}
+	waitClients(t, h, 0)
+
+	// the events it got are followed by the reason it was dropped
+	events := readSSE(t, resp)
+	for {
+		name, data := nextSSE(t, events)
+		if name == "close" {
+			if !strings.Contains(data, "fell behind") {
+				t.Errorf("closed with %s, want the client fell behind", data)
+			}
+			return
+		}
+	}
+}
+
+func TestEventStream_WebSocket(t *testing.T) {
+	h := &EventStream{}
+	srv := httptest.NewServer(newAuth().Company(h.Stream))
+	t.Cleanup(srv.Close)
+
+	header := http.Header{"X-API-Key": []string{"company-token"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/?sms_id=sms-2", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitClients(t, h, 1)
+
+	handleEvents(t, h,
+		user.SmsEvent{SmsID: "sms-1", CompanyID: "company-1", DeliveryStatus: user.StatusSmsSent},
+		user.SmsEvent{SmsID: "sms-2", CompanyID: "company-1", DeliveryStatus: user.StatusSmsSent},
+	)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var smsEvent user.SmsEvent
+	if err := conn.ReadJSON(&smsEvent); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if smsEvent.SmsID != "sms-2" {
+		t.Errorf("streamed %+v, want sms-2", smsEvent)
+	}
+
+	h.Close()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after close = %v, want going away", err)
+	}
+	waitClients(t, h, 0)
+
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header); err == nil {
+		t.Errorf("dial after close succeeded, want it refused")
+	}
+}
@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/qosimmax/sms-executor/monitoring/trace"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const (
+	defaultSubmitClass = "default"
+	maxSubmitBody      = 64 << 10
+	maxBatchBody       = 32 << 20
+)
+
+// Submit queues sms sent over HTTP on the subjects of their class.
+type Submit struct {
+	Queue user.SmsQueue
+	// Classes are the names of the configured classes.
+	Classes []string
+	// MaxSegments is the most segments of a sms, MaxBatch the most sms in
+	// a batch. Zero means no limit.
+	MaxSegments int
+	MaxBatch    int
+}
+
+// submitRequest is a sms with the class to queue it in, "default" when
+// empty. A missing sms_id is generated, a missing created_at is now.
+type submitRequest struct {
+	user.SmsData
+	Class string `json:"class"`
+}
+
+type submitResponse struct {
+	SmsID    string `json:"sms_id"`
+	Segments int    `json:"segments"`
+	Encoding string `json:"encoding"`
+	Subject  string `json:"subject"`
+}
+
+type batchRequest struct {
+	Messages []submitRequest `json:"messages"`
+}
+
+type batchResponse struct {
+	Results []submitResponse `json:"results"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// invalidResponse is the body of a 403 or 422 response, the field of a sms or
+// the invalid sms of a batch by index.
+type invalidResponse struct {
+	Error  string         `json:"error"`
+	Field  string         `json:"field,omitempty"`
+	Errors []invalidField `json:"errors,omitempty"`
+}
+
+type invalidField struct {
+	Index int    `json:"index"`
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// Send handles POST /v1/sms.
+func (s *Submit) Send(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	span, ctx := trace.ExtractFromCarrier(r.Context(), headerCarrier(r.Header), "SubmitSms")
+	defer span.Finish()
+
+	var req submitRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+
+	res, err := s.prepare(ctx, &req)
+	if err != nil {
+		writeInvalid(w, err)
+		return
+	}
+
+	res.Subject, err = s.Queue.QueueSms(ctx, req.Class, req.SmsData)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, res)
+}
+
+// SendBatch handles POST /v1/sms/batch. Every sms is validated before any
+// is queued, so an invalid batch queues nothing. A batch which fails while
+// queueing can be sent again as a whole, the queued sms_ids are dropped as
+// duplicates.
+func (s *Submit) SendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	span, ctx := trace.ExtractFromCarrier(r.Context(), headerCarrier(r.Header), "SubmitSmsBatch")
+	defer span.Finish()
+
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("messages are required"))
+		return
+	}
+
+	if s.MaxBatch > 0 && len(req.Messages) > s.MaxBatch {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%d messages exceed the batch limit of %d", len(req.Messages), s.MaxBatch))
+		return
+	}
+
+	results, invalid, forbidden := s.prepareBatch(ctx, req.Messages)
+	if len(invalid) > 0 {
+		status := http.StatusUnprocessableEntity
+		if forbidden {
+			status = http.StatusForbidden
+		}
+		writeJSON(w, status, invalidResponse{
+			Error:  fmt.Sprintf("%d of %d messages are invalid", len(invalid), len(req.Messages)),
+			Errors: invalid,
+		})
+		return
+	}
+
+	for i := range req.Messages {
+		subject, err := s.Queue.QueueSms(ctx, req.Messages[i].Class, req.Messages[i].SmsData)
+		if err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, batchResponse{
+				Results: results[:i],
+				Error:   fmt.Sprintf("message %d: %v", i, err),
+			})
+			return
+		}
+		results[i].Subject = subject
+	}
+
+	writeJSON(w, http.StatusAccepted, batchResponse{Results: results})
+}
+
+// prepare fills in the defaults of a sms and validates it. A company key
+// may only send for its company, from its senders and in its classes.
+func (s *Submit) prepare(ctx context.Context, req *submitRequest) (submitResponse, error) {
+	if req.Class == "" {
+		req.Class = defaultSubmitClass
+	}
+	if !s.knownClass(req.Class) {
+		return submitResponse{}, user.ErrInvalid{Field: "class", Err: fmt.Errorf("unknown class %q", req.Class)}
+	}
+
+	if key, ok := companyKey(ctx); ok {
+		if req.CompanyID == "" {
+			req.CompanyID = key.CompanyID
+		}
+
+		switch {
+		case req.CompanyID != key.CompanyID:
+			return submitResponse{}, user.ErrForbidden{Field: "company_id", Err: fmt.Errorf("not the company of the api key")}
+		case !key.AllowsSender(req.NickName):
+			return submitResponse{}, user.ErrForbidden{Field: "nick_name", Err: fmt.Errorf("sender %q is not allowed", req.NickName)}
+		case !key.AllowsClass(req.Class):
+			return submitResponse{}, user.ErrForbidden{Field: "class", Err: fmt.Errorf("class %q is not allowed", req.Class)}
+		}
+	}
+
+	if req.SmsID == "" {
+		req.SmsID = newSmsID()
+	}
+	if req.CreatedAt.IsZero() {
+		req.CreatedAt = time.Now().UTC()
+	}
+	req.State = user.SmsQueued
+	req.FindAndSetEncoding()
+
+	if err := req.Validate(); err != nil {
+		return submitResponse{}, err
+	}
+
+	segments, err := req.ShortMessages()
+	if err != nil {
+		return submitResponse{}, user.ErrInvalid{Field: "message", Err: err}
+	}
+
+	if s.MaxSegments > 0 && len(segments) > s.MaxSegments {
+		return submitResponse{}, user.ErrInvalid{
+			Field: "message",
+			Err:   fmt.Errorf("%d segments exceed the limit of %d", len(segments), s.MaxSegments),
+		}
+	}
+
+	return submitResponse{
+		SmsID:    req.SmsID,
+		Segments: len(segments),
+		Encoding: req.Encoding(),
+	}, nil
+}
+
+// prepareBatch prepares every sms of a batch, and returns the invalid ones
+// and whether any is forbidden rather than invalid.
+func (s *Submit) prepareBatch(ctx context.Context, reqs []submitRequest) ([]submitResponse, []invalidField, bool) {
+	results := make([]submitResponse, len(reqs))
+	var invalid []invalidField
+	forbidden := false
+	for i := range reqs {
+		res, err := s.prepare(ctx, &reqs[i])
+		if err != nil {
+			invalid = append(invalid, invalidField{Index: i, Field: fieldOf(err), Error: err.Error()})
+			forbidden = forbidden || statusOf(err) == http.StatusForbidden
+			continue
+		}
+		results[i] = res
+	}
+
+	return results, invalid, forbidden
+}
+
+func (s *Submit) knownClass(class string) bool {
+	for _, name := range s.Classes {
+		if name == class {
+			return true
+		}
+	}
+	return false
+}
+
+func writeInvalid(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), invalidResponse{Error: err.Error(), Field: fieldOf(err)})
+}
+
+// statusOf is 403 for a forbidden field and 422 for an invalid one.
+func statusOf(err error) int {
+	var errForbidden user.ErrForbidden
+	if errors.As(err, &errForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnprocessableEntity
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	var errInvalid user.ErrInvalid
+	if errors.As(err, &errInvalid) {
+		writeInvalid(w, err)
+		return
+	}
+
+	writeError(w, http.StatusServiceUnavailable, err)
+}
+
+func fieldOf(err error) string {
+	var errInvalid user.ErrInvalid
+	if errors.As(err, &errInvalid) {
+		return errInvalid.Field
+	}
+
+	var errForbidden user.ErrForbidden
+	if errors.As(err, &errForbidden) {
+		return errForbidden.Field
+	}
+	return ""
+}
+
+// headerCarrier carries the span context of the caller from the request
+// headers, the tracer matches header names case insensitively.
+func headerCarrier(header http.Header) opentracing.TextMapCarrier {
+	carrier := opentracing.TextMapCarrier{}
+	for key := range header {
+		carrier[key] = header.Get(key)
+	}
+	return carrier
+}
+
+// newSmsID returns a random UUID.
+func newSmsID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// smsQueue keeps the queued sms, or fails from the failAt-th one.
+type smsQueue struct {
+	queued []user.SmsData
+	failAt int
+}
+
+func (q *smsQueue) QueueSms(ctx context.Context, class string, smsData user.SmsData) (string, error) {
+	if q.failAt > 0 && len(q.queued)+1 >= q.failAt {
+		return "", fmt.Errorf("nats: timeout")
+	}
+	q.queued = append(q.queued, smsData)
+	return fmt.Sprintf("sms.create.test.%s", class), nil
+}
+
+func newSubmit(queue *smsQueue) *Submit {
+	return &Submit{
+		Queue:       queue,
+		Classes:     []string{"otp", "default"},
+		MaxSegments: 3,
+		MaxBatch:    2,
+	}
+}
+
+func post(handle http.HandlerFunc, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handle(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return w
+}
+
+func TestSubmit_Send(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		field    string
+		segments int
+		encoding string
+	}{
+		{"gsm7", `{"sms_id":"sms-1","recipient":"998901234567","nick_name":"Bank","message":"hello"}`, http.StatusAccepted, "", 1, "gsm7"},
+		{"gsm7 long", `{"recipient":"998901234567","nick_name":"Bank","message":"` + strings.Repeat("a", 161) + `"}`, http.StatusAccepted, "", 2, "gsm7"},
+		{"ucs2", `{"recipient":"998901234567","nick_name":"1234","message":"` + strings.Repeat("я", 71) + `","class":"otp"}`, http.StatusAccepted, "", 2, "ucs2"},
+		{"malformed", `{"recipient":`, http.StatusBadRequest, "", 0, ""},
+		{"recipient letters", `{"recipient":"99890abc567","nick_name":"Bank","message":"hello"}`, http.StatusUnprocessableEntity, "recipient", 0, ""},
+		{"recipient short", `{"recipient":"12345","nick_name":"Bank","message":"hello"}`, http.StatusUnprocessableEntity, "recipient", 0, ""},
+		{"sender missing", `{"recipient":"998901234567","message":"hello"}`, http.StatusUnprocessableEntity, "nick_name", 0, ""},
+		{"sender long", `{"recipient":"998901234567","nick_name":"VeryLongBankName","message":"hello"}`, http.StatusUnprocessableEntity, "nick_name", 0, ""},
+		{"sender unicode", `{"recipient":"998901234567","nick_name":"Банк","message":"hello"}`, http.StatusUnprocessableEntity, "nick_name", 0, ""},
+		{"message missing", `{"recipient":"998901234567","nick_name":"Bank"}`, http.StatusUnprocessableEntity, "message", 0, ""},
+		{"too many segments", `{"recipient":"998901234567","nick_name":"Bank","message":"` + strings.Repeat("a", 500) + `"}`, http.StatusUnprocessableEntity, "message", 0, ""},
+		{"unknown class", `{"recipient":"998901234567","nick_name":"Bank","message":"hello","class":"excel"}`, http.StatusUnprocessableEntity, "class", 0, ""},
+		{"expired", `{"recipient":"998901234567","nick_name":"Bank","message":"hello","created_at":"2023-01-01T00:00:00Z"}`, http.StatusUnprocessableEntity, "created_at", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &smsQueue{}
+			w := post(newSubmit(queue).Send, "/v1/sms", tt.body)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+
+			switch tt.status {
+			case http.StatusAccepted:
+				var res submitResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				if res.Segments != tt.segments || res.Encoding != tt.encoding {
+					t.Errorf("got %d segments in %s, want %d in %s", res.Segments, res.Encoding, tt.segments, tt.encoding)
+				}
+				if len(queue.queued) != 1 || queue.queued[0].SmsID != res.SmsID || res.SmsID == "" {
+					t.Fatalf("queued %+v, want sms %q", queue.queued, res.SmsID)
+				}
+				if sms := queue.queued[0]; sms.CreatedAt.IsZero() || sms.IsUnicode != (tt.encoding == "ucs2") {
+					t.Errorf("queued sms %+v has no created_at or the wrong encoding", sms)
+				}
+			case http.StatusUnprocessableEntity:
+				var res invalidResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				if res.Field != tt.field {
+					t.Errorf("field = %q, want %q: %s", res.Field, tt.field, res.Error)
+				}
+				fallthrough
+			default:
+				if len(queue.queued) != 0 {
+					t.Errorf("queued %d sms, want none", len(queue.queued))
+				}
+			}
+		})
+	}
+}
+
+func TestSubmit_SendBatch(t *testing.T) {
+	valid := `{"sms_id":"sms-%d","recipient":"998901234567","nick_name":"Bank","message":"hello"}`
+
+	t.Run("queued", func(t *testing.T) {
+		queue := &smsQueue{}
+		w := post(newSubmit(queue).SendBatch, "/v1/sms/batch",
+			`{"messages":[`+fmt.Sprintf(valid, 1)+`,`+fmt.Sprintf(valid, 2)+`]}`)
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+		}
+
+		var res batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if len(res.Results) != 2 || res.Results[1].SmsID != "sms-2" || res.Results[1].Subject != "sms.create.test.default" {
+			t.Errorf("results = %+v", res.Results)
+		}
+		if len(queue.queued) != 2 {
+			t.Errorf("queued %d sms, want 2", len(queue.queued))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		queue := &smsQueue{}
+		w := post(newSubmit(queue).SendBatch, "/v1/sms/batch",
+			`{"messages":[`+fmt.Sprintf(valid, 1)+`,{"recipient":"+998","nick_name":"Bank","message":"hello"}]}`)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+		}
+
+		var res invalidResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if len(res.Errors) != 1 || res.Errors[0].Index != 1 || res.Errors[0].Field != "recipient" {
+			t.Errorf("errors = %+v", res.Errors)
+		}
+		if len(queue.queued) != 0 {
+			t.Errorf("queued %d sms of an invalid batch", len(queue.queued))
+		}
+	})
+
+	t.Run("queue failure", func(t *testing.T) {
+		queue := &smsQueue{failAt: 2}
+		w := post(newSubmit(queue).SendBatch, "/v1/sms/batch",
+			`{"messages":[`+fmt.Sprintf(valid, 1)+`,`+fmt.Sprintf(valid, 2)+`]}`)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+		}
+
+		var res batchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if len(res.Results) != 1 || res.Error == "" {
+			t.Errorf("response = %+v, want the first sms and an error", res)
+		}
+	})
+
+	for name, body := range map[string]string{
+		"empty":     `{"messages":[]}`,
+		"malformed": `[`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := post(newSubmit(&smsQueue{}).SendBatch, "/v1/sms/batch", body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		w := post(newSubmit(&smsQueue{}).SendBatch, "/v1/sms/batch",
+			`{"messages":[`+fmt.Sprintf(valid, 1)+`,`+fmt.Sprintf(valid, 2)+`,`+fmt.Sprintf(valid, 3)+`]}`)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/qosimmax/sms-executor/monitoring/metrics"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// Webhook delivers sms events to the webhook of their company.
+type Webhook struct {
+	Webhooks user.WebhookStore
+	Poster   user.WebhookPoster
+	// Backoff is the delay before each retry of a failed request.
+	Backoff []time.Duration
+	// Concurrency caps the requests in flight per URL, 1 when unset.
+	Concurrency int
+	// DisableAfter is how many events in a row may fail every retry before
+	// the webhook is disabled, never when unset.
+	DisableAfter int
+
+	mu        sync.Mutex
+	endpoints map[string]chan struct{}
+}
+
+// Handle posts an sms event to the webhook of its company, retrying failed
+// requests. An event which failed every retry is not delivered again, it is
+// only visible in the attempts.
+func (h *Webhook) Handle(ctx context.Context, data []byte) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Webhook")
+	defer span.Finish()
+
+	var smsEvent user.SmsEvent
+	if err := json.Unmarshal(data, &smsEvent); err != nil {
+		return user.ErrNonRecoverable{Err: fmt.Errorf("error unmarshalling sms event: %w", err)}
+	}
+
+	if smsEvent.CompanyID == "" {
+		return nil
+	}
+
+	webhook, err := h.Webhooks.ReadWebhook(ctx, smsEvent.CompanyID)
+	var errNotFound user.ErrNotFound
+	if errors.As(err, &errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if webhook.Disabled {
+		return nil
+	}
+
+	release, err := h.acquire(ctx, webhook.URL)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for attempt := 1; ; attempt++ {
+		statusCode, err := h.post(ctx, webhook, smsEvent, attempt, data)
+		if err == nil {
+			h.succeeded(webhook)
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// an address which is not public stays refused
+		var errInvalid user.ErrInvalid
+		if !retryable(statusCode) || errors.As(err, &errInvalid) || attempt > len(h.Backoff) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(h.Backoff[attempt-1]):
+		}
+	}
+
+	h.failed(webhook)
+	return nil
+}
+
+// post makes one request and records it as an attempt.
+func (h *Webhook) post(ctx context.Context, webhook user.Webhook, smsEvent user.SmsEvent, attempt int, data []byte) (int, error) {
+	start := time.Now()
+	statusCode, err := h.Poster.PostWebhook(ctx, webhook, data)
+
+	record := user.WebhookAttempt{
+		Time:           start.UTC(),
+		SmsID:          smsEvent.SmsID,
+		DeliveryStatus: smsEvent.DeliveryStatus,
+		URL:            webhook.URL,
+		Attempt:        attempt,
+		StatusCode:     statusCode,
+		Duration:       time.Since(start),
+	}
+
+	switch {
+	case err == nil:
+		metrics.WebhookAttempt("delivered")
+	case !retryable(statusCode):
+		record.Error = attemptError(statusCode, err)
+		metrics.WebhookAttempt("rejected")
+	default:
+		record.Error = attemptError(statusCode, err)
+		metrics.WebhookAttempt("failed")
+	}
+	if err != nil {
+		log.Debugf("webhook attempt %d of sms %s to %s: %v", attempt, smsEvent.SmsID, webhook.URL, err)
+	}
+
+	// a lost attempt record never fails the delivery
+	if appendErr := h.Webhooks.AppendWebhookAttempt(context.Background(), webhook.CompanyID, record); appendErr != nil {
+		log.Errorf("error recording webhook attempt of sms %s: %v", smsEvent.SmsID, appendErr)
+	}
+
+	return statusCode, err
+}
+
+// attemptError describes a failed attempt to the company without the text of
+// the upstream error, which could tell about the network of the executor.
+func attemptError(statusCode int, err error) string {
+	var errInvalid user.ErrInvalid
+	var errNet net.Error
+	switch {
+	case statusCode != 0:
+		return fmt.Sprintf("webhook responded %d", statusCode)
+	case errors.As(err, &errInvalid):
+		return "webhook address is not public"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &errNet) && errNet.Timeout():
+		return "webhook timed out"
+	default:
+		return "webhook connection failed"
+	}
+}
+
+// retryable is false for the client errors a retry can't fix, a timeout or
+// throttling is worth another try.
+func retryable(statusCode int) bool {
+	switch {
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return true
+	case statusCode >= 400 && statusCode < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// acquire takes one of the request slots of a URL.
+func (h *Webhook) acquire(ctx context.Context, url string) (release func(), err error) {
+	h.mu.Lock()
+	if h.endpoints == nil {
+		h.endpoints = make(map[string]chan struct{})
+	}
+	slots, ok := h.endpoints[url]
+	if !ok {
+		n := h.Concurrency
+		if n <= 0 {
+			n = 1
+		}
+		slots = make(chan struct{}, n)
+		h.endpoints[url] = slots
+	}
+	h.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// succeeded clears the failures of a webhook, the count is shared by the
+// executors in the store.
+func (h *Webhook) succeeded(webhook user.Webhook) {
+	if h.DisableAfter <= 0 {
+		return
+	}
+
+	// the count is read on every delivered event, it is only written
+	// after failures
+	ctx := context.Background()
+	failures, err := h.Webhooks.WebhookFailures(ctx, webhook.CompanyID)
+	if err != nil {
+		log.Errorf("error reading webhook failures of company %s: %v", webhook.CompanyID, err)
+		return
+	}
+	if failures == 0 {
+		return
+	}
+
+	if err := h.Webhooks.ResetWebhookFailures(ctx, webhook.CompanyID); err != nil {
+		log.Errorf("error resetting webhook failures of company %s: %v", webhook.CompanyID, err)
+	}
+}
+
+// failed counts an event which failed every retry, and disables the webhook
+// after DisableAfter of them in a row.
+func (h *Webhook) failed(webhook user.Webhook) {
+	if h.DisableAfter <= 0 {
+		return
+	}
+
+	// the request context may be done by now
+	ctx := context.Background()
+
+	failures, err := h.Webhooks.AddWebhookFailure(ctx, webhook.CompanyID)
+	if err != nil {
+		log.Errorf("error counting webhook failures of company %s: %v", webhook.CompanyID, err)
+		return
+	}
+
+	if failures < h.DisableAfter {
+		return
+	}
+
+	// a webhook set again starts over
+	if err := h.Webhooks.ResetWebhookFailures(ctx, webhook.CompanyID); err != nil {
+		log.Errorf("error resetting webhook failures of company %s: %v", webhook.CompanyID, err)
+	}
+
+	// the webhook may have been changed while the events failed
+	current, err := h.Webhooks.ReadWebhook(ctx, webhook.CompanyID)
+	if err != nil || current.URL != webhook.URL || current.Disabled {
+		return
+	}
+
+	current.Disabled = true
+	current.DisabledAt = time.Now().UTC()
+	if err := h.Webhooks.WriteWebhook(ctx, current); err != nil {
+		log.Errorf("error disabling webhook of company %s: %v", webhook.CompanyID, err)
+		return
+	}
+
+	metrics.DisabledWebhook()
+	log.Warnf("webhook %s of company %s disabled after %d failed events", webhook.URL, webhook.CompanyID, h.DisableAfter)
+}
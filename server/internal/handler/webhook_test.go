@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// webhookStore keeps webhooks and attempts in memory.
+type webhookStore struct {
+	mu       sync.Mutex
+	webhooks map[string]user.Webhook
+	attempts map[string][]user.WebhookAttempt
+	failures map[string]int
+	// resets counts the resets of the failures
+	resets int
+}
+
+func newWebhookStore(webhooks ...user.Webhook) *webhookStore {
+	s := &webhookStore{
+		webhooks: make(map[string]user.Webhook),
+		attempts: make(map[string][]user.WebhookAttempt),
+		failures: make(map[string]int),
+	}
+	for _, webhook := range webhooks {
+		s.webhooks[webhook.CompanyID] = webhook
+	}
+	return s
+}
+
+func (s *webhookStore) ReadWebhook(ctx context.Context, companyID string) (user.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhook, ok := s.webhooks[companyID]
+	if !ok {
+		return user.Webhook{}, user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+	}
+	return webhook, nil
+}
+
+func (s *webhookStore) WriteWebhook(ctx context.Context, webhook user.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.webhooks[webhook.CompanyID] = webhook
+	return nil
+}
+
+func (s *webhookStore) DeleteWebhook(ctx context.Context, companyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[companyID]; !ok {
+		return user.ErrNotFound{Err: fmt.Errorf("no webhook of company %s", companyID)}
+	}
+	delete(s.webhooks, companyID)
+	return nil
+}
+
+func (s *webhookStore) AppendWebhookAttempt(ctx context.Context, companyID string, attempt user.WebhookAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts[companyID] = append([]user.WebhookAttempt{attempt}, s.attempts[companyID]...)
+	return nil
+}
+
+func (s *webhookStore) ReadWebhookAttempts(ctx context.Context, companyID string, limit int) ([]user.WebhookAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts[companyID]
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+	return attempts, nil
+}
+
+func (s *webhookStore) AddWebhookFailure(ctx context.Context, companyID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[companyID]++
+	return s.failures[companyID], nil
+}
+
+func (s *webhookStore) WebhookFailures(ctx context.Context, companyID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failures[companyID], nil
+}
+
+func (s *webhookStore) ResetWebhookFailures(ctx context.Context, companyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resets++
+	delete(s.failures, companyID)
+	return nil
+}
+
+// webhookPoster answers with the next status of its list, the last one
+// repeats, and keeps the most requests it saw in flight at once.
+type webhookPoster struct {
+	mu          sync.Mutex
+	statuses    []int
+	delay       time.Duration
+	posted      int
+	inFlight    int
+	maxInFlight int
+}
+
+func (p *webhookPoster) PostWebhook(ctx context.Context, webhook user.Webhook, body []byte) (int, error) {
+	p.mu.Lock()
+	status := p.statuses[len(p.statuses)-1]
+	if p.posted < len(p.statuses) {
+		status = p.statuses[p.posted]
+	}
+	p.posted++
+	p.inFlight++
+	if p.inFlight > p.maxInFlight {
+		p.maxInFlight = p.inFlight
+	}
+	p.mu.Unlock()
+
+	time.Sleep(p.delay)
+
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+
+	if status >= 300 {
+		return status, fmt.Errorf("webhook responded %d", status)
+	}
+	return status, nil
+}
+
+func smsEventData(t *testing.T, smsID, companyID string) []byte {
+	data, err := json.Marshal(user.SmsEvent{SmsID: smsID, CompanyID: companyID, DeliveryStatus: user.StatusSmsDELIVERED})
+	if err != nil {
+		t.Fatalf("marshal sms event: %v", err)
+	}
+	return data
+}
+
+func TestWebhook_Handle(t *testing.T) {
+	hook := user.Webhook{CompanyID: "company-1", URL: "https://example.com/hook", Secret: "secret"}
+
+	tests := []struct {
+		name     string
+		statuses []int
+		posted   int
+		codes    []int
+	}{
+		{"delivered", []int{http.StatusOK}, 1, []int{200}},
+		{"retried", []int{http.StatusBadGateway, http.StatusTooManyRequests, http.StatusOK}, 3, []int{200, 429, 502}},
+		{"rejected", []int{http.StatusGone}, 1, []int{410}},
+		{"exhausted", []int{http.StatusInternalServerError}, 3, []int{500, 500, 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newWebhookStore(hook)
+			poster := &webhookPoster{statuses: tt.statuses}
+			h := &Webhook{
+				Webhooks: store,
+				Poster:   poster,
+				Backoff:  []time.Duration{time.Millisecond, time.Millisecond},
+			}
+
+			if err := h.Handle(context.Background(), smsEventData(t, "sms-1", "company-1")); err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+
+			if poster.posted != tt.posted {
+				t.Errorf("posted %d times, want %d", poster.posted, tt.posted)
+			}
+
+			attempts := store.attempts["company-1"]
+			var codes []int
+			for _, attempt := range attempts {
+				codes = append(codes, attempt.StatusCode)
+				if attempt.SmsID != "sms-1" || attempt.URL != hook.URL {
+					t.Errorf("attempt %+v, want one of sms-1 to %s", attempt, hook.URL)
+				}
+			}
+			if fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+				t.Errorf("attempts answered %v, want %v latest first", codes, tt.codes)
+			}
+			if attempts[0].Attempt != tt.posted {
+				t.Errorf("latest attempt is number %d, want %d", attempts[0].Attempt, tt.posted)
+			}
+		})
+	}
+}
+
+func TestWebhook_Skipped(t *testing.T) {
+	store := newWebhookStore(user.Webhook{CompanyID: "company-2", URL: "https://example.com/hook", Disabled: true})
+	poster := &webhookPoster{statuses: []int{http.StatusOK}}
+	h := &Webhook{Webhooks: store, Poster: poster}
+
+	for _, companyID := range []string{"", "company-1", "company-2"} {
+		if err := h.Handle(context.Background(), smsEventData(t, "sms-1", companyID)); err != nil {
+			t.Errorf("handle event of %q: %v", companyID, err)
+		}
+	}
+
+	if poster.posted != 0 {
+		t.Errorf("posted %d times, want none without an enabled webhook", poster.posted)
+	}
+}
+
+func TestWebhook_Disable(t *testing.T) {
+	store := newWebhookStore(user.Webhook{CompanyID: "company-1", URL: "https://example.com/hook"})
+	poster := &webhookPoster{statuses: []int{http.StatusInternalServerError, http.StatusOK, http.StatusInternalServerError}}
+	h := &Webhook{Webhooks: store, Poster: poster, DisableAfter: 2}
+
+	// a delivered event resets the failures in a row
+	for i := 0; i < 3; i++ {
+		if err := h.Handle(context.Background(), smsEventData(t, fmt.Sprintf("sms-%d", i), "company-1")); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	if webhook, _ := store.ReadWebhook(context.Background(), "company-1"); webhook.Disabled {
+		t.Fatalf("webhook disabled after failures which were not in a row")
+	}
+	if store.resets != 1 {
+		t.Errorf("failures reset %d times, want once after the failure", store.resets)
+	}
+
+	// another executor counts on from the failures in the store
+	other := &Webhook{Webhooks: store, Poster: poster, DisableAfter: 2}
+	if err := other.Handle(context.Background(), smsEventData(t, "sms-3", "company-1")); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	webhook, _ := store.ReadWebhook(context.Background(), "company-1")
+	if !webhook.Disabled || webhook.DisabledAt.IsZero() {
+		t.Fatalf("webhook %+v, want it disabled", webhook)
+	}
+
+	if err := h.Handle(context.Background(), smsEventData(t, "sms-4", "company-1")); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if poster.posted != 4 {
+		t.Errorf("posted %d times, want nothing posted to a disabled webhook", poster.posted)
+	}
+}
+
+func TestWebhook_Concurrency(t *testing.T) {
+	store := newWebhookStore(user.Webhook{CompanyID: "company-1", URL: "https://example.com/hook"})
+	poster := &webhookPoster{statuses: []int{http.StatusOK}, delay: 20 * time.Millisecond}
+	h := &Webhook{Webhooks: store, Poster: poster, Concurrency: 2}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := h.Handle(context.Background(), smsEventData(t, fmt.Sprintf("sms-%d", i), "company-1")); err != nil {
+				t.Errorf("handle: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if poster.posted != 8 || poster.maxInFlight != 2 {
+		t.Errorf("posted %d with %d in flight, want 8 with 2", poster.posted, poster.maxInFlight)
+	}
+}
+
+func TestWebhook_Stopped(t *testing.T) {
+	store := newWebhookStore(user.Webhook{CompanyID: "company-1", URL: "https://example.com/hook"})
+	poster := &webhookPoster{statuses: []int{http.StatusInternalServerError}}
+	h := &Webhook{Webhooks: store, Poster: poster, Backoff: []time.Duration{time.Hour}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// a retry waiting when the executor stops is left to be delivered again
+	if err := h.Handle(ctx, smsEventData(t, "sms-1", "company-1")); err == nil {
+		t.Errorf("handle = nil, want the context error")
+	}
+}
+
+func TestAttemptError(t *testing.T) {
+	for _, tt := range []struct {
+		statusCode int
+		err        error
+		want       string
+	}{
+		{http.StatusBadGateway, fmt.Errorf("webhook responded 502 Bad Gateway"), "webhook responded 502"},
+		{0, user.ErrInvalid{Field: "url", Err: fmt.Errorf("webhook address is not public")}, "webhook address is not public"},
+		{0, fmt.Errorf("error posting webhook: %w", context.DeadlineExceeded), "webhook timed out"},
+		{0, fmt.Errorf("error posting webhook: dial tcp 10.0.0.5:80: connect: connection refused"), "webhook connection failed"},
+	} {
+		if got := attemptError(tt.statusCode, tt.err); got != tt.want {
+			t.Errorf("attempt error of %d, %v = %q, want %q", tt.statusCode, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const defaultWebhookAttemptsLimit = 50
+
+// Webhooks serves the webhook of a company and its delivery attempts. A
+// company key manages the webhook of its company, an admin the one of the
+// company_id query parameter.
+type Webhooks struct {
+	Store user.WebhookStore
+	// URLs refuses the webhooks which lead to private addresses.
+	URLs user.WebhookURLChecker
+}
+
+type webhookRequest struct {
+	URL string `json:"url"`
+	// Secret signs the requests, one is generated when it is empty.
+	Secret string `json:"secret"`
+}
+
+// Webhook handles GET, PUT and DELETE /v1/webhook. Setting a webhook enables
+// it again.
+func (h *Webhooks) Webhook(w http.ResponseWriter, r *http.Request) {
+	companyID, ok := requestCompany(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webhook, err := h.Store.ReadWebhook(r.Context(), companyID)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		// the secret is only shown when it is set
+		webhook.Secret = ""
+		writeJSON(w, http.StatusOK, webhook)
+	case http.MethodPut:
+		h.put(w, r, companyID)
+	case http.MethodDelete:
+		if err := h.Store.DeleteWebhook(r.Context(), companyID); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (h *Webhooks) put(w http.ResponseWriter, r *http.Request, companyID string) {
+	var req webhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubmitBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, invalidResponse{Error: "url must be an absolute http or https URL", Field: "url"})
+		return
+	}
+
+	if h.URLs != nil {
+		if err := h.URLs.CheckWebhookURL(r.Context(), req.URL); err != nil {
+			writeQueueError(w, err)
+			return
+		}
+	}
+
+	if req.Secret == "" {
+		req.Secret, err = newSecret()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	webhook := user.Webhook{
+		CompanyID: companyID,
+		URL:       req.URL,
+		Secret:    req.Secret,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	if err := h.Store.WriteWebhook(r.Context(), webhook); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhook)
+}
+
+// Attempts handles GET /v1/webhook/attempts?limit=, the latest first.
+func (h *Webhooks) Attempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	companyID, ok := requestCompany(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultWebhookAttemptsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", v))
+			return
+		}
+	}
+
+	attempts, err := h.Store.ReadWebhookAttempts(r.Context(), companyID, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if attempts == nil {
+		attempts = []user.WebhookAttempt{}
+	}
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	var errNotFound user.ErrNotFound
+	if errors.As(err, &errNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// urlChecker refuses the webhooks of its hosts.
+type urlChecker map[string]bool
+
+func (c urlChecker) CheckWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || c[u.Hostname()] {
+		return user.ErrInvalid{Field: "url", Err: fmt.Errorf("host must only resolve to public addresses")}
+	}
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	store := newWebhookStore(user.Webhook{CompanyID: "company-1", URL: "https://example.com/old", Disabled: true})
+	store.attempts["company-1"] = []user.WebhookAttempt{{SmsID: "sms-2"}, {SmsID: "sms-1"}}
+	h := &Webhooks{Store: store, URLs: urlChecker{"private.example.com": true}}
+
+	request := func(handle http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-API-Key", token)
+
+		w := httptest.NewRecorder()
+		newAuth().Company(handle)(w, r)
+		return w
+	}
+
+	w := request(h.Webhook, http.MethodPut, "/v1/webhook", "company-token", `{"url":"https://example.com/hook"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("put status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var put user.Webhook
+	if err := json.Unmarshal(w.Body.Bytes(), &put); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if put.Secret == "" || put.Disabled || store.webhooks["company-1"].URL != "https://example.com/hook" {
+		t.Errorf("put %+v, want an enabled webhook with a generated secret", put)
+	}
+
+	w = request(h.Webhook, http.MethodGet, "/v1/webhook", "company-token", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), put.Secret) {
+		t.Errorf("get status = %d, want the webhook without its secret: %s", w.Code, w.Body)
+	}
+
+	w = request(h.Attempts, http.MethodGet, "/v1/webhook/attempts?limit=1", "company-token", "")
+	var attempts []user.WebhookAttempt
+	if err := json.Unmarshal(w.Body.Bytes(), &attempts); err != nil || len(attempts) != 1 || attempts[0].SmsID != "sms-2" {
+		t.Errorf("attempts = %s, want the latest one", w.Body)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		handle http.HandlerFunc
+		method string
+		target string
+		token  string
+		body   string
+		status int
+	}{
+		{"invalid url", h.Webhook, http.MethodPut, "/v1/webhook", "company-token", `{"url":"ftp://example.com"}`, http.StatusUnprocessableEntity},
+		{"private url", h.Webhook, http.MethodPut, "/v1/webhook", "company-token", `{"url":"http://private.example.com"}`, http.StatusUnprocessableEntity},
+		{"other company", h.Webhook, http.MethodGet, "/v1/webhook?company_id=company-2", "company-token", "", http.StatusForbidden},
+		{"admin without company", h.Webhook, http.MethodGet, "/v1/webhook", "admin-token", "", http.StatusBadRequest},
+		{"admin", h.Attempts, http.MethodGet, "/v1/webhook/attempts?company_id=company-1", "admin-token", "", http.StatusOK},
+		{"unknown", h.Webhook, http.MethodGet, "/v1/webhook?company_id=company-2", "admin-token", "", http.StatusNotFound},
+		{"delete", h.Webhook, http.MethodDelete, "/v1/webhook", "company-token", "", http.StatusNoContent},
+		{"delete again", h.Webhook, http.MethodDelete, "/v1/webhook", "company-token", "", http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.handle, tt.method, tt.target, tt.token, tt.body)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -6,12 +6,20 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/qosimmax/sms-executor/api/smsv1"
+	"github.com/qosimmax/sms-executor/client/disk"
+	"github.com/qosimmax/sms-executor/client/natskv"
 	"github.com/qosimmax/sms-executor/client/redis"
+	"github.com/qosimmax/sms-executor/client/webhook"
 
 	"github.com/qosimmax/sms-executor/client/smpp"
 
@@ -21,32 +29,74 @@ import (
 	"github.com/qosimmax/sms-executor/monitoring/trace"
 	"github.com/qosimmax/sms-executor/server/internal/event"
 	"github.com/qosimmax/sms-executor/server/internal/handler"
+	"github.com/qosimmax/sms-executor/user"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
-// Server holds an HTTP server, config and all the clients.
+// Server holds an HTTP server, a gRPC server, config and all the clients.
 type Server struct {
-	Config  *config.Config
-	HTTP    *http.Server
-	PubSub  *pubsub.Client
-	SMPP    *smpp.Client
-	Storage *redis.Client
+	Config   *config.Config
+	HTTP     *http.Server
+	GRPC     *grpc.Server
+	PubSub   *pubsub.Client
+	SMPP     *smpp.Client
+	Storage  user.StorageReadWriter
+	History  user.HistoryReaderWriter
+	APIKeys  user.APIKeyReaderWriter
+	Webhooks user.WebhookStore
+	OptOuts  user.OptOutReaderWriter
+	Webhook  *webhook.Client
+
+	events     *handler.EventStream
+	runtime    *event.Runtime
+	tracer     io.Closer
+	stopFetch  context.CancelFunc
+	stopEvents context.CancelFunc
+	fetching   sync.WaitGroup
+	listening  sync.WaitGroup
 }
 
 // Create sets up a server with necessary all clients.
 // Returns an error if an error occurs.
 func (s *Server) Create(ctx context.Context, config *config.Config) error {
+	// the gRPC API is served only behind api keys
+	if config.GRPCPort != "" && !config.APIAuth {
+		return fmt.Errorf("GRPC_PORT is set with API_AUTH disabled, enable API_AUTH or leave GRPC_PORT empty")
+	}
+
+	// messages in progress are kept by half the ack wait
+	if config.NatsConsumerAckWait < time.Second {
+		return fmt.Errorf("NATS_CONSUMER_ACK_WAIT is %s, it must be at least 1s", config.NatsConsumerAckWait)
+	}
 
 	var psClient pubsub.Client
 	if err := psClient.Init(ctx, config); err != nil {
 		return fmt.Errorf("pubsub client: %w", err)
 	}
 
-	var rdClient redis.Client
-	if err := rdClient.Init(ctx, config); err != nil {
-		return fmt.Errorf("redis client: %w", err)
+	storage, err := newStorage(ctx, config, config.StorageBackend)
+	if err != nil {
+		return err
+	}
+
+	var history user.HistoryReaderWriter
+	switch config.HistoryBackend {
+	case "", config.StorageBackend:
+		history = storage
+	case "none":
+	default:
+		history, err = newStorage(ctx, config, config.HistoryBackend)
+		if err != nil {
+			return fmt.Errorf("history: %w", err)
+		}
+	}
+
+	var webhookClient webhook.Client
+	if err := webhookClient.Init(ctx, config); err != nil {
+		return fmt.Errorf("webhook client: %w", err)
 	}
 
 	var smppClient smpp.Client
@@ -56,15 +106,64 @@ func (s *Server) Create(ctx context.Context, config *config.Config) error {
 
 	s.PubSub = &psClient
 	s.SMPP = &smppClient
-	s.Storage = &rdClient
+	s.Storage = storage
+	s.History = history
+	s.APIKeys = storage
+	s.Webhooks = storage
+	s.OptOuts = storage
+	s.Webhook = &webhookClient
+	s.events = &handler.EventStream{Buffer: config.EventStreamBuffer}
+	s.runtime = &event.Runtime{}
 	s.Config = config
 	s.HTTP = &http.Server{
 		Addr: fmt.Sprintf(":%s", s.Config.Port),
 	}
+	if s.Config.GRPCPort != "" {
+		auth := s.auth()
+		s.GRPC = grpc.NewServer(
+			grpc.UnaryInterceptor(auth.UnaryInterceptor),
+			grpc.StreamInterceptor(auth.StreamInterceptor),
+		)
+	}
 
 	return nil
 }
 
+// storageClient is implemented by every storage backend.
+type storageClient interface {
+	user.StorageReadWriter
+	user.HistoryReaderWriter
+	user.APIKeyReaderWriter
+	user.WebhookStore
+	user.OptOutReaderWriter
+}
+
+// newStorage sets up the client of a storage backend.
+func newStorage(ctx context.Context, config *config.Config, backend string) (storageClient, error) {
+	switch backend {
+	case "redis":
+		var rdClient redis.Client
+		if err := rdClient.Init(ctx, config); err != nil {
+			return nil, fmt.Errorf("redis client: %w", err)
+		}
+		return &rdClient, nil
+	case "nats":
+		var kvClient natskv.Client
+		if err := kvClient.Init(ctx, config); err != nil {
+			return nil, fmt.Errorf("nats kv client: %w", err)
+		}
+		return &kvClient, nil
+	case "disk":
+		var diskClient disk.Client
+		if err := diskClient.Init(ctx, config); err != nil {
+			return nil, fmt.Errorf("disk client: %w", err)
+		}
+		return &diskClient, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
 // Serve starts subscribing for messages.
 // It also makes sure that the server gracefully shuts down on exit.
 // Returns an error if an error occurs.
@@ -75,10 +174,13 @@ func (s *Server) Serve(ctx context.Context, errc chan<- error) {
 		errc <- err
 	}
 
-	defer closer.Close()
+	s.tracer = closer
 
 	go s.serveHTTP(errc)
-	go s.subscribeAndListen(ctx, errc)
+	if s.GRPC != nil {
+		go s.serveGRPC(errc)
+	}
+	s.subscribeAndListen(ctx, errc)
 
 	log.Info("Ready")
 
@@ -98,34 +200,300 @@ func (s *Server) serveHTTP(errc chan<- error) {
 
 	http.HandleFunc("/_healthz", handler.Healthz)
 
+	auth := s.auth()
+
+	// the admin routes need an admin key even with API_AUTH disabled
+	for path, handle := range s.adminRoutes() {
+		http.HandleFunc(path, auth.Admin(handle))
+	}
+
+	submit := s.submit()
+	sms := map[string]http.HandlerFunc{http.MethodPost: submit.Send}
+	http.HandleFunc("/v1/sms/batch", auth.Company(submit.SendBatch))
+
+	if s.History != nil {
+		history := &handler.History{Store: s.History}
+		http.HandleFunc("/v1/sms/", auth.Company(history.Get))
+		sms[http.MethodGet] = history.List
+	}
+	http.HandleFunc("/v1/sms", auth.Company(handler.ByMethod(sms)))
+
+	if s.Webhooks != nil {
+		webhooks := &handler.Webhooks{Store: s.Webhooks, URLs: s.Webhook}
+		http.HandleFunc("/v1/webhook", auth.Company(webhooks.Webhook))
+		http.HandleFunc("/v1/webhook/attempts", auth.Company(webhooks.Attempts))
+	}
+
+	if s.OptOuts != nil {
+		optOuts := &handler.OptOuts{Store: s.OptOuts}
+		http.HandleFunc("/v1/optouts", auth.Company(optOuts.OptOuts))
+	}
+
+	if s.events != nil {
+		http.HandleFunc("/v1/events/stream", auth.Company(s.events.Stream))
+		// the streams never end by themselves, they would hold up a shutdown
+		s.HTTP.RegisterOnShutdown(s.events.Close)
+	}
+
 	if err := s.HTTP.ListenAndServe(); err != http.ErrServerClosed {
 		errc <- err
 	}
 }
 
+// adminRoutes are the routes of the HTTP API which manage the executors and
+// their keys, which serveHTTP registers behind an admin key.
+func (s *Server) adminRoutes() map[string]http.HandlerFunc {
+	deadLetter := &handler.DeadLetter{Queue: s.PubSub}
+	admin := &handler.Admin{
+		Settings:  s.PubSub,
+		Binds:     s.PubSub,
+		Consumers: s.PubSub,
+		Operator:  s.Config.NatsTopic,
+		Classes:   s.Config.SmsClasses.Names(),
+	}
+
+	routes := map[string]http.HandlerFunc{
+		"/v1/dlq":                  deadLetter.List,
+		"/v1/dlq/replay":           deadLetter.Replay,
+		"/v1/admin/binds":          admin.ListBinds,
+		"/v1/admin/binds/rebind":   admin.Rebind,
+		"/v1/admin/settings":       admin.GetSettings,
+		"/v1/admin/ratelimit":      admin.SetRateLimit,
+		"/v1/admin/classes/pause":  admin.PauseClass,
+		"/v1/admin/classes/resume": admin.ResumeClass,
+		"/v1/admin/consumers":      admin.ListConsumers,
+	}
+
+	if s.APIKeys != nil {
+		keys := &handler.APIKeys{Store: s.APIKeys}
+		routes["/v1/admin/keys"] = handler.ByMethod(map[string]http.HandlerFunc{
+			http.MethodGet:  keys.List,
+			http.MethodPost: keys.Create,
+		})
+		routes["/v1/admin/keys/"] = keys.Delete
+	}
+
+	return routes
+}
+
+func (s *Server) serveGRPC(errc chan<- error) {
+	smsv1.RegisterSmsServiceServer(s.GRPC, &handler.GRPC{
+		Submit:  s.submit(),
+		History: s.History,
+		Events:  s.events,
+	})
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", s.Config.GRPCPort))
+	if err != nil {
+		errc <- fmt.Errorf("grpc listen: %w", err)
+		return
+	}
+
+	if err := s.GRPC.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+		errc <- err
+	}
+}
+
+// auth authenticates the HTTP and gRPC APIs alike.
+func (s *Server) auth() *handler.Auth {
+	return &handler.Auth{
+		Keys:        s.APIKeys,
+		AdminTokens: s.Config.AdminAPIKeys,
+		Disabled:    !s.Config.APIAuth,
+	}
+}
+
+// submit queues the sms of the HTTP and gRPC APIs alike.
+func (s *Server) submit() *handler.Submit {
+	return &handler.Submit{
+		Queue:       s.PubSub,
+		Classes:     s.Config.SmsClasses.Names(),
+		MaxSegments: s.Config.SubmitMaxSegments,
+		MaxBatch:    s.Config.SubmitMaxBatch,
+	}
+}
+
 func (s *Server) subscribeAndListen(ctx context.Context, errc chan<- error) {
-	for _, e := range event.GetPubSubEvents(s.Storage, s.SMPP, s.Config) {
+	fetchCtx, stopFetch := context.WithCancel(ctx)
+	eventsCtx, stopEvents := context.WithCancel(ctx)
+	s.stopFetch = stopFetch
+	s.stopEvents = stopEvents
+
+	// a class paused at runtime stays paused from the first fetch on, the
+	// settings event applies the changes after that
+	settings, _, err := s.PubSub.ReadSettings(ctx, s.Config.NatsTopic)
+	if err != nil {
+		errc <- fmt.Errorf("runtime settings: %w", err)
+	} else {
+		s.SMPP.ApplySettings(settings)
+		s.runtime.ApplySettings(settings)
+	}
+
+	for _, e := range event.GetSettingsEvents(s.SMPP, s.runtime) {
+		s.fetching.Add(1)
+		go func(e event.SettingsEvent) {
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx, s.PubSub, errc)
+		}(e)
+	}
+
+	for _, e := range event.GetBindEvents(s.SMPP) {
+		s.fetching.Add(1)
+		go func(e event.BindEvent) {
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx, s.PubSub, errc)
+		}(e)
+	}
+
+	for _, e := range event.GetPubSubEvents(s.PubSub, s.Storage, s.History, s.OptOuts, s.SMPP, s.runtime, s.Config) {
+		s.fetching.Add(1)
 		go func(e event.PubSubEvent) {
-			e.SubscribeAndListen(ctx, s.PubSub, errc)
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx, s.PubSub, errc)
 		}(e)
 	}
-	for _, e := range event.GetAppEvents() {
+	for _, e := range event.GetAppEvents(s.PubSub, s.Storage, s.History, s.Config) {
+		s.fetching.Add(1)
 		go func(e event.AppEvent) {
-			e.SubscribeAndListen(ctx)
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx)
+		}(e)
+	}
+
+	for _, e := range event.GetWebhookEvents(s.Webhooks, s.Webhook, s.Config) {
+		s.fetching.Add(1)
+		go func(e event.WebhookEvent) {
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx, s.PubSub, errc)
 		}(e)
 	}
 
-	for _, e := range event.GetSmppEvents(s.PubSub, s.Storage) {
+	for _, e := range event.GetStreamEvents(s.events) {
+		s.fetching.Add(1)
+		go func(e event.StreamEvent) {
+			defer s.fetching.Done()
+			e.SubscribeAndListen(fetchCtx, s.PubSub, errc)
+		}(e)
+	}
+
+	for _, e := range event.GetSmppEvents(s.PubSub, s.Storage, s.History, s.OptOuts, s.Config) {
+		s.listening.Add(1)
 		go func(e event.SmppEvent) {
-			e.SubscribeAndListen(ctx, s.SMPP)
+			defer s.listening.Done()
+			e.SubscribeAndListen(eventsCtx, s.SMPP)
 		}(e)
 	}
 
 }
 
+// shutdown stops the server in order, so that no message which was fetched
+// or submitted is lost: fetching stops, the fetched messages are handled,
+// the submits get their responses, the received events are handled, and
+// only then the smpp session and the nats connection are closed.
 func (s *Server) shutdown(ctx context.Context) {
-	if err := s.HTTP.Shutdown(ctx); err != nil {
-		log.Error(err.Error())
+	ctx, cancel := context.WithTimeout(ctx, s.Config.ShutdownTimeout)
+	defer cancel()
+
+	if s.HTTP != nil {
+		log.Info("Stopping http server")
+		if err := s.HTTP.Shutdown(ctx); err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	if s.GRPC != nil {
+		log.Info("Stopping grpc server")
+		// the event watches never end by themselves, like the http streams
+		if s.events != nil {
+			s.events.Close()
+		}
+		if err := stopGRPC(ctx, s.GRPC); err != nil {
+			log.Errorf("grpc calls were not finished: %v", err)
+		}
+	}
+
+	log.Info("Stopping fetch and jobs, waiting for in-flight messages")
+	s.stopFetch()
+	if err := wait(ctx, &s.fetching); err != nil {
+		log.Errorf("in-flight messages were not handled: %v", err)
+	}
+
+	log.Info("Waiting for submit responses")
+	if err := s.SMPP.WaitPending(ctx); err != nil {
+		log.Errorf("submit responses were not received: %v", err)
+	}
+
+	log.Info("Flushing smpp events")
+	s.stopEvents()
+	if err := wait(ctx, &s.listening); err != nil {
+		log.Errorf("smpp events were not flushed: %v", err)
+	}
+
+	log.Info("Unbinding smpp session")
+	if err := s.SMPP.Close(); err != nil {
+		log.Errorf("smpp unbind: %v", err)
+	}
+
+	log.Info("Draining nats connection")
+	if err := s.PubSub.Drain(ctx); err != nil {
+		log.Errorf("nats drain: %v", err)
 	}
 
+	if closer, ok := s.Storage.(io.Closer); ok {
+		log.Info("Closing storage")
+		if err := closer.Close(); err != nil {
+			log.Errorf("storage close: %v", err)
+		}
+	}
+
+	// a history kept in the storage is closed with it
+	if closer, ok := s.History.(io.Closer); ok && interface{}(s.History) != interface{}(s.Storage) {
+		log.Info("Closing history")
+		if err := closer.Close(); err != nil {
+			log.Errorf("history close: %v", err)
+		}
+	}
+
+	if s.tracer != nil {
+		log.Info("Closing tracer")
+		if err := s.tracer.Close(); err != nil {
+			log.Errorf("tracer close: %v", err)
+		}
+	}
+
+	log.Info("Shutdown complete")
+}
+
+// stopGRPC stops a gRPC server gracefully, and cancels the calls still
+// running when ctx is done.
+func stopGRPC(ctx context.Context, server *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.Stop()
+		return ctx.Err()
+	}
+}
+
+// wait waits for a wait group until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
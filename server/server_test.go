@@ -0,0 +1,1704 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kelseyhightower/envconfig"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/qosimmax/gosmpp/data"
+
+	"github.com/qosimmax/sms-executor/client/disk"
+	"github.com/qosimmax/sms-executor/client/pubsub"
+	"github.com/qosimmax/sms-executor/client/redis"
+	"github.com/qosimmax/sms-executor/client/smpp"
+	"github.com/qosimmax/sms-executor/client/webhook"
+	"github.com/qosimmax/sms-executor/config"
+	"github.com/qosimmax/sms-executor/server/internal/event"
+	"github.com/qosimmax/sms-executor/server/internal/handler"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+const testTopic = "test"
+
+// testEnv runs the executor against an embedded nats-server, the redis
+// store on miniredis and a local SMSC simulator.
+type testEnv struct {
+	t      *testing.T
+	config *config.Config
+	nats   *natsserver.Server
+	js     nats.JetStreamContext
+	smsc   *smsc
+	redis  *miniredis.Miniredis
+	// storage is the store of the running server, set by start
+	storage *faultStorage
+	events  chan user.SmsEvent
+	orphans chan user.SmsEvent
+	server  *Server
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	ns, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("nats server: %v", err)
+	}
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server is not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("nats connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("jetstream: %v", err)
+	}
+
+	// sms events are published with jetstream acks, so a stream has to
+	// capture them like the downstream services do in production.
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     "sms-events",
+		Subjects: []string{"sms.events.>"},
+	})
+	if err != nil {
+		t.Fatalf("events stream: %v", err)
+	}
+
+	e := &testEnv{
+		t:       t,
+		nats:    ns,
+		js:      js,
+		smsc:    newSmsc(t),
+		redis:   miniredis.RunT(t),
+		events:  make(chan user.SmsEvent, 1000),
+		orphans: make(chan user.SmsEvent, 100),
+	}
+
+	_, err = nc.Subscribe("sms.events.>", func(msg *nats.Msg) {
+		var smsEvent user.SmsEvent
+		if err := json.Unmarshal(msg.Data, &smsEvent); err != nil {
+			t.Errorf("unmarshal sms event: %v", err)
+			return
+		}
+
+		if want := fmt.Sprintf("sms.events.%s", smsEvent.DeliveryStatus); msg.Subject != want {
+			t.Errorf("sms event subject = %s, want %s", msg.Subject, want)
+		}
+
+		e.events <- smsEvent
+	})
+	if err != nil {
+		t.Fatalf("events subscribe: %v", err)
+	}
+
+	_, err = nc.Subscribe("sms.orphans.>", func(msg *nats.Msg) {
+		var smsEvent user.SmsEvent
+		if err := json.Unmarshal(msg.Data, &smsEvent); err != nil {
+			t.Errorf("unmarshal orphan receipt: %v", err)
+			return
+		}
+
+		e.orphans <- smsEvent
+	})
+	if err != nil {
+		t.Fatalf("orphans subscribe: %v", err)
+	}
+
+	t.Setenv("REDIS_ADDRESS", e.redis.Addr())
+	t.Setenv("NATS_URL", ns.ClientURL())
+	t.Setenv("NATS_TOPIC", testTopic)
+	t.Setenv("OPERATOR_URL", e.smsc.addr())
+	t.Setenv("OPERATOR_LOGIN", "login")
+	t.Setenv("OPERATOR_PASSWORD", "password")
+
+	e.config = &config.Config{}
+	if err := envconfig.Process("", e.config); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+
+	e.config.RateLimit = 100
+	e.config.MaxDeliver = 3
+	e.config.RedeliveryBackoff = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+	e.config.ReceiptParkBackoff = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+
+	return e
+}
+
+// start boots a server and returns a function which stops it.
+func (e *testEnv) start() (stop func()) {
+	e.t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var psClient pubsub.Client
+	if err := psClient.Init(ctx, e.config); err != nil {
+		e.t.Fatalf("pubsub client: %v", err)
+	}
+
+	var smppClient smpp.Client
+	if err := smppClient.Init(ctx, e.config); err != nil {
+		e.t.Fatalf("smpp client: %v", err)
+	}
+
+	var webhookClient webhook.Client
+	if err := webhookClient.Init(ctx, e.config); err != nil {
+		e.t.Fatalf("webhook client: %v", err)
+	}
+
+	var redisClient redis.Client
+	if err := redisClient.Init(ctx, e.config); err != nil {
+		e.t.Fatalf("redis client: %v", err)
+	}
+	e.storage = &faultStorage{Client: &redisClient}
+
+	s := Server{
+		Config:   e.config,
+		PubSub:   &psClient,
+		SMPP:     &smppClient,
+		Storage:  e.storage,
+		History:  e.storage,
+		APIKeys:  e.storage,
+		Webhooks: e.storage,
+		OptOuts:  e.storage,
+		Webhook:  &webhookClient,
+		events:   &handler.EventStream{Buffer: 16},
+		runtime:  &event.Runtime{},
+	}
+
+	errc := make(chan error, 1)
+	s.subscribeAndListen(ctx, errc)
+	e.server = &s
+
+	stopped := false
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+
+		s.shutdown(context.Background())
+		cancel()
+
+		select {
+		case err := <-errc:
+			e.t.Errorf("server error: %v", err)
+		default:
+		}
+	}
+	e.t.Cleanup(stop)
+
+	return stop
+}
+
+func (e *testEnv) publish(class string, data []byte) {
+	e.t.Helper()
+
+	_, err := e.js.Publish(fmt.Sprintf("sms.create.%s.%s", testTopic, class), data)
+	if err != nil {
+		e.t.Fatalf("publish: %v", err)
+	}
+}
+
+func (e *testEnv) publishSms(class string, smsData user.SmsData) {
+	e.t.Helper()
+
+	data, err := json.Marshal(smsData)
+	if err != nil {
+		e.t.Fatalf("marshal sms data: %v", err)
+	}
+
+	e.publish(class, data)
+}
+
+// expectEvents waits for exactly n events, failing on timeout or on any
+// extra event which arrives shortly afterwards.
+func (e *testEnv) expectEvents(n int) []user.SmsEvent {
+	e.t.Helper()
+
+	var events []user.SmsEvent
+	timeout := time.After(10 * time.Second)
+	for len(events) < n {
+		select {
+		case smsEvent := <-e.events:
+			events = append(events, smsEvent)
+		case <-timeout:
+			e.t.Fatalf("got %d events, want %d: %+v", len(events), n, events)
+		}
+	}
+
+	e.expectNoEvents(300 * time.Millisecond)
+
+	return events
+}
+
+func (e *testEnv) expectNoEvents(d time.Duration) {
+	e.t.Helper()
+
+	select {
+	case smsEvent := <-e.events:
+		e.t.Fatalf("unexpected event: %+v", smsEvent)
+	case <-time.After(d):
+	}
+}
+
+// expectAcked asserts that every message of the class consumer was acked.
+func (e *testEnv) expectAcked(durable string) {
+	e.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := e.js.ConsumerInfo(e.config.NatsStreamName, durable)
+		if err != nil {
+			e.t.Fatalf("consumer info: %v", err)
+		}
+
+		if info.NumAckPending == 0 && info.NumPending == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			e.t.Fatalf("consumer %s: ack pending %d, pending %d", durable, info.NumAckPending, info.NumPending)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// eventKey is the comparable part of an sms event, timestamps excluded.
+type eventKey struct {
+	SmsID             string
+	DeliveryStatus    string
+	CommandStatus     string
+	DestAddress       string
+	SequenceMessageID string
+	CompanyID         string
+	TariffID          int
+	IsUnicode         bool
+	Final             bool
+}
+
+func keysOf(events []user.SmsEvent) []eventKey {
+	keys := make([]eventKey, 0, len(events))
+	for _, smsEvent := range events {
+		keys = append(keys, eventKey{
+			SmsID:             smsEvent.SmsID,
+			DeliveryStatus:    smsEvent.DeliveryStatus,
+			CommandStatus:     smsEvent.CommandStatus,
+			DestAddress:       smsEvent.DestAddress,
+			SequenceMessageID: smsEvent.SequenceMessageID,
+			CompanyID:         smsEvent.CompanyID,
+			TariffID:          smsEvent.TariffID,
+			IsUnicode:         smsEvent.IsUnicode,
+			Final:             smsEvent.Final,
+		})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].SmsID != keys[j].SmsID {
+			return keys[i].SmsID < keys[j].SmsID
+		}
+		if keys[i].SequenceMessageID != keys[j].SequenceMessageID {
+			return keys[i].SequenceMessageID < keys[j].SequenceMessageID
+		}
+		// SENT sorts before any receipt of the same segment, and intermediate
+		// receipts before the final one
+		if rank(keys[i]) != rank(keys[j]) {
+			return rank(keys[i]) < rank(keys[j])
+		}
+		return keys[i].DeliveryStatus < keys[j].DeliveryStatus
+	})
+
+	return keys
+}
+
+func rank(key eventKey) int {
+	switch {
+	case key.DeliveryStatus == user.StatusSmsSent:
+		return 0
+	case !key.Final:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func assertEvents(t *testing.T, got []user.SmsEvent, want []eventKey) {
+	t.Helper()
+
+	gotKeys := keysOf(got)
+	if len(gotKeys) != len(want) {
+		t.Fatalf("got %d events, want %d:\n got: %+v\nwant: %+v", len(gotKeys), len(want), gotKeys, want)
+	}
+
+	for i := range want {
+		if gotKeys[i] != want[i] {
+			t.Errorf("event %d:\n got: %+v\nwant: %+v", i, gotKeys[i], want[i])
+		}
+	}
+}
+
+func newSmsData(id, recipient, message string) user.SmsData {
+	return user.SmsData{
+		SmsID:     id,
+		Message:   message,
+		Recipient: recipient,
+		CreatedAt: time.Now(),
+		NickName:  "Sender",
+		TariffID:  7,
+		CompanyID: "company-1",
+	}
+}
+
+// sent and receipt build the expected events of a delivered segment.
+func sent(smsData user.SmsData, messageID string) eventKey {
+	return eventKey{
+		SmsID:             smsData.SmsID,
+		DeliveryStatus:    user.StatusSmsSent,
+		CommandStatus:     data.ESME_ROK.String(),
+		DestAddress:       smsData.Recipient,
+		SequenceMessageID: messageID,
+		CompanyID:         smsData.CompanyID,
+		TariffID:          smsData.TariffID,
+		IsUnicode:         smsData.IsUnicode,
+	}
+}
+
+func receipt(smsData user.SmsData, messageID, stat string) eventKey {
+	return eventKey{
+		SmsID:             smsData.SmsID,
+		DeliveryStatus:    stat,
+		CommandStatus:     data.ESME_ROK.String(),
+		DestAddress:       smsData.Recipient,
+		SequenceMessageID: messageID,
+		CompanyID:         smsData.CompanyID,
+		TariffID:          smsData.TariffID,
+		IsUnicode:         smsData.IsUnicode,
+		Final:             user.StateOf(stat) == user.SmsFinal,
+	}
+}
+
+func TestServer_Classes(t *testing.T) {
+	for _, class := range []string{"otp", "default", "excel"} {
+		t.Run(class, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.start()
+
+			smsData := newSmsData("sms-"+class, "998901234567", "Your code is 1234")
+			e.publishSms(class, smsData)
+
+			assertEvents(t, e.expectEvents(2), []eventKey{
+				sent(smsData, "1001"),
+				receipt(smsData, "1001", user.StatusSmsDELIVERED),
+			})
+
+			submits := e.smsc.submitted()
+			if len(submits) != 1 {
+				t.Fatalf("got %d submits, want 1", len(submits))
+			}
+
+			if got := submits[0].SourceAddr.Address(); got != smsData.NickName {
+				t.Errorf("source address = %s, want %s", got, smsData.NickName)
+			}
+
+			message, _ := submits[0].Message.GetMessage()
+			if message != smsData.Message {
+				t.Errorf("message = %q, want %q", message, smsData.Message)
+			}
+		})
+	}
+}
+
+func TestServer_Multipart(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		segments  int
+		isUnicode bool
+	}{
+		{
+			name:     "gsm7",
+			message:  strings.Repeat("a", 200),
+			segments: 2,
+		},
+		{
+			name:      "ucs2",
+			message:   strings.Repeat("я", 100),
+			segments:  2,
+			isUnicode: true,
+		},
+		{
+			name:      "ucs2 single",
+			message:   strings.Repeat("я", 70),
+			segments:  1,
+			isUnicode: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.start()
+
+			smsData := newSmsData("sms-multipart", "998901234567", tt.message)
+			e.publishSms("default", smsData)
+			smsData.IsUnicode = tt.isUnicode
+
+			// only the receipt of the last segment finishes the sms
+			var want []eventKey
+			for i := 0; i < tt.segments; i++ {
+				messageID := fmt.Sprint(1001 + i)
+				delivered := receipt(smsData, messageID, user.StatusSmsDELIVERED)
+				delivered.Final = i == tt.segments-1
+				want = append(want, sent(smsData, messageID), delivered)
+			}
+
+			assertEvents(t, e.expectEvents(2*tt.segments), want)
+
+			submits := e.smsc.submitted()
+			if len(submits) != tt.segments {
+				t.Fatalf("got %d submits, want %d", len(submits), tt.segments)
+			}
+
+			for _, submit := range submits {
+				if tt.segments > 1 && submit.EsmClass != 0x40 {
+					t.Errorf("esm_class = %#x, want UDHI", submit.EsmClass)
+				}
+
+				if submit.SequenceNumber != submits[0].SequenceNumber {
+					t.Errorf("segments use different sequence numbers")
+				}
+			}
+		})
+	}
+}
+
+func TestServer_Failures(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	rejected := newSmsData("sms-rejected", "998900000001", "hello")
+	e.smsc.setRule(rejected.Recipient, smscRule{CommandStatus: data.ESME_RINVDSTADR})
+
+	undelivered := newSmsData("sms-undelivered", "998900000002", "hello")
+	e.smsc.setRule(undelivered.Recipient, smscRule{Stat: "UNDELIV"})
+
+	e.publishSms("otp", rejected)
+	e.publishSms("otp", undelivered)
+
+	// both are submitted concurrently, so either may get the first message id
+	events := e.expectEvents(3)
+	messageID := messageIDOf(events, undelivered.SmsID)
+	assertEvents(t, events, []eventKey{
+		{
+			SmsID:          rejected.SmsID,
+			DeliveryStatus: user.StatusSmsFailed,
+			CommandStatus:  data.ESME_RINVDSTADR.String(),
+			DestAddress:    rejected.Recipient,
+			CompanyID:      rejected.CompanyID,
+			TariffID:       rejected.TariffID,
+			Final:          true,
+		},
+		sent(undelivered, messageID),
+		receipt(undelivered, messageID, "UNDELIV"),
+	})
+
+	e.expectAcked(fmt.Sprintf("sms-executor:sms:otp:%s", testTopic))
+}
+
+func TestServer_OptOut(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	ctx := context.Background()
+	optedOut := newSmsData("sms-opted-out", "998900000001", "Sale today")
+	_ = e.storage.WriteOptOut(ctx, user.OptOut{Recipient: optedOut.Recipient})
+	// another sender of the company keeps sending
+	other := newSmsData("sms-other-sender", "998900000002", "Sale today")
+	_ = e.storage.WriteOptOut(ctx, user.OptOut{Recipient: other.Recipient, CompanyID: other.CompanyID, Sender: "Shop"})
+
+	rejected := func(smsData user.SmsData) eventKey {
+		return eventKey{
+			SmsID:          smsData.SmsID,
+			DeliveryStatus: user.StatusSmsRejected,
+			CommandStatus:  user.CommandStatusOptedOut,
+			DestAddress:    smsData.Recipient,
+			CompanyID:      smsData.CompanyID,
+			TariffID:       smsData.TariffID,
+			Final:          true,
+		}
+	}
+
+	e.publishSms("default", optedOut)
+	assertEvents(t, e.expectEvents(1), []eventKey{rejected(optedOut)})
+
+	otp := newSmsData("sms-otp", optedOut.Recipient, "Your code is 1234")
+	e.publishSms("otp", otp)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(otp, "1001"),
+		receipt(otp, "1001", user.StatusSmsDELIVERED),
+	})
+
+	e.publishSms("default", other)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(other, "1002"),
+		receipt(other, "1002", user.StatusSmsDELIVERED),
+	})
+
+	if len(e.smsc.submitted()) != 2 {
+		t.Errorf("submitted %d sms, want the otp and the other sender", len(e.smsc.submitted()))
+	}
+	if history, err := e.storage.ReadHistory(ctx, optedOut.CompanyID, optedOut.SmsID); err != nil || !history.Final {
+		t.Errorf("history of the rejected sms = %+v, %v", history, err)
+	}
+
+	// the recipient replies to a sms of the company
+	before := newSmsData("sms-before-reply", "998900000003", "Sale today")
+	e.publishSms("default", before)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(before, "1003"),
+		receipt(before, "1003", user.StatusSmsDELIVERED),
+	})
+
+	e.smsc.sendMO("998900000003", "Sender", "Stop")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		optOuts, _ := e.storage.ListOptOuts(ctx, "998900000003")
+		if len(optOuts) == 2 {
+			sort.Slice(optOuts, func(i, j int) bool { return optOuts[i].CompanyID < optOuts[j].CompanyID })
+			if optOuts[0].Sender != "Sender" || optOuts[0].Keyword != "STOP" {
+				t.Errorf("opt-out = %+v, want one of Sender by keyword", optOuts[0])
+			}
+			if optOuts[1].CompanyID != before.CompanyID || optOuts[1].Sender != "" || optOuts[1].Keyword != "STOP" {
+				t.Errorf("opt-out = %+v, want one of the company by keyword", optOuts[1])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no opt-out after the stop keyword")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// another sender of the company is stopped too
+	replied := newSmsData("sms-replied", "998900000003", "Sale today")
+	replied.NickName = "Shop"
+	e.publishSms("excel", replied)
+	assertEvents(t, e.expectEvents(1), []eventKey{rejected(replied)})
+}
+
+func TestServer_NonRecoverable(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	expired := newSmsData("sms-expired", "998901234567", "hello")
+	expired.CreatedAt = time.Now().Add(-4 * time.Hour)
+
+	e.publish("default", []byte("{not json"))
+	e.publishSms("default", expired)
+
+	e.expectNoEvents(time.Second)
+	e.expectAcked(fmt.Sprintf("sms-executor:sms:%s", testTopic))
+
+	if submits := e.smsc.submitted(); len(submits) != 0 {
+		t.Fatalf("got %d submits, want 0", len(submits))
+	}
+
+	deadLetters := e.expectDeadLetters(2)
+	for _, deadLetter := range deadLetters {
+		if want := fmt.Sprintf("sms.dlq.%s.default", testTopic); deadLetter.Subject != want {
+			t.Errorf("dead letter subject = %s, want %s", deadLetter.Subject, want)
+		}
+
+		if want := fmt.Sprintf("sms.create.%s.default", testTopic); deadLetter.OriginalSubject != want {
+			t.Errorf("dead letter original subject = %s, want %s", deadLetter.OriginalSubject, want)
+		}
+
+		if deadLetter.DeliveryCount != 1 {
+			t.Errorf("dead letter delivery count = %d, want 1", deadLetter.DeliveryCount)
+		}
+	}
+
+	// the messages are handled concurrently, so the dead letters may be in
+	// either order
+	if string(deadLetters[0].Data) != "{not json" {
+		deadLetters[0], deadLetters[1] = deadLetters[1], deadLetters[0]
+	}
+
+	if string(deadLetters[0].Data) != "{not json" || !strings.Contains(deadLetters[0].Error, "unmarshal") {
+		t.Errorf("unexpected dead letter: %+v", deadLetters[0])
+	}
+
+	if !strings.Contains(deadLetters[1].Error, "timeout") {
+		t.Errorf("unexpected dead letter error: %s", deadLetters[1].Error)
+	}
+}
+
+func TestServer_DeadLetterReplay(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	e.publish("otp", []byte("{not json"))
+	deadLetters := e.expectDeadLetters(1)
+
+	deadLetter := &handler.DeadLetter{Queue: e.server.PubSub}
+
+	rec := httptest.NewRecorder()
+	deadLetter.Replay(rec, httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/v1/dlq/replay?sequence=%d", deadLetters[0].Sequence), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("replay status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// the replayed message fails again and is parked under a new sequence
+	replayed := e.expectDeadLetters(1)
+	if replayed[0].Sequence == deadLetters[0].Sequence {
+		t.Errorf("dead letter was not replayed")
+	}
+
+	rec = httptest.NewRecorder()
+	deadLetter.List(rec, httptest.NewRequest(http.MethodGet,
+		fmt.Sprintf("/v1/dlq?subject=sms.dlq.%s.otp", testTopic), nil))
+
+	var listed []user.DeadLetter
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("unmarshal dead letters: %v", err)
+	}
+
+	if len(listed) != 1 || listed[0].Sequence != replayed[0].Sequence {
+		t.Errorf("listed dead letters = %+v, want sequence %d", listed, replayed[0].Sequence)
+	}
+
+	rec = httptest.NewRecorder()
+	deadLetter.List(rec, httptest.NewRequest(http.MethodGet, "/v1/dlq?limit=1001", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("list above the limit status = %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	deadLetter.Replay(rec, httptest.NewRequest(http.MethodPost,
+		fmt.Sprintf("/v1/dlq/replay?sequence=%d", deadLetters[0].Sequence), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("replay of a removed dead letter status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServer_DeadLetterReplayOnce(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	// a sms parked by an earlier failure which is fixed by now, without a
+	// sms_id nothing but the stream drops a second replay
+	smsData := newSmsData("", "998901234567", "hello")
+	data, _ := json.Marshal(smsData)
+	msg := nats.NewMsg(fmt.Sprintf("sms.create.%s.otp", testTopic))
+	msg.Data = data
+	if err := e.server.PubSub.PublishDeadLetter(context.Background(), msg, errors.New("storage is unavailable")); err != nil {
+		t.Fatalf("publish dead letter: %v", err)
+	}
+	deadLetters := e.expectDeadLetters(1)
+
+	// concurrent replays of the entry publish it once
+	deadLetter := &handler.DeadLetter{Queue: e.server.PubSub}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadLetter.Replay(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost,
+				fmt.Sprintf("/v1/dlq/replay?sequence=%d", deadLetters[0].Sequence), nil))
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(e.smsc.submitted()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if submits := e.smsc.submitted(); len(submits) != 1 {
+		t.Errorf("got %d submits, want 1", len(submits))
+	}
+}
+
+// expectDeadLetters waits until exactly n dead letters are parked.
+func (e *testEnv) expectDeadLetters(n int) []user.DeadLetter {
+	e.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deadLetters, err := e.server.PubSub.DeadLetters(context.Background(), "", 0, 100)
+		if err != nil {
+			e.t.Fatalf("dead letters: %v", err)
+		}
+
+		if len(deadLetters) == n {
+			return deadLetters
+		}
+
+		if time.Now().After(deadline) {
+			e.t.Fatalf("got %d dead letters, want %d", len(deadLetters), n)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestServer_Redelivery(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	smsData := newSmsData("sms-retry", "998901234567", "hello")
+	e.storage.failWrites(2)
+	e.publishSms("otp", smsData)
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+
+	if attempts := e.storage.attempts(); attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestServer_RedeliveryExhausted(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	smsData := newSmsData("sms-exhausted", "998901234567", "hello")
+	e.storage.failWrites(-1)
+	e.publishSms("default", smsData)
+
+	assertEvents(t, e.expectEvents(1), []eventKey{
+		{
+			SmsID:          smsData.SmsID,
+			DeliveryStatus: user.StatusSmsFailed,
+			CommandStatus:  user.CommandStatusRetriesExhausted,
+			DestAddress:    smsData.Recipient,
+			CompanyID:      smsData.CompanyID,
+			TariffID:       smsData.TariffID,
+			Final:          true,
+		},
+	})
+
+	if attempts := e.storage.attempts(); attempts != e.config.MaxDeliver {
+		t.Errorf("got %d attempts, want %d", attempts, e.config.MaxDeliver)
+	}
+
+	if submits := e.smsc.submitted(); len(submits) != 0 {
+		t.Fatalf("got %d submits, want 0", len(submits))
+	}
+
+	e.expectAcked(fmt.Sprintf("sms-executor:sms:%s", testTopic))
+}
+
+func TestServer_Duplicates(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	smsData := newSmsData("sms-dup", "998901234567", "hello")
+	subject := fmt.Sprintf("sms.create.%s.otp", testTopic)
+
+	// republished within the duplicate window, dropped by the stream
+	for i := 0; i < 3; i++ {
+		if err := e.server.PubSub.PublishSms(context.Background(), subject, smsData); err != nil {
+			t.Fatalf("publish sms: %v", err)
+		}
+	}
+
+	info, err := e.js.StreamInfo(e.config.NatsStreamName)
+	if err != nil {
+		t.Fatalf("stream info: %v", err)
+	}
+
+	if info.State.Msgs != 1 {
+		t.Errorf("stream holds %d messages, want 1", info.State.Msgs)
+	}
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+
+	// published without a message id, dropped by the handler
+	e.publishSms("default", smsData)
+	e.expectNoEvents(500 * time.Millisecond)
+	e.expectAcked(fmt.Sprintf("sms-executor:sms:%s", testTopic))
+
+	if submits := e.smsc.submitted(); len(submits) != 1 {
+		t.Fatalf("got %d submits, want 1", len(submits))
+	}
+
+	// the same sms_id of another company is another sms
+	other := smsData
+	other.CompanyID = "company-2"
+	if err := e.server.PubSub.PublishSms(context.Background(), subject, other); err != nil {
+		t.Fatalf("publish sms: %v", err)
+	}
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(other, "1002"),
+		receipt(other, "1002", user.StatusSmsDELIVERED),
+	})
+}
+
+func TestServer_PendingDuplicate(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	// another delivery is submitting the sms for longer than the backoff
+	ctx := context.Background()
+	smsData := newSmsData("sms-pending", "998901234567", "hello")
+	if _, err := e.storage.ClaimSubmission(ctx, smsData.CompanyID, smsData.SmsID); err != nil {
+		t.Fatalf("claim submission: %v", err)
+	}
+
+	e.publishSms("default", smsData)
+	e.expectNoEvents(2 * time.Second)
+
+	// the other delivery failed, the duplicate submits it
+	if err := e.storage.ReleaseSubmission(ctx, smsData.CompanyID, smsData.SmsID); err != nil {
+		t.Fatalf("release submission: %v", err)
+	}
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+}
+
+func TestServer_StreamReconcile(t *testing.T) {
+	e := newTestEnv(t)
+	stop := e.start()
+	stop()
+
+	e.config.NatsStreamMaxAge = time.Hour
+	e.config.NatsStreamMaxBytes = 1 << 20
+	e.config.NatsConsumerMaxAckPending = 50
+	e.start()
+
+	info, err := e.js.StreamInfo(e.config.NatsStreamName)
+	if err != nil {
+		t.Fatalf("stream info: %v", err)
+	}
+
+	if info.Config.MaxAge != time.Hour || info.Config.MaxBytes != 1<<20 {
+		t.Errorf("stream max age = %s, max bytes = %d", info.Config.MaxAge, info.Config.MaxBytes)
+	}
+
+	durable := fmt.Sprintf("sms-executor:sms:otp:%s", testTopic)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		consumer, err := e.js.ConsumerInfo(e.config.NatsStreamName, durable)
+		if err == nil && consumer.Config.MaxAckPending == 50 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer %s was not updated: %v", durable, err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestServer_Restart(t *testing.T) {
+	e := newTestEnv(t)
+	stop := e.start()
+
+	first := newSmsData("sms-1", "998901234567", "first")
+	e.publishSms("otp", first)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(first, "1001"),
+		receipt(first, "1001", user.StatusSmsDELIVERED),
+	})
+
+	stop()
+
+	// messages published while the executor is down wait in the stream
+	second := newSmsData("sms-2", "998901234568", "second")
+	third := newSmsData("sms-3", "998901234569", "third")
+	e.publishSms("otp", second)
+	e.publishSms("excel", third)
+	e.expectNoEvents(500 * time.Millisecond)
+
+	e.start()
+
+	events := e.expectEvents(4)
+	secondID, thirdID := messageIDOf(events, second.SmsID), messageIDOf(events, third.SmsID)
+	assertEvents(t, events, []eventKey{
+		sent(second, secondID),
+		receipt(second, secondID, user.StatusSmsDELIVERED),
+		sent(third, thirdID),
+		receipt(third, thirdID, user.StatusSmsDELIVERED),
+	})
+
+	if submits := e.smsc.submitted(); len(submits) != 3 {
+		t.Fatalf("got %d submits, want 3", len(submits))
+	}
+}
+
+func TestServer_ReceiptAfterRestart(t *testing.T) {
+	e := newTestEnv(t)
+	stop := e.start()
+
+	smsData := newSmsData("sms-late", "998901234567", "hello")
+	e.smsc.setRule(smsData.Recipient, smscRule{Stat: "DELIVRD", ReceiptDelay: 2 * time.Second})
+	e.publishSms("default", smsData)
+
+	assertEvents(t, e.expectEvents(1), []eventKey{
+		sent(smsData, "1001"),
+	})
+
+	stop()
+	e.start()
+
+	// the receipt arrives on the new bind and is matched via storage
+	assertEvents(t, e.expectEvents(1), []eventKey{
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+}
+
+func messageIDOf(events []user.SmsEvent, smsID string) string {
+	for _, smsEvent := range events {
+		if smsEvent.SmsID == smsID && smsEvent.DeliveryStatus == user.StatusSmsSent {
+			return smsEvent.SequenceMessageID
+		}
+	}
+
+	return ""
+}
+
+func TestServer_CompanyFairness(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.config.SmsClasses.Decode("otp:priority=1,default:weight=1,excel:weight=1:fair=true:batch=5"); err != nil {
+		t.Fatalf("sms classes: %v", err)
+	}
+
+	// the first run creates the stream with the per-company subjects
+	stop := e.start()
+	stop()
+
+	// company A queues a bulk campaign just before company B sends a few
+	for i := 0; i < 40; i++ {
+		e.publishSms("excel.A", newSmsData(fmt.Sprintf("sms-a-%d", i), fmt.Sprintf("99890100%04d", i), "campaign"))
+	}
+	for i := 0; i < 5; i++ {
+		e.publishSms("excel.B", newSmsData(fmt.Sprintf("sms-b-%d", i), fmt.Sprintf("99890200%04d", i), "invoice"))
+	}
+
+	e.start()
+
+	var sentIDs []string
+	for _, smsEvent := range e.expectEvents(90) {
+		if smsEvent.DeliveryStatus == user.StatusSmsSent {
+			sentIDs = append(sentIDs, smsEvent.SmsID)
+		}
+	}
+
+	// B is served in turn with A instead of after the whole campaign
+	last := -1
+	for i, smsID := range sentIDs {
+		if strings.HasPrefix(smsID, "sms-b-") {
+			last = i
+		}
+	}
+
+	if last < 0 || last >= 20 {
+		t.Errorf("last sms of company B was sent as %d of %d: %v", last+1, len(sentIDs), sentIDs)
+	}
+
+	e.expectAcked("sms-executor:sms:excel:test:A")
+	e.expectAcked("sms-executor:sms:excel:test:B")
+
+	// the consumers of the companies are deleted once unused
+	info, err := e.js.ConsumerInfo(e.config.NatsStreamName, "sms-executor:sms:excel:test:A")
+	if err != nil {
+		t.Fatalf("consumer info: %v", err)
+	}
+	// not before the sms it handled are too old for a new consumer
+	if info.Config.InactiveThreshold <= user.SmsLifetime {
+		t.Errorf("inactive threshold = %s, want more than the sms lifetime", info.Config.InactiveThreshold)
+	}
+}
+
+func TestServer_GracefulShutdown(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.RateLimit = 20
+	e.config.Workers = 2
+	stop := e.start()
+
+	var all []user.SmsData
+	for i := 0; i < 10; i++ {
+		smsData := newSmsData(fmt.Sprintf("sms-%d", i), fmt.Sprintf("99890123%04d", i), "hello")
+		e.publishSms("default", smsData)
+		all = append(all, smsData)
+	}
+
+	// stop while the rate limiter still holds back part of the messages
+	time.Sleep(150 * time.Millisecond)
+	stop()
+
+	submitted := len(e.smsc.submitted())
+	if submitted == 0 || submitted == len(all) {
+		t.Fatalf("got %d submits before shutdown, want some of %d", submitted, len(all))
+	}
+
+	// every submit got its response handled before the session was closed
+	sentIDs := e.expectSent(submitted, 300*time.Millisecond)
+
+	// the rest was left in the stream and is sent after a restart
+	e.start()
+	sentIDs = append(sentIDs, e.expectSent(len(all)-submitted, 5*time.Second)...)
+
+	sort.Strings(sentIDs)
+	for i := 1; i < len(sentIDs); i++ {
+		if sentIDs[i] == sentIDs[i-1] {
+			t.Errorf("%s was sent twice", sentIDs[i])
+		}
+	}
+
+	if submits := e.smsc.submitted(); len(submits) != len(all) {
+		t.Errorf("got %d submits, want %d", len(submits), len(all))
+	}
+}
+
+// expectSent waits for exactly n SENT events, ignoring receipts, and
+// returns their sms ids.
+func (e *testEnv) expectSent(n int, timeout time.Duration) []string {
+	e.t.Helper()
+
+	var sentIDs []string
+	deadline := time.After(timeout)
+	for len(sentIDs) < n {
+		select {
+		case smsEvent := <-e.events:
+			if smsEvent.DeliveryStatus == user.StatusSmsSent {
+				sentIDs = append(sentIDs, smsEvent.SmsID)
+			}
+		case <-deadline:
+			e.t.Fatalf("got %d sent events, want %d: %v", len(sentIDs), n, sentIDs)
+		}
+	}
+
+	quiet := time.After(300 * time.Millisecond)
+	for {
+		select {
+		case smsEvent := <-e.events:
+			if smsEvent.DeliveryStatus == user.StatusSmsSent {
+				e.t.Fatalf("unexpected sent event: %+v", smsEvent)
+			}
+		case <-quiet:
+			return sentIDs
+		}
+	}
+}
+
+func TestServer_TwoInstances(t *testing.T) {
+	e := newTestEnv(t)
+
+	// both instances share the storage and consume the same classes, a
+	// sequence number handed out twice would attribute events to the
+	// wrong sms
+	e.start()
+	e.start()
+
+	var all []user.SmsData
+	for i := 0; i < 40; i++ {
+		smsData := newSmsData(fmt.Sprintf("sms-%02d", i), fmt.Sprintf("99890123%04d", i), fmt.Sprintf("message %d", i))
+		e.publishSms("default", smsData)
+		all = append(all, smsData)
+	}
+
+	events := e.expectEvents(2 * len(all))
+
+	var want []eventKey
+	for _, smsData := range all {
+		messageID := messageIDOf(events, smsData.SmsID)
+		want = append(want, sent(smsData, messageID), receipt(smsData, messageID, user.StatusSmsDELIVERED))
+	}
+	assertEvents(t, events, want)
+
+	if submits := e.smsc.submitted(); len(submits) != len(all) {
+		t.Errorf("got %d submits, want %d", len(submits), len(all))
+	}
+}
+
+func TestServer_IntermediateReceipts(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	smsData := newSmsData("sms-enroute", "998901234567", "hello")
+	e.smsc.setRule(smsData.Recipient, smscRule{Stat: "DELIVRD", Intermediate: []string{"ENROUTE", "ACCEPTD"}})
+	e.publishSms("default", smsData)
+
+	// the final receipt is still matched after the intermediate ones
+	events := e.expectEvents(4)
+	assertEvents(t, events, []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", "ACCEPTD"),
+		receipt(smsData, "1001", "ENROUTE"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+
+	var statuses []string
+	for _, smsEvent := range events {
+		statuses = append(statuses, smsEvent.DeliveryStatus)
+	}
+	if want := []string{"SENT", "ENROUTE", "ACCEPTD", "DELIVRD"}; strings.Join(statuses, ",") != strings.Join(want, ",") {
+		t.Errorf("events in order %v, want %v", statuses, want)
+	}
+
+	// the correlation is kept final until the end of the validity
+	if smsData, _ := e.storage.ReadMessageSequence(context.Background(), "1001"); smsData.State != user.SmsFinal {
+		t.Errorf("correlation of a delivered sms = %+v, want it final", smsData)
+	}
+
+	// a late intermediate receipt of the delivered sms is dropped
+	e.smsc.deliver(e.smsc.submitted()[0], "1001", "ENROUTE")
+	e.expectNoEvents(500 * time.Millisecond)
+
+	select {
+	case orphan := <-e.orphans:
+		t.Errorf("late receipt reported as orphan: %+v", orphan)
+	default:
+	}
+}
+
+func TestServer_PlainReceipt(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	// a receipt without the esm_class bits whose dates don't parse is still
+	// a receipt, not a message of the recipient
+	smsData := newSmsData("sms-plain", "998901234567", "hello")
+	e.smsc.setRule(smsData.Recipient, smscRule{Stat: "DELIVRD", PlainReceipt: true})
+	e.publishSms("default", smsData)
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+
+	select {
+	case orphan := <-e.orphans:
+		t.Errorf("unexpected orphan receipt: %+v", orphan)
+	default:
+	}
+}
+
+func TestServer_ParkedReceipt(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	// the receipt arrives 100ms after the submit, before the correlation
+	e.storage.lagMessageWrites(250 * time.Millisecond)
+
+	smsData := newSmsData("sms-early", "998901234567", "hello")
+	e.publishSms("default", smsData)
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+
+	select {
+	case orphan := <-e.orphans:
+		t.Errorf("unexpected orphan receipt: %+v", orphan)
+	default:
+	}
+}
+
+func TestServer_OrphanReceipt(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	// the correlation is never written within the parking time
+	e.storage.lagMessageWrites(10 * time.Second)
+
+	smsData := newSmsData("sms-orphan", "998901234567", "hello")
+	e.publishSms("default", smsData)
+
+	assertEvents(t, e.expectEvents(1), []eventKey{
+		sent(smsData, "1001"),
+	})
+
+	select {
+	case orphan := <-e.orphans:
+		if orphan.SequenceMessageID != "1001" || orphan.DeliveryStatus != user.StatusSmsDELIVERED {
+			t.Errorf("unexpected orphan receipt: %+v", orphan)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no orphan receipt")
+	}
+}
+
+func TestServer_ExpiredSweep(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.ExpirySweepInterval = 100 * time.Millisecond
+	e.config.ExpirySweepJitter = 0
+	// redis keeps the expiries in whole seconds
+	e.config.SmsValidity = 2 * time.Second
+	e.start()
+
+	// the smsc never sends a receipt for it
+	smsData := newSmsData("sms-no-receipt", "998901234567", "hello")
+	e.smsc.setRule(smsData.Recipient, smscRule{})
+	e.publishSms("default", smsData)
+
+	events := e.expectEvents(2)
+	assertEvents(t, events, []eventKey{
+		sent(smsData, "1001"),
+		{
+			SmsID:             smsData.SmsID,
+			DeliveryStatus:    user.StatusExpired,
+			CommandStatus:     user.CommandStatusNoReceipt,
+			DestAddress:       smsData.Recipient,
+			SequenceMessageID: "1001",
+			CompanyID:         smsData.CompanyID,
+			TariffID:          smsData.TariffID,
+			Final:             true,
+		},
+	})
+
+	if smsData, _ := e.storage.ReadMessageSequence(context.Background(), "1001"); smsData.SmsID != "" {
+		t.Errorf("correlation of an expired sms was kept: %+v", smsData)
+	}
+
+	// a delivered sms is not expired, its correlation is only removed
+	delivered := newSmsData("sms-delivered", "998901234568", "hello")
+	e.publishSms("default", delivered)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(delivered, "1002"),
+		receipt(delivered, "1002", user.StatusSmsDELIVERED),
+	})
+	e.expectNoEvents(2 * time.Second)
+
+	if smsData, _ := e.storage.ReadMessageSequence(context.Background(), "1002"); smsData.SmsID != "" {
+		t.Errorf("correlation of a delivered sms was kept: %+v", smsData)
+	}
+
+	// a multipart sms expires once, with the last of its segments
+	multipart := newSmsData("sms-multipart", "998901234569", strings.Repeat("a", 200))
+	e.smsc.setRule(multipart.Recipient, smscRule{})
+	e.publishSms("default", multipart)
+
+	events = e.expectEvents(3)
+	assertEvents(t, events, []eventKey{
+		sent(multipart, "1003"),
+		sent(multipart, "1004"),
+		{
+			SmsID:             multipart.SmsID,
+			DeliveryStatus:    user.StatusExpired,
+			CommandStatus:     user.CommandStatusNoReceipt,
+			DestAddress:       multipart.Recipient,
+			SequenceMessageID: events[2].SequenceMessageID,
+			CompanyID:         multipart.CompanyID,
+			TariffID:          multipart.TariffID,
+			Final:             true,
+		},
+	})
+	e.expectNoEvents(2 * time.Second)
+
+	for _, messageID := range []string{"1003", "1004"} {
+		if smsData, _ := e.storage.ReadMessageSequence(context.Background(), messageID); smsData.SmsID != "" {
+			t.Errorf("correlation of an expired segment was kept: %+v", smsData)
+		}
+	}
+}
+
+func TestServer_History(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	smsData := newSmsData("sms-history", "998901234567", strings.Repeat("a", 200))
+	e.publishSms("default", smsData)
+	e.expectEvents(4)
+
+	// the history is written after the events are published
+	var history user.SmsHistory
+	deadline := time.Now().Add(5 * time.Second)
+	for len(history.Entries) < 6 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		history, _ = e.storage.ReadHistory(context.Background(), smsData.CompanyID, smsData.SmsID)
+	}
+
+	if history.Recipient != smsData.Recipient || history.NickName != smsData.NickName || history.CompanyID != smsData.CompanyID {
+		t.Errorf("history = %+v, want the sms metadata", history)
+	}
+
+	sort.Strings(history.MessageIDs)
+	if fmt.Sprint(history.MessageIDs) != "[1001 1002]" {
+		t.Errorf("message ids = %v, want one per segment", history.MessageIDs)
+	}
+
+	if history.Status != user.StatusSmsDELIVERED || !history.Final {
+		t.Errorf("status = %s final = %v, want a final %s", history.Status, history.Final, user.StatusSmsDELIVERED)
+	}
+
+	kinds := map[string]int{}
+	for _, entry := range history.Entries {
+		kinds[entry.Kind+":"+entry.DeliveryStatus]++
+	}
+
+	want := map[string]int{
+		user.HistoryReceived + ":":                        1,
+		user.HistorySubmitted + ":":                       1,
+		user.HistoryEvent + ":" + user.StatusSmsSent:      2,
+		user.HistoryEvent + ":" + user.StatusSmsDELIVERED: 2,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("entries = %v, want %v", kinds, want)
+	}
+}
+
+func TestServer_Submit(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	submit := &handler.Submit{
+		Queue:   e.server.PubSub,
+		Classes: e.config.SmsClasses.Names(),
+	}
+
+	smsData := newSmsData("sms-api", "998901234567", "hello")
+	body, err := json.Marshal(smsData)
+	if err != nil {
+		t.Fatalf("marshal sms: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	submit.Send(w, httptest.NewRequest(http.MethodPost, "/v1/sms", bytes.NewReader(body)))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	// default is a fair class, the sms goes to the subject of its company
+	subject := fmt.Sprintf("sms.create.%s.default.company-1", testTopic)
+	if _, err := e.js.GetLastMsg(e.config.NatsStreamName, subject); err != nil {
+		t.Errorf("no sms on %s: %v", subject, err)
+	}
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(smsData, "1001"),
+		receipt(smsData, "1001", user.StatusSmsDELIVERED),
+	})
+}
+
+func TestServer_Webhook(t *testing.T) {
+	e := newTestEnv(t)
+
+	// the test webhook listens on the loopback address
+	e.config.WebhookAllowPrivate = true
+
+	received := make(chan user.SmsEvent, 10)
+	failures := 1
+	var mu sync.Mutex
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+		if r.Header.Get("X-Signature") != webhook.Sign("secret", timestamp, body) {
+			t.Errorf("invalid signature %s", r.Header.Get("X-Signature"))
+		}
+
+		// the first request fails, the retry delivers it
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var smsEvent user.SmsEvent
+		if err := json.Unmarshal(body, &smsEvent); err != nil {
+			t.Errorf("unmarshal webhook body: %v", err)
+		}
+		received <- smsEvent
+	}))
+	t.Cleanup(hook.Close)
+
+	e.config.WebhookEnabled = true
+	e.config.WebhookBackoff = []time.Duration{50 * time.Millisecond}
+	e.start()
+
+	err := e.storage.WriteWebhook(context.Background(), user.Webhook{CompanyID: "company-1", URL: hook.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatalf("write webhook: %v", err)
+	}
+
+	smsData := newSmsData("sms-webhook", "998901234567", "hello")
+	e.publishSms("default", smsData)
+	e.expectEvents(2)
+
+	statuses := map[string]bool{}
+	for len(statuses) < 2 {
+		select {
+		case smsEvent := <-received:
+			if smsEvent.SmsID != smsData.SmsID {
+				t.Errorf("webhook got sms %s, want %s", smsEvent.SmsID, smsData.SmsID)
+			}
+			statuses[smsEvent.DeliveryStatus] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook got %v, want SENT and DELIVRD", statuses)
+		}
+	}
+
+	if !statuses[user.StatusSmsSent] || !statuses[user.StatusSmsDELIVERED] {
+		t.Errorf("webhook got %v, want SENT and DELIVRD", statuses)
+	}
+
+	attempts, err := e.storage.ReadWebhookAttempts(context.Background(), "company-1", 10)
+	if err != nil || len(attempts) != 3 {
+		t.Errorf("attempts = %+v, %v, want one failed and two delivered", attempts, err)
+	}
+}
+
+func TestServer_EventStream(t *testing.T) {
+	e := newTestEnv(t)
+	e.start()
+
+	stream := httptest.NewServer(http.HandlerFunc(e.server.events.Stream))
+	t.Cleanup(stream.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		stream.URL+"?status=DELIVRD&operator="+e.config.NatsTopic, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// the stream is subscribed once the headers are flushed
+	smsData := newSmsData("sms-stream", "998901234567", "hello")
+	e.publishSms("default", smsData)
+	e.expectEvents(2)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			var smsEvent user.SmsEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &smsEvent); err != nil {
+				t.Fatalf("unmarshal streamed event: %v", err)
+			}
+			if smsEvent.SmsID != smsData.SmsID || smsEvent.DeliveryStatus != user.StatusSmsDELIVERED || smsEvent.Operator != e.config.NatsTopic {
+				t.Errorf("streamed %+v, want the DELIVRD event of %s", smsEvent, smsData.SmsID)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event streamed")
+		}
+	}
+}
+
+// expectBind waits until the executor reports a bind matching ok.
+func (e *testEnv) expectBind(ok func(user.Bind) bool) user.Bind {
+	e.t.Helper()
+
+	var binds []user.Bind
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var err error
+		binds, err = e.server.PubSub.Binds(context.Background())
+		if err != nil {
+			e.t.Fatalf("binds: %v", err)
+		}
+		if len(binds) == 1 && ok(binds[0]) {
+			return binds[0]
+		}
+	}
+
+	e.t.Fatalf("binds = %+v", binds)
+	return user.Bind{}
+}
+
+func TestServer_Admin(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.InstanceID = "executor-1"
+	e.config.AdminReplyWait = 100 * time.Millisecond
+	e.start()
+
+	ctx := context.Background()
+	ps := e.server.PubSub
+
+	e.expectBind(func(bind user.Bind) bool {
+		return bind.Instance == "executor-1" && bind.Operator == testTopic && bind.State == user.BindBound
+	})
+
+	settings, revision, err := ps.ReadSettings(ctx, testTopic)
+	if err != nil {
+		t.Fatalf("read settings: %v", err)
+	}
+
+	settings.RateLimit = 50
+	settings.Paused = []string{"default"}
+	if err := ps.WriteSettings(ctx, settings, revision); err != nil {
+		t.Fatalf("write settings: %v", err)
+	}
+
+	var errConflict user.ErrConflict
+	if err := ps.WriteSettings(ctx, settings, revision); !errors.As(err, &errConflict) {
+		t.Errorf("write at an old revision: %v, want a conflict", err)
+	}
+
+	// the fetch loop gets the settings before the smpp session
+	e.expectBind(func(bind user.Bind) bool { return bind.RateLimit == 50 })
+
+	paused := newSmsData("sms-paused", "998901234567", "hello")
+	e.publishSms("default", paused)
+	e.expectNoEvents(time.Second)
+
+	consumers, err := ps.ListConsumers(ctx)
+	if err != nil {
+		t.Fatalf("consumers: %v", err)
+	}
+	lag := map[string]uint64{}
+	for _, consumer := range consumers {
+		lag[consumer.Name] = consumer.Pending
+	}
+	if durable := "sms-executor:sms:" + testTopic; lag[durable] != 1 {
+		t.Errorf("consumer lag = %v, want the paused sms on %s", lag, durable)
+	}
+
+	settings, revision, err = ps.ReadSettings(ctx, testTopic)
+	if err != nil {
+		t.Fatalf("read settings: %v", err)
+	}
+	settings.Paused = nil
+	if err := ps.WriteSettings(ctx, settings, revision); err != nil {
+		t.Fatalf("write settings: %v", err)
+	}
+
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(paused, "1001"),
+		receipt(paused, "1001", user.StatusSmsDELIVERED),
+	})
+
+	// the response of a submit is lost with the session it was sent on
+	e.smsc.setRule("998901234599", smscRule{NoResponse: true})
+	e.publishSms("default", newSmsData("sms-unanswered", "998901234599", "hello"))
+	e.expectBind(func(bind user.Bind) bool { return bind.Pending == 1 })
+
+	binds, err := ps.Rebind(ctx, testTopic, "executor-1")
+	if err != nil {
+		t.Fatalf("rebind: %v", err)
+	}
+	if len(binds) != 1 || binds[0].Rebinds != 1 || binds[0].State != user.BindBound || binds[0].Pending != 0 {
+		t.Fatalf("binds after rebind = %+v", binds)
+	}
+
+	// the receipts come on the new session
+	rebound := newSmsData("sms-rebound", "998901234567", "hello")
+	e.publishSms("default", rebound)
+	assertEvents(t, e.expectEvents(2), []eventKey{
+		sent(rebound, "1002"),
+		receipt(rebound, "1002", user.StatusSmsDELIVERED),
+	})
+}
+
+func TestServer_GRPCNeedsAuth(t *testing.T) {
+	var s Server
+	err := s.Create(context.Background(), &config.Config{GRPCPort: "9000"})
+	if err == nil || !strings.Contains(err.Error(), "API_AUTH") {
+		t.Errorf("create with gRPC and no auth: %v, want an API_AUTH error", err)
+	}
+}
+
+func TestServer_AckWaitValidated(t *testing.T) {
+	var s Server
+	err := s.Create(context.Background(), &config.Config{APIAuth: true, NatsConsumerAckWait: time.Nanosecond})
+	if err == nil || !strings.Contains(err.Error(), "NATS_CONSUMER_ACK_WAIT") {
+		t.Errorf("create with an ack wait of 1ns: %v, want a NATS_CONSUMER_ACK_WAIT error", err)
+	}
+}
+
+func TestServer_AdminRoutes(t *testing.T) {
+	var store disk.Client
+	cfg := &config.Config{DiskPath: filepath.Join(t.TempDir(), "sms.db")}
+	if err := store.Init(context.Background(), cfg); err != nil {
+		t.Fatalf("disk client: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	// with API_AUTH disabled the admin routes still need an admin key
+	s := &Server{Config: cfg, APIKeys: &store}
+	auth := s.auth()
+
+	routes := s.adminRoutes()
+	for _, path := range []string{
+		"/v1/dlq/replay",
+		"/v1/admin/keys",
+		"/v1/admin/binds/rebind",
+		"/v1/admin/ratelimit",
+		"/v1/admin/classes/pause",
+		"/v1/admin/classes/resume",
+		"/v1/admin/consumers",
+	} {
+		handle, ok := routes[path]
+		if !ok {
+			t.Errorf("%s is not an admin route", path)
+			continue
+		}
+
+		w := httptest.NewRecorder()
+		auth.Admin(handle)(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without an admin key: status = %d, want %d", path, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
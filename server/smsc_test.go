@@ -0,0 +1,284 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qosimmax/gosmpp/data"
+	"github.com/qosimmax/gosmpp/pdu"
+)
+
+// smscRule describes how the simulator answers submits for a recipient.
+type smscRule struct {
+	// CommandStatus is returned in submit_sm_resp, ESME_ROK by default.
+	CommandStatus data.CommandStatusType
+	// Stat is the receipt status sent in deliver_sm, DELIVRD by default.
+	// An empty value after setting a rule means no receipt is sent.
+	Stat string
+	// ReceiptDelay is the time between submit_sm_resp and deliver_sm.
+	ReceiptDelay time.Duration
+	// Intermediate are the states of receipts sent before the Stat one.
+	Intermediate []string
+	// NoResponse leaves the submit_sm without a response.
+	NoResponse bool
+	// PlainReceipt sends receipts without the esm_class bits and with
+	// dates in a format of another SMSC.
+	PlainReceipt bool
+}
+
+// smsc is a minimal SMPP server which binds any transceiver, answers
+// submit_sm and sends delivery receipts on the most recent bind.
+type smsc struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu      sync.Mutex
+	rules   map[string]smscRule
+	submits []*pdu.SubmitSM
+	nextID  int
+	conn    *smscConn
+	closed  bool
+}
+
+type smscConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *smscConn) write(p pdu.PDU) error {
+	buf := pdu.NewBuffer(make([]byte, 0, 64))
+	p.Marshal(buf)
+	return c.writeRaw(buf.Bytes())
+}
+
+func (c *smscConn) writeRaw(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func newSmsc(t *testing.T) *smsc {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("smsc listen: %v", err)
+	}
+
+	s := &smsc{
+		t:      t,
+		ln:     ln,
+		rules:  make(map[string]smscRule),
+		nextID: 1000,
+	}
+
+	go s.serve()
+	t.Cleanup(s.close)
+
+	return s
+}
+
+func (s *smsc) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smsc) setRule(recipient string, rule smscRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules[recipient] = rule
+}
+
+func (s *smsc) rule(recipient string) smscRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rule, ok := s.rules[recipient]
+	if !ok {
+		rule.Stat = "DELIVRD"
+	}
+
+	return rule
+}
+
+// submitted returns a copy of all submit_sm PDUs received so far.
+func (s *smsc) submitted() []*pdu.SubmitSM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*pdu.SubmitSM(nil), s.submits...)
+}
+
+func (s *smsc) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+
+	_ = s.ln.Close()
+	if conn != nil {
+		_ = conn.conn.Close()
+	}
+}
+
+func (s *smsc) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(&smscConn{conn: conn})
+	}
+}
+
+func (s *smsc) handle(c *smscConn) {
+	defer func() {
+		_ = c.conn.Close()
+
+		s.mu.Lock()
+		if s.conn == c {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		p, err := pdu.Parse(c.conn)
+		if err != nil {
+			return
+		}
+
+		switch pd := p.(type) {
+		case *pdu.BindRequest:
+			resp := pd.GetResponse().(*pdu.BindResp)
+			resp.SystemID = "smsc"
+
+			s.mu.Lock()
+			s.conn = c
+			s.mu.Unlock()
+
+			_ = c.write(resp)
+
+		case *pdu.EnquireLink:
+			_ = c.write(pd.GetResponse())
+
+		case *pdu.Unbind:
+			_ = c.write(pd.GetResponse())
+			return
+
+		case *pdu.SubmitSM:
+			s.submit(c, pd)
+		}
+	}
+}
+
+func (s *smsc) submit(c *smscConn, p *pdu.SubmitSM) {
+	rule := s.rule(p.DestAddr.Address())
+
+	s.mu.Lock()
+	s.submits = append(s.submits, p)
+	if rule.NoResponse {
+		s.mu.Unlock()
+		return
+	}
+	s.nextID++
+	messageID := strconv.Itoa(s.nextID)
+	s.mu.Unlock()
+
+	if rule.CommandStatus != data.ESME_ROK {
+		// a failed submit_sm_resp carries no message_id body
+		header := pdu.Header{
+			CommandLength:  16,
+			CommandID:      data.SUBMIT_SM_RESP,
+			CommandStatus:  rule.CommandStatus,
+			SequenceNumber: p.SequenceNumber,
+		}
+		buf := pdu.NewBuffer(make([]byte, 0, 16))
+		header.Marshal(buf)
+		_ = c.writeRaw(buf.Bytes())
+
+		return
+	}
+
+	resp := p.GetResponse().(*pdu.SubmitSMResp)
+	resp.MessageID = messageID
+	_ = c.write(resp)
+
+	if rule.Stat == "" {
+		return
+	}
+
+	go func() {
+		time.Sleep(rule.ReceiptDelay + 100*time.Millisecond)
+		for _, stat := range rule.Intermediate {
+			s.deliver(p, messageID, stat)
+			time.Sleep(50 * time.Millisecond)
+		}
+		s.deliver(p, messageID, rule.Stat)
+	}()
+}
+
+// deliver sends a delivery receipt on the current bind, waiting for a
+// rebind if there is none.
+func (s *smsc) deliver(p *pdu.SubmitSM, messageID, stat string) {
+	rule := s.rule(p.DestAddr.Address())
+
+	layout, esmClass := "0601021504", byte(0x04)
+	if rule.PlainReceipt {
+		layout, esmClass = "060102150405", 0
+	}
+
+	now := time.Now().Format(layout)
+	receipt := fmt.Sprintf("id:%s sub:001 dlvrd:001 submit date:%s done date:%s stat:%s err:000 text:",
+		messageID, now, now, stat)
+
+	deliverSM := pdu.NewDeliverSM().(*pdu.DeliverSM)
+	deliverSM.SourceAddr = p.DestAddr
+	deliverSM.DestAddr = p.SourceAddr
+	deliverSM.EsmClass = esmClass
+	if err := deliverSM.Message.SetMessageWithEncoding(receipt, data.GSM7BIT); err != nil {
+		s.t.Errorf("smsc receipt: %v", err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		conn, closed := s.conn, s.closed
+		s.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		if conn != nil && conn.write(deliverSM) == nil {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sendMO sends a mobile originated message of a recipient to a sender on
+// the current bind.
+func (s *smsc) sendMO(recipient, sender, message string) {
+	deliverSM := pdu.NewDeliverSM().(*pdu.DeliverSM)
+	_ = deliverSM.SourceAddr.SetAddress(recipient)
+	_ = deliverSM.DestAddr.SetAddress(sender)
+	if err := deliverSM.Message.SetMessageWithEncoding(message, data.UCS2); err != nil {
+		s.t.Errorf("smsc mo: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil || conn.write(deliverSM) != nil {
+		s.t.Errorf("smsc mo: no bind")
+	}
+}
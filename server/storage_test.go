@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/qosimmax/sms-executor/client/redis"
+	"github.com/qosimmax/sms-executor/user"
+)
+
+// faultStorage is the redis store of the tests, it fails or delays the
+// correlation writes on demand.
+type faultStorage struct {
+	*redis.Client
+
+	mu sync.Mutex
+	// writeFailures is the number of upcoming sequence writes which fail,
+	// a negative value makes all of them fail.
+	writeFailures int
+	writeAttempts int
+
+	// messageLag delays message sequence writes, like a correlation which
+	// is written after the receipt already arrived.
+	messageLag time.Duration
+}
+
+func (f *faultStorage) WriteSequenceNumber(ctx context.Context, smsData user.SmsData) error {
+	f.mu.Lock()
+	f.writeAttempts++
+	if f.writeFailures != 0 {
+		f.writeFailures--
+		f.mu.Unlock()
+		return errors.New("storage is unavailable")
+	}
+	f.mu.Unlock()
+
+	return f.Client.WriteSequenceNumber(ctx, smsData)
+}
+
+func (f *faultStorage) failWrites(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writeFailures = n
+}
+
+func (f *faultStorage) attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeAttempts
+}
+
+func (f *faultStorage) WriteMessageSequence(ctx context.Context, smsData user.SmsData) error {
+	f.mu.Lock()
+	lag := f.messageLag
+	f.mu.Unlock()
+
+	if lag > 0 {
+		go func() {
+			time.Sleep(lag)
+			_ = f.Client.WriteMessageSequence(context.Background(), smsData)
+		}()
+
+		return nil
+	}
+
+	return f.Client.WriteMessageSequence(ctx, smsData)
+}
+
+func (f *faultStorage) lagMessageWrites(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.messageLag = d
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// Bind states.
+const (
+	BindBound     = "bound"
+	BindRebinding = "rebinding"
+	BindClosed    = "closed"
+)
+
+// Bind is the smpp session of an executor.
+type Bind struct {
+	Instance string    `json:"instance"`
+	Operator string    `json:"operator"`
+	SMSC     string    `json:"smsc"`
+	SystemID string    `json:"system_id"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error,omitempty"`
+	Rebinds  int       `json:"rebinds"`
+	// Pending is how many submits wait for their response.
+	Pending   int64 `json:"pending"`
+	RateLimit int   `json:"rate_limit"`
+}
+
+// Settings are the settings of the executors of an operator which can be
+// changed while they run. Unset values keep the configured ones.
+type Settings struct {
+	Operator string `json:"operator"`
+	// RateLimit replaces RATE_LIMIT, the submits per second of the operator.
+	RateLimit int `json:"rate_limit,omitempty"`
+	// ClassRateLimits caps the sms per second fetched of a class.
+	ClassRateLimits map[string]int `json:"class_rate_limits,omitempty"`
+	// Paused are the classes which are not fetched.
+	Paused    []string  `json:"paused,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+}
+
+// IsPaused returns whether a class is paused.
+func (s Settings) IsPaused(class string) bool {
+	for _, paused := range s.Paused {
+		if paused == class {
+			return true
+		}
+	}
+	return false
+}
+
+// RebindRequest selects the instance of an operator to rebind, every one
+// when empty.
+type RebindRequest struct {
+	Instance string `json:"instance,omitempty"`
+}
+
+// Consumer is the state of a durable consumer of the sms stream.
+type Consumer struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	// Pending is the lag, how many messages were not delivered yet.
+	Pending     uint64 `json:"pending"`
+	AckPending  int    `json:"ack_pending"`
+	Redelivered int    `json:"redelivered"`
+	Waiting     int    `json:"waiting"`
+}
+
+// SettingsReaderWriter is an interface for the runtime settings of the
+// operators. ReadSettings returns the revision the settings were read at,
+// and WriteSettings returns ErrConflict when they changed since.
+type SettingsReaderWriter interface {
+	ReadSettings(ctx context.Context, operator string) (Settings, uint64, error)
+	WriteSettings(ctx context.Context, settings Settings, revision uint64) error
+}
+
+// SettingsApplier is an interface for applying the runtime settings of the
+// operator of an executor.
+type SettingsApplier interface {
+	ApplySettings(settings Settings)
+}
+
+// Binder is an interface for the smpp session of an executor.
+type Binder interface {
+	Bind() Bind
+	Rebind() error
+}
+
+// BindController is an interface for reaching the smpp sessions of every
+// executor. Rebind rebinds the sessions of an operator, or of one instance
+// of it, and returns them after the rebind.
+type BindController interface {
+	Binds(ctx context.Context) ([]Bind, error)
+	Rebind(ctx context.Context, operator, instance string) ([]Bind, error)
+}
+
+// ConsumerMonitor is an interface for the lag of the durable consumers of
+// the sms stream.
+type ConsumerMonitor interface {
+	ListConsumers(ctx context.Context) ([]Consumer, error)
+}
@@ -0,0 +1,58 @@
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// APIKey authorizes HTTP requests of a company, or of an operator of the
+// executor when Admin is set. Only the hash of the token is stored, the
+// token itself is shown once when the key is created.
+type APIKey struct {
+	// ID is the hex sha256 of the token.
+	ID        string `json:"id"`
+	CompanyID string `json:"company_id"`
+	// Senders are the nick names the company may send from, Classes the
+	// classes it may send in. Empty allows any.
+	Senders   []string  `json:"senders,omitempty"`
+	Classes   []string  `json:"classes,omitempty"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyID returns the id of the key of a token.
+func APIKeyID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AllowsSender reports if the key may send from a nick name.
+func (k APIKey) AllowsSender(nickName string) bool {
+	return len(k.Senders) == 0 || contains(k.Senders, nickName)
+}
+
+// AllowsClass reports if the key may send in a class.
+func (k APIKey) AllowsClass(class string) bool {
+	return len(k.Classes) == 0 || contains(k.Classes, class)
+}
+
+// APIKeyReader is an interface for looking up api keys, ReadAPIKey returns
+// ErrNotFound for an unknown key.
+type APIKeyReader interface {
+	ReadAPIKey(ctx context.Context, id string) (APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+}
+
+// APIKeyWriter is an interface for managing api keys, DeleteAPIKey returns
+// ErrNotFound for an unknown key.
+type APIKeyWriter interface {
+	WriteAPIKey(ctx context.Context, key APIKey) error
+	DeleteAPIKey(ctx context.Context, id string) error
+}
+
+type APIKeyReaderWriter interface {
+	APIKeyReader
+	APIKeyWriter
+}
@@ -0,0 +1,25 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// DeadLetter is a message which could never be processed and was parked
+// on a dead-letter subject instead of being dropped.
+type DeadLetter struct {
+	Sequence        uint64            `json:"sequence"`
+	Subject         string            `json:"subject"`
+	OriginalSubject string            `json:"original_subject"`
+	Error           string            `json:"error"`
+	DeliveryCount   uint64            `json:"delivery_count"`
+	FailedAt        time.Time         `json:"failed_at"`
+	Header          map[string]string `json:"header"`
+	Data            []byte            `json:"data"`
+}
+
+// DeadLetterQueue is an interface for inspecting and replaying dead letters
+type DeadLetterQueue interface {
+	DeadLetters(ctx context.Context, subject string, fromSequence uint64, limit int) ([]DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, sequence uint64) error
+}
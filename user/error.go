@@ -31,3 +31,88 @@ func (e ErrExpected) Error() string {
 func (e ErrExpected) Unwrap() error {
 	return e.Err
 }
+
+// ErrInProgress is an error type for a message which another delivery is
+// still handling. It is handled again later without using up a delivery
+// attempt.
+type ErrInProgress struct {
+	Err error
+}
+
+func (e ErrInProgress) Error() string {
+	return fmt.Sprintf("in progress: %v", e.Err)
+}
+
+func (e ErrInProgress) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotFound is an error type for lookups of entities which don't exist.
+type ErrNotFound struct {
+	Err error
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("not found: %v", e.Err)
+}
+
+func (e ErrNotFound) Unwrap() error {
+	return e.Err
+}
+
+// ErrUncorrelated is an error type for receipts which can't be matched to
+// a sms yet, because the correlation is not written or already removed.
+type ErrUncorrelated struct {
+	Err error
+}
+
+func (e ErrUncorrelated) Error() string {
+	return fmt.Sprintf("uncorrelated: %v", e.Err)
+}
+
+func (e ErrUncorrelated) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalid is an error type for a sms field which fails validation.
+type ErrInvalid struct {
+	Field string
+	Err   error
+}
+
+func (e ErrInvalid) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Field, e.Err)
+}
+
+func (e ErrInvalid) Unwrap() error {
+	return e.Err
+}
+
+// ErrForbidden is an error type for a sms field the api key of the request
+// is not allowed to use.
+type ErrForbidden struct {
+	Field string
+	Err   error
+}
+
+func (e ErrForbidden) Error() string {
+	return fmt.Sprintf("forbidden %s: %v", e.Field, e.Err)
+}
+
+func (e ErrForbidden) Unwrap() error {
+	return e.Err
+}
+
+// ErrConflict is an error type for a write which lost the race against
+// another one, it can be retried on what was written.
+type ErrConflict struct {
+	Err error
+}
+
+func (e ErrConflict) Error() string {
+	return fmt.Sprintf("conflict: %v", e.Err)
+}
+
+func (e ErrConflict) Unwrap() error {
+	return e.Err
+}
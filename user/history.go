@@ -0,0 +1,132 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// History entry kinds.
+const (
+	// HistoryReceived is the sms taken from the stream.
+	HistoryReceived = "received"
+	// HistorySubmitted is a submit_sm sent for the sms.
+	HistorySubmitted = "submitted"
+	// HistorySubmitFailed is a submission which failed before the SMSC
+	// responded, it is retried unless the error is permanent.
+	HistorySubmitFailed = "submit_failed"
+	// HistoryEvent is a sms event: a submit_sm_resp, a receipt, or a final
+	// state given by the executor itself.
+	HistoryEvent = "event"
+)
+
+// SmsHistory is everything that happened to a sms, for support.
+type SmsHistory struct {
+	SmsID     string    `json:"sms_id"`
+	Recipient string    `json:"recipient,omitempty"`
+	NickName  string    `json:"nick_name,omitempty"`
+	CompanyID string    `json:"company_id,omitempty"`
+	TariffID  int       `json:"tariff_id,omitempty"`
+	IsUnicode bool      `json:"is_unicode"`
+	CreatedAt time.Time `json:"created_at"`
+	// MessageIDs are the SMSC message ids, one per segment.
+	MessageIDs []string `json:"message_ids"`
+	// Status is the delivery status of the latest event.
+	Status  string         `json:"status,omitempty"`
+	Final   bool           `json:"final"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// HistoryEntry is one step in the history of a sms.
+type HistoryEntry struct {
+	Time              time.Time `json:"time"`
+	Kind              string    `json:"kind"`
+	MessageLength     int       `json:"message_length,omitempty"`
+	SequenceNumber    int32     `json:"sequence_number,omitempty"`
+	SequenceMessageID string    `json:"sequence_message_id,omitempty"`
+	CommandStatus     string    `json:"command_status,omitempty"`
+	DeliveryStatus    string    `json:"delivery_status,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// Merge adds an entry to the history. The fields set in sms fill in the
+// ones not known yet, so every step can carry only what it knows.
+func (h *SmsHistory) Merge(sms SmsHistory, entry HistoryEntry) {
+	if h.SmsID == "" {
+		h.SmsID = sms.SmsID
+	}
+	if h.Recipient == "" {
+		h.Recipient = sms.Recipient
+	}
+	if h.NickName == "" {
+		h.NickName = sms.NickName
+	}
+	if h.CompanyID == "" {
+		h.CompanyID = sms.CompanyID
+	}
+	if h.TariffID == 0 {
+		h.TariffID = sms.TariffID
+	}
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = sms.CreatedAt
+	}
+	h.IsUnicode = h.IsUnicode || sms.IsUnicode
+
+	if id := entry.SequenceMessageID; id != "" && !contains(h.MessageIDs, id) {
+		h.MessageIDs = append(h.MessageIDs, id)
+	}
+
+	// entries written by different instances can arrive out of order
+	i := sort.Search(len(h.Entries), func(i int) bool {
+		return h.Entries[i].Time.After(entry.Time)
+	})
+	h.Entries = append(h.Entries, HistoryEntry{})
+	copy(h.Entries[i+1:], h.Entries[i:])
+	h.Entries[i] = entry
+
+	h.Status, h.Final = "", false
+	for _, e := range h.Entries {
+		if e.Kind == HistoryEvent {
+			h.Status = e.DeliveryStatus
+			h.Final = h.Final || StateOf(e.DeliveryStatus) == SmsFinal
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryQuery selects the sms of a recipient or a company, or both, first
+// seen between From and To. A zero From or To leaves that end open.
+type HistoryQuery struct {
+	Recipient string
+	CompanyID string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+// HistoryWriter is an interface for recording the history of sms
+type HistoryWriter interface {
+	AppendHistory(ctx context.Context, sms SmsHistory, entry HistoryEntry) error
+}
+
+// HistoryReader is an interface for looking up the history of sms. A sms_id
+// is only unique within its company, so the history is read by both.
+// ReadHistory returns ErrNotFound for an unknown or expired sms, FindHistory
+// returns the most recently seen sms first.
+type HistoryReader interface {
+	ReadHistory(ctx context.Context, companyID, smsID string) (SmsHistory, error)
+	FindHistory(ctx context.Context, query HistoryQuery) ([]SmsHistory, error)
+}
+
+type HistoryReaderWriter interface {
+	HistoryWriter
+	HistoryReader
+}
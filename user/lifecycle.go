@@ -0,0 +1,58 @@
+package user
+
+// SmsState is the lifecycle state of a sms:
+// queued → submitted → sent → intermediate → final.
+//
+// A sms only moves forward, events which would move it back are ignored.
+type SmsState int
+
+const (
+	// SmsQueued means the sms waits in the stream.
+	SmsQueued SmsState = iota
+	// SmsSubmitted means a submit_sm was sent for the sms.
+	SmsSubmitted
+	// SmsSent means the SMSC accepted the submit_sm.
+	SmsSent
+	// SmsIntermediate means a receipt with a non-final state was received.
+	SmsIntermediate
+	// SmsFinal means the sms was delivered or failed for good.
+	SmsFinal
+)
+
+// intermediateStatuses are receipt states after which the SMSC still
+// sends a final receipt.
+var intermediateStatuses = map[string]bool{
+	"ENROUTE": true,
+	"ACCEPTD": true,
+	"BUFFRED": true,
+}
+
+// StateOf returns the lifecycle state a sms is in after an event with the
+// given delivery status.
+func StateOf(deliveryStatus string) SmsState {
+	switch {
+	case deliveryStatus == StatusSmsSent:
+		return SmsSent
+	case intermediateStatuses[deliveryStatus]:
+		return SmsIntermediate
+	default:
+		return SmsFinal
+	}
+}
+
+func (s SmsState) String() string {
+	switch s {
+	case SmsQueued:
+		return "queued"
+	case SmsSubmitted:
+		return "submitted"
+	case SmsSent:
+		return "sent"
+	case SmsIntermediate:
+		return "intermediate"
+	case SmsFinal:
+		return "final"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,113 @@
+package user
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Opt-out sources.
+const (
+	OptOutSourceAPI = "api"
+	OptOutSourceMO  = "mo"
+)
+
+// OptOut stops the sms to a recipient which are not exempt, like OTPs. The
+// scope is every company and sender when CompanyID and Sender are empty,
+// and narrows to a company, a sender or both when they are set.
+type OptOut struct {
+	Recipient string `json:"recipient"`
+	CompanyID string `json:"company_id,omitempty"`
+	Sender    string `json:"sender,omitempty"`
+	// Source is api for entries added over HTTP, mo when the recipient
+	// replied with a stop keyword.
+	Source    string    `json:"source"`
+	Keyword   string    `json:"keyword,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// Key identifies the opt-out among the ones of its recipient. It only holds
+// characters which are valid in every storage key.
+func (o OptOut) Key() string {
+	return o.Recipient + "." + base64.RawURLEncoding.EncodeToString([]byte(o.CompanyID+"\x00"+o.Sender))
+}
+
+// Validate checks the recipient and the scope of the opt-out. The errors
+// are ErrInvalid naming the field.
+func (o OptOut) Validate() error {
+	if !isDigits(o.Recipient) || len(o.Recipient) < 7 || len(o.Recipient) > 15 {
+		return ErrInvalid{Field: "recipient", Err: fmt.Errorf("must be an international number of 7 to 15 digits")}
+	}
+
+	if len(o.CompanyID) > 64 {
+		return ErrInvalid{Field: "company_id", Err: fmt.Errorf("must be at most 64 characters")}
+	}
+
+	if len(o.Sender) > 15 {
+		return ErrInvalid{Field: "sender", Err: fmt.Errorf("must be at most 15 characters")}
+	}
+
+	return nil
+}
+
+// Covers reports if the opt-out applies to a sms of a company from a sender.
+func (o OptOut) Covers(companyID, sender string) bool {
+	return (o.CompanyID == "" || o.CompanyID == companyID) && (o.Sender == "" || o.Sender == sender)
+}
+
+// OptOutKeywords are the replies which opt a recipient out by default. Words
+// which are common replies otherwise, like END, are left out.
+var OptOutKeywords = []string{
+	// english
+	"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "QUIT", "OPTOUT",
+	// uzbek
+	"BEKOR", "TOXTAT", "TO'XTAT", "БЕКОР", "ТЎХТАТ",
+	// russian
+	"СТОП", "ОТПИСАТЬСЯ", "ОТПИСКА", "ОТМЕНА",
+	// german, french, spanish
+	"STOPP", "ABMELDEN", "ARRET", "ARRÊT", "DESABONNER", "DÉSABONNER", "CANCELAR",
+	// turkish, kazakh
+	"İPTAL", "IPTAL", "ТОҚТАТУ",
+}
+
+// OptOutKeyword returns the stop keyword of a mobile originated message,
+// which must be the only word of it, or an empty string. The keywords match
+// regardless of case, punctuation and hyphens.
+func OptOutKeyword(message string, keywords []string) string {
+	word := normalizeKeyword(message)
+	for _, keyword := range keywords {
+		if word != "" && normalizeKeyword(keyword) == word {
+			return word
+		}
+	}
+	return ""
+}
+
+func normalizeKeyword(s string) string {
+	word := strings.ToUpper(strings.TrimFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r) && r != '\''
+	}))
+	return strings.ReplaceAll(word, "-", "")
+}
+
+// OptOutReader is an interface for looking up the opt-outs of a recipient.
+type OptOutReader interface {
+	ListOptOuts(ctx context.Context, recipient string) ([]OptOut, error)
+}
+
+// OptOutWriter is an interface for managing opt-outs, an opt-out replaces
+// the one of the same scope. DeleteOptOut returns ErrNotFound for an
+// unknown opt-out.
+type OptOutWriter interface {
+	WriteOptOut(ctx context.Context, optOut OptOut) error
+	DeleteOptOut(ctx context.Context, optOut OptOut) error
+}
+
+type OptOutReaderWriter interface {
+	OptOutReader
+	OptOutWriter
+}
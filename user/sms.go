@@ -2,9 +2,12 @@ package user
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/qosimmax/gosmpp/data"
+	"github.com/qosimmax/gosmpp/pdu"
 )
 
 type SmsData struct {
@@ -16,12 +19,19 @@ type SmsData struct {
 	TariffID          int       `json:"tariff_id"`
 	CompanyID         string    `json:"company_id"`
 	IsUnicode         bool      `json:"is_unicode"`
+	State             SmsState  `json:"state,omitempty"`
 	SequenceNumber    int32     `json:"-"`
 	SequenceMessageID string    `json:"-"`
+	// Segments is how many short messages the sms was submitted in, each
+	// of them gets its own message id and receipts.
+	Segments int `json:"segments,omitempty"`
 }
 
+// SmsLifetime is how long after its creation a sms may still be sent.
+const SmsLifetime = 3 * time.Hour
+
 func (s *SmsData) IsTimout() bool {
-	if time.Now().Sub(s.CreatedAt).Seconds() > 10800 {
+	if time.Now().Sub(s.CreatedAt) > SmsLifetime {
 		return true
 	}
 	return false
@@ -33,6 +43,104 @@ func (s *SmsData) FindAndSetEncoding() {
 	}
 }
 
+// Sms encodings, as reported by Encoding.
+const (
+	EncodingGSM7 = "gsm7"
+	EncodingUCS2 = "ucs2"
+)
+
+// Encoding returns the encoding the message is submitted in.
+func (s *SmsData) Encoding() string {
+	if s.IsUnicode {
+		return EncodingUCS2
+	}
+	return EncodingGSM7
+}
+
+// ShortMessages splits the message into the short messages of its
+// submit_sm, one per segment.
+func (s *SmsData) ShortMessages() ([]*pdu.ShortMessage, error) {
+	enc := data.GSM7BIT
+	if s.IsUnicode {
+		enc = data.UCS2
+	}
+
+	if enc == data.UCS2 && len([]rune(s.Message)) <= 70 {
+		sm, err := pdu.NewShortMessageWithEncoding(s.Message, enc)
+		if err != nil {
+			return nil, err
+		}
+		return []*pdu.ShortMessage{&sm}, nil
+	}
+
+	return pdu.NewLongMessageWithEncoding(s.Message, enc)
+}
+
+// Validate checks the fields a sms needs to be submitted. The errors are
+// ErrInvalid naming the field.
+func (s *SmsData) Validate() error {
+	if s.SmsID == "" || len(s.SmsID) > 64 || strings.ContainsAny(s.SmsID, " \t\r\n") {
+		return ErrInvalid{Field: "sms_id", Err: fmt.Errorf("must be 1 to 64 characters without spaces")}
+	}
+
+	if !isDigits(s.Recipient) || len(s.Recipient) < 7 || len(s.Recipient) > 15 {
+		return ErrInvalid{Field: "recipient", Err: fmt.Errorf("must be an international number of 7 to 15 digits")}
+	}
+
+	switch {
+	case s.NickName == "":
+		return ErrInvalid{Field: "nick_name", Err: fmt.Errorf("is required")}
+	case isDigits(s.NickName):
+		if len(s.NickName) > 15 {
+			return ErrInvalid{Field: "nick_name", Err: fmt.Errorf("numeric sender must be at most 15 digits")}
+		}
+	case !isAlphanumericSender(s.NickName) || len(s.NickName) > 11:
+		return ErrInvalid{Field: "nick_name", Err: fmt.Errorf("alphanumeric sender must be at most 11 latin letters, digits, spaces or .-_&")}
+	}
+
+	if s.Message == "" {
+		return ErrInvalid{Field: "message", Err: fmt.Errorf("is required")}
+	}
+
+	if s.TariffID < 0 {
+		return ErrInvalid{Field: "tariff_id", Err: fmt.Errorf("must not be negative")}
+	}
+
+	if s.CreatedAt.IsZero() {
+		return ErrInvalid{Field: "created_at", Err: fmt.Errorf("is required")}
+	}
+
+	if s.IsTimout() {
+		return ErrInvalid{Field: "created_at", Err: fmt.Errorf("is too long ago, the sms would expire")}
+	}
+
+	return nil
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlphanumericSender(value string) bool {
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(" .-_&", r):
+		default:
+			return false
+		}
+	}
+	return strings.TrimSpace(value) != ""
+}
+
 type SmsEvent struct {
 	SmsID             string `json:"sms_id"`
 	DestAddress       string `json:"destination_address"`
@@ -46,6 +154,13 @@ type SmsEvent struct {
 	TariffID          int    `json:"tariff_id"`
 	CompanyID         string `json:"company_id"`
 	IsUnicode         bool   `json:"is_unicode"`
+	// Operator is the NATS topic of the executor which sent the sms.
+	Operator string `json:"operator,omitempty"`
+	// Message is the text of a mobile originated message.
+	Message string `json:"message,omitempty"`
+	// Final is false for SENT and intermediate receipts, another event
+	// follows for the same sms.
+	Final bool `json:"final"`
 }
 
 const (
@@ -54,6 +169,25 @@ const (
 	StatusSmsSent         = "SENT"
 	StatusSmsDELIVERED    = "DELIVRD"
 	StatusSmsFailed       = "FAILED"
+
+	// StatusSmsRejected is the final status of a sms which was not
+	// submitted because its recipient opted out.
+	StatusSmsRejected = "REJECTED"
+
+	// StatusSmsMO marks a mobile originated message of a recipient, it is
+	// not an event of a sms.
+	StatusSmsMO = "MO"
+
+	// CommandStatusNoReceipt is the command status of a SMS_EXPIRED event
+	// for a sms which got no final receipt within its validity.
+	CommandStatusNoReceipt = "NO_RECEIPT"
+
+	// CommandStatusRetriesExhausted is the command status of a FAILED event
+	// for a sms which was never submitted within the max deliveries.
+	CommandStatusRetriesExhausted = "RETRIES_EXHAUSTED"
+
+	// CommandStatusOptedOut is the command status of a REJECTED event.
+	CommandStatusOptedOut = "OPTED_OUT"
 )
 
 // SmsSender is an interface for sending a sms
@@ -61,24 +195,87 @@ type SmsSender interface {
 	SendSms(ctx context.Context, smsData SmsData) (err error)
 }
 
+// SmsQueue is an interface for queueing a sms of a class to be sent,
+// it returns the subject the sms was queued on
+type SmsQueue interface {
+	QueueSms(ctx context.Context, class string, smsData SmsData) (subject string, err error)
+}
+
 // SequenceNumberReaderWriter is an interface for saving and getting a message sequence number
 type SequenceNumberReaderWriter interface {
 	WriteSequenceNumber(ctx context.Context, smsData SmsData) error
 	ReadSequenceNumber(ctx context.Context, sequenceNumber int32) (SmsData, error)
 }
 
+// SequenceAllocator is an interface for reserving sequence numbers which are
+// unique across all the instances sending for an operator. The numbers grow
+// forever, callers wrap them into the smpp sequence number range.
+type SequenceAllocator interface {
+	AllocateSequenceNumbers(ctx context.Context, n int64) (first int64, err error)
+}
+
 // MessageSequenceReaderWriter is an interface for saving and getting a given message id
 type MessageSequenceReaderWriter interface {
 	WriteMessageSequence(ctx context.Context, smsData SmsData) error
 	ReadMessageSequence(ctx context.Context, sequenceMessageID string) (SmsData, error)
+	DeleteMessageSequence(ctx context.Context, sequenceMessageID string) error
+	// ExpiredMessageSequences returns up to limit correlations whose sms
+	// validity ended before the given time, the ones of finished sms are
+	// in the SmsFinal state.
+	ExpiredMessageSequences(ctx context.Context, before time.Time, limit int) ([]SmsData, error)
+}
+
+// SegmentCounter is an interface for counting the finished segments of a
+// multipart sms, so that only its last segment finishes the sms.
+// FinishSegments adds n segments, which is -1 to undo one, and returns the
+// finished segments of the sms so far.
+type SegmentCounter interface {
+	FinishSegments(ctx context.Context, companyID, smsID string, n int) (int, error)
+}
+
+// SubmissionState is the deduplication state of a sms submission.
+type SubmissionState int
+
+const (
+	// SubmissionNew means the sms was claimed for submission by the caller.
+	SubmissionNew SubmissionState = iota
+	// SubmissionPending means another delivery of the sms is being submitted.
+	SubmissionPending
+	// SubmissionDone means the sms was already submitted.
+	SubmissionDone
+)
+
+// SubmissionReaderWriter is an interface for deduplicating sms submissions by
+// company_id and sms_id, a sms_id is only unique within its company.
+type SubmissionReaderWriter interface {
+	ClaimSubmission(ctx context.Context, companyID, smsID string) (SubmissionState, error)
+	CompleteSubmission(ctx context.Context, companyID, smsID string) error
+	ReleaseSubmission(ctx context.Context, companyID, smsID string) error
+}
+
+// Locker is an interface for locks shared by all the instances, Lock returns
+// false when another holder has the lock. The lock expires after ttl.
+type Locker interface {
+	Lock(ctx context.Context, name string, ttl time.Duration) (token string, ok bool, err error)
+	Unlock(ctx context.Context, name, token string) error
 }
 
 type StorageReadWriter interface {
+	Locker
+	SequenceAllocator
 	SequenceNumberReaderWriter
 	MessageSequenceReaderWriter
+	SegmentCounter
+	SubmissionReaderWriter
 }
 
 // SmsEventNotifier is an interface for notify other apps about sms statuses
 type SmsEventNotifier interface {
 	NotifySmsEvent(ctx context.Context, smsEvent SmsEvent) error
 }
+
+// OrphanReceiptNotifier is an interface for reporting receipts which could
+// not be matched to a sms
+type OrphanReceiptNotifier interface {
+	NotifyOrphanReceipt(ctx context.Context, smsEvent SmsEvent) error
+}
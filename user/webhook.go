@@ -0,0 +1,76 @@
+package user
+
+import (
+	"context"
+	"time"
+)
+
+// WebhookAttemptsKept is how many of the latest delivery attempts are kept
+// per company.
+const WebhookAttemptsKept = 100
+
+// Webhook is the callback URL a company receives its sms events on. The
+// requests are signed with Secret. A webhook failing too many deliveries in
+// a row is disabled until it is set again.
+type Webhook struct {
+	CompanyID  string    `json:"company_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	Disabled   bool      `json:"disabled"`
+	DisabledAt time.Time `json:"disabled_at,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookAttempt is one request delivering a sms event to a webhook.
+type WebhookAttempt struct {
+	Time           time.Time     `json:"time"`
+	SmsID          string        `json:"sms_id"`
+	DeliveryStatus string        `json:"delivery_status"`
+	URL            string        `json:"url"`
+	Attempt        int           `json:"attempt"`
+	StatusCode     int           `json:"status_code,omitempty"`
+	Duration       time.Duration `json:"duration"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// WebhookReaderWriter is an interface for the webhooks of companies,
+// ReadWebhook and DeleteWebhook return ErrNotFound for a company without one.
+type WebhookReaderWriter interface {
+	ReadWebhook(ctx context.Context, companyID string) (Webhook, error)
+	WriteWebhook(ctx context.Context, webhook Webhook) error
+	DeleteWebhook(ctx context.Context, companyID string) error
+}
+
+// WebhookAttemptReaderWriter is an interface for the delivery attempts of
+// the webhook of a company, the latest first, WebhookAttemptsKept at most.
+type WebhookAttemptReaderWriter interface {
+	AppendWebhookAttempt(ctx context.Context, companyID string, attempt WebhookAttempt) error
+	ReadWebhookAttempts(ctx context.Context, companyID string, limit int) ([]WebhookAttempt, error)
+}
+
+// WebhookFailureCounter is an interface for counting the events in a row
+// which failed every retry on the webhook of a company, across the executors.
+// AddWebhookFailure returns the count so far, WebhookFailures reads it.
+type WebhookFailureCounter interface {
+	AddWebhookFailure(ctx context.Context, companyID string) (int, error)
+	WebhookFailures(ctx context.Context, companyID string) (int, error)
+	ResetWebhookFailures(ctx context.Context, companyID string) error
+}
+
+type WebhookStore interface {
+	WebhookReaderWriter
+	WebhookAttemptReaderWriter
+	WebhookFailureCounter
+}
+
+// WebhookURLChecker is an interface for checking where a webhook URL leads,
+// it returns ErrInvalid for a URL which may not be posted to.
+type WebhookURLChecker interface {
+	CheckWebhookURL(ctx context.Context, rawURL string) error
+}
+
+// WebhookPoster is an interface for posting a signed request to a webhook,
+// it returns the response status code, and an error for any but a 2xx.
+type WebhookPoster interface {
+	PostWebhook(ctx context.Context, webhook Webhook, body []byte) (statusCode int, err error)
+}